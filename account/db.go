@@ -6,6 +6,7 @@ import (
 	"sync"
 
 	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/marshal"
 	"github.com/attic-labs/noms/go/spec"
 	"github.com/attic-labs/noms/go/types"
@@ -16,8 +17,20 @@ import (
 type DB struct {
 	ds datas.Dataset
 
+	// updateMu serializes Updates through this instance.
+	updateMu sync.Mutex
+
 	mu   sync.Mutex
 	head Commit
+	// regular is the set of regular accounts overlaid by ReadAllRecords. If
+	// nil, RegularAccounts is used.
+	regular []Record
+	// headHash is the hash of the head commit, used to notice when Reload
+	// picks up a new head.
+	headHash hash.Hash
+	// generation is incremented whenever head or the regular accounts
+	// change, ie whenever ReadAllRecords might return something different.
+	generation uint64
 }
 
 // Commit is the Git-like commit structure Noms uses to store values.
@@ -75,8 +88,18 @@ func (db *DB) initLocked() error {
 	if head.Value.Record == nil {
 		head.Value.Record = map[uint32]Record{}
 	}
+	// Records from before URL patterns have hosts instead, and records
+	// from before statuses may be disabled. The migrated records are saved
+	// by the next write.
+	for id, record := range head.Value.Record {
+		head.Value.Record[id] = MigrateDisabled(MigrateClientViewHosts(record))
+	}
 
 	db.head = head
+	if h := db.ds.HeadRef().TargetHash(); h != db.headHash {
+		db.headHash = h
+		db.generation++
+	}
 	return nil
 }
 
@@ -103,6 +126,18 @@ func (db *DB) SetHeadWithValue(accounts Records) error {
 	return db.setHeadLocked(Commit{Value: accounts})
 }
 
+// setHeadWithValueIfUnchanged is SetHeadWithValue, except that it returns a
+// RetryError without writing if head is no longer base. This catches
+// conflicting writes through this DB instance, which Noms can't see because
+// they share the same view of the database.
+func (db *DB) setHeadWithValueIfUnchanged(base hash.Hash, accounts Records) error {
+	defer db.lock()()
+	if db.headHash != base {
+		return RetryError{fmt.Errorf("head changed from %s to %s", base, db.headHash)}
+	}
+	return db.setHeadLocked(Commit{Value: accounts})
+}
+
 func (db *DB) setHeadLocked(newHead Commit) error {
 	v, err := marshal.Marshal(db.Noms(), newHead)
 	if err != nil {
@@ -117,9 +152,45 @@ func (db *DB) setHeadLocked(newHead Commit) error {
 	}
 	db.ds = ds
 	db.head = newHead
+	db.headHash = ref.TargetHash()
+	db.generation++
 	return nil
 }
 
+// SetRegularAccounts replaces the regular accounts that ReadAllRecords
+// overlays on the records in the db. Passing nil restores the default,
+// RegularAccounts.
+func (db *DB) SetRegularAccounts(records []Record) {
+	defer db.lock()()
+	db.regular = records
+	db.generation++
+}
+
+// headValueAndHash returns the head value and the hash of the head commit.
+func (db *DB) headValueAndHash() (Records, hash.Hash) {
+	defer db.lock()()
+	return db.head.Value, db.headHash
+}
+
+// snapshot returns the head value, the regular accounts, and the
+// generation they correspond to.
+func (db *DB) snapshot() (Records, []Record, uint64) {
+	defer db.lock()()
+	regular := db.regular
+	if regular == nil {
+		regular = RegularAccounts
+	}
+	return db.head.Value, regular, db.generation
+}
+
+// Generation returns a number that changes whenever the records or regular
+// accounts in db change, as far as this DB instance knows: changes made by
+// other processes are noticed on Reload.
+func (db *DB) Generation() uint64 {
+	defer db.lock()()
+	return db.generation
+}
+
 // RetryError indicates someone set head out from under us and the operation
 // should be retried (re-load the new head, re-apply the changes, and attempt to
 // set head again).
@@ -135,7 +206,7 @@ func (e *RetryError) Unwrap() error { return e.wrapped }
 
 // Reload reloads the latest state from the underlying noms db.
 func (db *DB) Reload() error {
-	db.lock()()
+	defer db.lock()()
 	db.ds.Database().Rebase()
 	db.ds = db.ds.Database().GetDataset(db.ds.ID())
 	return db.initLocked()
@@ -6,6 +6,8 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
 	"github.com/stretchr/testify/assert"
 	"roci.dev/diff-server/account"
 )
@@ -82,3 +84,54 @@ func TestConcurrentSetHead(t *testing.T) {
 	var retryError account.RetryError
 	assert.True(errors.As(err, &retryError))
 }
+
+func TestReadOldRecords(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	// Records as they were stored before keys and URL patterns.
+	type Record struct {
+		ID              uint32
+		Name            string
+		Email           string
+		ClientViewHosts []string
+		DateCreated     string
+		ClientViewURLs  []string
+	}
+	type Records struct {
+		NextASID uint32
+		Record   map[uint32]Record
+	}
+	type Commit struct {
+		Parents []types.Ref `noms:",set"`
+		Meta    struct{}
+		Value   Records
+	}
+	old := Commit{Value: Records{
+		NextASID: account.LowestASID + 1,
+		Record: map[uint32]Record{
+			account.LowestASID: {ID: account.LowestASID, Name: "Old", ClientViewHosts: []string{"old.com"}, ClientViewURLs: []string{}},
+		},
+	}}
+	noms := db.Noms()
+	v, err := marshal.Marshal(noms, old)
+	assert.NoError(err)
+	_, err = noms.SetHead(noms.GetDataset(account.DatasetName), noms.WriteValue(v))
+	assert.NoError(err)
+
+	db2 := account.LoadTempDBWithPath(assert, dir)
+	records, err := account.ReadRecords(db2)
+	assert.NoError(err)
+	got := records.Record[account.LowestASID]
+	assert.Equal("Old", got.Name)
+	assert.Equal(0, len(got.Keys))
+	assert.Equal(account.HostURLPatterns("old.com"), got.ClientViewURLPatterns)
+
+	// The migration is saved by the next write.
+	assert.NoError(account.Update(db2, func(records *account.Records) error { return nil }))
+	noms.Rebase()
+	var saved Commit
+	assert.NoError(marshal.Unmarshal(noms.GetDataset(account.DatasetName).Head(), &saved))
+	assert.Equal(0, len(saved.Value.Record[account.LowestASID].ClientViewHosts))
+}
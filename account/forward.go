@@ -0,0 +1,95 @@
+package account
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Forward lists the headers and cookies of pull requests that are copied to
+// the client view requests they cause, for data layers that need eg the
+// client's locale or session to compute its view.
+type Forward struct {
+	Headers []Forwarded `json:"headers,omitempty" yaml:"headers,omitempty" noms:",omitempty"`
+	Cookies []Forwarded `json:"cookies,omitempty" yaml:"cookies,omitempty" noms:",omitempty"`
+}
+
+// Forwarded names a header or cookie to forward. The values of sensitive
+// ones are redacted from HTTP logs.
+type Forwarded struct {
+	Name      string `json:"name" yaml:"name"`
+	Sensitive bool   `json:"sensitive,omitempty" yaml:"sensitive,omitempty" noms:",omitempty"`
+}
+
+// reservedHeaders are set on client view requests by the server and so
+// can't be forwarded. Cookies are forwarded with Forward.Cookies, so that
+// only the allowed ones are.
+var reservedHeaders = map[string]bool{
+	"Accept-Encoding":   true,
+	"Authorization":     true,
+	"Connection":        true,
+	"Content-Encoding":  true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Cookie":            true,
+	"Host":              true,
+	"Transfer-Encoding": true,
+}
+
+// IsZero returns true if f forwards nothing.
+func (f Forward) IsZero() bool {
+	return len(f.Headers) == 0 && len(f.Cookies) == 0
+}
+
+// Validate returns an error if f names an invalid header or cookie, or a
+// header the server sets itself.
+func (f Forward) Validate() error {
+	for _, h := range f.Headers {
+		if !isToken(h.Name) {
+			return fmt.Errorf("invalid header name %q", h.Name)
+		}
+		c := http.CanonicalHeaderKey(h.Name)
+		if reservedHeaders[c] || strings.HasPrefix(c, "X-Replicache-") {
+			return fmt.Errorf("header %s is set by the server and can't be forwarded", c)
+		}
+	}
+	for _, c := range f.Cookies {
+		if !isToken(c.Name) {
+			return fmt.Errorf("invalid cookie name %q", c.Name)
+		}
+	}
+	return nil
+}
+
+// SensitiveHeaders returns the names of the headers that carry f's
+// sensitive values: its sensitive headers, and Cookie if any of its cookies
+// is sensitive.
+func (f Forward) SensitiveHeaders() []string {
+	var names []string
+	for _, h := range f.Headers {
+		if h.Sensitive {
+			names = append(names, h.Name)
+		}
+	}
+	for _, c := range f.Cookies {
+		if c.Sensitive {
+			names = append(names, "Cookie")
+			break
+		}
+	}
+	return names
+}
+
+// isToken returns true if s is a valid header or cookie name, a token in
+// the terms of RFC 7230.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
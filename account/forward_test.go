@@ -0,0 +1,74 @@
+package account_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/account"
+)
+
+func TestForwardValidate(t *testing.T) {
+	assert := assert.New(t)
+	h := func(names ...string) account.Forward {
+		var f account.Forward
+		for _, n := range names {
+			f.Headers = append(f.Headers, account.Forwarded{Name: n})
+		}
+		return f
+	}
+	tc := []struct {
+		forward account.Forward
+		wantErr string
+	}{
+		{account.Forward{}, ""},
+		{h("Accept-Language", "x-app-version"), ""},
+		{account.Forward{Cookies: []account.Forwarded{{Name: "session"}}}, ""},
+		{h(""), `invalid header name ""`},
+		{h("Bad Header"), `invalid header name "Bad Header"`},
+		{h("authorization"), "header Authorization is set by the server and can't be forwarded"},
+		{h("Cookie"), "header Cookie is set by the server and can't be forwarded"},
+		{h("X-Replicache-SyncID"), "header X-Replicache-Syncid is set by the server and can't be forwarded"},
+		{account.Forward{Cookies: []account.Forwarded{{Name: "a=b"}}}, `invalid cookie name "a=b"`},
+	}
+	for i, t := range tc {
+		err := t.forward.Validate()
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+		} else {
+			assert.EqualError(err, t.wantErr, "test case %d", i)
+		}
+	}
+}
+
+func TestForwardSensitiveHeaders(t *testing.T) {
+	assert := assert.New(t)
+	f := account.Forward{
+		Headers: []account.Forwarded{{Name: "Accept-Language"}, {Name: "X-Session", Sensitive: true}},
+		Cookies: []account.Forwarded{{Name: "theme"}},
+	}
+	assert.Equal([]string{"X-Session"}, f.SensitiveHeaders())
+	f.Cookies = append(f.Cookies, account.Forwarded{Name: "session", Sensitive: true}, account.Forwarded{Name: "csrf", Sensitive: true})
+	assert.Equal([]string{"X-Session", "Cookie"}, f.SensitiveHeaders())
+	assert.Nil(account.Forward{}.SensitiveHeaders())
+}
+
+func TestForwardStored(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	account.AddUnittestAccount(assert, db)
+
+	f := account.Forward{Headers: []account.Forwarded{{Name: "Accept-Language"}}, Cookies: []account.Forwarded{{Name: "session", Sensitive: true}}}
+	assert.NoError(account.Update(db, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Forward = f
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+	db = account.LoadTempDBWithPath(assert, dir)
+	records, err := account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(f, records.Record[account.UnittestID].Forward)
+	assert.Equal(f, account.CopyRecord(records.Record[account.UnittestID]).Forward)
+}
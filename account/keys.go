@@ -0,0 +1,160 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"roci.dev/diff-server/util/time"
+)
+
+// Key is a secret API key that authorizes requests for an account. Only the
+// hash of the secret is stored; the secret itself is shown once, when the
+// key is created.
+type Key struct {
+	Name        string
+	Hash        string // Hex-encoded SHA-256 of the secret.
+	DateCreated string
+	DateRevoked string // Empty if the key has not been revoked.
+}
+
+// Revoked returns true if the key has been revoked.
+func (k Key) Revoked() bool {
+	return k.DateRevoked != ""
+}
+
+// Keys have the form rk_<account id>_<hex secret>. The account ID lets us
+// find the record to verify against without scanning all of them.
+const keyPrefix = "rk_"
+
+// keySecretBytes is the number of random bytes in a key.
+const keySecretBytes = 32
+
+// NewKey generates a new key for the given account. It returns the secret,
+// which the caller must show to the customer because it cannot be recovered,
+// and the Key to store in the account Record.
+func NewKey(accountID uint32, name string) (string, Key, error) {
+	b := make([]byte, keySecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", Key{}, err
+	}
+	secret := fmt.Sprintf("%s%d_%s", keyPrefix, accountID, hex.EncodeToString(b))
+	return secret, Key{Name: name, Hash: hashKey(secret), DateCreated: time.Now().String()}, nil
+}
+
+// AddKey generates a new key named name and adds it to record. It returns
+// the key's secret, which cannot be recovered later. Key names identify
+// keys, so they must be unique among the record's keys, revoked or not.
+func AddKey(record *Record, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("key name is required")
+	}
+	if _, ok := findKey(*record, name); ok {
+		return "", fmt.Errorf("account %d already has a key named %q", record.ID, name)
+	}
+	secret, key, err := NewKey(record.ID, name)
+	if err != nil {
+		return "", err
+	}
+	record.Keys = append(record.Keys, key)
+	return secret, nil
+}
+
+// RevokeKey revokes record's key named name, so that it no longer
+// authorizes requests. Revoked keys are kept so that they can be shown.
+func RevokeKey(record *Record, name string) error {
+	i, ok := findKey(*record, name)
+	if !ok {
+		return fmt.Errorf("account %d has no key named %q", record.ID, name)
+	}
+	if record.Keys[i].Revoked() {
+		return fmt.Errorf("key %q of account %d is already revoked", name, record.ID)
+	}
+	// Keys are copied so that records sharing the slice are unaffected.
+	record.Keys = append([]Key(nil), record.Keys...)
+	record.Keys[i].DateRevoked = time.Now().String()
+	return nil
+}
+
+// findKey returns the index of record's key named name.
+func findKey(record Record, name string) (int, bool) {
+	for i, k := range record.Keys {
+		if k.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// ValidKeyHash returns true if h has the form of Key.Hash: lower case hex
+// of sha256.Size bytes.
+func ValidKeyHash(h string) bool {
+	b, err := hex.DecodeString(h)
+	return err == nil && len(b) == sha256.Size && hex.EncodeToString(b) == h
+}
+
+func hashKey(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// keyAccountID returns the account ID embedded in a key, or false if
+// authorization does not look like a key.
+func keyAccountID(authorization string) (uint32, bool) {
+	if !strings.HasPrefix(authorization, keyPrefix) {
+		return 0, false
+	}
+	parts := strings.SplitN(authorization[len(keyPrefix):], "_", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// verifyKey returns true if secret matches one of the record's unrevoked
+// keys. The comparison is constant time and checks every key so that timing
+// reveals nothing about which key, if any, matched.
+func verifyKey(record Record, secret string) bool {
+	h := []byte(hashKey(secret))
+	found := 0
+	for _, k := range record.Keys {
+		match := subtle.ConstantTimeCompare(h, []byte(k.Hash))
+		if k.Revoked() {
+			match = 0
+		}
+		found |= match
+	}
+	return found == 1
+}
+
+// HasActiveKeys returns true if the record has at least one unrevoked key.
+func HasActiveKeys(record Record) bool {
+	for _, k := range record.Keys {
+		if !k.Revoked() {
+			return true
+		}
+	}
+	return false
+}
+
+// Signing secrets have the form rss_<hex secret>.
+const signingSecretPrefix = "rss_"
+
+// NewSigningSecret generates a new secret for signing client view requests,
+// see Record.SigningSecret.
+func NewSigningSecret() (string, error) {
+	b := make([]byte, keySecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return signingSecretPrefix + hex.EncodeToString(b), nil
+}
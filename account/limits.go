@@ -0,0 +1,87 @@
+package account
+
+// Limits caps how much an account may use the service. Zero fields take
+// their value from the account's defaults (see EffectiveLimits); negative
+// fields mean unlimited. A negative rate disables its token bucket; a
+// burst of less than one with a positive rate is treated as one.
+type Limits struct {
+	// PullsPerSecond and PullBurst configure a token bucket limiting the
+	// rate of pulls across all of the account's clients.
+	PullsPerSecond float64 `json:"pullsPerSecond,omitempty" yaml:"pullsPerSecond,omitempty" noms:",omitempty"`
+	PullBurst      int     `json:"pullBurst,omitempty" yaml:"pullBurst,omitempty" noms:",omitempty"`
+	// ClientPullsPerSecond and ClientPullBurst configure a token bucket
+	// limiting the rate of pulls from each of the account's clients.
+	ClientPullsPerSecond float64 `json:"clientPullsPerSecond,omitempty" yaml:"clientPullsPerSecond,omitempty" noms:",omitempty"`
+	ClientPullBurst      int     `json:"clientPullBurst,omitempty" yaml:"clientPullBurst,omitempty" noms:",omitempty"`
+	// DailyPulls is the number of pulls allowed per UTC day.
+	DailyPulls int64 `json:"dailyPulls,omitempty" yaml:"dailyPulls,omitempty" noms:",omitempty"`
+	// DailyClientViewBytes is the number of client view bytes (keys and
+	// values) that may be fetched per UTC day.
+	DailyClientViewBytes int64 `json:"dailyClientViewBytes,omitempty" yaml:"dailyClientViewBytes,omitempty" noms:",omitempty"`
+
+	// The size limits protect the server from oversized requests and
+	// client views. Zero takes the server's default, which is configured
+	// per server rather than per kind of account.
+
+	// MaxPullBytes caps the size of pull request bodies.
+	MaxPullBytes int64 `json:"maxPullBytes,omitempty" yaml:"maxPullBytes,omitempty" noms:",omitempty"`
+	// MaxClientViewBytes caps the size of each client view response.
+	MaxClientViewBytes int64 `json:"maxClientViewBytes,omitempty" yaml:"maxClientViewBytes,omitempty" noms:",omitempty"`
+	// MaxClientViewKeys caps the number of keys in a client view.
+	MaxClientViewKeys int64 `json:"maxClientViewKeys,omitempty" yaml:"maxClientViewKeys,omitempty" noms:",omitempty"`
+	// MaxClientViewValueBytes caps the size of each value in a client
+	// view.
+	MaxClientViewValueBytes int64 `json:"maxClientViewValueBytes,omitempty" yaml:"maxClientViewValueBytes,omitempty" noms:",omitempty"`
+}
+
+// DefaultASLimits are the limits of auto-signup accounts that don't
+// override them.
+var DefaultASLimits = Limits{
+	PullsPerSecond:       20,
+	PullBurst:            100,
+	ClientPullsPerSecond: 2,
+	ClientPullBurst:      10,
+	DailyPulls:           200000,
+	DailyClientViewBytes: 1 << 30,
+}
+
+// DefaultRegularLimits are the limits of regular accounts that don't
+// override them: unlimited. Regular accounts are customers we know.
+var DefaultRegularLimits = Limits{
+	PullsPerSecond:       -1,
+	PullBurst:            -1,
+	ClientPullsPerSecond: -1,
+	ClientPullBurst:      -1,
+	DailyPulls:           -1,
+	DailyClientViewBytes: -1,
+}
+
+// EffectiveLimits returns the limits that apply to record: its own, with
+// zero fields filled in from the defaults for its kind of account. Size
+// limits are left zero unless the record overrides them.
+func EffectiveLimits(record Record) Limits {
+	d := DefaultRegularLimits
+	if isASID(record.ID) {
+		d = DefaultASLimits
+	}
+	l := record.Limits
+	if l.PullsPerSecond == 0 {
+		l.PullsPerSecond = d.PullsPerSecond
+	}
+	if l.PullBurst == 0 {
+		l.PullBurst = d.PullBurst
+	}
+	if l.ClientPullsPerSecond == 0 {
+		l.ClientPullsPerSecond = d.ClientPullsPerSecond
+	}
+	if l.ClientPullBurst == 0 {
+		l.ClientPullBurst = d.ClientPullBurst
+	}
+	if l.DailyPulls == 0 {
+		l.DailyPulls = d.DailyPulls
+	}
+	if l.DailyClientViewBytes == 0 {
+		l.DailyClientViewBytes = d.DailyClientViewBytes
+	}
+	return l
+}
@@ -0,0 +1,32 @@
+package account_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+)
+
+func TestEffectiveLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := []struct {
+		record account.Record
+		want   account.Limits
+	}{
+		{account.Record{ID: account.LowestASID}, account.DefaultASLimits},
+		{account.Record{ID: 1}, account.DefaultRegularLimits},
+		{
+			account.Record{ID: account.LowestASID, Limits: account.Limits{PullsPerSecond: 1, DailyPulls: -1}},
+			account.Limits{PullsPerSecond: 1, PullBurst: 100, ClientPullsPerSecond: 2, ClientPullBurst: 10, DailyPulls: -1, DailyClientViewBytes: 1 << 30},
+		},
+		{
+			account.Record{ID: 1, Limits: account.Limits{ClientPullsPerSecond: 5, ClientPullBurst: 5}},
+			account.Limits{PullsPerSecond: -1, PullBurst: -1, ClientPullsPerSecond: 5, ClientPullBurst: 5, DailyPulls: -1, DailyClientViewBytes: -1},
+		},
+	}
+	for i, t := range tc {
+		assert.Equal(t.want, account.EffectiveLimits(t.record), "test case %d", i)
+	}
+}
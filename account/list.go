@@ -3,16 +3,17 @@ package account
 var (
 	RegularAccounts = []Record{
 		{
-			ID:              0,
-			Name:            "Sandbox",
-			ClientViewHosts: []string{"localhost"},
-			ClientViewURLs:  []string{"http://localhost:8000/replicache-client-view"},
+			ID:                    0,
+			Name:                  "Sandbox",
+			ClientViewURLPatterns: HostURLPatterns("localhost"),
+			ClientViewURLs:        []string{"http://localhost:8000/replicache-client-view"},
 		},
 		{
-			ID:              1,
-			Name:            "Replicache Sample TODO",
-			ClientViewHosts: []string{"replicache-sample-todo.now.sh"},
-			ClientViewURLs:  []string{"https://replicache-sample-todo.now.sh/serve/replicache-client-view"},
+			ID:                    1,
+			Name:                  "Replicache Sample TODO",
+			ClientViewURLPatterns: []URLPattern{{Scheme: "https", Host: "replicache-sample-todo.now.sh", Path: "/serve/replicache-client-view"}},
+			HTTPSOnly:             true,
+			ClientViewURLs:        []string{"https://replicache-sample-todo.now.sh/serve/replicache-client-view"},
 		},
 		// Inactive
 		// {
@@ -21,16 +22,18 @@ var (
 		//  ClientViewURLs: []string{"https://api.cron.app/replicache-client-view"},
 		// },
 		{
-			ID:              3,
-			Name:            "Songbook Studio",
-			ClientViewHosts: []string{"us-central1-songbookstudio.cloudfunctions.net"},
-			ClientViewURLs:  []string{"https://us-central1-songbookstudio.cloudfunctions.net/repliclient/4rzcWwvc83dlTz3CoX9WY8NHUxV2"},
+			ID:                    3,
+			Name:                  "Songbook Studio",
+			ClientViewURLPatterns: []URLPattern{{Scheme: "https", Host: "us-central1-songbookstudio.cloudfunctions.net", Path: "/repliclient"}},
+			HTTPSOnly:             true,
+			ClientViewURLs:        []string{"https://us-central1-songbookstudio.cloudfunctions.net/repliclient/4rzcWwvc83dlTz3CoX9WY8NHUxV2"},
 		},
 		{
-			ID:              4,
-			Name:            "Songbook Studio (Vercel)",
-			ClientViewHosts: []string{"songbook.studio"},
-			ClientViewURLs:  []string{"https://songbook.studio/api/repliclient"},
+			ID:                    4,
+			Name:                  "Songbook Studio (Vercel)",
+			ClientViewURLPatterns: []URLPattern{{Scheme: "https", Host: "songbook.studio", Path: "/api/repliclient"}},
+			HTTPSOnly:             true,
+			ClientViewURLs:        []string{"https://songbook.studio/api/repliclient"},
 		},
 	}
 )
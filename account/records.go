@@ -1,8 +1,11 @@
 package account
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 
 	zl "github.com/rs/zerolog"
 )
@@ -27,13 +30,55 @@ func CopyRecords(records Records) Records {
 	return copy
 }
 
-// Record represents a single account record.
+// Record represents a single account record. Fields added after accounts
+// were first stored must be omitempty so that older records can be read.
 type Record struct {
-	ID              uint32
-	Name            string
-	Email           string
+	ID    uint32
+	Name  string
+	Email string
+	// ClientViewHosts is DEPRECATED: hosts are migrated to
+	// ClientViewURLPatterns when records are read, see
+	// MigrateClientViewHosts. It remains so old records can be read.
 	ClientViewHosts []string
-	DateCreated     string
+	// ClientViewURLPatterns are the client view URLs the account may pull
+	// from.
+	ClientViewURLPatterns []URLPattern `noms:",omitempty"`
+	// HTTPSOnly accounts may only pull from https client view URLs,
+	// whatever their patterns say.
+	HTTPSOnly   bool `noms:",omitempty"`
+	DateCreated string
+	// Keys are the API keys that authorize requests for this account,
+	// including revoked ones.
+	Keys []Key `noms:",omitempty"`
+	// Disabled is DEPRECATED: disabled accounts are migrated to a
+	// suspended Status when records are read, see MigrateDisabled. It
+	// remains so old records can be read.
+	Disabled bool `noms:",omitempty"`
+	// Status says whether the account can be used, see Active.
+	Status Status `noms:",omitempty"`
+	// Limits overrides the account's default limits, see EffectiveLimits.
+	Limits Limits `noms:",omitempty"`
+	// Verification is set until the account's email address is verified.
+	// Unverified accounts cannot be used to pull.
+	Verification Verification `noms:",omitempty"`
+	// StorageSpec is the spec of the Noms database the account's client
+	// data is stored in. If empty it is stored under the server's storage
+	// root. Change it with the move-storage command, which copies the data.
+	StorageSpec string `noms:",omitempty"`
+	// SigningSecret, if set, is used to sign requests to the account's
+	// client view URLs so that the customer can verify that they came from
+	// us, see package signature. Unlike keys it is stored as is, because
+	// signing needs it.
+	SigningSecret string `noms:",omitempty"`
+	// TLS configures the connections the account's client views are
+	// fetched over.
+	TLS TLS `noms:",omitempty"`
+	// Schemas are checked against the values of the account's client
+	// views before they are stored.
+	Schemas []KeySchema `noms:",omitempty"`
+	// Forward lists the pull request headers and cookies copied to the
+	// account's client view requests.
+	Forward Forward `noms:",omitempty"`
 
 	// ClientViewURLS is used only by Version 2 clients. It is DEPRECATED
 	// and will go away when Version 2 is no longer supported.
@@ -44,39 +89,86 @@ type Record struct {
 // CopyRecord deep copies a Record (it contains a pointer type).
 func CopyRecord(record Record) Record {
 	copy := Record{
-		ID:              record.ID,
-		Name:            record.Name,
-		Email:           record.Email,
-		ClientViewHosts: make([]string, 0, len(record.ClientViewHosts)),
-		DateCreated:     record.DateCreated,
-		ClientViewURLs:  make([]string, 0, len(record.ClientViewURLs)),
+		ID:                    record.ID,
+		Name:                  record.Name,
+		Email:                 record.Email,
+		ClientViewHosts:       make([]string, 0, len(record.ClientViewHosts)),
+		ClientViewURLPatterns: make([]URLPattern, 0, len(record.ClientViewURLPatterns)),
+		HTTPSOnly:             record.HTTPSOnly,
+		DateCreated:           record.DateCreated,
+		Keys:                  make([]Key, 0, len(record.Keys)),
+		Disabled:              record.Disabled,
+		Status:                record.Status,
+		Limits:                record.Limits,
+		Verification:          record.Verification,
+		StorageSpec:           record.StorageSpec,
+		SigningSecret:         record.SigningSecret,
+		TLS:                   record.TLS,
+		ClientViewURLs:        make([]string, 0, len(record.ClientViewURLs)),
+	}
+	if record.Schemas != nil {
+		copy.Schemas = append([]KeySchema{}, record.Schemas...)
+	}
+	if record.Forward.Headers != nil {
+		copy.Forward.Headers = append([]Forwarded{}, record.Forward.Headers...)
+	}
+	if record.Forward.Cookies != nil {
+		copy.Forward.Cookies = append([]Forwarded{}, record.Forward.Cookies...)
 	}
 	for _, url := range record.ClientViewHosts {
 		copy.ClientViewHosts = append(copy.ClientViewHosts, url)
 	}
+	for _, p := range record.ClientViewURLPatterns {
+		copy.ClientViewURLPatterns = append(copy.ClientViewURLPatterns, p)
+	}
+	for _, key := range record.Keys {
+		copy.Keys = append(copy.Keys, key)
+	}
 	for _, url := range record.ClientViewURLs {
 		copy.ClientViewURLs = append(copy.ClientViewURLs, url)
 	}
 	return copy
 }
 
+// Redact returns a copy of record without key hashes, the verification
+// token hash, the signing secret and the TLS client key, for showing to
+// operators: none of them has any business leaving the server.
+func Redact(record Record) Record {
+	c := CopyRecord(record)
+	for i := range c.Keys {
+		c.Keys[i].Hash = ""
+	}
+	c.Verification.TokenHash = ""
+	c.SigningSecret = ""
+	c.TLS.ClientKey = ""
+	return c
+}
+
 // ASIDs are issued in a separate range from regular accounts.
 // See RFC: https://github.com/rocicorp/repc/issues/269
 const LowestASID uint32 = 1000000
 
-// We limit the number of auto-added client view hosts for auto-signup accounts.
+// We limit the number of distinct hosts in the client view URL patterns of
+// auto-signup accounts.
 const MaxASClientViewHosts int = 5
 
 // ReadAllRecords returns the full set of Replicache account records. Reading
 // of Records is separate from Lookup so the caller can cache Records if they
 // so desire (it doesn't change very often).
 func ReadAllRecords(db *DB) (Records, error) {
-	dbRecords, err := ReadRecords(db)
-	if err != nil {
-		return Records{}, err
+	records, _, err := readAllRecords(db)
+	return records, err
+}
+
+// readAllRecords is ReadAllRecords that also returns the DB generation the
+// records correspond to.
+func readAllRecords(db *DB) (Records, uint64, error) {
+	if err := db.Reload(); err != nil {
+		return Records{}, 0, err
 	}
+	dbRecords, regular, generation := db.snapshot()
 
-	// Now overlay the hard-coded regular accounts, removing any stale regular
+	// Now overlay the regular accounts, removing any stale regular
 	// account records that might have been saved. Since we are mutating records
 	// we make a copy of it first :( Otherwise others who have a handle on it
 	// will see our changes.
@@ -89,11 +181,11 @@ func ReadAllRecords(db *DB) (Records, error) {
 			delete(records.Record, record.ID)
 		}
 	}
-	for _, record := range RegularAccounts {
+	for _, record := range regular {
 		records.Record[record.ID] = record
 	}
 
-	return records, nil
+	return records, generation, nil
 }
 
 // ReadRecords reads records from the db WITHOUT overlaying the production
@@ -106,87 +198,174 @@ func ReadRecords(db *DB) (Records, error) {
 }
 
 // Lookup returns the account record for the given authorization string
-// and true, or the empty Record and false if it does not exist.
-func Lookup(records Records, authorization string) (Record, bool) {
+// and true, or the empty Record and false if Authenticate returns an error.
+func Lookup(records Records, authorization string, allowIDs bool) (Record, bool) {
+	r, err := Authenticate(records, authorization, allowIDs)
+	return r, err == nil
+}
+
+// Authenticate returns the account record for the given authorization
+// string. The authorization string must be one of the account's unrevoked
+// keys. It returns ErrUnknownAccount if the account does not exist, is
+// unverified, or the authorization is not valid for it, and a *StatusError
+// if the authorization is valid but the account is not active.
+//
+// If allowIDs is true, Authenticate also accepts the bare account ID (and
+// "sandbox" for account 0) for compatibility with clients from before
+// accounts had keys, but only for accounts that don't have any active keys
+// yet. Once a customer creates a key their account ID stops working as a
+// credential.
+func Authenticate(records Records, authorization string, allowIDs bool) (Record, error) {
+	var r Record
+	if id, ok := keyAccountID(authorization); ok {
+		var found bool
+		r, found = records.Record[id]
+		if !found || Unverified(r) || !verifyKey(r, authorization) {
+			return Record{}, ErrUnknownAccount
+		}
+	} else {
+		if !allowIDs {
+			return Record{}, ErrUnknownAccount
+		}
+		var found bool
+		r, found = LookupID(records, authorization)
+		if !found || Unverified(r) || HasActiveKeys(r) {
+			return Record{}, ErrUnknownAccount
+		}
+	}
+	if !Active(r) {
+		return Record{}, &StatusError{ID: r.ID, Status: r.Status}
+	}
+	return r, nil
+}
+
+// LookupID returns the account record with the given ID and true, or the
+// empty Record and false if it does not exist. It does no authorization.
+func LookupID(records Records, id string) (Record, bool) {
 	// We have a special-case account where we send an auth string
-	// instead of an ID in the Authorization header, so here do the
-	// mapping manually. We could clean this up if we wanted, but it's
-	// still not a bad idea to have indirection between the Authorization
-	// header and an account Record eg if we wanted to hand out actual
-	// authorization tokens that would need to be decoded and validated.
-	if authorization == "sandbox" {
-		authorization = "0"
-	}
-	id, err := strconv.ParseUint(authorization, 10, 32)
+	// instead of an ID, so here do the mapping manually.
+	if id == "sandbox" {
+		id = "0"
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
 	if err != nil {
 		return Record{}, false
 	}
-	r, found := records.Record[uint32(id)]
+	r, found := records.Record[uint32(n)]
 	return r, found
 }
 
+// LookupEmail returns the account record with the given email address, which
+// is compared case-insensitively, and true, or the empty Record and false if
+// there isn't one.
+func LookupEmail(records Records, email string) (Record, bool) {
+	email = strings.TrimSpace(email)
+	for _, r := range records.Record {
+		if strings.EqualFold(strings.TrimSpace(r.Email), email) {
+			return r, true
+		}
+	}
+	return Record{}, false
+}
+
 // WriteRecords writes the given records to the underlying db. It might
 // return an RetryError in which case the caller should retry the entire
 // operation: re-read Records with ReadRecords, copy it, apply changes,
 // and call WriteRecords again. Do not retry if the returned error cannot be
-// converted to a RetryError (via errors.As).
+// converted to a RetryError (via errors.As). Update does all of this and is
+// what writers should use.
 func WriteRecords(db *DB, records Records) error {
 	return db.SetHeadWithValue(records)
 }
 
 // ClientViewURLAuthorized returns a bool indicating whether the URL the client
-// is attempting to fetch from is authorized. We allow auto-signup accounts to
-// fetch their client view from any URL from up to some number of unique hosts. We
+// is attempting to fetch from is authorized and, if it is not, the reason. A URL
+// is authorized if it matches one of the account's ClientViewURLPatterns (and
+// is https, for HTTPSOnly accounts). We allow auto-signup accounts to fetch their
+// client view from any URL from up to some number of unique hosts: a pattern
+// for the URL's scheme, host and port is added the first time it is used. We
 // limit this number to prevent spamming and require fixed, explicitly configured
-// hosts for the non-ASID case for security.
+// patterns for the non-ASID case for security.
 //
-// ClientViewURLAuthorized assumes that records is mutable. If the caller doesn't
-// want to see changes from ClientViewURLAuthorized it should pass in a copy from
-// CopyRecords().
-func ClientViewURLAuthorized(maxASClientViewHosts int, db *DB, records Records, ID uint32, url string, l zl.Logger) (bool, error) {
+// ClientViewURLAuthorized checks against records, which it does not modify. If
+// a pattern has to be added it is added to the record in db with Update.
+func ClientViewURLAuthorized(maxASClientViewHosts int, db *DB, records Records, ID uint32, rawurl string, l zl.Logger) (bool, string, error) {
 	record, exists := records.Record[ID]
 	if !exists {
-		return false, nil
+		return false, "unknown account", nil
 	}
+	record = MigrateClientViewHosts(record)
 
-	clientViewHost, err := host(url)
-	if err != nil {
-		return false, err
+	u, err := url.Parse(rawurl)
+	if err != nil || !u.IsAbs() || u.Hostname() == "" {
+		return false, "clientViewURL must be an absolute URL", nil
 	}
-
-	for _, authorizedHost := range record.ClientViewHosts {
-		if clientViewHost == authorizedHost {
-			return true, nil
-		}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false, fmt.Sprintf("clientViewURL scheme %s is not supported", u.Scheme), nil
 	}
-	// Regular accounts have a fixed list of authorized hosts.
+	if record.HTTPSOnly && u.Scheme != "https" {
+		return false, "clientViewURL must use https for this account", nil
+	}
+	if matchesPattern(record, u) {
+		return true, "", nil
+	}
+	// Regular accounts have a fixed list of authorized patterns.
 	if !isASID(record.ID) {
-		return false, nil
+		return false, "clientViewURL does not match any of the account's client view URL patterns", nil
 	}
 
-	// Here we know this is an auto-signup account and the host is not in the list.
-	if len(record.ClientViewHosts) >= maxASClientViewHosts {
-		return false, nil
+	// Here we know this is an auto-signup account and the URL doesn't match.
+	// Check again against the latest records since they might have changed.
+	p := URLPattern{Scheme: u.Scheme, Host: strings.ToLower(u.Hostname()), Port: u.Port(), Path: "/"}
+	authorized, reason := false, ""
+	err = Update(db, func(records *Records) error {
+		record, exists := records.Record[ID]
+		if !exists {
+			authorized, reason = false, "unknown account"
+			return errNoChange
+		}
+		record = MigrateClientViewHosts(record)
+		if matchesPattern(record, u) {
+			authorized, reason = true, ""
+			return errNoChange
+		}
+		if patternHosts(record) >= maxASClientViewHosts && !hasHost(record, p.Host) {
+			authorized, reason = false, fmt.Sprintf("account already uses the maximum of %d client view hosts", maxASClientViewHosts)
+			return errNoChange
+		}
+		record.ClientViewURLPatterns = append(record.ClientViewURLPatterns, p)
+		records.Record[record.ID] = record
+		authorized, reason = true, ""
+		l.Debug().Msgf("Adding clientViewURLPattern %s for account %d (now %v)", p, ID, record.ClientViewURLPatterns)
+		return nil
+	})
+	if err != nil && err != errNoChange {
+		return false, "", err
 	}
+	return authorized, reason, nil
+}
+
+// errNoChange aborts an Update that has nothing to write.
+var errNoChange = errors.New("no change")
 
-	record.ClientViewHosts = append(record.ClientViewHosts, clientViewHost)
-	records.Record[record.ID] = record
-	// TODO retry
-	if err := WriteRecords(db, records); err != nil {
-		return false, err
+func matchesPattern(record Record, u *url.URL) bool {
+	for _, p := range record.ClientViewURLPatterns {
+		if p.Matches(u) {
+			return true
+		}
 	}
-	l.Debug().Msgf("Added clientViewHost %s for account %d (now %v)", clientViewHost, ID, record.ClientViewHosts)
-	return true, nil
+	return false
 }
 
-func isASID(id uint32) bool {
-	return id >= LowestASID
+func hasHost(record Record, host string) bool {
+	for _, p := range record.ClientViewURLPatterns {
+		if p.Host == host {
+			return true
+		}
+	}
+	return false
 }
 
-func host(rawurl string) (string, error) {
-	u, err := url.Parse(rawurl)
-	if err != nil {
-		return "", err
-	}
-	return u.Hostname(), nil
+func isASID(id uint32) bool {
+	return id >= LowestASID
 }
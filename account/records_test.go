@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,10 +17,18 @@ func TestReadAllRecordsAndLookup(t *testing.T) {
 	db, dir := account.LoadTempDB(assert)
 	defer func() { assert.NoError(os.RemoveAll(dir)) }()
 
-	// Add an ASID account.
+	// Add an ASID account without keys and one with a live and a revoked key.
 	newAccount := account.Record{ID: account.LowestASID + 42, Name: "Larry"}
+	keyedAccount := account.Record{ID: account.LowestASID + 43, Name: "Moe"}
+	secret, key, err := account.NewKey(keyedAccount.ID, "live")
+	assert.NoError(err)
+	revokedSecret, revokedKey, err := account.NewKey(keyedAccount.ID, "revoked")
+	assert.NoError(err)
+	revokedKey.DateRevoked = "yesterday"
+	keyedAccount.Keys = []account.Key{key, revokedKey}
 	accounts := db.HeadValue()
 	accounts.Record[newAccount.ID] = newAccount
+	accounts.Record[keyedAccount.ID] = keyedAccount
 	assert.NoError(db.SetHeadWithValue(accounts))
 
 	// Make sure unittest-account-adding function works.
@@ -29,6 +38,7 @@ func TestReadAllRecordsAndLookup(t *testing.T) {
 		name      string
 		db        *account.DB
 		auth      string
+		allowIDs  bool
 		wantFound bool
 		wantName  string
 	}{
@@ -36,6 +46,7 @@ func TestReadAllRecordsAndLookup(t *testing.T) {
 			"no such account",
 			db,
 			"nosuchaccount",
+			true,
 			false,
 			"",
 		},
@@ -44,12 +55,22 @@ func TestReadAllRecordsAndLookup(t *testing.T) {
 			db,
 			"sandbox",
 			true,
+			true,
 			"Sandbox",
 		},
+		{
+			"sandbox regular account without id auth",
+			db,
+			"sandbox",
+			false,
+			false,
+			"",
+		},
 		{
 			"unittest account (added with test helper)",
 			db,
-			fmt.Sprintf("%d", account.UnittestID),
+			account.UnittestKey,
+			false,
 			true,
 			"Unittest",
 		},
@@ -58,6 +79,7 @@ func TestReadAllRecordsAndLookup(t *testing.T) {
 			db,
 			"1",
 			true,
+			true,
 			"Replicache Sample TODO",
 		},
 		{
@@ -65,14 +87,63 @@ func TestReadAllRecordsAndLookup(t *testing.T) {
 			db,
 			fmt.Sprintf("%d", newAccount.ID),
 			true,
+			true,
 			"Larry",
 		},
+		{
+			"new autosignup account without id auth",
+			db,
+			fmt.Sprintf("%d", newAccount.ID),
+			false,
+			false,
+			"",
+		},
+		{
+			"key",
+			db,
+			secret,
+			false,
+			true,
+			"Moe",
+		},
+		{
+			"revoked key",
+			db,
+			revokedSecret,
+			true,
+			false,
+			"",
+		},
+		{
+			"wrong key",
+			db,
+			fmt.Sprintf("rk_%d_0123456789", keyedAccount.ID),
+			true,
+			false,
+			"",
+		},
+		{
+			"key for another account",
+			db,
+			strings.Replace(secret, fmt.Sprintf("%d", keyedAccount.ID), fmt.Sprintf("%d", newAccount.ID), 1),
+			true,
+			false,
+			"",
+		},
+		{
+			"id of account with keys",
+			db,
+			fmt.Sprintf("%d", keyedAccount.ID),
+			true,
+			false,
+			"",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			accounts, err := account.ReadAllRecords(tt.db)
 			assert.NoError(err)
-			got, found := account.Lookup(accounts, tt.auth)
+			got, found := account.Lookup(accounts, tt.auth, tt.allowIDs)
 			assert.Equal(tt.wantFound, found, "%s", tt.name)
 			if tt.wantFound {
 				assert.Equal(tt.wantName, got.Name, "%s", tt.name)
@@ -112,17 +183,24 @@ func TestWriteRecords(t *testing.T) {
 	assert.True(found)
 	assert.Equal(newAccount.ID, got.ID)
 	assert.Equal(newAccount.Name, got.Name)
-	assert.True(reflect.DeepEqual(newAccount.ClientViewHosts, got.ClientViewHosts))
+	// Hosts are migrated to patterns on read.
+	assert.Equal(0, len(got.ClientViewHosts))
+	assert.Equal(account.HostURLPatterns("host.com"), got.ClientViewURLPatterns)
 }
 
 func TestClientViewURLAuthorized(t *testing.T) {
 	assert := assert.New(t)
+	pattern := func(s string) account.URLPattern {
+		p, err := account.ParseURLPattern(s)
+		assert.NoError(err)
+		return p
+	}
 	tests := []struct {
 		name           string
 		ID             uint32
 		url            string
 		wantAuthorized bool
-		wantErr        string
+		wantReason     string
 		wantAdded      bool
 	}{
 		{
@@ -130,7 +208,7 @@ func TestClientViewURLAuthorized(t *testing.T) {
 			123,
 			"http://authorized.com",
 			false,
-			"",
+			"unknown account",
 			false,
 		},
 		{
@@ -138,7 +216,7 @@ func TestClientViewURLAuthorized(t *testing.T) {
 			0,
 			"http://UNauthorized.com",
 			false,
-			"",
+			"does not match",
 			false,
 		},
 		{
@@ -157,6 +235,54 @@ func TestClientViewURLAuthorized(t *testing.T) {
 			"",
 			false,
 		},
+		{
+			"regular account, authorized path",
+			1,
+			"https://prod.com/api/cv?x=y",
+			true,
+			"",
+			false,
+		},
+		{
+			"regular account, unauthorized path",
+			1,
+			"https://prod.com/other/cv",
+			false,
+			"does not match",
+			false,
+		},
+		{
+			"regular account, unauthorized port",
+			1,
+			"https://prod.com:8443/api/cv",
+			false,
+			"does not match",
+			false,
+		},
+		{
+			"regular account, https only",
+			1,
+			"http://prod.com/api/cv",
+			false,
+			"must use https",
+			false,
+		},
+		{
+			"relative url",
+			1,
+			"/api/cv",
+			false,
+			"absolute URL",
+			false,
+		},
+		{
+			"unsupported scheme",
+			1,
+			"ftp://prod.com/api/cv",
+			false,
+			"scheme ftp is not supported",
+			false,
+		},
 		{
 			"auto account, authorized url",
 			account.LowestASID,
@@ -173,6 +299,14 @@ func TestClientViewURLAuthorized(t *testing.T) {
 			"",
 			true,
 		},
+		{
+			"auto account, new port on known host",
+			account.LowestASID + 1,
+			"https://authorized.com:8443/cv",
+			true,
+			"",
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -181,32 +315,39 @@ func TestClientViewURLAuthorized(t *testing.T) {
 			records := account.Records{
 				0,
 				map[uint32]account.Record{
-					0:                  {ID: 0, ClientViewHosts: []string{"authorized.com"}},
-					account.LowestASID: {ID: account.LowestASID, ClientViewHosts: []string{"authorized.com"}},
+					// Legacy hosts are migrated to patterns.
+					0:                      {ID: 0, ClientViewHosts: []string{"authorized.com"}},
+					1:                      {ID: 1, ClientViewURLPatterns: []account.URLPattern{pattern("https://prod.com/api")}, HTTPSOnly: true},
+					account.LowestASID:     {ID: account.LowestASID, ClientViewHosts: []string{"authorized.com"}},
+					account.LowestASID + 1: {ID: account.LowestASID + 1, ClientViewURLPatterns: []account.URLPattern{pattern("https://authorized.com/")}},
 				},
 			}
 			assert.NoError(account.WriteRecords(db, records))
 			recordsCopy := account.CopyRecords(records)
+			pristine := account.CopyRecords(records)
 
-			gotAuthorized, err := account.ClientViewURLAuthorized(account.MaxASClientViewHosts, db, recordsCopy, tt.ID, tt.url, log.Default())
-			if tt.wantErr != "" {
-				assert.Error(err)
-				assert.Contains(err.Error(), tt.wantErr)
+			gotAuthorized, gotReason, err := account.ClientViewURLAuthorized(account.MaxASClientViewHosts, db, recordsCopy, tt.ID, tt.url, log.Default())
+			assert.NoError(err)
+			assert.Equal(tt.wantAuthorized, gotAuthorized, tt.name)
+			if tt.wantReason == "" {
+				assert.Equal("", gotReason)
 			} else {
+				assert.Contains(gotReason, tt.wantReason)
+			}
+			assert.True(reflect.DeepEqual(pristine, recordsCopy), "records must not be modified")
+
+			originalRecord, exists := records.Record[tt.ID]
+			if exists {
+				recordsAfter, err := account.ReadRecords(db)
 				assert.NoError(err)
-				assert.Equal(tt.wantAuthorized, gotAuthorized, tt.name)
-
-				originalRecord, exists := records.Record[tt.ID]
-				if exists {
-					recordsAfter, err := account.ReadRecords(db)
-					assert.NoError(err)
-					urlAdded := len(originalRecord.ClientViewHosts) != len(recordsAfter.Record[tt.ID].ClientViewHosts)
-					assert.Equal(tt.wantAdded, urlAdded, "%s: URLs before: %v, URLs after: %v", tt.name, originalRecord.ClientViewHosts, recordsAfter.Record[tt.ID].ClientViewHosts)
-				}
+				before := account.MigrateClientViewHosts(originalRecord).ClientViewURLPatterns
+				after := recordsAfter.Record[tt.ID].ClientViewURLPatterns
+				assert.Equal(tt.wantAdded, len(before) != len(after), "%s: patterns before: %v, patterns after: %v", tt.name, before, after)
 			}
 		})
 	}
 }
+
 func TestClientViewURLAuthorizedWithMaxedURLs(t *testing.T) {
 	assert := assert.New(t)
 	db, dir := account.LoadTempDB(assert)
@@ -224,21 +365,27 @@ func TestClientViewURLAuthorizedWithMaxedURLs(t *testing.T) {
 	records.Record[account.LowestASID] = record
 	assert.NoError(account.WriteRecords(db, records))
 
-	gotAuthorized, err := account.ClientViewURLAuthorized(account.MaxASClientViewHosts, db, records, account.LowestASID, "http://somenewhost.com", log.Default())
+	gotAuthorized, gotReason, err := account.ClientViewURLAuthorized(account.MaxASClientViewHosts, db, records, account.LowestASID, "http://somenewhost.com", log.Default())
 	assert.NoError(err)
 	assert.False(gotAuthorized)
+	assert.Contains(gotReason, "maximum")
 }
 
 func TestCopyRecord(t *testing.T) {
 	assert := assert.New(t)
 
 	record := account.Record{
-		ID:              1,
-		Name:            "name",
-		Email:           "email",
-		ClientViewHosts: []string{"host1"},
-		DateCreated:     "date",
-		ClientViewURLs:  []string{"url1"},
+		ID:                    1,
+		Name:                  "name",
+		Email:                 "email",
+		ClientViewHosts:       []string{"host1"},
+		ClientViewURLPatterns: []account.URLPattern{{Scheme: "https", Host: "host1", Path: "/"}},
+		HTTPSOnly:             true,
+		DateCreated:           "date",
+		Keys:                  []account.Key{{Name: "key1", Hash: "hash1"}},
+		Disabled:              true,
+		Status:                account.Status{State: account.StateSuspended, Reason: "abuse", Date: "date"},
+		ClientViewURLs:        []string{"url1"},
 	}
 	copy := account.CopyRecord(record)
 	assert.True(reflect.DeepEqual(record, copy))
@@ -246,6 +393,54 @@ func TestCopyRecord(t *testing.T) {
 	// Ensure no aliasing.
 	copy.ClientViewHosts = append(copy.ClientViewHosts, "host2")
 	assert.NotEqual(len(record.ClientViewHosts), len(copy.ClientViewHosts))
+	copy.ClientViewURLPatterns[0].Port = "8080"
+	assert.Equal("", record.ClientViewURLPatterns[0].Port)
+	copy.Keys[0].DateRevoked = "now"
+	assert.False(record.Keys[0].Revoked())
 	copy.ClientViewURLs = append(copy.ClientViewURLs, "url2")
 	assert.NotEqual(len(record.ClientViewURLs), len(copy.ClientViewURLs))
 }
+
+func TestAddAndRevokeKey(t *testing.T) {
+	assert := assert.New(t)
+	r := account.Record{ID: account.LowestASID + 1}
+	first, err := account.AddKey(&r, "first")
+	assert.NoError(err)
+	second, err := account.AddKey(&r, "second")
+	assert.NoError(err)
+	_, err = account.AddKey(&r, "first")
+	assert.EqualError(err, fmt.Sprintf(`account %d already has a key named "first"`, r.ID))
+	_, err = account.AddKey(&r, "")
+	assert.EqualError(err, "key name is required")
+	records := account.Records{Record: map[uint32]account.Record{r.ID: r}}
+	for _, secret := range []string{first, second} {
+		_, err := account.Authenticate(records, secret, false)
+		assert.NoError(err)
+	}
+
+	shared := r
+	assert.NoError(account.RevokeKey(&r, "first"))
+	assert.True(r.Keys[0].Revoked())
+	assert.False(shared.Keys[0].Revoked())
+	assert.EqualError(account.RevokeKey(&r, "first"), fmt.Sprintf(`key "first" of account %d is already revoked`, r.ID))
+	assert.EqualError(account.RevokeKey(&r, "third"), fmt.Sprintf(`account %d has no key named "third"`, r.ID))
+	records.Record[r.ID] = r
+	_, err = account.Authenticate(records, first, false)
+	assert.Equal(account.ErrUnknownAccount, err)
+	_, err = account.Authenticate(records, second, false)
+	assert.NoError(err)
+}
+
+func TestRedact(t *testing.T) {
+	assert := assert.New(t)
+	r := account.Record{ID: 7, Name: "Acme", Keys: []account.Key{{Name: "default", Hash: "h"}}, SigningSecret: "rss_x"}
+	r.Verification.TokenHash = "t"
+	r.TLS.ClientKey = "k"
+	got := account.Redact(r)
+	assert.Equal("Acme", got.Name)
+	assert.Equal([]account.Key{{Name: "default"}}, got.Keys)
+	assert.Equal("", got.Verification.TokenHash)
+	assert.Equal("", got.SigningSecret)
+	assert.Equal("", got.TLS.ClientKey)
+	assert.Equal("h", r.Keys[0].Hash)
+}
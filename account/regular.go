@@ -0,0 +1,229 @@
+package account
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/attic-labs/noms/go/spec"
+	zl "github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// regularAccount is the representation of a regular account in a regular
+// accounts file.
+type regularAccount struct {
+	ID    uint32 `json:"id" yaml:"id"`
+	Name  string `json:"name" yaml:"name"`
+	Email string `json:"email" yaml:"email"`
+	// ClientViewHosts is DEPRECATED, use ClientViewURLPatterns.
+	ClientViewHosts       []string     `json:"clientViewHosts" yaml:"clientViewHosts"`
+	ClientViewURLPatterns []string     `json:"clientViewURLPatterns" yaml:"clientViewURLPatterns"`
+	HTTPSOnly             bool         `json:"httpsOnly" yaml:"httpsOnly"`
+	ClientViewURLs        []string     `json:"clientViewURLs" yaml:"clientViewURLs"`
+	Limits                Limits       `json:"limits" yaml:"limits"`
+	StorageSpec           string       `json:"storageSpec" yaml:"storageSpec"`
+	SigningSecret         string       `json:"signingSecret" yaml:"signingSecret"`
+	TLS                   TLS          `json:"tls" yaml:"tls"`
+	Schemas               []KeySchema  `json:"schemas" yaml:"schemas"`
+	Forward               Forward      `json:"forward" yaml:"forward"`
+	Keys                  []regularKey `json:"keys" yaml:"keys"`
+}
+
+// regularKey is the representation of a Key in a regular accounts file.
+// Only the hash of the secret is in the file; `diffs account add-key`
+// generates a secret and prints the hash to add here.
+type regularKey struct {
+	Name        string `json:"name" yaml:"name"`
+	Hash        string `json:"hash" yaml:"hash"`
+	DateRevoked string `json:"dateRevoked" yaml:"dateRevoked"`
+}
+
+// regularAccountsFile is the top level of a regular accounts file.
+type regularAccountsFile struct {
+	Accounts []regularAccount `json:"accounts" yaml:"accounts"`
+}
+
+// LoadRegularAccounts reads and validates the regular accounts in the file
+// at path. Files ending in .json are parsed as JSON, all others as YAML. For
+// example:
+//
+//	accounts:
+//	- id: 1
+//	  name: Replicache Sample TODO
+//	  clientViewURLPatterns: [https://replicache-sample-todo.now.sh/serve/]
+//	  httpsOnly: true
+//	  keys:
+//	  - name: ci
+//	    hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+func LoadRegularAccounts(path string) ([]Record, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f regularAccountsFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		err = d.Decode(&f)
+	} else {
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		err = d.Decode(&f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	records, err := validateRegularAccounts(f.Accounts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular accounts in %s: %w", path, err)
+	}
+	return records, nil
+}
+
+func validateRegularAccounts(accounts []regularAccount) ([]Record, error) {
+	records := make([]Record, 0, len(accounts))
+	seen := map[uint32]bool{}
+	for i, a := range accounts {
+		if isASID(a.ID) {
+			return nil, fmt.Errorf("entry %d: id %d is not less than %d", i, a.ID, LowestASID)
+		}
+		if seen[a.ID] {
+			return nil, fmt.Errorf("entry %d: duplicate id %d", i, a.ID)
+		}
+		seen[a.ID] = true
+		if a.Name == "" {
+			return nil, fmt.Errorf("account %d: name is required", a.ID)
+		}
+		for _, h := range a.ClientViewHosts {
+			if h == "" || strings.ContainsAny(h, "/:@ ") {
+				return nil, fmt.Errorf("account %d: invalid client view host %q, want a bare hostname", a.ID, h)
+			}
+		}
+		var patterns []URLPattern
+		for _, s := range a.ClientViewURLPatterns {
+			p, err := ParseURLPattern(s)
+			if err != nil {
+				return nil, fmt.Errorf("account %d: %w", a.ID, err)
+			}
+			patterns = append(patterns, p)
+		}
+		if a.StorageSpec != "" {
+			if _, err := spec.ForDatabase(a.StorageSpec); err != nil {
+				return nil, fmt.Errorf("account %d: invalid storage spec: %w", a.ID, err)
+			}
+		}
+		if _, err := a.TLS.Config(); err != nil {
+			return nil, fmt.Errorf("account %d: invalid tls: %w", a.ID, err)
+		}
+		if err := ValidateSchemas(a.Schemas); err != nil {
+			return nil, fmt.Errorf("account %d: %w", a.ID, err)
+		}
+		if err := a.Forward.Validate(); err != nil {
+			return nil, fmt.Errorf("account %d: invalid forward: %w", a.ID, err)
+		}
+		for _, u := range a.ClientViewURLs {
+			if pu, err := url.Parse(u); err != nil || pu.Scheme == "" || pu.Host == "" {
+				return nil, fmt.Errorf("account %d: invalid client view URL %q", a.ID, u)
+			}
+		}
+		keys, err := validateRegularKeys(a.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("account %d: %w", a.ID, err)
+		}
+		records = append(records, MigrateClientViewHosts(Record{
+			ID:                    a.ID,
+			Name:                  a.Name,
+			Email:                 a.Email,
+			ClientViewHosts:       a.ClientViewHosts,
+			ClientViewURLPatterns: patterns,
+			HTTPSOnly:             a.HTTPSOnly,
+			ClientViewURLs:        a.ClientViewURLs,
+			Limits:                a.Limits,
+			StorageSpec:           a.StorageSpec,
+			SigningSecret:         a.SigningSecret,
+			TLS:                   a.TLS,
+			Schemas:               a.Schemas,
+			Forward:               a.Forward,
+			Keys:                  keys,
+		}))
+	}
+	return records, nil
+}
+
+func validateRegularKeys(regularKeys []regularKey) ([]Key, error) {
+	var keys []Key
+	seen := map[string]bool{}
+	for i, k := range regularKeys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("key %d: name is required", i)
+		}
+		if seen[k.Name] {
+			return nil, fmt.Errorf("key %d: duplicate name %q", i, k.Name)
+		}
+		seen[k.Name] = true
+		if !ValidKeyHash(k.Hash) {
+			return nil, fmt.Errorf("key %q: invalid hash, want lower case hex SHA-256", k.Name)
+		}
+		keys = append(keys, Key{Name: k.Name, Hash: k.Hash, DateRevoked: k.DateRevoked})
+	}
+	return keys, nil
+}
+
+// WatchRegularAccounts loads the regular accounts in the file at path into
+// db (see SetRegularAccounts), then keeps them up to date in the background:
+// the file is reloaded when its modification time or size changes, checked
+// every interval, and whenever a value is received on reload (eg, SIGHUP). If
+// a reload fails the error is logged and the previous accounts stay in
+// effect. The returned stop function stops watching.
+func WatchRegularAccounts(db *DB, path string, interval time.Duration, reload <-chan os.Signal, l zl.Logger) (stop func(), err error) {
+	records, err := LoadRegularAccounts(path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetRegularAccounts(records)
+	last, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	l.Info().Msgf("Loaded %d regular accounts from %s", len(records), path)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			force := false
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			case <-reload:
+				force = true
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				l.Error().Err(err).Msgf("Could not stat regular accounts file %s", path)
+				continue
+			}
+			if !force && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+				continue
+			}
+			last = fi
+			records, err := LoadRegularAccounts(path)
+			if err != nil {
+				l.Error().Err(err).Msg("Could not reload regular accounts, keeping previous ones")
+				continue
+			}
+			db.SetRegularAccounts(records)
+			l.Info().Msgf("Reloaded %d regular accounts from %s", len(records), path)
+		}
+	}()
+	return func() { close(done) }, nil
+}
@@ -0,0 +1,180 @@
+package account_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestLoadRegularAccounts(t *testing.T) {
+	assert := assert.New(t)
+	const keyHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	want := []account.Record{
+		{ID: 0, Name: "Sandbox", ClientViewURLPatterns: account.HostURLPatterns("localhost")},
+		{ID: 7, Name: "Acme", Email: "ops@acme.com", ClientViewURLPatterns: []account.URLPattern{
+			{Scheme: "https", Host: "acme.com", Path: "/replicache/"},
+			{Scheme: "https", Host: "api.acme.com", Port: "8443", Path: "/cv/*"},
+		}, HTTPSOnly: true, ClientViewURLs: []string{"https://acme.com/cv"}, Limits: account.Limits{DailyPulls: 1000}, StorageSpec: "nbs:/data/acme", SigningSecret: "rss_acme", TLS: account.TLS{MinVersion: "1.2"},
+			Schemas: []account.KeySchema{{Prefix: "todo/", Schema: `{"required":["title"],"type":"object"}`}},
+			Forward: account.Forward{Headers: []account.Forwarded{{Name: "Accept-Language"}}, Cookies: []account.Forwarded{{Name: "session", Sensitive: true}}},
+			Keys:    []account.Key{{Name: "ci", Hash: keyHash}, {Name: "old", Hash: keyHash, DateRevoked: "2020-01-02"}}},
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"ok.yaml", `
+accounts:
+- id: 0
+  name: Sandbox
+  clientViewHosts: [localhost]
+- id: 7
+  name: Acme
+  email: ops@acme.com
+  clientViewURLPatterns: [https://acme.com/replicache/, "https://api.acme.com:8443/cv/*"]
+  httpsOnly: true
+  clientViewURLs: [https://acme.com/cv]
+  limits:
+    dailyPulls: 1000
+  storageSpec: nbs:/data/acme
+  signingSecret: rss_acme
+  tls:
+    minVersion: "1.2"
+  schemas:
+  - prefix: todo/
+    schema: {type: object, required: [title]}
+  forward:
+    headers:
+    - name: Accept-Language
+    cookies:
+    - name: session
+      sensitive: true
+  keys:
+  - name: ci
+    hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+  - name: old
+    hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+    dateRevoked: "2020-01-02"
+`, ""},
+		{"ok.json", `{"accounts": [
+			{"id": 0, "name": "Sandbox", "clientViewHosts": ["localhost"]},
+			{"id": 7, "name": "Acme", "email": "ops@acme.com", "clientViewURLPatterns": ["https://acme.com/replicache/", "https://api.acme.com:8443/cv/*"], "httpsOnly": true, "clientViewURLs": ["https://acme.com/cv"], "limits": {"dailyPulls": 1000}, "storageSpec": "nbs:/data/acme", "signingSecret": "rss_acme", "tls": {"minVersion": "1.2"}, "schemas": [{"prefix": "todo/", "schema": {"required": ["title"], "type": "object"}}], "forward": {"headers": [{"name": "Accept-Language"}], "cookies": [{"name": "session", "sensitive": true}]}, "keys": [{"name": "ci", "hash": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"}, {"name": "old", "hash": "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "dateRevoked": "2020-01-02"}]}
+		]}`, ""},
+		{"syntax.json", `{"accounts": [`, "could not parse"},
+		{"unknown.yaml", "accounts:\n- id: 1\n  name: x\n  hosts: [a.com]\n", "field hosts not found"},
+		{"unknown.json", `{"accounts": [{"id": 1, "name": "x", "hosts": ["a.com"]}]}`, `unknown field "hosts"`},
+		{"asid.yaml", "accounts:\n- id: 1000000\n  name: x\n", "not less than 1000000"},
+		{"dup.yaml", "accounts:\n- id: 1\n  name: x\n- id: 1\n  name: y\n", "duplicate id 1"},
+		{"noname.yaml", "accounts:\n- id: 1\n", "name is required"},
+		{"badhost.yaml", "accounts:\n- id: 1\n  name: x\n  clientViewHosts: [https://a.com]\n", "invalid client view host"},
+		{"badpattern.yaml", "accounts:\n- id: 1\n  name: x\n  clientViewURLPatterns: [ftp://a.com/]\n", "scheme must be http or https"},
+		{"badspec.yaml", "accounts:\n- id: 1\n  name: x\n  storageSpec: \"bogus:x\"\n", "invalid storage spec"},
+		{"badschema.yaml", "accounts:\n- id: 1\n  name: x\n  schemas:\n  - prefix: a\n    schema: {type: date}\n", `schema for prefix "a": /type: unknown type "date"`},
+		{"badtls.yaml", "accounts:\n- id: 1\n  name: x\n  tls:\n    minVersion: \"2\"\n", "invalid tls"},
+		{"badforward.yaml", "accounts:\n- id: 1\n  name: x\n  forward:\n    headers:\n    - name: Authorization\n", "invalid forward"},
+		{"nokeyname.yaml", "accounts:\n- id: 1\n  name: x\n  keys:\n  - hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08\n", "key 0: name is required"},
+		{"dupkey.yaml", "accounts:\n- id: 1\n  name: x\n  keys:\n  - {name: a, hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08}\n  - {name: a, hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08}\n", `key 1: duplicate name "a"`},
+		{"badkeyhash.yaml", "accounts:\n- id: 1\n  name: x\n  keys:\n  - {name: a, hash: 9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08}\n", `key "a": invalid hash`},
+		{"badurl.yaml", "accounts:\n- id: 1\n  name: x\n  clientViewURLs: [/cv]\n", "invalid client view URL"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		assert.NoError(ioutil.WriteFile(path, []byte(tt.content), 0644))
+		got, err := account.LoadRegularAccounts(path)
+		if tt.wantErr != "" {
+			if assert.Error(err, tt.name) {
+				assert.Contains(err.Error(), tt.wantErr, tt.name)
+			}
+			continue
+		}
+		assert.NoError(err, tt.name)
+		assert.Equal(want, got, tt.name)
+	}
+
+	_, err = account.LoadRegularAccounts(filepath.Join(dir, "missing.yaml"))
+	assert.Error(err)
+}
+
+func TestSetRegularAccounts(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	records, err := account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(len(account.RegularAccounts), len(records.Record))
+
+	db.SetRegularAccounts([]account.Record{{ID: 42, Name: "Answer"}})
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(1, len(records.Record))
+	assert.Equal("Answer", records.Record[42].Name)
+
+	db.SetRegularAccounts(nil)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(len(account.RegularAccounts), len(records.Record))
+}
+
+func TestWatchRegularAccounts(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	path := filepath.Join(dir, "accounts.yaml")
+
+	name := func() string {
+		records, err := account.ReadAllRecords(db)
+		assert.NoError(err)
+		return records.Record[1].Name
+	}
+	write := func(content string, mtime time.Time) {
+		assert.NoError(ioutil.WriteFile(path, []byte(content), 0644))
+		assert.NoError(os.Chtimes(path, mtime, mtime))
+	}
+	waitFor := func(want string) {
+		assert.Eventually(func() bool { return name() == want }, time.Second, time.Millisecond, want)
+	}
+
+	// Initial load errors are returned.
+	write("accounts:\n- id: 1\n", time.Now())
+	_, err := account.WatchRegularAccounts(db, path, time.Millisecond, nil, log.Default())
+	assert.Error(err)
+
+	write("accounts:\n- id: 1\n  name: One\n", time.Now().Add(-time.Hour))
+	reload := make(chan os.Signal, 1)
+	stop, err := account.WatchRegularAccounts(db, path, time.Millisecond, reload, log.Default())
+	assert.NoError(err)
+	defer stop()
+	assert.Equal("One", name())
+
+	// Changes on disk are picked up.
+	write("accounts:\n- id: 1\n  name: Two\n", time.Now())
+	waitFor("Two")
+
+	// Invalid files are ignored.
+	write("accounts:\n- id: 1\n  name: Three\n  bogus: true\n", time.Now().Add(time.Hour))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal("Two", name())
+
+	// A signal forces a reload even if the file looks the same.
+	mtime := time.Now().Add(2 * time.Hour)
+	write("accounts:\n- id: 1\n  name: Four\n", mtime)
+	waitFor("Four")
+	write("accounts:\n- id: 1\n  name: Five\n", mtime)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal("Four", name())
+	reload <- os.Interrupt
+	waitFor("Five")
+}
@@ -0,0 +1,86 @@
+package account
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+
+	"roci.dev/diff-server/util/jsonschema"
+)
+
+// KeySchema is a JSON Schema that the client view values of keys starting
+// with Prefix must be valid against. See package jsonschema for the
+// keywords supported. Where several prefixes match a key the longest one
+// applies.
+type KeySchema struct {
+	Prefix string
+	// Schema is the text of the schema.
+	Schema string
+}
+
+// keySchemaJSON is the JSON and YAML representation of a KeySchema, in
+// which the schema is an object rather than a string.
+type keySchemaJSON struct {
+	Prefix string          `json:"prefix"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s KeySchema) MarshalJSON() ([]byte, error) {
+	return json.Marshal(keySchemaJSON{Prefix: s.Prefix, Schema: json.RawMessage(s.Schema)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *KeySchema) UnmarshalJSON(b []byte) error {
+	var j keySchemaJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	var schema bytes.Buffer
+	if len(j.Schema) > 0 {
+		if err := json.Compact(&schema, j.Schema); err != nil {
+			return err
+		}
+	}
+	*s = KeySchema{Prefix: j.Prefix, Schema: schema.String()}
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, so that schemas can be written
+// in YAML in regular accounts files.
+func (s *KeySchema) UnmarshalYAML(n *yaml.Node) error {
+	var y struct {
+		Prefix string      `yaml:"prefix"`
+		Schema interface{} `yaml:"schema"`
+	}
+	if err := n.Decode(&y); err != nil {
+		return err
+	}
+	b, err := json.Marshal(y.Schema)
+	if err != nil {
+		return fmt.Errorf("schema for prefix %q can't be represented as JSON: %w", y.Prefix, err)
+	}
+	*s = KeySchema{Prefix: y.Prefix, Schema: string(b)}
+	return nil
+}
+
+// ValidateSchemas returns an error if any of schemas doesn't compile or if
+// a prefix has more than one schema.
+func ValidateSchemas(schemas []KeySchema) error {
+	seen := map[string]bool{}
+	for _, s := range schemas {
+		if seen[s.Prefix] {
+			return fmt.Errorf("duplicate schema for prefix %q", s.Prefix)
+		}
+		seen[s.Prefix] = true
+		if s.Schema == "" {
+			return fmt.Errorf("schema for prefix %q is empty", s.Prefix)
+		}
+		if _, err := jsonschema.Compile([]byte(s.Schema)); err != nil {
+			return fmt.Errorf("schema for prefix %q: %w", s.Prefix, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package account_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+)
+
+func TestValidateSchemas(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		schemas []account.KeySchema
+		wantErr string
+	}{
+		{nil, ""},
+		{[]account.KeySchema{{Prefix: "", Schema: `true`}, {Prefix: "todo/", Schema: `{"type": "object"}`}}, ""},
+		{[]account.KeySchema{{Prefix: "todo/", Schema: `{}`}, {Prefix: "todo/", Schema: `{}`}}, `duplicate schema for prefix "todo/"`},
+		{[]account.KeySchema{{Prefix: "todo/", Schema: ``}}, `schema for prefix "todo/" is empty`},
+		{[]account.KeySchema{{Prefix: "todo/", Schema: `{"oneOf": []}`}}, `schema for prefix "todo/": /oneOf: unsupported keyword`},
+	}
+	for i, t := range tc {
+		err := account.ValidateSchemas(t.schemas)
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+		} else {
+			assert.EqualError(err, t.wantErr, "test case %d", i)
+		}
+	}
+}
+
+func TestKeySchemaStorage(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	account.AddUnittestAccount(assert, db)
+
+	// In JSON the schema is an object.
+	var schemas []account.KeySchema
+	assert.NoError(json.Unmarshal([]byte(`[{"prefix": "todo/", "schema": {"type": "object"}}]`), &schemas))
+	assert.Equal([]account.KeySchema{{Prefix: "todo/", Schema: `{"type":"object"}`}}, schemas)
+	b, err := json.Marshal(schemas)
+	assert.NoError(err)
+	assert.Equal(`[{"prefix":"todo/","schema":{"type":"object"}}]`, string(b))
+
+	assert.NoError(account.Update(db, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Schemas = schemas
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+	db = account.LoadTempDBWithPath(assert, dir)
+	records, err := account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(schemas, records.Record[account.UnittestID].Schemas)
+}
@@ -0,0 +1,116 @@
+package account
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"math/bits"
+
+	"github.com/attic-labs/noms/go/types"
+)
+
+// sketchPrecision is the number of hash bits that pick a clientSketch
+// register. 2^10 registers estimate counts with a standard error of about 3%.
+const (
+	sketchPrecision = 10
+	sketchRegisters = 1 << sketchPrecision
+)
+
+// clientSketch is a HyperLogLog sketch of a set of client IDs: it estimates
+// how many distinct IDs were added in sketchRegisters bytes, however many
+// there are. Sketches of the same day from different flushes and processes
+// merge without counting a client twice. The zero value is empty.
+type clientSketch []byte
+
+// add returns s with clientID added, which may be s itself.
+func (s clientSketch) add(clientID string) clientSketch {
+	if s == nil {
+		s = make(clientSketch, sketchRegisters)
+	}
+	h := hashClientID(clientID)
+	// The first bits pick a register, which keeps the longest run of
+	// leading zeros seen in the rest. The low bit stops the run at the end
+	// of the hash.
+	i := h >> (64 - sketchPrecision)
+	rho := byte(bits.LeadingZeros64(h<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rho > s[i] {
+		s[i] = rho
+	}
+	return s
+}
+
+// merge returns the union of s and o, which may be s itself.
+func (s clientSketch) merge(o clientSketch) clientSketch {
+	if len(o) == 0 {
+		return s
+	}
+	if s == nil {
+		return append(clientSketch(nil), o...)
+	}
+	for i, r := range o {
+		if r > s[i] {
+			s[i] = r
+		}
+	}
+	return s
+}
+
+// count estimates the number of distinct client IDs added to s.
+func (s clientSketch) count() uint64 {
+	if len(s) == 0 {
+		return 0
+	}
+	m := float64(len(s))
+	sum := 0.0
+	zeros := 0
+	for _, r := range s {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small counts.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// MarshalNoms stores s as a Blob.
+func (s clientSketch) MarshalNoms(vrw types.ValueReadWriter) (types.Value, error) {
+	return types.NewBlob(vrw, bytes.NewReader(s)), nil
+}
+
+// UnmarshalNoms reads s from a Blob.
+func (s *clientSketch) UnmarshalNoms(v types.Value) error {
+	b, ok := v.(types.Blob)
+	if !ok {
+		return fmt.Errorf("client sketch is a %s, not a Blob", types.TypeOf(v).Describe())
+	}
+	r, err := ioutil.ReadAll(b.Reader())
+	if err != nil {
+		return err
+	}
+	if len(r) != sketchRegisters {
+		return fmt.Errorf("client sketch has %d registers, not %d", len(r), sketchRegisters)
+	}
+	*s = r
+	return nil
+}
+
+// hashClientID hashes id with FNV-1a, whose bits are then mixed with the
+// SplitMix64 finalizer so that the leading ones are evenly distributed.
+func hashClientID(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
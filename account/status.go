@@ -0,0 +1,81 @@
+package account
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Account states. Only active accounts can be used. Deleted accounts keep
+// their record (and usage history) but their client data is removed.
+const (
+	StateActive    = "active"
+	StateSuspended = "suspended"
+	StateDeleted   = "deleted"
+)
+
+// Status is the state of an account, why it is in that state and since when.
+// The zero Status is active, so that records from before accounts had a
+// status are active.
+type Status struct {
+	State  string `json:"state" noms:",omitempty"`
+	Reason string `json:"reason,omitempty" noms:",omitempty"`
+	// Date is when the account entered State, in RFC3339 format.
+	Date string `json:"date,omitempty" noms:",omitempty"`
+}
+
+// NewStatus returns a Status in the given state as of now. It returns an
+// error if state is not one of the account states.
+func NewStatus(state, reason string, now time.Time) (Status, error) {
+	switch state {
+	case StateActive, StateSuspended, StateDeleted:
+	default:
+		return Status{}, fmt.Errorf("unknown account state %q, must be one of %s, %s or %s", state, StateActive, StateSuspended, StateDeleted)
+	}
+	return Status{State: state, Reason: reason, Date: now.UTC().Format(time.RFC3339)}, nil
+}
+
+// StateOf returns the state of record.
+func StateOf(record Record) string {
+	if record.Status.State == "" {
+		return StateActive
+	}
+	return record.Status.State
+}
+
+// Active returns true if record can be used.
+func Active(record Record) bool {
+	return StateOf(record) == StateActive
+}
+
+// MigrateDisabled returns record with its legacy Disabled flag converted to
+// a suspended Status. record is not modified.
+func MigrateDisabled(record Record) Record {
+	if !record.Disabled {
+		return record
+	}
+	r := record
+	if Active(r) {
+		r.Status = Status{State: StateSuspended, Reason: "disabled"}
+	}
+	r.Disabled = false
+	return r
+}
+
+// StatusError is returned by Authenticate for accounts that are not active.
+type StatusError struct {
+	ID     uint32
+	Status Status
+}
+
+func (e *StatusError) Error() string {
+	s := fmt.Sprintf("account %d is %s", e.ID, e.Status.State)
+	if e.Status.Reason != "" {
+		s += ": " + e.Status.Reason
+	}
+	return s
+}
+
+// ErrUnknownAccount is returned by Authenticate if the authorization doesn't
+// identify a usable account.
+var ErrUnknownAccount = errors.New("unknown account or invalid key")
@@ -0,0 +1,78 @@
+package account_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/account"
+)
+
+func TestAuthenticateStatus(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	account.AddUnittestAccount(assert, db)
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	tc := []struct {
+		state      string
+		reason     string
+		wantErr    string
+		wantActive bool
+	}{
+		{"", "", "", true},
+		{account.StateActive, "", "", true},
+		{account.StateSuspended, "abuse", "account 4294967295 is suspended: abuse", false},
+		{account.StateDeleted, "", "account 4294967295 is deleted", false},
+	}
+	for i, t := range tc {
+		assert.NoError(account.Update(db, func(records *account.Records) error {
+			r := records.Record[account.UnittestID]
+			r.Status = account.Status{State: t.state, Reason: t.reason}
+			records.Record[account.UnittestID] = r
+			return nil
+		}), "test case %d", i)
+		records, err := account.ReadAllRecords(db)
+		assert.NoError(err)
+		assert.Equal(t.wantActive, account.Active(records.Record[account.UnittestID]), "test case %d", i)
+		got, err := account.Authenticate(records, account.UnittestKey, false)
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+			assert.Equal(uint32(account.UnittestID), got.ID, "test case %d", i)
+			continue
+		}
+		var se *account.StatusError
+		assert.True(errors.As(err, &se), "test case %d", i)
+		assert.Equal(t.wantErr, err.Error(), "test case %d", i)
+
+		// The status is only revealed to valid credentials.
+		_, err = account.Authenticate(records, account.UnittestKey+"x", false)
+		assert.Equal(account.ErrUnknownAccount, err, "test case %d", i)
+	}
+
+	_, err := account.NewStatus("gone", "", now)
+	assert.Error(err)
+	s, err := account.NewStatus(account.StateSuspended, "abuse", now)
+	assert.NoError(err)
+	assert.Equal(account.Status{State: account.StateSuspended, Reason: "abuse", Date: "2020-05-01T12:00:00Z"}, s)
+}
+
+func TestMigrateDisabled(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	records := db.HeadValue()
+	records.Record[account.LowestASID] = account.Record{ID: account.LowestASID, Disabled: true}
+	records.Record[account.LowestASID+1] = account.Record{ID: account.LowestASID + 1, Disabled: true, Status: account.Status{State: account.StateDeleted}}
+	assert.NoError(account.WriteRecords(db, records))
+
+	db = account.LoadTempDBWithPath(assert, dir)
+	records, err := account.ReadRecords(db)
+	assert.NoError(err)
+	assert.Equal(account.Record{ID: account.LowestASID, Status: account.Status{State: account.StateSuspended, Reason: "disabled"}}, records.Record[account.LowestASID])
+	assert.Equal(account.Record{ID: account.LowestASID + 1, Status: account.Status{State: account.StateDeleted}}, records.Record[account.LowestASID+1])
+}
@@ -0,0 +1,93 @@
+package account
+
+import (
+	"sync"
+	"time"
+
+	zl "github.com/rs/zerolog"
+)
+
+// DefaultRefreshInterval is how often a Store reloads the account DB to pick
+// up changes made by other processes.
+const DefaultRefreshInterval = 5 * time.Second
+
+// Store caches the full set of account records (as returned by
+// ReadAllRecords) so that readers on the hot path, like pull, don't have to
+// reload and copy the account DB on every request.
+//
+// The cache is refreshed when it is older than the refresh interval, or
+// immediately when the underlying DB's head or regular accounts change
+// through the same DB instance (see DB.Generation).
+type Store struct {
+	db       *DB
+	interval time.Duration
+
+	mu         sync.Mutex
+	snapshot   Records
+	generation uint64
+	loaded     time.Time
+	// reloading is closed when the reload in progress, if any, is done.
+	reloading chan struct{}
+}
+
+// NewStore returns a Store that caches the records in db, reloading them
+// from storage at most every interval.
+func NewStore(db *DB, interval time.Duration) *Store {
+	return &Store{db: db, interval: interval}
+}
+
+// Records returns a snapshot of all account records. The snapshot is shared
+// with other callers and MUST NOT be modified; use CopyRecords to get a copy
+// that is safe to change.
+//
+// Records are reloaded without holding the Store's lock, one reload at a
+// time. While the cache is being refreshed only because it is older than the
+// refresh interval, other callers get the cached records rather than wait;
+// after a change through the same DB they wait, so that they see it.
+func (s *Store) Records() (Records, error) {
+	for {
+		s.mu.Lock()
+		current := s.snapshot.Record != nil && s.db.Generation() == s.generation
+		if current && (s.reloading != nil || time.Since(s.loaded) < s.interval) {
+			records := s.snapshot
+			s.mu.Unlock()
+			return records, nil
+		}
+		if s.reloading != nil {
+			reloading := s.reloading
+			s.mu.Unlock()
+			<-reloading
+			continue
+		}
+		reloading := make(chan struct{})
+		s.reloading = reloading
+		s.mu.Unlock()
+
+		records, generation, err := readAllRecords(s.db)
+
+		s.mu.Lock()
+		if err == nil {
+			s.snapshot = records
+			s.generation = generation
+			s.loaded = time.Now()
+		}
+		s.reloading = nil
+		close(reloading)
+		s.mu.Unlock()
+		if err != nil {
+			return Records{}, err
+		}
+		return records, nil
+	}
+}
+
+// ClientViewURLAuthorized is the package-level ClientViewURLAuthorized
+// checked against the cached records. Patterns added to auto-signup accounts are
+// written to the DB and are visible in the next snapshot.
+func (s *Store) ClientViewURLAuthorized(maxASClientViewHosts int, ID uint32, url string, l zl.Logger) (bool, string, error) {
+	records, err := s.Records()
+	if err != nil {
+		return false, "", err
+	}
+	return ClientViewURLAuthorized(maxASClientViewHosts, s.db, records, ID, url, l)
+}
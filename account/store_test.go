@@ -0,0 +1,136 @@
+package account_test
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestStoreRecords(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	account.AddUnittestAccount(assert, db)
+
+	store := account.NewStore(db, time.Hour)
+	same := func(a, b account.Records) bool {
+		return reflect.ValueOf(a.Record).Pointer() == reflect.ValueOf(b.Record).Pointer()
+	}
+
+	r1, err := store.Records()
+	assert.NoError(err)
+	_, ok := r1.Record[account.UnittestID]
+	assert.True(ok)
+	assert.Equal(len(account.RegularAccounts)+1, len(r1.Record))
+
+	// Cached.
+	r2, err := store.Records()
+	assert.NoError(err)
+	assert.True(same(r1, r2))
+
+	// Writes through the same DB are seen immediately.
+	account.AddUnittestAccountHost(assert, db, "example.com")
+	r3, err := store.Records()
+	assert.NoError(err)
+	assert.False(same(r2, r3))
+	assert.Equal(account.HostURLPatterns("example.com"), r3.Record[account.UnittestID].ClientViewURLPatterns)
+	assert.Equal(0, len(r2.Record[account.UnittestID].ClientViewURLPatterns))
+
+	// So are regular account changes.
+	db.SetRegularAccounts([]account.Record{})
+	r4, err := store.Records()
+	assert.NoError(err)
+	assert.Equal(1, len(r4.Record))
+
+	// Writes from elsewhere are not seen until the cache expires.
+	db2 := account.LoadTempDBWithPath(assert, dir)
+	records, err := account.ReadRecords(db2)
+	assert.NoError(err)
+	records = account.CopyRecords(records)
+	records.Record[account.LowestASID] = account.Record{ID: account.LowestASID}
+	assert.NoError(account.WriteRecords(db2, records))
+	r5, err := store.Records()
+	assert.NoError(err)
+	assert.True(same(r4, r5))
+
+	store = account.NewStore(db, time.Millisecond)
+	_, err = store.Records()
+	assert.NoError(err)
+	records = account.CopyRecords(records)
+	records.Record[account.LowestASID+1] = account.Record{ID: account.LowestASID + 1}
+	assert.NoError(account.WriteRecords(db2, records))
+	time.Sleep(5 * time.Millisecond)
+	r6, err := store.Records()
+	assert.NoError(err)
+	_, ok = r6.Record[account.LowestASID+1]
+	assert.True(ok)
+}
+
+func TestStoreRecordsConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	account.AddUnittestAccount(assert, db)
+
+	// Every call finds the cache expired, so reloads overlap with reads and
+	// with each other.
+	store := account.NewStore(db, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				records, err := store.Records()
+				assert.NoError(err)
+				_, ok := records.Record[account.UnittestID]
+				assert.True(ok)
+			}
+		}()
+	}
+	account.AddUnittestAccountHost(assert, db, "example.com")
+	wg.Wait()
+
+	// A write through the same DB is seen once it is done.
+	records, err := store.Records()
+	assert.NoError(err)
+	assert.Equal(account.HostURLPatterns("example.com"), records.Record[account.UnittestID].ClientViewURLPatterns)
+}
+
+func TestStoreClientViewURLAuthorized(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	account.AddUnittestAccount(assert, db)
+	store := account.NewStore(db, time.Hour)
+
+	before, err := store.Records()
+	assert.NoError(err)
+
+	ok, _, err := store.ClientViewURLAuthorized(1, account.UnittestID, "https://example.com/cv", log.Default())
+	assert.NoError(err)
+	assert.True(ok)
+	ok, _, err = store.ClientViewURLAuthorized(1, account.UnittestID, "https://other.com/cv", log.Default())
+	assert.NoError(err)
+	assert.False(ok)
+	ok, _, err = store.ClientViewURLAuthorized(1, 12345, "https://example.com/cv", log.Default())
+	assert.NoError(err)
+	assert.False(ok)
+
+	// The old snapshot is unchanged, the new one has the pattern, and so
+	// does the DB.
+	want := []account.URLPattern{{Scheme: "https", Host: "example.com", Path: "/"}}
+	assert.Equal(0, len(before.Record[account.UnittestID].ClientViewURLPatterns))
+	after, err := store.Records()
+	assert.NoError(err)
+	assert.Equal(want, after.Record[account.UnittestID].ClientViewURLPatterns)
+	records, err := account.ReadRecords(account.LoadTempDBWithPath(assert, dir))
+	assert.NoError(err)
+	assert.Equal(want, records.Record[account.UnittestID].ClientViewURLPatterns)
+}
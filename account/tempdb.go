@@ -22,10 +22,13 @@ func LoadTempDBWithPath(assert *assert.Assertions, td string) (r *DB) {
 
 const UnittestID = 0xFFFFFFFF
 
+// UnittestKey is a valid key for the unittest account.
+const UnittestKey = "rk_4294967295_unittest"
+
 func AddUnittestAccount(assert *assert.Assertions, db *DB) {
 	accounts, err := ReadAllRecords(db)
 	assert.NoError(err)
-	record := Record{ID: UnittestID, Name: "Unittest", ClientViewHosts: []string{}}
+	record := Record{ID: UnittestID, Name: "Unittest", Keys: []Key{{Name: "unittest", Hash: hashKey(UnittestKey)}}}
 	accounts.Record[record.ID] = record
 	assert.NoError(WriteRecords(db, accounts))
 }
@@ -35,7 +38,7 @@ func AddUnittestAccountHost(assert *assert.Assertions, db *DB, host string) {
 	assert.NoError(err)
 	record, exists := accounts.Record[UnittestID]
 	assert.True(exists)
-	record.ClientViewHosts = append(record.ClientViewHosts, host)
+	record.ClientViewURLPatterns = append(record.ClientViewURLPatterns, HostURLPatterns(host)...)
 	accounts.Record[UnittestID] = record
 	assert.NoError(WriteRecords(db, accounts))
 }
@@ -0,0 +1,69 @@
+package account
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+// TLS configures the TLS connections client views are fetched over, for
+// data layers behind private PKI. The zero TLS uses the system's roots and
+// Go's defaults. Certificates and keys are PEM encoded.
+type TLS struct {
+	// ClientCert and ClientKey are the certificate (chain) and key
+	// presented to data layers that ask for one.
+	ClientCert string `json:"clientCert,omitempty" yaml:"clientCert,omitempty" noms:",omitempty"`
+	ClientKey  string `json:"clientKey,omitempty" yaml:"clientKey,omitempty" noms:",omitempty"`
+	// RootCAs are trusted in addition to the system's roots.
+	RootCAs string `json:"rootCAs,omitempty" yaml:"rootCAs,omitempty" noms:",omitempty"`
+	// MinVersion is the minimum TLS version, eg "1.2". If empty Go's
+	// default is used.
+	MinVersion string `json:"minVersion,omitempty" yaml:"minVersion,omitempty" noms:",omitempty"`
+}
+
+// tlsVersions maps the versions MinVersion can take to their tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// IsZero returns true if t doesn't change anything from the defaults.
+func (t TLS) IsZero() bool {
+	return t == TLS{}
+}
+
+// Config returns the tls.Config t describes, or an error if t is invalid.
+func (t TLS) Config() (*tls.Config, error) {
+	c := &tls.Config{}
+	if t.ClientCert != "" || t.ClientKey != "" {
+		if t.ClientCert == "" || t.ClientKey == "" {
+			return nil, errors.New("client certificate and key must be given together")
+		}
+		cert, err := tls.X509KeyPair([]byte(t.ClientCert), []byte(t.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if t.RootCAs != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(t.RootCAs)) {
+			return nil, errors.New("invalid root CAs: no PEM certificates found")
+		}
+		c.RootCAs = pool
+	}
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid minimum TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", t.MinVersion)
+		}
+		c.MinVersion = v
+	}
+	return c, nil
+}
@@ -0,0 +1,40 @@
+package account_test
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+)
+
+func TestTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		tls            account.TLS
+		wantErr        string
+		wantMinVersion uint16
+	}{
+		{account.TLS{}, "", 0},
+		{account.TLS{MinVersion: "1.3"}, "", tls.VersionTLS13},
+		{account.TLS{MinVersion: "1.2"}, "", tls.VersionTLS12},
+		{account.TLS{MinVersion: "2"}, `invalid minimum TLS version "2"`, 0},
+		{account.TLS{ClientKey: "key"}, "client certificate and key must be given together", 0},
+		{account.TLS{ClientCert: "cert", ClientKey: "key"}, "invalid client certificate", 0},
+		{account.TLS{RootCAs: "not pem"}, "invalid root CAs: no PEM certificates found", 0},
+	}
+	for i, t := range tc {
+		c, err := t.tls.Config()
+		if t.wantErr != "" {
+			if assert.Error(err, "test case %d", i) {
+				assert.Contains(err.Error(), t.wantErr, "test case %d", i)
+			}
+			continue
+		}
+		assert.NoError(err, "test case %d", i)
+		assert.Equal(t.wantMinVersion, c.MinVersion, "test case %d", i)
+	}
+	assert.True(account.TLS{}.IsZero())
+	assert.False(account.TLS{MinVersion: "1.2"}.IsZero())
+}
@@ -0,0 +1,55 @@
+package account
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	// MaxUpdateAttempts bounds how many times Update tries to write before
+	// giving up and returning the RetryError.
+	MaxUpdateAttempts = 10
+
+	updateInitialBackoff = 5 * time.Millisecond
+	updateMaxBackoff     = 500 * time.Millisecond
+)
+
+// Update runs a read-modify-write transaction on the records in db. It
+// reloads the latest records (WITHOUT the regular accounts overlaid, see
+// ReadRecords), passes a copy of them to f to modify, and writes the result.
+// If head changed in the meantime it backs off, reloads and calls f again,
+// so f must be safe to call more than once and should only act on the
+// records it is given. If f returns an error nothing is written and Update
+// returns that error.
+//
+// Update is the only safe way to change records: every account writer
+// should use it.
+func Update(db *DB, f func(records *Records) error) error {
+	// Writers in this process take turns; only writers in other processes
+	// can cause conflicts.
+	db.updateMu.Lock()
+	defer db.updateMu.Unlock()
+
+	backoff := updateInitialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := db.Reload(); err != nil {
+			return err
+		}
+		records, base := db.headValueAndHash()
+		records = CopyRecords(records)
+		if err := f(&records); err != nil {
+			return err
+		}
+		err := db.setHeadWithValueIfUnchanged(base, records)
+		var retryError RetryError
+		if err == nil || !errors.As(err, &retryError) || attempt == MaxUpdateAttempts {
+			return err
+		}
+		// Full jitter: sleep a random duration up to the current backoff.
+		time.Sleep(time.Duration(rand.Int63n(int64(backoff))))
+		if backoff *= 2; backoff > updateMaxBackoff {
+			backoff = updateMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package account_test
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/account"
+)
+
+func TestUpdate(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	assert.NoError(account.Update(db, func(records *account.Records) error {
+		records.Record[records.NextASID] = account.Record{ID: records.NextASID, Name: "one"}
+		records.NextASID++
+		return nil
+	}))
+	records, err := account.ReadRecords(db)
+	assert.NoError(err)
+	assert.Equal(account.LowestASID+1, records.NextASID)
+	assert.Equal("one", records.Record[account.LowestASID].Name)
+
+	// Errors from f abort the update.
+	boom := errors.New("boom")
+	err = account.Update(db, func(records *account.Records) error {
+		records.NextASID = 42
+		return boom
+	})
+	assert.Equal(boom, err)
+	records, err = account.ReadRecords(db)
+	assert.NoError(err)
+	assert.Equal(account.LowestASID+1, records.NextASID)
+
+	// A conflicting write from another instance causes a retry that sees
+	// the other write.
+	db2 := account.LoadTempDBWithPath(assert, dir)
+	calls := 0
+	assert.NoError(account.Update(db, func(records *account.Records) error {
+		calls++
+		if calls == 1 {
+			assert.NoError(account.Update(db2, func(records *account.Records) error {
+				records.Record[records.NextASID] = account.Record{ID: records.NextASID, Name: "two"}
+				records.NextASID++
+				return nil
+			}))
+		}
+		records.Record[records.NextASID] = account.Record{ID: records.NextASID, Name: "three"}
+		records.NextASID++
+		return nil
+	}))
+	assert.Equal(2, calls)
+	records, err = account.ReadRecords(db)
+	assert.NoError(err)
+	assert.Equal(account.LowestASID+3, records.NextASID)
+	assert.Equal("two", records.Record[account.LowestASID+1].Name)
+	assert.Equal("three", records.Record[account.LowestASID+2].Name)
+}
+
+func TestUpdateConcurrentUniqueIDs(t *testing.T) {
+	assert := assert.New(t)
+	_, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	// Half the writers share an instance, like requests to one server. The
+	// rest each have their own, like separate servers (or signup, which opens
+	// the DB per request).
+	const writers = 16
+	shared := account.LoadTempDBWithPath(assert, dir)
+	dbs := make([]*account.DB, writers)
+	for i := range dbs {
+		if i%2 == 0 {
+			dbs[i] = shared
+		} else {
+			dbs[i] = account.LoadTempDBWithPath(assert, dir)
+		}
+	}
+
+	ids := make([]uint32, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(account.Update(dbs[i], func(records *account.Records) error {
+				ids[i] = records.NextASID
+				records.Record[ids[i]] = account.Record{ID: ids[i]}
+				records.NextASID++
+				return nil
+			}))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[uint32]bool{}
+	for _, id := range ids {
+		assert.False(seen[id], "duplicate id %d", id)
+		seen[id] = true
+	}
+	records, err := account.ReadRecords(account.LoadTempDBWithPath(assert, dir))
+	assert.NoError(err)
+	assert.Equal(account.LowestASID+writers, records.NextASID)
+	assert.Equal(writers, len(records.Record))
+	for _, id := range ids {
+		_, ok := records.Record[id]
+		assert.True(ok)
+	}
+}
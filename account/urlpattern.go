@@ -0,0 +1,195 @@
+package account
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// URLPattern describes a set of client view URLs an account may pull from.
+// Its string form is scheme://host[:port]/path, eg
+// https://example.com/replicache-client-view or http://localhost:*/.
+type URLPattern struct {
+	Scheme string // "http" or "https".
+	Host   string // Hostname, matched case-insensitively.
+	// Port is empty to match only the scheme's default port, "*" to match
+	// any port, or a port number.
+	Port string
+	// Path is a glob (see path.Match) if it contains any of *?[ and a path
+	// prefix otherwise. A prefix matches itself and anything under it:
+	// /api matches /api and /api/cv but not /apiary.
+	Path string
+}
+
+// AnyPort is the URLPattern.Port that matches any port.
+const AnyPort = "*"
+
+// ParseURLPattern parses the string form of a URLPattern.
+func ParseURLPattern(s string) (URLPattern, error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return URLPattern{}, fmt.Errorf("invalid URL pattern %q: missing scheme", s)
+	}
+	p := URLPattern{Scheme: strings.ToLower(s[:i]), Path: "/"}
+	rest := s[i+len("://"):]
+	if j := strings.Index(rest, "/"); j >= 0 {
+		rest, p.Path = rest[:j], rest[j:]
+	}
+	p.Host = rest
+	if j := strings.LastIndex(rest, ":"); j >= 0 {
+		p.Host, p.Port = rest[:j], rest[j+1:]
+		if p.Port == "" {
+			return URLPattern{}, fmt.Errorf("invalid URL pattern %q: empty port", s)
+		}
+	}
+	p.Host = strings.ToLower(p.Host)
+	if err := p.validate(); err != nil {
+		return URLPattern{}, fmt.Errorf("invalid URL pattern %q: %w", s, err)
+	}
+	return p, nil
+}
+
+func (p URLPattern) validate() error {
+	if p.Scheme != "http" && p.Scheme != "https" {
+		return fmt.Errorf("scheme must be http or https")
+	}
+	if p.Host == "" || strings.ContainsAny(p.Host, "/:@*? ") {
+		return fmt.Errorf("invalid host %q", p.Host)
+	}
+	if p.Port != "" && p.Port != AnyPort {
+		for _, c := range p.Port {
+			if c < '0' || c > '9' {
+				return fmt.Errorf("invalid port %q", p.Port)
+			}
+		}
+	}
+	if !strings.HasPrefix(p.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if _, err := path.Match(p.Path, ""); err != nil {
+		return fmt.Errorf("invalid path glob %q", p.Path)
+	}
+	return nil
+}
+
+// String returns the string form of p, which ParseURLPattern parses.
+func (p URLPattern) String() string {
+	hostport := p.Host
+	if p.Port != "" {
+		hostport += ":" + p.Port
+	}
+	return p.Scheme + "://" + hostport + p.Path
+}
+
+// MarshalJSON marshals p as its string form.
+func (p URLPattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON unmarshals p from its string form.
+func (p *URLPattern) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseURLPattern(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Matches returns true if u matches the pattern. URLs whose path has . or
+// .. segments, escaped or not, never match: the server they are sent to
+// may resolve them to a path outside the pattern's.
+func (p URLPattern) Matches(u *url.URL) bool {
+	if !strings.EqualFold(u.Scheme, p.Scheme) || !strings.EqualFold(u.Hostname(), p.Host) {
+		return false
+	}
+	if hasDotSegment(u.Path) {
+		return false
+	}
+	switch port := u.Port(); p.Port {
+	case AnyPort:
+	case "":
+		if port != "" && port != defaultPorts[p.Scheme] {
+			return false
+		}
+	default:
+		if port != p.Port && !(port == "" && p.Port == defaultPorts[p.Scheme]) {
+			return false
+		}
+	}
+	upath := u.EscapedPath()
+	if upath == "" {
+		upath = "/"
+	}
+	if strings.ContainsAny(p.Path, "*?[") {
+		ok, _ := path.Match(p.Path, upath)
+		return ok
+	}
+	return upath == p.Path ||
+		strings.HasPrefix(upath, p.Path) && (strings.HasSuffix(p.Path, "/") || upath[len(p.Path)] == '/')
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// hasDotSegment returns true if the unescaped path p has a . or .. segment.
+func hasDotSegment(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// HostURLPatterns returns the patterns equivalent to the legacy
+// ClientViewHosts entry host: any path on any port, over http or https.
+func HostURLPatterns(host string) []URLPattern {
+	host = strings.ToLower(host)
+	return []URLPattern{
+		{Scheme: "https", Host: host, Port: AnyPort, Path: "/"},
+		{Scheme: "http", Host: host, Port: AnyPort, Path: "/"},
+	}
+}
+
+// MigrateClientViewHosts returns record with its legacy ClientViewHosts
+// converted to ClientViewURLPatterns. record is not modified.
+func MigrateClientViewHosts(record Record) Record {
+	if len(record.ClientViewHosts) == 0 {
+		return record
+	}
+	r := record
+	r.ClientViewURLPatterns = append([]URLPattern(nil), record.ClientViewURLPatterns...)
+	for _, host := range r.ClientViewHosts {
+		for _, p := range HostURLPatterns(host) {
+			if !hasPattern(r, p) {
+				r.ClientViewURLPatterns = append(r.ClientViewURLPatterns, p)
+			}
+		}
+	}
+	r.ClientViewHosts = nil
+	return r
+}
+
+func hasPattern(record Record, p URLPattern) bool {
+	for _, q := range record.ClientViewURLPatterns {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// patternHosts returns the number of distinct hosts in record's patterns.
+func patternHosts(record Record) int {
+	hosts := map[string]bool{}
+	for _, p := range record.ClientViewURLPatterns {
+		hosts[p.Host] = true
+	}
+	return len(hosts)
+}
@@ -0,0 +1,118 @@
+package account_test
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"roci.dev/diff-server/account"
+)
+
+func TestParseURLPattern(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		in      string
+		want    account.URLPattern
+		wantStr string
+		wantErr string
+	}{
+		{"https://example.com", account.URLPattern{Scheme: "https", Host: "example.com", Path: "/"}, "https://example.com/", ""},
+		{"HTTPS://Example.COM/Path", account.URLPattern{Scheme: "https", Host: "example.com", Path: "/Path"}, "https://example.com/Path", ""},
+		{"http://localhost:*/", account.URLPattern{Scheme: "http", Host: "localhost", Port: "*", Path: "/"}, "http://localhost:*/", ""},
+		{"https://example.com:8443/api/*/cv", account.URLPattern{Scheme: "https", Host: "example.com", Port: "8443", Path: "/api/*/cv"}, "https://example.com:8443/api/*/cv", ""},
+		{"example.com/cv", account.URLPattern{}, "", "missing scheme"},
+		{"ftp://example.com/", account.URLPattern{}, "", "scheme must be http or https"},
+		{"https:///cv", account.URLPattern{}, "", "invalid host"},
+		{"https://*.example.com/", account.URLPattern{}, "", "invalid host"},
+		{"https://example.com:/", account.URLPattern{}, "", "empty port"},
+		{"https://example.com:http/", account.URLPattern{}, "", "invalid port"},
+		{"https://example.com/[", account.URLPattern{}, "", "invalid path glob"},
+	}
+	for _, tt := range tests {
+		got, err := account.ParseURLPattern(tt.in)
+		if tt.wantErr != "" {
+			if assert.Error(err, tt.in) {
+				assert.Contains(err.Error(), tt.wantErr, tt.in)
+			}
+			continue
+		}
+		assert.NoError(err, tt.in)
+		assert.Equal(tt.want, got, tt.in)
+		assert.Equal(tt.wantStr, got.String(), tt.in)
+
+		b, err := json.Marshal(got)
+		assert.NoError(err)
+		var roundtrip account.URLPattern
+		assert.NoError(json.Unmarshal(b, &roundtrip))
+		assert.Equal(got, roundtrip)
+	}
+}
+
+func TestURLPatternMatches(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		pattern string
+		url     string
+		want    bool
+	}{
+		{"https://example.com/", "https://example.com", true},
+		{"https://example.com/", "https://EXAMPLE.com/anything?q=1", true},
+		{"https://example.com/", "http://example.com/", false},
+		{"https://example.com/", "https://other.com/", false},
+		{"https://example.com/", "https://sub.example.com/", false},
+
+		// Ports.
+		{"https://example.com/", "https://example.com:443/", true},
+		{"https://example.com/", "https://example.com:8443/", false},
+		{"https://example.com:8443/", "https://example.com:8443/", true},
+		{"https://example.com:8443/", "https://example.com/", false},
+		{"https://example.com:443/", "https://example.com/", true},
+		{"http://localhost:*/", "http://localhost:3000/", true},
+		{"http://localhost:*/", "http://localhost/", true},
+
+		// Path prefixes.
+		{"https://example.com/api", "https://example.com/api", true},
+		{"https://example.com/api", "https://example.com/api/cv", true},
+		{"https://example.com/api", "https://example.com/apiary", false},
+		{"https://example.com/api/", "https://example.com/api/cv", true},
+		{"https://example.com/api/", "https://example.com/api", false},
+		{"https://example.com/api", "https://example.com/", false},
+		{"https://example.com/api", "https://example.com/api/../admin", false},
+		{"https://example.com/api", "https://example.com/api/%2e%2e/admin", false},
+		{"https://example.com/api", "https://example.com/api%2F..%2Fadmin", false},
+		{"https://example.com/api", "https://example.com/api/./cv", false},
+		{"https://example.com/", "https://example.com/..", false},
+		{"https://example.com/api", "https://example.com/api/..cv", true},
+
+		// Path globs.
+		{"https://example.com/*/cv", "https://example.com/tenant/cv", true},
+		{"https://example.com/*/cv", "https://example.com/a/b/cv", false},
+		{"https://example.com/cv-?", "https://example.com/cv-1", true},
+		{"https://example.com/cv-[0-9]", "https://example.com/cv-x", false},
+		{"https://example.com/*/cv", "https://example.com/../cv", false},
+	}
+	for _, tt := range tests {
+		p, err := account.ParseURLPattern(tt.pattern)
+		assert.NoError(err)
+		u, err := url.Parse(tt.url)
+		assert.NoError(err)
+		assert.Equal(tt.want, p.Matches(u), "%s %s", tt.pattern, tt.url)
+	}
+}
+
+func TestMigrateClientViewHosts(t *testing.T) {
+	assert := assert.New(t)
+	existing := account.URLPattern{Scheme: "https", Host: "a.com", Port: "*", Path: "/"}
+	record := account.Record{ID: 1, ClientViewHosts: []string{"a.com", "B.com"}, ClientViewURLPatterns: []account.URLPattern{existing}}
+	got := account.MigrateClientViewHosts(record)
+	assert.Equal(0, len(got.ClientViewHosts))
+	assert.Equal(append(account.HostURLPatterns("a.com"), account.HostURLPatterns("b.com")...), got.ClientViewURLPatterns)
+
+	// The input is not modified.
+	assert.Equal([]string{"a.com", "B.com"}, record.ClientViewHosts)
+	assert.Equal([]account.URLPattern{existing}, record.ClientViewURLPatterns)
+
+	// Records without hosts are returned as is.
+	assert.Equal(got, account.MigrateClientViewHosts(got))
+}
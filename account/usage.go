@@ -0,0 +1,464 @@
+package account
+
+import (
+	"fmt"
+	"sync"
+	gotime "time"
+
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
+	zl "github.com/rs/zerolog"
+
+	"roci.dev/diff-server/util/time"
+)
+
+// UsageDatasetName is the dataset of the account database that usage is
+// stored in. It is separate from the records' dataset so that writing usage
+// doesn't create record commits.
+const UsageDatasetName = "usage"
+
+// UsageRetention is how long daily usage is kept.
+const UsageRetention = 400 * 24 * gotime.Hour
+
+// ClientViewSizeRetention is how long the size of the latest client view
+// fetched for a client counts towards its account's StoredBytes. Clients
+// that haven't fetched a client view for that long are assumed gone.
+const ClientViewSizeRetention = 30 * 24 * gotime.Hour
+
+// DefaultUsageFlushInterval is how often a Meter writes usage by default.
+const DefaultUsageFlushInterval = gotime.Minute
+
+// DailyUsage is an account's usage during one UTC day.
+type DailyUsage struct {
+	Day                string `json:"day"` // YYYY-MM-DD.
+	Pulls              uint64 `json:"pulls"`
+	FullSyncs          uint64 `json:"fullSyncs"`
+	PatchBytes         uint64 `json:"patchBytes"` // Uncompressed pull response bytes.
+	ClientViewFetches  uint64 `json:"clientViewFetches"`
+	ClientViewFailures uint64 `json:"clientViewFailures"`
+	// ActiveClients is the approximate number of distinct clients that
+	// pulled.
+	ActiveClients uint64 `json:"activeClients" noms:"-"`
+	// StoredBytes approximates the account's stored data as of the end of
+	// the day: the sum of the sizes of the latest client view fetched for
+	// each of its clients that fetched one in the ClientViewSizeRetention
+	// before.
+	StoredBytes uint64 `json:"storedBytes"`
+	// Clients estimates the distinct clients that pulled, in a fixed amount
+	// of space however many there are. ActiveClients is computed from it.
+	Clients clientSketch `json:"-" noms:",omitempty"`
+}
+
+func (u *DailyUsage) add(o DailyUsage) {
+	u.Pulls += o.Pulls
+	u.FullSyncs += o.FullSyncs
+	u.PatchBytes += o.PatchBytes
+	u.ClientViewFetches += o.ClientViewFetches
+	u.ClientViewFailures += o.ClientViewFailures
+	u.Clients = u.Clients.merge(o.Clients)
+}
+
+// pendingUsage is the usage of one account counted since the last flush.
+type pendingUsage struct {
+	Days map[string]DailyUsage // Map key is the day.
+	// ClientViewSizes is the latest client view fetched for each client.
+	ClientViewSizes map[string]clientViewSize
+}
+
+// clientViewSize is the size of the latest client view fetched for a
+// client, and the day it was fetched.
+type clientViewSize struct {
+	Size uint64
+	Day  string
+}
+
+// accountUsage is the stored usage of one account. Its maps are edited in
+// place by flushes, so that writing usage costs as much as the usage added
+// rather than all of the usage stored.
+type accountUsage struct {
+	Days types.Map // Day to DailyUsage.
+	// ClientViews maps each client to its clientViewSize, and StoredBytes
+	// is the sum of their sizes. Clients are removed once their latest
+	// client view is older than ClientViewSizeRetention.
+	ClientViews types.Map `noms:",omitempty"`
+	// ClientViewDays has the key "<day>/<client ID>" for each entry of
+	// ClientViews, so that expired clients can be found without iterating
+	// over all of them.
+	ClientViewDays types.Map `noms:",omitempty"`
+	StoredBytes    uint64
+	// ClientViewSizes is DEPRECATED: it maps each client to the size of its
+	// latest client view, without the day. Flushes move its entries to
+	// ClientViews.
+	ClientViewSizes types.Map `noms:",omitempty"`
+}
+
+// usageCommit is the value at the head of the usage dataset.
+type usageCommit struct {
+	// Parents and Meta are unused.
+	Parents []types.Ref `noms:",set"`
+	Meta    struct {
+	}
+
+	Value struct {
+		Account types.Map // Account ID to accountUsage.
+	}
+}
+
+// MarshalNomsStructName makes usageCommit a Noms commit.
+func (usageCommit) MarshalNomsStructName() string {
+	return "Commit"
+}
+
+// PullUsage describes a pull for metering.
+type PullUsage struct {
+	ClientID   string
+	FullSync   bool
+	PatchBytes uint64
+	// ClientViewFetched is true if the client view was requested, and
+	// ClientViewFailed if the request or storing the result failed.
+	ClientViewFetched bool
+	ClientViewFailed  bool
+	// ClientViewSize is the size of the client view fetched, if it was
+	// fetched successfully.
+	ClientViewSize uint64
+}
+
+// Meter counts usage per account and periodically adds it to the usage
+// stored in the account database. Counts are kept in memory between
+// writes, so up to a flush interval of usage is lost if the process exits
+// without calling Flush.
+type Meter struct {
+	db       *DB
+	interval gotime.Duration
+	l        zl.Logger
+
+	mu        sync.Mutex
+	pending   map[uint32]*pendingUsage
+	lastFlush gotime.Time
+	flushing  bool
+}
+
+// NewMeter returns a Meter that writes usage to db in the background at
+// most every interval, as pulls are recorded.
+func NewMeter(db *DB, interval gotime.Duration, l zl.Logger) *Meter {
+	return &Meter{
+		db:        db,
+		interval:  interval,
+		l:         l,
+		pending:   map[uint32]*pendingUsage{},
+		lastFlush: time.Now(),
+	}
+}
+
+// RecordPull counts a pull of accountID.
+func (m *Meter) RecordPull(accountID uint32, u PullUsage) {
+	now := time.Now().UTC()
+	d := DailyUsage{
+		Day:        now.Format(dayFormat),
+		Pulls:      1,
+		PatchBytes: u.PatchBytes,
+	}
+	if u.FullSync {
+		d.FullSyncs = 1
+	}
+	if u.ClientViewFetched {
+		d.ClientViewFetches = 1
+	}
+	if u.ClientViewFailed {
+		d.ClientViewFailures = 1
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.pending[accountID]
+	if a == nil {
+		a = &pendingUsage{Days: map[string]DailyUsage{}, ClientViewSizes: map[string]clientViewSize{}}
+		m.pending[accountID] = a
+	}
+	day := a.Days[d.Day]
+	day.Day = d.Day
+	day.add(d)
+	day.Clients = day.Clients.add(u.ClientID)
+	a.Days[d.Day] = day
+	if u.ClientViewFetched && !u.ClientViewFailed {
+		a.ClientViewSizes[u.ClientID] = clientViewSize{u.ClientViewSize, d.Day}
+	}
+	if !m.flushing && now.Sub(m.lastFlush) >= m.interval {
+		m.flushing = true
+		go func() {
+			if err := m.Flush(); err != nil {
+				m.l.Info().Err(err).Msg("Could not write usage")
+			}
+		}()
+	}
+}
+
+// Flush adds the usage counted since the last flush to the usage stored
+// in the database. If it fails the usage is kept for the next flush.
+func (m *Meter) Flush() error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = map[uint32]*pendingUsage{}
+	m.lastFlush = time.Now()
+	m.flushing = true
+	m.mu.Unlock()
+
+	err := m.write(pending)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushing = false
+	if err != nil {
+		// Put the unwritten usage back, adding anything counted since.
+		for id, a := range pending {
+			if p := m.pending[id]; p != nil {
+				mergeAccountUsage(a, *p)
+			}
+			m.pending[id] = a
+		}
+	}
+	return err
+}
+
+func (m *Meter) write(pending map[uint32]*pendingUsage) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	// Usage shares the database root with the records, so serialize with
+	// Updates through the same DB.
+	m.db.updateMu.Lock()
+	defer m.db.updateMu.Unlock()
+	noms := m.db.Noms()
+	var err error
+	for i := 0; i < MaxUpdateAttempts; i++ {
+		noms.Rebase()
+		ds := noms.GetDataset(UsageDatasetName)
+		var c usageCommit
+		if c, err = readUsageCommit(noms, ds); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		accounts := c.Value.Account.Edit()
+		for id, p := range pending {
+			a, err := addUsage(noms, c.Value.Account, id, *p, now)
+			if err != nil {
+				return err
+			}
+			v, err := marshal.Marshal(noms, a)
+			if err != nil {
+				return err
+			}
+			accounts.Set(types.Number(id), v)
+		}
+		c.Value.Account = accounts.Map()
+		c.Parents = nil
+		v, merr := marshal.Marshal(noms, c)
+		if merr != nil {
+			return merr
+		}
+		if _, err = noms.SetHead(ds, noms.WriteValue(v)); err == nil {
+			return nil
+		}
+		if err != datas.ErrOptimisticLockFailed && err != datas.ErrMergeNeeded {
+			return err
+		}
+	}
+	return err
+}
+
+// addUsage returns the stored usage of account id in accounts with p added,
+// and days and client view sizes past their retention at now removed.
+func addUsage(noms types.ValueReadWriter, accounts types.Map, id uint32, p pendingUsage, now gotime.Time) (accountUsage, error) {
+	a := accountUsage{Days: types.NewMap(noms), ClientViews: types.NewMap(noms), ClientViewDays: types.NewMap(noms)}
+	if v, ok := accounts.MaybeGet(types.Number(id)); ok {
+		if err := marshal.Unmarshal(v, &a); err != nil {
+			return accountUsage{}, err
+		}
+	}
+	today := now.Format(dayFormat)
+	oldest := now.Add(-UsageRetention).Format(dayFormat)
+
+	// Sizes from before days were kept are counted as fetched today: they
+	// are already in StoredBytes.
+	if a.ClientViewSizes != (types.Map{}) {
+		sizes := map[string]clientViewSize{}
+		a.ClientViewSizes.Iter(func(k, v types.Value) bool {
+			sizes[string(k.(types.String))] = clientViewSize{uint64(v.(types.Number)), today}
+			return false
+		})
+		stored := a.StoredBytes
+		if err := setClientViewSizes(noms, &a, sizes); err != nil {
+			return accountUsage{}, err
+		}
+		a.StoredBytes = stored
+		a.ClientViewSizes = types.Map{}
+	}
+	if err := setClientViewSizes(noms, &a, p.ClientViewSizes); err != nil {
+		return accountUsage{}, err
+	}
+	if err := expireClientViewSizes(&a, now.Add(-ClientViewSizeRetention).Format(dayFormat)); err != nil {
+		return accountUsage{}, err
+	}
+
+	days := a.Days.Edit()
+	a.Days.Iter(func(k, _ types.Value) bool {
+		if string(k.(types.String)) >= oldest {
+			return true
+		}
+		days.Remove(k)
+		return false
+	})
+	for day, d := range p.Days {
+		if day < oldest {
+			continue
+		}
+		k := types.String(day)
+		var u DailyUsage
+		if v, ok := a.Days.MaybeGet(k); ok {
+			if err := marshal.Unmarshal(v, &u); err != nil {
+				return accountUsage{}, err
+			}
+		}
+		u.Day = day
+		u.add(d)
+		u.StoredBytes = a.StoredBytes
+		v, err := marshal.Marshal(noms, u)
+		if err != nil {
+			return accountUsage{}, err
+		}
+		days.Set(k, v)
+	}
+	a.Days = days.Map()
+	return a, nil
+}
+
+// setClientViewSizes sets the sizes of the latest client views of the
+// clients in sizes, updating StoredBytes.
+func setClientViewSizes(noms types.ValueReadWriter, a *accountUsage, sizes map[string]clientViewSize) error {
+	clients := a.ClientViews.Edit()
+	days := a.ClientViewDays.Edit()
+	for clientID, size := range sizes {
+		k := types.String(clientID)
+		if v, ok := a.ClientViews.MaybeGet(k); ok {
+			var old clientViewSize
+			if err := marshal.Unmarshal(v, &old); err != nil {
+				return err
+			}
+			a.StoredBytes -= old.Size
+			days.Remove(types.String(old.Day + "/" + clientID))
+		}
+		a.StoredBytes += size.Size
+		v, err := marshal.Marshal(noms, size)
+		if err != nil {
+			return err
+		}
+		clients.Set(k, v)
+		days.Set(types.String(size.Day+"/"+clientID), types.Bool(true))
+	}
+	a.ClientViews = clients.Map()
+	a.ClientViewDays = days.Map()
+	return nil
+}
+
+// expireClientViewSizes removes the clients whose latest client view was
+// fetched before the day oldest, updating StoredBytes.
+func expireClientViewSizes(a *accountUsage, oldest string) error {
+	clients := a.ClientViews.Edit()
+	days := a.ClientViewDays.Edit()
+	var err error
+	a.ClientViewDays.Iter(func(k, _ types.Value) bool {
+		dayClient := string(k.(types.String))
+		if dayClient >= oldest {
+			return true
+		}
+		days.Remove(k)
+		clientID := types.String(dayClient[len(dayFormat)+1:])
+		if v, ok := a.ClientViews.MaybeGet(clientID); ok {
+			var size clientViewSize
+			if err = marshal.Unmarshal(v, &size); err != nil {
+				return true
+			}
+			a.StoredBytes -= size.Size
+			clients.Remove(clientID)
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	a.ClientViews = clients.Map()
+	a.ClientViewDays = days.Map()
+	return nil
+}
+
+func mergeAccountUsage(into *pendingUsage, from pendingUsage) {
+	if into.Days == nil {
+		into.Days = map[string]DailyUsage{}
+	}
+	if into.ClientViewSizes == nil {
+		into.ClientViewSizes = map[string]clientViewSize{}
+	}
+	for day, d := range from.Days {
+		u := into.Days[day]
+		u.Day = day
+		u.add(d)
+		into.Days[day] = u
+	}
+	for id, size := range from.ClientViewSizes {
+		into.ClientViewSizes[id] = size
+	}
+}
+
+func readUsageCommit(noms types.ValueReadWriter, ds datas.Dataset) (usageCommit, error) {
+	var c usageCommit
+	if !ds.HasHead() {
+		c.Value.Account = types.NewMap(noms)
+		return c, nil
+	}
+	err := marshal.Unmarshal(ds.Head(), &c)
+	return c, err
+}
+
+const dayFormat = "2006-01-02"
+
+// ReadUsage returns the stored daily usage of each account from since
+// (a UTC day) on, oldest first.
+func ReadUsage(db *DB, since gotime.Time) (map[uint32][]DailyUsage, error) {
+	noms := db.Noms()
+	noms.Rebase()
+	c, err := readUsageCommit(noms, noms.GetDataset(UsageDatasetName))
+	if err != nil {
+		return nil, err
+	}
+	first := types.String(since.UTC().Format(dayFormat))
+	r := map[uint32][]DailyUsage{}
+	c.Value.Account.Iter(func(k, v types.Value) bool {
+		var a accountUsage
+		if err = marshal.Unmarshal(v, &a); err != nil {
+			return true
+		}
+		var days []DailyUsage
+		a.Days.IterFrom(first, func(_, v types.Value) bool {
+			var d DailyUsage
+			if err = marshal.Unmarshal(v, &d); err != nil {
+				return true
+			}
+			d.ActiveClients = d.Clients.count()
+			d.Clients = nil
+			days = append(days, d)
+			return false
+		})
+		if err != nil {
+			return true
+		}
+		if len(days) > 0 {
+			r[uint32(k.(types.Number))] = days
+		}
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read usage: %w", err)
+	}
+	return r, nil
+}
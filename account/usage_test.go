@@ -0,0 +1,140 @@
+package account_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/log"
+	rtime "roci.dev/diff-server/util/time"
+)
+
+func TestMeter(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	// A second instance, as if in another process.
+	db2 := account.LoadTempDBWithPath(assert, dir)
+
+	m := account.NewMeter(db, time.Hour, log.Default())
+	m2 := account.NewMeter(db2, time.Hour, log.Default())
+	m.RecordPull(1, account.PullUsage{ClientID: "a", FullSync: true, PatchBytes: 10, ClientViewFetched: true, ClientViewSize: 100})
+	m.RecordPull(1, account.PullUsage{ClientID: "a", PatchBytes: 5, ClientViewFetched: true, ClientViewSize: 50})
+	m.RecordPull(2, account.PullUsage{ClientID: "a"})
+	m2.RecordPull(1, account.PullUsage{ClientID: "b", FullSync: true, PatchBytes: 1, ClientViewFetched: true, ClientViewFailed: true})
+
+	// Nothing is written until the flush interval has passed or Flush is
+	// called.
+	usage, err := account.ReadUsage(db, time.Now())
+	assert.NoError(err)
+	assert.Equal(0, len(usage))
+
+	assert.NoError(m.Flush())
+	assert.NoError(m2.Flush())
+	assert.NoError(m2.Flush())
+
+	// Usage is recorded to another dataset, so records are unaffected.
+	records, err := account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(account.LowestASID, records.NextASID)
+
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, d := range []*account.DB{db, db2} {
+		usage, err = account.ReadUsage(d, time.Now())
+		assert.NoError(err)
+		assert.Equal(map[uint32][]account.DailyUsage{
+			1: {{
+				Day:                today,
+				Pulls:              3,
+				FullSyncs:          2,
+				PatchBytes:         16,
+				ClientViewFetches:  3,
+				ClientViewFailures: 1,
+				ActiveClients:      2,
+				StoredBytes:        50,
+			}},
+			2: {{
+				Day:           today,
+				Pulls:         1,
+				ActiveClients: 1,
+			}},
+		}, usage)
+	}
+
+	usage, err = account.ReadUsage(db, time.Now().Add(48*time.Hour))
+	assert.NoError(err)
+	assert.Equal(0, len(usage))
+
+	// Usage is also flushed in the background once the interval passes.
+	m3 := account.NewMeter(db, 0, log.Default())
+	m3.RecordPull(2, account.PullUsage{ClientID: "c"})
+	assert.Eventually(func() bool {
+		usage, err := account.ReadUsage(db, time.Now())
+		assert.NoError(err)
+		return usage[2][0].Pulls == 2
+	}, time.Second, time.Millisecond)
+}
+
+func TestMeterActiveClients(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	db2 := account.LoadTempDBWithPath(assert, dir)
+
+	// Two processes see overlapping clients, over several flushes: 20000
+	// distinct in all.
+	m := account.NewMeter(db, time.Hour, log.Default())
+	m2 := account.NewMeter(db2, time.Hour, log.Default())
+	for i := 0; i < 15000; i++ {
+		m.RecordPull(1, account.PullUsage{ClientID: fmt.Sprintf("client-%d", i)})
+		m2.RecordPull(1, account.PullUsage{ClientID: fmt.Sprintf("client-%d", i+5000)})
+		if i%5000 == 0 {
+			assert.NoError(m.Flush())
+			assert.NoError(m2.Flush())
+		}
+	}
+	assert.NoError(m.Flush())
+	assert.NoError(m2.Flush())
+
+	usage, err := account.ReadUsage(db, time.Now())
+	assert.NoError(err)
+	assert.Equal(uint64(30000), usage[1][0].Pulls)
+	assert.InDelta(20000, usage[1][0].ActiveClients, 20000*0.1)
+}
+
+func TestMeterClientViewSizeRetention(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	m := account.NewMeter(db, time.Hour, log.Default())
+
+	// Client a last fetched long ago.
+	undo := rtime.SetFake()
+	long := rtime.Now()
+	m.RecordPull(1, account.PullUsage{ClientID: "a", ClientViewFetched: true, ClientViewSize: 100})
+	m.RecordPull(1, account.PullUsage{ClientID: "b", ClientViewFetched: true, ClientViewSize: 10})
+	assert.NoError(m.Flush())
+	usage, err := account.ReadUsage(db, long)
+	assert.NoError(err)
+	assert.Equal(uint64(110), usage[1][0].StoredBytes)
+	undo()
+
+	// b fetches again, a doesn't, so a no longer counts.
+	m.RecordPull(1, account.PullUsage{ClientID: "b", ClientViewFetched: true, ClientViewSize: 20})
+	m.RecordPull(1, account.PullUsage{ClientID: "c", ClientViewFetched: true, ClientViewSize: 1})
+	assert.NoError(m.Flush())
+	usage, err = account.ReadUsage(db, time.Now())
+	assert.NoError(err)
+	assert.Equal(uint64(21), usage[1][0].StoredBytes)
+
+	// Nor does a count again once expired.
+	m.RecordPull(1, account.PullUsage{ClientID: "b", ClientViewFetched: true, ClientViewSize: 30})
+	assert.NoError(m.Flush())
+	usage, err = account.ReadUsage(db, time.Now())
+	assert.NoError(err)
+	assert.Equal(uint64(31), usage[1][0].StoredBytes)
+}
@@ -0,0 +1,89 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// VerificationTTL is how long a new auto-signup account has to verify its
+// email address. Accounts that don't are deleted, see
+// DeleteExpiredUnverified.
+const VerificationTTL = 48 * time.Hour
+
+// Verification is a pending verification of an account's email address.
+// The zero value means there is nothing to verify: the address has been
+// verified or the account was created by an operator.
+type Verification struct {
+	TokenHash string // Hex-encoded SHA-256 of the token.
+	Expires   string // RFC 3339.
+}
+
+// ErrVerificationFailed is returned by Verify if the token is wrong or has
+// expired. It doesn't say which so as not to help guessers.
+var ErrVerificationFailed = errors.New("invalid or expired verification token")
+
+// verificationTokenBytes is the number of random bytes in a token.
+const verificationTokenBytes = 32
+
+// NewVerification returns a token to send to the account's email address
+// and the Verification to store in its Record. The token must be presented
+// to Verify before the returned Verification expires.
+func NewVerification(now time.Time) (string, Verification, error) {
+	b := make([]byte, verificationTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", Verification{}, err
+	}
+	token := hex.EncodeToString(b)
+	return token, Verification{
+		TokenHash: hashKey(token),
+		Expires:   now.Add(VerificationTTL).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// Unverified returns true if record's email address has not been verified.
+// Unverified accounts cannot be used.
+func Unverified(record Record) bool {
+	return record.Verification.TokenHash != ""
+}
+
+func verificationExpired(v Verification, now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, v.Expires)
+	return err != nil || !now.Before(expires)
+}
+
+// Verify marks the email address of account id in records verified if
+// token is its unexpired verification token. It returns
+// ErrVerificationFailed otherwise. Verifying an account twice succeeds, so
+// that following the link again isn't an error.
+func Verify(records *Records, id uint32, token string, now time.Time) error {
+	record, ok := records.Record[id]
+	if !ok {
+		return ErrVerificationFailed
+	}
+	if !Unverified(record) {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashKey(token)), []byte(record.Verification.TokenHash)) != 1 ||
+		verificationExpired(record.Verification, now) {
+		return ErrVerificationFailed
+	}
+	record.Verification = Verification{}
+	records.Record[id] = record
+	return nil
+}
+
+// DeleteExpiredUnverified deletes the records whose verification has
+// expired and returns their IDs.
+func DeleteExpiredUnverified(records *Records, now time.Time) []uint32 {
+	var deleted []uint32
+	for id, record := range records.Record {
+		if Unverified(record) && verificationExpired(record.Verification, now) {
+			delete(records.Record, id)
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted
+}
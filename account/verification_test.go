@@ -0,0 +1,46 @@
+package account_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+)
+
+func TestVerification(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	token, v, err := account.NewVerification(now)
+	assert.NoError(err)
+	assert.Equal(64, len(token))
+	assert.NotContains(v.TokenHash, token)
+	assert.Equal("2020-05-03T12:00:00Z", v.Expires)
+
+	secret, key, err := account.NewKey(account.LowestASID, "default")
+	assert.NoError(err)
+	records := account.Records{Record: map[uint32]account.Record{
+		account.LowestASID:     {ID: account.LowestASID, Keys: []account.Key{key}, Verification: v},
+		account.LowestASID + 1: {ID: account.LowestASID + 1, Verification: account.Verification{TokenHash: "x", Expires: "2020-05-01T11:00:00Z"}},
+		account.LowestASID + 2: {ID: account.LowestASID + 2},
+	}}
+
+	// Unverified accounts can't be used.
+	assert.True(account.Unverified(records.Record[account.LowestASID]))
+	_, ok := account.Lookup(records, secret, false)
+	assert.False(ok)
+
+	assert.Equal(account.ErrVerificationFailed, account.Verify(&records, account.LowestASID, "wrong", now))
+	assert.Equal(account.ErrVerificationFailed, account.Verify(&records, 12345, token, now))
+	assert.Equal(account.ErrVerificationFailed, account.Verify(&records, account.LowestASID, token, now.Add(account.VerificationTTL)))
+	assert.NoError(account.Verify(&records, account.LowestASID, token, now))
+	assert.False(account.Unverified(records.Record[account.LowestASID]))
+	_, ok = account.Lookup(records, secret, false)
+	assert.True(ok)
+	assert.NoError(account.Verify(&records, account.LowestASID, token, now))
+
+	// Only expired unverified accounts are deleted.
+	assert.Equal([]uint32{account.LowestASID + 1}, account.DeleteExpiredUnverified(&records, now))
+	assert.Equal(2, len(records.Record))
+}
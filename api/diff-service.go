@@ -14,6 +14,7 @@ import (
 
 	"roci.dev/diff-server/account"
 	"roci.dev/diff-server/serve"
+	"roci.dev/diff-server/serve/admin"
 	"roci.dev/diff-server/util/loghttp"
 )
 
@@ -21,13 +22,15 @@ const (
 	aws_access_key_id     = "REPLICANT_AWS_ACCESS_KEY_ID"
 	aws_secret_access_key = "REPLICANT_AWS_SECRET_ACCESS_KEY"
 	aws_region            = "us-west-2"
+	admin_token           = "DIFFS_ADMIN_TOKEN"
 
 	storageRoot = "aws:replicant/aa-replicant2"
 )
 
 var (
 	diffServiceHandler http.Handler
-	headerLogAllowlist = []string{"Authorization", "Content-Type", "Host", "X-Replicache-SyncID"}
+	// Authorization is not logged because it carries account keys.
+	headerLogAllowlist = []string{"Content-Type", "Host", "X-Replicache-SyncID"}
 )
 
 func init() {
@@ -51,9 +54,14 @@ func init() {
 		panic(err)
 	}
 
-	svc := serve.NewService(storageRoot, account.MaxASClientViewHosts, accountDB, false, serve.ClientViewGetter{}, false)
+	// Bare account IDs are still accepted for accounts without keys. Accounts
+	// that have been given keys (account add-key, or keys in the regular
+	// accounts file) refuse them.
+	svc := serve.NewService(storageRoot, account.MaxASClientViewHosts, accountDB, false, serve.NewClientViewGetter(serve.DefaultClientViewGetterConfig), false, serve.WithAccountIDAuth(true), serve.WithMeter(account.NewMeter(accountDB, account.DefaultUsageFlushInterval, zlog.Logger)))
 	mux := mux.NewRouter()
 	serve.RegisterHandlers(svc, mux)
+	// The admin API is only served if a token is configured.
+	admin.RegisterHandlers(admin.NewService(zlog.Logger, os.Getenv(admin_token), accountDB, svc), mux)
 	diffServiceHandler = mux
 }
 
@@ -17,6 +17,14 @@ import (
 	"roci.dev/diff-server/util/log"
 )
 
+const (
+	smtp_addr       = "DIFFS_SMTP_ADDR"
+	smtp_username   = "DIFFS_SMTP_USERNAME"
+	smtp_password   = "DIFFS_SMTP_PASSWORD"
+	mail_from       = "DIFFS_MAIL_FROM"
+	signup_base_url = "DIFFS_SIGNUP_BASE_URL"
+)
+
 var (
 	signupHandler http.Handler
 )
@@ -38,7 +46,11 @@ func init() {
 
 	// Set up signup service.
 	tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
-	service := signup.NewService(log.Default(), tmpl, storageRoot)
+	var mailer signup.Mailer = signup.LogMailer{Logger: log.Default()}
+	if addr := os.Getenv(smtp_addr); addr != "" {
+		mailer = signup.NewSMTPMailer(addr, os.Getenv(mail_from), os.Getenv(smtp_username), os.Getenv(smtp_password))
+	}
+	service := signup.NewService(log.Default(), tmpl, storageRoot, signup.WithMailer(mailer), signup.WithBaseURL(os.Getenv(signup_base_url)), signup.WithClientIPHeader("X-Forwarded-For"))
 	signup.RegisterHandlers(service, mux)
 
 	signupHandler = mux
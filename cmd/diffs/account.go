@@ -0,0 +1,826 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"roci.dev/diff-server/account"
+	servepkg "roci.dev/diff-server/serve"
+	"roci.dev/diff-server/util/tbl"
+	"roci.dev/diff-server/util/time"
+)
+
+const deleteAccountWarning = "This command deletes account %d and all of its client data. This operation is not recoverable. Proceed? y/n\n"
+
+// accountCmd registers the account administration commands. They operate on
+// the account DB given by --account-db (and, to delete client data, the
+// databases given by --db).
+func accountCmd(parent *kingpin.Application, sps *string, ads *string, in io.Reader, out io.Writer) {
+	kc := parent.Command("account", "Administer Replicache accounts.")
+	asJSON := kc.Flag("json", "Print output as JSON instead of a table").Bool()
+	regularAccounts := kc.Flag("regular-accounts", "JSON or YAML file of regular accounts to show instead of the built-in list").PlaceHolder("/path/to/accounts.yaml").String()
+
+	openDB := func() (*account.DB, error) {
+		db, err := account.NewDB(*ads)
+		if err != nil {
+			return nil, err
+		}
+		if *regularAccounts != "" {
+			records, err := account.LoadRegularAccounts(*regularAccounts)
+			if err != nil {
+				return nil, err
+			}
+			db.SetRegularAccounts(records)
+		}
+		return db, nil
+	}
+
+	list := kc.Command("list", "Lists all accounts, including the regular accounts.")
+	list.Action(func(_ *kingpin.ParseContext) error {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		records, err := account.ReadAllRecords(db)
+		if err != nil {
+			return err
+		}
+		ids := make([]uint32, 0, len(records.Record))
+		for id := range records.Record {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if *asJSON {
+			l := make([]account.Record, 0, len(ids))
+			for _, id := range ids {
+				l = append(l, account.Redact(records.Record[id]))
+			}
+			return printJSON(out, l)
+		}
+		t := &tbl.Table{}
+		for _, id := range ids {
+			r := records.Record[id]
+			summary := fmt.Sprintf("%s <%s> patterns=%s", r.Name, r.Email, joinPatterns(r.ClientViewURLPatterns, ","))
+			if r.HTTPSOnly {
+				summary += " (https only)"
+			}
+			if !account.Active(r) {
+				summary += fmt.Sprintf(" (%s)", account.StateOf(r))
+			}
+			if account.Unverified(r) {
+				summary += " (unverified)"
+			}
+			t.Add(fmt.Sprintf("%d ", id), summary)
+		}
+		_, err = t.WriteTo(out)
+		return err
+	})
+
+	show := kc.Command("show", "Shows a single account.")
+	showID := show.Arg("id", "Account ID").Required().Uint32()
+	show.Action(func(_ *kingpin.ParseContext) error {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		records, err := account.ReadAllRecords(db)
+		if err != nil {
+			return err
+		}
+		r, ok := records.Record[*showID]
+		if !ok {
+			return fmt.Errorf("no such account: %d", *showID)
+		}
+		if *asJSON {
+			return printJSON(out, account.Redact(r))
+		}
+		return printRecord(out, r)
+	})
+
+	create := kc.Command("create", "Creates an auto-signup account and prints its first key. The key is shown only once.")
+	createName := create.Flag("name", "Name of the customer").Required().String()
+	createEmail := create.Flag("email", "Contact email of the customer").Required().String()
+	create.Action(func(_ *kingpin.ParseContext) error {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		var created account.Record
+		var secret string
+		err = account.Update(db, func(records *account.Records) error {
+			id := records.NextASID
+			var key account.Key
+			var err error
+			secret, key, err = account.NewKey(id, "default")
+			if err != nil {
+				return err
+			}
+			created = account.Record{
+				ID:          id,
+				Name:        *createName,
+				Email:       *createEmail,
+				DateCreated: time.Now().String(),
+				Keys:        []account.Key{key},
+			}
+			records.Record[id] = created
+			records.NextASID++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(out, struct {
+				Record account.Record
+				Key    string
+			}{account.Redact(created), secret})
+		}
+		t := &tbl.Table{}
+		t.Add("ID: ", strconv.FormatUint(uint64(created.ID), 10))
+		t.Add("Key: ", secret)
+		_, err = t.WriteTo(out)
+		return err
+	})
+
+	addPattern := kc.Command("add-pattern", "Authorizes client view URLs matching a pattern for an account.")
+	addPatternID := addPattern.Arg("id", "Account ID").Required().Uint32()
+	addPatternPattern := addPattern.Arg("pattern", "URL pattern, scheme://host[:port]/path, eg https://example.com/replicache/ or http://localhost:*/").Required().String()
+	addPattern.Action(func(_ *kingpin.ParseContext) error {
+		p, err := account.ParseURLPattern(*addPatternPattern)
+		if err != nil {
+			return err
+		}
+		return updateRecord(openDB, *addPatternID, out, *asJSON, func(r *account.Record) error {
+			if !hasPattern(*r, p) {
+				r.ClientViewURLPatterns = append(r.ClientViewURLPatterns, p)
+			}
+			return nil
+		})
+	})
+
+	removePattern := kc.Command("remove-pattern", "Removes a client view URL pattern from an account.")
+	removePatternID := removePattern.Arg("id", "Account ID").Required().Uint32()
+	removePatternPattern := removePattern.Arg("pattern", "URL pattern, as shown by show").Required().String()
+	removePattern.Action(func(_ *kingpin.ParseContext) error {
+		p, err := account.ParseURLPattern(*removePatternPattern)
+		if err != nil {
+			return err
+		}
+		return updateRecord(openDB, *removePatternID, out, *asJSON, func(r *account.Record) error {
+			patterns := make([]account.URLPattern, 0, len(r.ClientViewURLPatterns))
+			for _, q := range r.ClientViewURLPatterns {
+				if q != p {
+					patterns = append(patterns, q)
+				}
+			}
+			if len(patterns) == len(r.ClientViewURLPatterns) {
+				return fmt.Errorf("account %d does not have pattern %s", r.ID, p)
+			}
+			r.ClientViewURLPatterns = patterns
+			return nil
+		})
+	})
+
+	addHost := kc.Command("add-host", "Authorizes client view URLs on a host, any port, path or scheme, for an account. DEPRECATED, use add-pattern.")
+	addHostID := addHost.Arg("id", "Account ID").Required().Uint32()
+	addHostHost := addHost.Arg("host", "Hostname, eg example.com").Required().String()
+	addHost.Action(func(_ *kingpin.ParseContext) error {
+		if err := checkHost(*addHostHost); err != nil {
+			return err
+		}
+		return updateRecord(openDB, *addHostID, out, *asJSON, func(r *account.Record) error {
+			for _, p := range account.HostURLPatterns(*addHostHost) {
+				if !hasPattern(*r, p) {
+					r.ClientViewURLPatterns = append(r.ClientViewURLPatterns, p)
+				}
+			}
+			return nil
+		})
+	})
+
+	removeHost := kc.Command("remove-host", "Removes the patterns added by add-host from an account. DEPRECATED, use remove-pattern.")
+	removeHostID := removeHost.Arg("id", "Account ID").Required().Uint32()
+	removeHostHost := removeHost.Arg("host", "Hostname, eg example.com").Required().String()
+	removeHost.Action(func(_ *kingpin.ParseContext) error {
+		if err := checkHost(*removeHostHost); err != nil {
+			return err
+		}
+		hostPatterns := account.HostURLPatterns(*removeHostHost)
+		return updateRecord(openDB, *removeHostID, out, *asJSON, func(r *account.Record) error {
+			patterns := make([]account.URLPattern, 0, len(r.ClientViewURLPatterns))
+			for _, q := range r.ClientViewURLPatterns {
+				if q != hostPatterns[0] && q != hostPatterns[1] {
+					patterns = append(patterns, q)
+				}
+			}
+			if len(patterns) == len(r.ClientViewURLPatterns) {
+				return fmt.Errorf("account %d does not have host %s", r.ID, *removeHostHost)
+			}
+			r.ClientViewURLPatterns = patterns
+			return nil
+		})
+	})
+
+	httpsOnly := kc.Command("https-only", "Sets whether an account may only use https client view URLs.")
+	httpsOnlyID := httpsOnly.Arg("id", "Account ID").Required().Uint32()
+	httpsOnlyValue := httpsOnly.Arg("value", "true or false").Default("true").Bool()
+	httpsOnly.Action(func(_ *kingpin.ParseContext) error {
+		return updateRecord(openDB, *httpsOnlyID, out, *asJSON, func(r *account.Record) error {
+			r.HTTPSOnly = *httpsOnlyValue
+			return nil
+		})
+	})
+
+	signingSecret := kc.Command("signing-secret", "Generates a new secret to sign an account's client view requests with and prints it, replacing any previous secret. The secret is shown only once.")
+	signingSecretID := signingSecret.Arg("id", "Account ID").Required().Uint32()
+	signingSecretRemove := signingSecret.Flag("remove", "Remove the account's secret so that its requests are no longer signed").Bool()
+	signingSecret.Action(func(_ *kingpin.ParseContext) error {
+		if err := checkMutable(*signingSecretID); err != nil {
+			return err
+		}
+		if *signingSecretRemove {
+			return updateRecord(openDB, *signingSecretID, out, *asJSON, func(r *account.Record) error {
+				r.SigningSecret = ""
+				return nil
+			})
+		}
+		secret, err := account.NewSigningSecret()
+		if err != nil {
+			return err
+		}
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		var updated account.Record
+		err = account.Update(db, func(records *account.Records) error {
+			r, ok := records.Record[*signingSecretID]
+			if !ok {
+				return fmt.Errorf("no such account: %d", *signingSecretID)
+			}
+			r.SigningSecret = secret
+			records.Record[r.ID] = r
+			updated = r
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(out, struct {
+				Record        account.Record
+				SigningSecret string
+			}{account.Redact(updated), secret})
+		}
+		t := &tbl.Table{}
+		t.Add("ID: ", strconv.FormatUint(uint64(updated.ID), 10))
+		t.Add("Signing secret: ", secret)
+		_, err = t.WriteTo(out)
+		return err
+	})
+
+	addKey := kc.Command("add-key", "Generates a new key for an account and prints it. The key is shown only once. Keys of regular accounts are not stored; add the printed hash to the regular accounts file.")
+	addKeyID := addKey.Arg("id", "Account ID").Required().Uint32()
+	addKeyName := addKey.Arg("name", "Name of the key, unique within the account").Required().String()
+	addKey.Action(func(_ *kingpin.ParseContext) error {
+		if checkMutable(*addKeyID) != nil {
+			secret, key, err := account.NewKey(*addKeyID, *addKeyName)
+			if err != nil {
+				return err
+			}
+			if *asJSON {
+				return printJSON(out, struct {
+					Name string
+					Hash string
+					Key  string
+				}{key.Name, key.Hash, secret})
+			}
+			t := &tbl.Table{}
+			t.Add("Name: ", key.Name)
+			t.Add("Hash: ", key.Hash)
+			t.Add("Key: ", secret)
+			_, err = t.WriteTo(out)
+			return err
+		}
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		var updated account.Record
+		var secret string
+		err = account.Update(db, func(records *account.Records) error {
+			r, ok := records.Record[*addKeyID]
+			if !ok {
+				return fmt.Errorf("no such account: %d", *addKeyID)
+			}
+			var err error
+			if secret, err = account.AddKey(&r, *addKeyName); err != nil {
+				return err
+			}
+			records.Record[r.ID] = r
+			updated = r
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(out, struct {
+				Record account.Record
+				Key    string
+			}{account.Redact(updated), secret})
+		}
+		t := &tbl.Table{}
+		t.Add("ID: ", strconv.FormatUint(uint64(updated.ID), 10))
+		t.Add("Key: ", secret)
+		_, err = t.WriteTo(out)
+		return err
+	})
+
+	revokeKey := kc.Command("revoke-key", "Revokes an account's key so that it no longer authorizes requests.")
+	revokeKeyID := revokeKey.Arg("id", "Account ID").Required().Uint32()
+	revokeKeyName := revokeKey.Arg("name", "Name of the key, as shown by show").Required().String()
+	revokeKey.Action(func(_ *kingpin.ParseContext) error {
+		return updateRecord(openDB, *revokeKeyID, out, *asJSON, func(r *account.Record) error {
+			return account.RevokeKey(r, *revokeKeyName)
+		})
+	})
+
+	setLimits := kc.Command("set-limits", "Sets an account's limits. Omitted limits take the default for the account; negative limits are unlimited.")
+	setLimitsID := setLimits.Arg("id", "Account ID").Required().Uint32()
+	var limits account.Limits
+	setLimits.Flag("pulls-per-second", "Average pulls per second across the account's clients").Float64Var(&limits.PullsPerSecond)
+	setLimits.Flag("pull-burst", "Pulls allowed in a burst across the account's clients").IntVar(&limits.PullBurst)
+	setLimits.Flag("client-pulls-per-second", "Average pulls per second from each client").Float64Var(&limits.ClientPullsPerSecond)
+	setLimits.Flag("client-pull-burst", "Pulls allowed in a burst from each client").IntVar(&limits.ClientPullBurst)
+	setLimits.Flag("daily-pulls", "Pulls allowed per UTC day").Int64Var(&limits.DailyPulls)
+	setLimits.Flag("daily-client-view-bytes", "Client view bytes that may be fetched per UTC day").Int64Var(&limits.DailyClientViewBytes)
+	setLimits.Flag("max-pull-bytes", "Largest pull request body accepted").Int64Var(&limits.MaxPullBytes)
+	setLimits.Flag("max-client-view-bytes", "Largest client view response accepted").Int64Var(&limits.MaxClientViewBytes)
+	setLimits.Flag("max-client-view-keys", "Most keys accepted in a client view").Int64Var(&limits.MaxClientViewKeys)
+	setLimits.Flag("max-client-view-value-bytes", "Largest value accepted in a client view").Int64Var(&limits.MaxClientViewValueBytes)
+	setLimits.Action(func(_ *kingpin.ParseContext) error {
+		return updateRecord(openDB, *setLimitsID, out, *asJSON, func(r *account.Record) error {
+			r.Limits = limits
+			return nil
+		})
+	})
+
+	setTLS := kc.Command("set-tls", "Sets the TLS settings an account's client views are fetched with, for data layers behind private PKI. Omitted settings take the default.")
+	setTLSID := setTLS.Arg("id", "Account ID").Required().Uint32()
+	setTLSCert := setTLS.Flag("client-cert", "PEM file with the client certificate (chain) to present").ExistingFile()
+	setTLSKey := setTLS.Flag("client-key", "PEM file with the client certificate's key").ExistingFile()
+	setTLSRootCAs := setTLS.Flag("root-cas", "PEM file with CA certificates to trust in addition to the system's").ExistingFile()
+	setTLSMinVersion := setTLS.Flag("min-version", "Minimum TLS version").Enum("1.0", "1.1", "1.2", "1.3")
+	setTLS.Action(func(_ *kingpin.ParseContext) error {
+		var t account.TLS
+		for _, f := range []struct {
+			path string
+			into *string
+		}{{*setTLSCert, &t.ClientCert}, {*setTLSKey, &t.ClientKey}, {*setTLSRootCAs, &t.RootCAs}} {
+			if f.path == "" {
+				continue
+			}
+			b, err := ioutil.ReadFile(f.path)
+			if err != nil {
+				return err
+			}
+			*f.into = string(b)
+		}
+		t.MinVersion = *setTLSMinVersion
+		if _, err := t.Config(); err != nil {
+			return err
+		}
+		return updateRecord(openDB, *setTLSID, out, *asJSON, func(r *account.Record) error {
+			r.TLS = t
+			return nil
+		})
+	})
+
+	setSchema := kc.Command("set-schema", "Sets the JSON Schema that client view values of keys with a prefix must be valid against. Client views with invalid values are not stored.")
+	setSchemaID := setSchema.Arg("id", "Account ID").Required().Uint32()
+	setSchemaPrefix := setSchema.Arg("prefix", "Key prefix; where several match a key the longest applies").Required().String()
+	setSchemaFile := setSchema.Arg("file", "JSON Schema file").Required().ExistingFile()
+	setSchema.Action(func(_ *kingpin.ParseContext) error {
+		b, err := ioutil.ReadFile(*setSchemaFile)
+		if err != nil {
+			return err
+		}
+		var schema bytes.Buffer
+		if err := json.Compact(&schema, b); err != nil {
+			return fmt.Errorf("invalid schema: %w", err)
+		}
+		ks := account.KeySchema{Prefix: *setSchemaPrefix, Schema: schema.String()}
+		if err := account.ValidateSchemas([]account.KeySchema{ks}); err != nil {
+			return err
+		}
+		return updateRecord(openDB, *setSchemaID, out, *asJSON, func(r *account.Record) error {
+			schemas := []account.KeySchema{}
+			for _, s := range r.Schemas {
+				if s.Prefix != ks.Prefix {
+					schemas = append(schemas, s)
+				}
+			}
+			r.Schemas = append(schemas, ks)
+			return nil
+		})
+	})
+
+	removeSchema := kc.Command("remove-schema", "Removes the JSON Schema for a key prefix from an account.")
+	removeSchemaID := removeSchema.Arg("id", "Account ID").Required().Uint32()
+	removeSchemaPrefix := removeSchema.Arg("prefix", "Key prefix").Required().String()
+	removeSchema.Action(func(_ *kingpin.ParseContext) error {
+		return updateRecord(openDB, *removeSchemaID, out, *asJSON, func(r *account.Record) error {
+			schemas := []account.KeySchema{}
+			for _, s := range r.Schemas {
+				if s.Prefix != *removeSchemaPrefix {
+					schemas = append(schemas, s)
+				}
+			}
+			if len(schemas) == len(r.Schemas) {
+				return fmt.Errorf("account %d does not have a schema for prefix %q", r.ID, *removeSchemaPrefix)
+			}
+			r.Schemas = schemas
+			return nil
+		})
+	})
+
+	setForward := kc.Command("set-forward", "Sets the pull request headers and cookies copied to an account's client view requests, replacing any set before. With no flags nothing is forwarded.")
+	setForwardID := setForward.Arg("id", "Account ID").Required().Uint32()
+	setForwardHeaders := setForward.Flag("header", "Header to forward").Strings()
+	setForwardSensitiveHeaders := setForward.Flag("sensitive-header", "Header to forward, redacted from HTTP logs").Strings()
+	setForwardCookies := setForward.Flag("cookie", "Cookie to forward").Strings()
+	setForwardSensitiveCookies := setForward.Flag("sensitive-cookie", "Cookie to forward, redacted from HTTP logs").Strings()
+	setForward.Action(func(_ *kingpin.ParseContext) error {
+		forwarded := func(names []string, sensitive bool) []account.Forwarded {
+			var f []account.Forwarded
+			for _, n := range names {
+				f = append(f, account.Forwarded{Name: n, Sensitive: sensitive})
+			}
+			return f
+		}
+		f := account.Forward{
+			Headers: append(forwarded(*setForwardHeaders, false), forwarded(*setForwardSensitiveHeaders, true)...),
+			Cookies: append(forwarded(*setForwardCookies, false), forwarded(*setForwardSensitiveCookies, true)...),
+		}
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		return updateRecord(openDB, *setForwardID, out, *asJSON, func(r *account.Record) error {
+			r.Forward = f
+			return nil
+		})
+	})
+
+	migrate := kc.Command("migrate", "Rewrites all account records in the current format, eg converting client view hosts to URL patterns.")
+	migrate.Action(func(_ *kingpin.ParseContext) error {
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		n := 0
+		// Records are migrated when they are read, so all that's left is to
+		// write them back.
+		err = account.Update(db, func(records *account.Records) error {
+			n = len(records.Record)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "Rewrote %d account records\n", n)
+		return err
+	})
+
+	setStatus := func(id uint32, state, reason string) error {
+		status, err := account.NewStatus(state, reason, time.Now())
+		if err != nil {
+			return err
+		}
+		return updateRecord(openDB, id, out, *asJSON, func(r *account.Record) error {
+			if account.StateOf(*r) == account.StateDeleted {
+				return fmt.Errorf("account %d is deleted", id)
+			}
+			r.Status = status
+			return nil
+		})
+	}
+
+	suspend := kc.Command("suspend", "Suspends an account so that it can no longer pull.").Alias("disable")
+	suspendID := suspend.Arg("id", "Account ID").Required().Uint32()
+	suspendReason := suspend.Flag("reason", "Why the account is suspended").String()
+	suspend.Action(func(_ *kingpin.ParseContext) error {
+		return setStatus(*suspendID, account.StateSuspended, *suspendReason)
+	})
+
+	activate := kc.Command("activate", "Reactivates a suspended account.")
+	activateID := activate.Arg("id", "Account ID").Required().Uint32()
+	activate.Action(func(_ *kingpin.ParseContext) error {
+		return setStatus(*activateID, account.StateActive, "")
+	})
+
+	move := kc.Command("move-storage", "Copies an account's client data to another Noms database and stores the account there from then on. The old data is left in place.")
+	moveID := move.Arg("id", "Account ID").Required().Uint32()
+	moveSpec := move.Arg("spec", "Noms database spec to move the account to, eg aws://table:bucket/acme. If omitted, the account is moved back under --db.").String()
+	move.Action(func(_ *kingpin.ParseContext) error {
+		if *sps == "" {
+			return errors.New("required flag --db not provided: it is needed to find the account's client data")
+		}
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		svc := servepkg.NewService(*sps, account.MaxASClientViewHosts, db, false, nil, false)
+		n, err := svc.CopyStorage(*moveID, *moveSpec)
+		if err != nil {
+			return err
+		}
+		if checkMutable(*moveID) != nil {
+			_, err = fmt.Fprintf(out, "Copied %d datasets. Set storageSpec for account %d in the regular accounts file to use them.\n", n, *moveID)
+			return err
+		}
+		if !*asJSON {
+			if _, err := fmt.Fprintf(out, "Copied %d datasets\n", n); err != nil {
+				return err
+			}
+		}
+		return updateRecord(openDB, *moveID, out, *asJSON, func(r *account.Record) error {
+			r.StorageSpec = *moveSpec
+			return nil
+		})
+	})
+
+	verify := kc.Command("verify", "Marks an account's email address verified, as if the signup verification link had been followed.")
+	verifyID := verify.Arg("id", "Account ID").Required().Uint32()
+	verify.Action(func(_ *kingpin.ParseContext) error {
+		return updateRecord(openDB, *verifyID, out, *asJSON, func(r *account.Record) error {
+			r.Verification = account.Verification{}
+			return nil
+		})
+	})
+
+	del := kc.Command("delete", "Deletes an account and removes its client data from the databases given by --db. The account record is kept, marked deleted.")
+	delID := del.Arg("id", "Account ID").Required().Uint32()
+	delReason := del.Flag("reason", "Why the account is deleted").String()
+	delForce := del.Flag("force", "Don't ask for confirmation").Bool()
+	del.Action(func(_ *kingpin.ParseContext) error {
+		if err := checkMutable(*delID); err != nil {
+			return err
+		}
+		if *sps == "" {
+			return errors.New("required flag --db not provided: it is needed to remove the account's client data")
+		}
+		if !*delForce && !confirm(in, out, fmt.Sprintf(deleteAccountWarning, *delID)) {
+			return nil
+		}
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		status, err := account.NewStatus(account.StateDeleted, *delReason, time.Now())
+		if err != nil {
+			return err
+		}
+		err = account.Update(db, func(records *account.Records) error {
+			r, ok := records.Record[*delID]
+			if !ok {
+				return fmt.Errorf("no such account: %d", *delID)
+			}
+			// Deleting again removes any client data left over, but keeps
+			// the original status.
+			if account.StateOf(r) != account.StateDeleted {
+				r.Status = status
+			}
+			records.Record[*delID] = r
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		svc := servepkg.NewService(*sps, account.MaxASClientViewHosts, db, false, nil, false)
+		n, err := svc.DeleteClients(strconv.FormatUint(uint64(*delID), 10))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, "Deleted account %d and removed %d clients\n", *delID, n)
+		return err
+	})
+}
+
+// updateRecord applies f to a single auto-signup account record and prints
+// the result.
+func updateRecord(openDB func() (*account.DB, error), id uint32, out io.Writer, asJSON bool, f func(r *account.Record) error) error {
+	if err := checkMutable(id); err != nil {
+		return err
+	}
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	var updated account.Record
+	err = account.Update(db, func(records *account.Records) error {
+		r, ok := records.Record[id]
+		if !ok {
+			return fmt.Errorf("no such account: %d", id)
+		}
+		if err := f(&r); err != nil {
+			return err
+		}
+		records.Record[id] = r
+		updated = r
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(out, account.Redact(updated))
+	}
+	return printRecord(out, updated)
+}
+
+// checkMutable returns an error for regular accounts: they are overlaid
+// from the regular accounts file (or account.RegularAccounts), so changes to
+// them in the DB have no effect.
+func checkMutable(id uint32) error {
+	if id < account.LowestASID {
+		return fmt.Errorf("account %d is a regular account; change it in the regular accounts file", id)
+	}
+	return nil
+}
+
+// checkHost returns an error unless host is a bare hostname, as add-host
+// and remove-host take.
+func checkHost(host string) error {
+	if host == "" || strings.ContainsAny(host, "/:@ ") {
+		return fmt.Errorf("invalid host %q, want a bare hostname, eg example.com", host)
+	}
+	return nil
+}
+
+func hasPattern(r account.Record, p account.URLPattern) bool {
+	for _, q := range r.ClientViewURLPatterns {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+func printRecord(out io.Writer, r account.Record) error {
+	t := &tbl.Table{}
+	t.Add("ID: ", strconv.FormatUint(uint64(r.ID), 10))
+	t.Add("Name: ", r.Name)
+	t.Add("Email: ", r.Email)
+	t.Add("Created: ", r.DateCreated)
+	t.Add("Status: ", formatStatus(r))
+	verified := "true"
+	if account.Unverified(r) {
+		verified = "false, expires " + r.Verification.Expires
+	}
+	t.Add("Verified: ", verified)
+	t.Add("HTTPS only: ", strconv.FormatBool(r.HTTPSOnly))
+	t.Add("Patterns: ", joinPatterns(r.ClientViewURLPatterns, ", "))
+	t.Add("Limits: ", formatLimits(account.EffectiveLimits(r)))
+	t.Add("Sizes: ", formatSizeLimits(r.Limits))
+	storage := r.StorageSpec
+	if storage == "" {
+		storage = "default"
+	}
+	t.Add("Storage: ", storage)
+	t.Add("Signed: ", strconv.FormatBool(r.SigningSecret != ""))
+	t.Add("TLS: ", formatTLS(r.TLS))
+	t.Add("Forward: ", formatForward(r.Forward))
+	for _, s := range r.Schemas {
+		t.Add("Schema: ", fmt.Sprintf("%q %s", s.Prefix, s.Schema))
+	}
+	for _, k := range r.Keys {
+		state := "created " + k.DateCreated
+		if k.Revoked() {
+			state += ", revoked " + k.DateRevoked
+		}
+		t.Add("Key: ", fmt.Sprintf("%s (%s)", k.Name, state))
+	}
+	_, err := t.WriteTo(out)
+	return err
+}
+
+func formatStatus(r account.Record) string {
+	s := account.StateOf(r)
+	if r.Status.Date != "" {
+		s += " since " + r.Status.Date
+	}
+	if r.Status.Reason != "" {
+		s += ": " + r.Status.Reason
+	}
+	return s
+}
+
+func formatTLS(t account.TLS) string {
+	if t.IsZero() {
+		return "default"
+	}
+	var s []string
+	if t.ClientCert != "" {
+		s = append(s, "client certificate")
+	}
+	if t.RootCAs != "" {
+		s = append(s, "extra root CAs")
+	}
+	if t.MinVersion != "" {
+		s = append(s, "minimum version "+t.MinVersion)
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatForward(f account.Forward) string {
+	if f.IsZero() {
+		return "nothing"
+	}
+	names := func(kind string, forwarded []account.Forwarded) string {
+		s := make([]string, 0, len(forwarded))
+		for _, fw := range forwarded {
+			if fw.Sensitive {
+				s = append(s, fw.Name+" (sensitive)")
+			} else {
+				s = append(s, fw.Name)
+			}
+		}
+		return kind + " " + strings.Join(s, ", ")
+	}
+	var s []string
+	if len(f.Headers) > 0 {
+		s = append(s, names("headers", f.Headers))
+	}
+	if len(f.Cookies) > 0 {
+		s = append(s, names("cookies", f.Cookies))
+	}
+	return strings.Join(s, "; ")
+}
+
+func formatLimits(l account.Limits) string {
+	rate := func(perSecond float64, burst int) string {
+		if perSecond < 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%g/s (burst %d)", perSecond, burst)
+	}
+	quota := func(n int64) string {
+		if n < 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("pulls %s, client pulls %s, daily pulls %s, daily client view bytes %s",
+		rate(l.PullsPerSecond, l.PullBurst), rate(l.ClientPullsPerSecond, l.ClientPullBurst),
+		quota(l.DailyPulls), quota(l.DailyClientViewBytes))
+}
+
+// formatSizeLimits formats the size limits of l, which default to the
+// server's settings rather than to per-account defaults.
+func formatSizeLimits(l account.Limits) string {
+	size := func(n int64) string {
+		switch {
+		case n == 0:
+			return "server default"
+		case n < 0:
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("pull bytes %s, client view bytes %s, client view keys %s, client view value bytes %s",
+		size(l.MaxPullBytes), size(l.MaxClientViewBytes), size(l.MaxClientViewKeys), size(l.MaxClientViewValueBytes))
+}
+
+func joinPatterns(patterns []account.URLPattern, sep string) string {
+	s := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, sep)
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
+
+func confirm(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprint(out, prompt)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(strings.ToLower(answer)) == "y"
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	servepkg "roci.dev/diff-server/serve"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestAccountCommands(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	run := func(in string, args ...string) (string, string, int) {
+		out, errs := &bytes.Buffer{}, &bytes.Buffer{}
+		code := 0
+		impl(append([]string{"--account-db=" + dir, "account"}, args...), strings.NewReader(in), out, errs, func(c int) { code = c })
+		return out.String(), errs.String(), code
+	}
+
+	// Create.
+	out, _, code := run("", "--json", "create", "--name=Larry", "--email=larry@example.com")
+	assert.Equal(0, code)
+	var created struct {
+		Record account.Record
+		Key    string
+	}
+	assert.NoError(json.Unmarshal([]byte(out), &created))
+	id := created.Record.ID
+	assert.Equal(account.LowestASID, id)
+	assert.Equal("", created.Record.Keys[0].Hash)
+	sid := fmt.Sprintf("%d", id)
+
+	db := account.LoadTempDBWithPath(assert, dir)
+	records, err := account.ReadAllRecords(db)
+	assert.NoError(err)
+	got, found := account.Lookup(records, created.Key, false)
+	assert.True(found)
+	assert.Equal("Larry", got.Name)
+
+	// List and show.
+	out, _, code = run("", "list")
+	assert.Equal(0, code)
+	assert.Contains(out, "Sandbox")
+	assert.Contains(out, sid+" Larry <larry@example.com>")
+	out, _, code = run("", "show", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Name:       Larry")
+	assert.NotContains(out, created.Key)
+	_, errOut, code := run("", "show", "12345")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "no such account")
+
+	// Patterns.
+	_, _, code = run("", "add-pattern", sid, "https://a.com/cv")
+	assert.Equal(0, code)
+	out, _, code = run("", "add-pattern", sid, "http://localhost:*/")
+	assert.Equal(0, code)
+	assert.Contains(out, "https://a.com/cv, http://localhost:*/")
+	out, _, code = run("", "remove-pattern", sid, "https://a.com/cv")
+	assert.Equal(0, code)
+	assert.Contains(out, "Patterns:   http://localhost:*/\n")
+	_, errOut, code = run("", "remove-pattern", sid, "https://a.com/cv")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "does not have pattern")
+	_, errOut, code = run("", "add-pattern", sid, "a.com")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "missing scheme")
+
+	// Hosts are shorthand for patterns.
+	out, _, code = run("", "add-host", sid, "B.com")
+	assert.Equal(0, code)
+	assert.Contains(out, "Patterns:   http://localhost:*/, https://b.com:*/, http://b.com:*/\n")
+	out, _, code = run("", "add-host", sid, "b.com")
+	assert.Equal(0, code)
+	assert.Contains(out, "Patterns:   http://localhost:*/, https://b.com:*/, http://b.com:*/\n")
+	out, _, code = run("", "remove-host", sid, "b.com")
+	assert.Equal(0, code)
+	assert.Contains(out, "Patterns:   http://localhost:*/\n")
+	_, errOut, code = run("", "remove-host", sid, "b.com")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "does not have host b.com")
+	_, errOut, code = run("", "add-host", sid, "https://b.com")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "want a bare hostname")
+	out, _, code = run("", "https-only", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "HTTPS only: true\n")
+	out, _, code = run("", "https-only", sid, "false")
+	assert.Equal(0, code)
+	assert.Contains(out, "HTTPS only: false\n")
+
+	// Limits.
+	out, _, code = run("", "show", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Limits:     pulls 20/s (burst 100), client pulls 2/s (burst 10), daily pulls 200000, daily client view bytes 1073741824\n")
+	out, _, code = run("", "set-limits", sid, "--pulls-per-second=0.5", "--daily-pulls=-1")
+	assert.Equal(0, code)
+	assert.Contains(out, "Limits:     pulls 0.5/s (burst 100), client pulls 2/s (burst 10), daily pulls unlimited, daily client view bytes 1073741824\n")
+	assert.Contains(out, "Sizes:      pull bytes server default, client view bytes server default, client view keys server default, client view value bytes server default\n")
+	out, _, code = run("", "set-limits", sid, "--max-pull-bytes=1000", "--max-client-view-keys=-1")
+	assert.Equal(0, code)
+	assert.Contains(out, "Sizes:      pull bytes 1000, client view bytes server default, client view keys unlimited, client view value bytes server default\n")
+
+	// Regular accounts are configured elsewhere.
+	_, errOut, code = run("", "add-pattern", "1", "https://a.com/")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "regular account")
+
+	// Migrate rewrites legacy hosts as patterns.
+	records, err = account.ReadRecords(db)
+	assert.NoError(err)
+	records = account.CopyRecords(records)
+	legacy := records.Record[id]
+	legacy.ClientViewURLPatterns = nil
+	legacy.ClientViewHosts = []string{"legacy.com"}
+	records.Record[id] = legacy
+	assert.NoError(account.WriteRecords(db, records))
+	out, _, code = run("", "migrate")
+	assert.Equal(0, code)
+	assert.Equal("Rewrote 1 account records\n", out)
+	out, _, code = run("", "show", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Patterns:   https://legacy.com:*/, http://legacy.com:*/\n")
+
+	// Usage.
+	meter := account.NewMeter(db, time.Hour, log.Default())
+	meter.RecordPull(id, account.PullUsage{ClientID: "c1", FullSync: true, PatchBytes: 42})
+	meter.RecordPull(0, account.PullUsage{ClientID: "c1"})
+	assert.NoError(meter.Flush())
+	usage := func(args ...string) (string, int) {
+		out, errs := &bytes.Buffer{}, &bytes.Buffer{}
+		code := 0
+		impl(append([]string{"--account-db=" + dir, "usage"}, args...), strings.NewReader(""), out, errs, func(c int) { code = c })
+		return out.String() + errs.String(), code
+	}
+	out, code = usage("--account=12345")
+	assert.Equal(0, code, out)
+	assert.Equal("", out)
+	today := time.Now().UTC().Format("2006-01-02")
+	out, code = usage("--account=" + sid)
+	assert.Equal(0, code, out)
+	assert.Equal(fmt.Sprintf("%s %s pulls=1 fullSyncs=1 patchBytes=42 clientViewFetches=0 clientViewFailures=0 clients=1 storedBytes=0\n", sid, today), out)
+	out, code = usage("--json", "--days=1")
+	assert.Equal(0, code, out)
+	assert.Contains(out, `"account": 0,`)
+	assert.Contains(out, `"patchBytes": 42,`)
+	out, code = usage("--account=x")
+	assert.Equal(1, code)
+	assert.Contains(out, "invalid account ID")
+
+	// Verify.
+	assert.NoError(account.Update(db, func(records *account.Records) error {
+		r := records.Record[id]
+		_, r.Verification, err = account.NewVerification(time.Now())
+		records.Record[id] = r
+		return err
+	}))
+	out, _, code = run("", "list")
+	assert.Equal(0, code)
+	assert.Contains(out, " (unverified)")
+	out, _, code = run("", "verify", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Verified:   true\n")
+
+	// Signing secret.
+	out, _, code = run("", "signing-secret", sid)
+	assert.Equal(0, code)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	secret := records.Record[id].SigningSecret
+	assert.True(strings.HasPrefix(secret, "rss_"))
+	assert.Contains(out, "Signing secret: "+secret+"\n")
+	out, _, code = run("", "show", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Signed:     true\n")
+	assert.NotContains(out, secret)
+	hash := records.Record[id].Keys[0].Hash
+	for _, args := range [][]string{{"show", sid}, {"list"}, {"https-only", sid}} {
+		out, _, code = run("", append([]string{"--json"}, args...)...)
+		assert.Equal(0, code, args)
+		assert.Contains(out, `"ID": `+sid, args)
+		assert.NotContains(out, secret, args)
+		assert.NotContains(out, hash, args)
+	}
+	out, _, code = run("", "signing-secret", sid, "--remove")
+	assert.Equal(0, code)
+	assert.Contains(out, "Signed:     false\n")
+	_, errOut, code = run("", "signing-secret", "0")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "regular account")
+
+	// Keys.
+	out, _, code = run("", "add-key", sid, "ci")
+	assert.Equal(0, code)
+	key := strings.TrimSpace(strings.TrimPrefix(strings.Split(out, "\n")[1], "Key:"))
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	_, found = account.Lookup(records, key, false)
+	assert.True(found)
+	_, errOut, code = run("", "add-key", sid, "ci")
+	assert.Equal(1, code)
+	assert.Contains(errOut, `already has a key named "ci"`)
+	out, _, code = run("", "revoke-key", sid, "ci")
+	assert.Equal(0, code)
+	assert.Regexp(`Key: +ci \(created .+, revoked .+\)`, out)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	_, found = account.Lookup(records, key, false)
+	assert.False(found)
+	_, found = account.Lookup(records, created.Key, false)
+	assert.True(found)
+	_, errOut, code = run("", "revoke-key", sid, "ci")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "already revoked")
+	out, _, code = run("", "--json", "add-key", "0", "ci")
+	assert.Equal(0, code)
+	var regularKey struct{ Name, Hash, Key string }
+	assert.NoError(json.Unmarshal([]byte(out), &regularKey))
+	assert.Equal("ci", regularKey.Name)
+	assert.True(account.ValidKeyHash(regularKey.Hash))
+	assert.True(strings.HasPrefix(regularKey.Key, "rk_0_"))
+	_, errOut, code = run("", "revoke-key", "0", "ci")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "regular account")
+
+	// TLS.
+	out, _, code = run("", "set-tls", sid, "--min-version=1.3")
+	assert.Equal(0, code)
+	assert.Contains(out, "TLS:        minimum version 1.3\n")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NoError(ioutil.WriteFile(keyFile, []byte("key"), 0600))
+	_, errOut, code = run("", "set-tls", sid, "--client-key="+keyFile)
+	assert.Equal(1, code)
+	assert.Contains(errOut, "client certificate and key must be given together")
+	out, _, code = run("", "set-tls", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "TLS:        default\n")
+
+	// Schemas.
+	schemaFile := filepath.Join(dir, "schema.json")
+	assert.NoError(ioutil.WriteFile(schemaFile, []byte("{\n  \"type\": \"object\"\n}\n"), 0600))
+	out, _, code = run("", "set-schema", sid, "todo/", schemaFile)
+	assert.Equal(0, code)
+	assert.Contains(out, `Schema:     "todo/" {"type":"object"}`+"\n")
+	assert.NoError(ioutil.WriteFile(schemaFile, []byte(`{"type": "date"}`), 0600))
+	_, errOut, code = run("", "set-schema", sid, "todo/", schemaFile)
+	assert.Equal(1, code)
+	assert.Contains(errOut, `unknown type "date"`)
+	out, _, code = run("", "remove-schema", sid, "todo/")
+	assert.Equal(0, code)
+	assert.NotContains(out, "Schema:")
+	_, errOut, code = run("", "remove-schema", sid, "todo/")
+	assert.Equal(1, code)
+	assert.Contains(errOut, `does not have a schema for prefix "todo/"`)
+
+	// Forwarded headers and cookies.
+	out, _, code = run("", "show", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Forward:    nothing\n")
+	out, _, code = run("", "set-forward", sid, "--header=Accept-Language", "--header=X-App-Version", "--sensitive-cookie=session")
+	assert.Equal(0, code)
+	assert.Contains(out, "Forward:    headers Accept-Language, X-App-Version; cookies session (sensitive)\n")
+	_, errOut, code = run("", "set-forward", sid, "--sensitive-header=Cookie")
+	assert.Equal(1, code)
+	assert.Contains(errOut, "header Cookie is set by the server")
+	out, _, code = run("", "set-forward", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Forward:    nothing\n")
+
+	// Suspend and reactivate. disable is an alias of suspend.
+	for _, cmd := range []string{"suspend", "disable"} {
+		out, _, code = run("", cmd, sid, "--reason=abuse")
+		assert.Equal(0, code)
+		assert.Contains(out, "Status:     suspended since ")
+		records, err = account.ReadAllRecords(db)
+		assert.NoError(err)
+		assert.Equal(account.Status{State: account.StateSuspended, Reason: "abuse", Date: records.Record[id].Status.Date}, records.Record[id].Status)
+		_, err = account.Authenticate(records, created.Key, false)
+		assert.Equal(fmt.Sprintf("account %d is suspended: abuse", id), err.Error())
+		out, _, code = run("", "list")
+		assert.Equal(0, code)
+		assert.Contains(out, " (suspended)")
+		out, _, code = run("", "activate", sid)
+		assert.Equal(0, code)
+		assert.Contains(out, "Status:     active since ")
+	}
+
+	dataDir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dataDir)) }()
+	svc := servepkg.NewService(dataDir, account.MaxASClientViewHosts, db, false, nil, false)
+	_, err = svc.GetDB(sid, "c1")
+	assert.NoError(err)
+	withDB := func(in string, args ...string) (string, string, int) {
+		out, errs := &bytes.Buffer{}, &bytes.Buffer{}
+		code := 0
+		impl(append([]string{"--db=" + dataDir, "--account-db=" + dir, "account"}, args...), strings.NewReader(in), out, errs, func(c int) { code = c })
+		return out.String(), errs.String(), code
+	}
+
+	// Move storage and back.
+	otherDir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(otherDir)) }()
+	_, errOut, code = run("", "move-storage", sid, otherDir)
+	assert.Equal(1, code)
+	assert.Contains(errOut, "--db")
+	out, _, code = withDB("", "move-storage", sid, otherDir)
+	assert.Equal(0, code)
+	assert.Contains(out, "Copied 1 datasets\n")
+	assert.Contains(out, "Storage:    "+otherDir+"\n")
+	_, errOut, code = withDB("", "move-storage", sid, otherDir)
+	assert.Equal(1, code)
+	assert.Contains(errOut, "already stored in")
+	out, _, code = withDB("", "move-storage", sid)
+	assert.Equal(0, code)
+	assert.Contains(out, "Storage:    default\n")
+	out, _, code = withDB("", "move-storage", "0", otherDir)
+	assert.Equal(0, code)
+	assert.Contains(out, "regular accounts file")
+
+	// Delete needs --db, and confirmation.
+	del := func(in string, args ...string) (string, string, int) {
+		return withDB(in, append([]string{"delete"}, args...)...)
+	}
+	_, errOut, code = run("y\n", "delete", sid)
+	assert.Equal(1, code)
+	assert.Contains(errOut, "--db")
+	_, _, code = del("n\n", sid)
+	assert.Equal(0, code)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.True(account.Active(records.Record[id]))
+	out, _, code = del("y\n", sid, "--reason=churned")
+	assert.Equal(0, code)
+	assert.Contains(out, fmt.Sprintf("Deleted account %d and removed 1 clients\n", id))
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(account.StateDeleted, records.Record[id].Status.State)
+	assert.Equal("churned", records.Record[id].Status.Reason)
+	assert.Equal(id+1, records.NextASID)
+	ids, err := svc.ClientIDs(sid)
+	assert.NoError(err)
+	assert.Equal([]string{}, ids)
+	_, errOut, code = run("", "activate", sid)
+	assert.Equal(1, code)
+	assert.Contains(errOut, "is deleted")
+}
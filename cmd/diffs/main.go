@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -9,6 +10,8 @@ import (
 	"os/signal"
 	"runtime/pprof"
 	"runtime/trace"
+	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,6 +23,7 @@ import (
 
 	"roci.dev/diff-server/account"
 	servepkg "roci.dev/diff-server/serve"
+	"roci.dev/diff-server/serve/admin"
 	"roci.dev/diff-server/serve/signup"
 	"roci.dev/diff-server/util/log"
 	"roci.dev/diff-server/util/version"
@@ -27,6 +31,9 @@ import (
 
 const (
 	dropWarning = "This command deletes an entire database and its history. This operations is not recoverable. Proceed? y/n\n"
+	// serverWriteTimeout limits how long diffs serve may take to answer a
+	// request, including fetching client views.
+	serverWriteTimeout = 10 * time.Second
 )
 
 type opt struct {
@@ -48,7 +55,7 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	app.Terminate(exit)
 
 	v := app.Flag("version", "Prints the version of diffs - same as the 'version' command.").Short('v').Bool()
-	sps := app.Flag("db", "The prefix to use for databases managed. Both local and remote databases are supported. For local databases, specify a directory path to store the database in. For remote databases, specify the http(s) URL to the database (usually https://serve.replicate.to/<mydb>).").PlaceHolder("/path/to/db").Required().String()
+	sps := app.Flag("db", "The prefix to use for databases managed. Both local and remote databases are supported. For local databases, specify a directory path to store the database in. For remote databases, specify the http(s) URL to the database (usually https://serve.replicate.to/<mydb>).").PlaceHolder("/path/to/db").String()
 	ads := app.Flag("account-db", "Prefix for the account database. Both local and remote databases are supported. For local databases, this is a directory path.").PlaceHolder("/path/to/db").Required().String()
 	tf := app.Flag("trace", "Name of a file to write a trace to").OpenFile(os.O_RDWR|os.O_CREATE, 0644)
 	cpu := app.Flag("cpu", "Name of file to write CPU profile to").OpenFile(os.O_RDWR|os.O_CREATE, 0644)
@@ -74,6 +81,7 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 	}
 	defer stopTrace()
 	defer stopCPUProfile()
+	atExit := &exitHooks{}
 
 	app.Action(func(pc *kingpin.ParseContext) error {
 		if pc.SelectedCommand == nil {
@@ -96,6 +104,7 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		go func() {
 			<-c
+			atExit.run()
 			stopTrace()
 			stopCPUProfile()
 			os.Exit(1)
@@ -104,7 +113,9 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 		return nil
 	})
 
-	serve(app, sps, ads, errs, l)
+	serve(app, sps, ads, errs, atExit, l)
+	accountCmd(app, sps, ads, in, out)
+	usageCmd(app, ads, out)
 
 	if len(args) == 0 {
 		app.Usage(args)
@@ -120,12 +131,64 @@ func impl(args []string, in io.Reader, out, errs io.Writer, exit func(int)) {
 
 type gsp func() (spec.Spec, error)
 
-func serve(parent *kingpin.Application, sps *string, ads *string, errs io.Writer, l zl.Logger) {
+// exitHooks are run, most recently added first, when diffs is stopped by
+// SIGINT or SIGTERM, which exits without running deferred calls.
+type exitHooks struct {
+	mu    sync.Mutex
+	hooks []func()
+}
+
+func (h *exitHooks) add(f func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, f)
+}
+
+func (h *exitHooks) run() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.hooks) - 1; i >= 0; i-- {
+		h.hooks[i]()
+	}
+}
+
+func serve(parent *kingpin.Application, sps *string, ads *string, errs io.Writer, atExit *exitHooks, l zl.Logger) {
 	kc := parent.Command("serve", "Starts a local diff-server.")
 	port := kc.Flag("port", "The port to run on").Default("7001").Int()
-	enableInject := kc.Flag("enable-inject", "Enable /inject endpoint which writes directly to the database for testing").Default("false").Bool()
+	enableInject := kc.Flag("enable-inject", "Accept unsigned /inject requests, which write directly to the database, for testing").Default("false").Bool()
+	devClientViewSources := kc.Flag("dev-client-view-sources", "Enable file:// and exec:// client view URLs, which read files and run commands on the server, for local development. Never enable in production.").Default("false").Bool()
 	disableAuth := parent.Flag("disable-auth", "Disable auth check in pull").Default("false").Bool()
+	allowAccountIDAuth := kc.Flag("allow-account-id-auth", "Accept a bare account ID (or \"sandbox\") instead of a key in the Authorization header, for accounts that don't have any keys yet").Default("false").Bool()
+	compressionLevel := kc.Flag("compression-level", "How hard to compress pull responses (zstd, br or gzip, as negotiated with the client)").Default("default").Enum("fastest", "default", "best")
+	compressionMinSize := kc.Flag("compression-min-size", "Pull responses smaller than this many bytes are sent uncompressed").Default(strconv.Itoa(servepkg.DefaultCompressionConfig.MinSize)).Int()
+	regularAccounts := kc.Flag("regular-accounts", "JSON or YAML file to load regular accounts from instead of the built-in list. It is reloaded when it changes or on SIGHUP.").PlaceHolder("/path/to/accounts.yaml").String()
+	regularAccountsInterval := kc.Flag("regular-accounts-poll-interval", "How often to check the regular accounts file for changes").Default("10s").Duration()
+	accountRefresh := kc.Flag("account-refresh-interval", "How often pull reloads account records to pick up changes made by other processes").Default(account.DefaultRefreshInterval.String()).Duration()
+	usageFlush := kc.Flag("usage-flush-interval", "How often metered usage is written to the account DB").Default(account.DefaultUsageFlushInterval.String()).Duration()
+	smtpAddr := kc.Flag("smtp-addr", "SMTP server (host:port) to send signup verification email through. If empty, email is written to --mail-file or logged.").String()
+	smtpUsername := kc.Flag("smtp-username", "SMTP username").String()
+	smtpPassword := kc.Flag("smtp-password", "SMTP password").Envar("DIFFS_SMTP_PASSWORD").String()
+	mailFrom := kc.Flag("mail-from", "Sender of signup verification email").Default("Replicache <support@replicache.dev>").String()
+	mailFile := kc.Flag("mail-file", "File to append signup verification email to instead of sending it, for local use").PlaceHolder("/path/to/mail.txt").String()
+	cvConnectTimeout := kc.Flag("client-view-connect-timeout", "How long connecting to the data layer to fetch a client view may take").Default(servepkg.DefaultClientViewGetterConfig.ConnectTimeout.String()).Duration()
+	cvTimeout := kc.Flag("client-view-timeout", "How long each attempt to fetch a client view may take, including reading the response").Default(servepkg.DefaultClientViewGetterConfig.ResponseTimeout.String()).Duration()
+	cvTotalTimeout := kc.Flag("client-view-total-timeout", "How long fetching a client view may take including retries; must be less than the server's write timeout").Default(servepkg.DefaultClientViewGetterConfig.TotalTimeout.String()).Duration()
+	cvRetries := kc.Flag("client-view-retries", "How many times client view fetches are retried after network errors or 5xx responses").Default(strconv.Itoa(servepkg.DefaultClientViewGetterConfig.Retries)).Int()
+	cvRetryBackoff := kc.Flag("client-view-retry-backoff", "Base delay before retrying a client view fetch; it doubles with each retry and is jittered").Default(servepkg.DefaultClientViewGetterConfig.RetryBackoff.String()).Duration()
+	cvMaxBytes := kc.Flag("client-view-max-bytes", "Client view responses larger than this are rejected").Default(strconv.FormatInt(servepkg.DefaultClientViewGetterConfig.MaxBodyBytes, 10)).Int64()
+	cvMaxKeys := kc.Flag("client-view-max-keys", "Client views with more keys than this are rejected").Default(strconv.FormatInt(servepkg.DefaultClientViewGetterConfig.MaxKeys, 10)).Int64()
+	cvMaxValueBytes := kc.Flag("client-view-max-value-bytes", "Client views with a value larger than this are rejected").Default(strconv.FormatInt(servepkg.DefaultClientViewGetterConfig.MaxValueBytes, 10)).Int64()
+	maxPullBytes := kc.Flag("max-pull-bytes", "Pull request bodies larger than this are rejected. Zero disables the limit.").Default(strconv.FormatInt(servepkg.DefaultMaxPullBytes, 10)).Int64()
+	breakerThreshold := kc.Flag("client-view-breaker-threshold", "Consecutive failed client view fetches from a host for an account after which its pulls stop fetching from the host and serve the data they have. Zero disables the circuit breaker.").Default(strconv.Itoa(servepkg.DefaultBreakerConfig.Threshold)).Int()
+	breakerCooldown := kc.Flag("client-view-breaker-cooldown", "How long to wait before probing a client view host whose circuit breaker has opened").Default(servepkg.DefaultBreakerConfig.Cooldown.String()).Duration()
+	adminToken := kc.Flag("admin-token", "Bearer token for the /admin API. The admin API is disabled if empty.").Envar("DIFFS_ADMIN_TOKEN").String()
 	kc.Action(func(_ *kingpin.ParseContext) error {
+		if *sps == "" {
+			return errors.New("required flag --db not provided")
+		}
+		if *cvTotalTimeout <= 0 || *cvTotalTimeout >= serverWriteTimeout {
+			return fmt.Errorf("--client-view-total-timeout must be greater than zero and less than the server's write timeout of %s", serverWriteTimeout)
+		}
 		l.Info().Msgf("Listening on %d...", *port)
 
 		// Set up diffserver service (pull, inject, etc).
@@ -137,21 +200,75 @@ func serve(parent *kingpin.Application, sps *string, ads *string, errs io.Writer
 		if err != nil {
 			panic(err)
 		}
+		if *regularAccounts != "" {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			stop, err := account.WatchRegularAccounts(accountDB, *regularAccounts, *regularAccountsInterval, hup, l)
+			if err != nil {
+				return err
+			}
+			defer stop()
+		}
 
-		svc := servepkg.NewService(*sps, account.MaxASClientViewHosts, accountDB, *disableAuth, servepkg.ClientViewGetter{}, *enableInject)
+		level, err := servepkg.ParseCompressionLevel(*compressionLevel)
+		if err != nil {
+			return err
+		}
+		compression := servepkg.WithCompression(servepkg.CompressionConfig{Level: level, MinSize: *compressionMinSize})
+		meter := account.NewMeter(accountDB, *usageFlush, l)
+		flushUsage := func() {
+			if err := meter.Flush(); err != nil {
+				l.Info().Err(err).Msg("Could not write usage")
+			}
+		}
+		defer flushUsage()
+		atExit.add(flushUsage)
+		cvConfig := servepkg.ClientViewGetterConfig{
+			ConnectTimeout:  *cvConnectTimeout,
+			ResponseTimeout: *cvTimeout,
+			TotalTimeout:    *cvTotalTimeout,
+			Retries:         *cvRetries,
+			RetryBackoff:    *cvRetryBackoff,
+			MaxBodyBytes:    *cvMaxBytes,
+			MaxKeys:         *cvMaxKeys,
+			MaxValueBytes:   *cvMaxValueBytes,
+		}
+		cvg := servepkg.NewClientViewGetter(cvConfig)
+		opts := []servepkg.Option{compression, servepkg.WithAccountIDAuth(*allowAccountIDAuth), servepkg.WithAccountRefreshInterval(*accountRefresh), servepkg.WithMeter(meter),
+			servepkg.WithClientViewBreaker(servepkg.BreakerConfig{Threshold: *breakerThreshold, Cooldown: *breakerCooldown}), servepkg.WithMaxPullBytes(*maxPullBytes)}
+		if *devClientViewSources {
+			l.Warn().Msg("file:// and exec:// client view URLs are enabled (--dev-client-view-sources): clients can read files and run commands on this server")
+			opts = append(opts,
+				servepkg.WithClientViewSource("file", servepkg.NewFileClientViewSource(cvConfig)),
+				servepkg.WithClientViewSource("exec", servepkg.NewExecClientViewSource(cvConfig)))
+		}
+		svc := servepkg.NewService(*sps, account.MaxASClientViewHosts, accountDB, *disableAuth, cvg, *enableInject, opts...)
 		mux := mux.NewRouter()
 		servepkg.RegisterHandlers(svc, mux)
 
 		// Set up signup service.
 		tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
-		service := signup.NewService(l, tmpl, *ads)
+		var mailer signup.Mailer = signup.LogMailer{Logger: l}
+		if *smtpAddr != "" {
+			mailer = signup.NewSMTPMailer(*smtpAddr, *mailFrom, *smtpUsername, *smtpPassword)
+		} else if *mailFile != "" {
+			mailer = &signup.FileMailer{Path: *mailFile}
+		}
+		service := signup.NewService(l, tmpl, *ads, signup.WithMailer(mailer))
 		signup.RegisterHandlers(service, mux)
 
+		// Set up admin service.
+		if *adminToken != "" {
+			l.Info().Msg("Admin API enabled")
+		}
+		adminService := admin.NewService(l, *adminToken, accountDB, svc)
+		admin.RegisterHandlers(adminService, mux)
+
 		server := &http.Server{
 			Addr:         fmt.Sprintf(":%d", *port),
 			Handler:      mux,
 			ReadTimeout:  10 * time.Second,
-			WriteTimeout: 10 * time.Second,
+			WriteTimeout: serverWriteTimeout,
 		}
 		return server.ListenAndServe()
 	})
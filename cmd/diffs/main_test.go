@@ -66,7 +66,7 @@ func TestServe(t *testing.T) {
 	}{
 		{"pull",
 			fmt.Sprintf(`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "clientID": "clientid", "clientViewURL": "%s", "version": 3}`, cvServer.URL),
-			fmt.Sprintf("%d", account.UnittestID),
+			account.UnittestKey,
 			`{"stateID":"r0d74qu25vi4dr8fmf58oike0cj4jpth","lastMutationID":0,"patch":[{"op":"replace","path":"","valueString":"{}"}],"checksum":"00000000","clientViewInfo":{"httpStatusCode":200,"errorMessage":""}}`,
 			""},
 	}
@@ -100,3 +100,13 @@ func TestEmptyInput(t *testing.T) {
 	args = []string{"--db=/tmp/foo"}
 	impl(args, strings.NewReader(""), ioutil.Discard, ioutil.Discard, func(_ int) {})
 }
+
+func TestExitHooks(t *testing.T) {
+	assert := assert.New(t)
+	var ran []int
+	h := &exitHooks{}
+	h.add(func() { ran = append(ran, 1) })
+	h.add(func() { ran = append(ran, 2) })
+	h.run()
+	assert.Equal([]int{2, 1}, ran)
+}
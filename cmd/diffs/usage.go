@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	kingpin "gopkg.in/alecthomas/kingpin.v2"
+
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/tbl"
+	"roci.dev/diff-server/util/time"
+)
+
+// accountUsage is the JSON output of the usage command.
+type accountUsage struct {
+	Account uint32               `json:"account"`
+	Usage   []account.DailyUsage `json:"usage"`
+}
+
+// usageCmd registers the usage command, which reports the usage metered by
+// diffs serve in the account DB given by --account-db.
+func usageCmd(parent *kingpin.Application, ads *string, out io.Writer) {
+	kc := parent.Command("usage", "Reports daily usage per account.")
+	only := kc.Flag("account", "Only report this account").PlaceHolder("ID").String()
+	days := kc.Flag("days", "Number of days to report, including today").Default("30").Int()
+	asJSON := kc.Flag("json", "Print output as JSON instead of a table").Bool()
+	kc.Action(func(_ *kingpin.ParseContext) error {
+		if *days < 1 {
+			return fmt.Errorf("--days must be positive")
+		}
+		var id uint64
+		if *only != "" {
+			var err error
+			if id, err = strconv.ParseUint(*only, 10, 32); err != nil {
+				return fmt.Errorf("invalid account ID %q", *only)
+			}
+		}
+		db, err := account.NewDB(*ads)
+		if err != nil {
+			return err
+		}
+		usage, err := account.ReadUsage(db, time.Now().UTC().AddDate(0, 0, 1-*days))
+		if err != nil {
+			return err
+		}
+		l := []accountUsage{}
+		for aid, u := range usage {
+			if *only == "" || uint64(aid) == id {
+				l = append(l, accountUsage{aid, u})
+			}
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i].Account < l[j].Account })
+		if *asJSON {
+			return printJSON(out, l)
+		}
+		t := &tbl.Table{}
+		for _, a := range l {
+			for _, d := range a.Usage {
+				t.Add(fmt.Sprintf("%d %s ", a.Account, d.Day), fmt.Sprintf("pulls=%d fullSyncs=%d patchBytes=%d clientViewFetches=%d clientViewFailures=%d clients=%d storedBytes=%d",
+					d.Pulls, d.FullSyncs, d.PatchBytes, d.ClientViewFetches, d.ClientViewFailures, d.ActiveClients, d.StoredBytes))
+			}
+		}
+		_, err = t.WriteTo(out)
+		return err
+	})
+}
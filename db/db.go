@@ -113,9 +113,15 @@ func Read(noms types.ValueReadWriter, hash hash.Hash) (Commit, error) {
 	return c, err
 }
 
+// ErrHeadChanged is returned by MaybePutData if the dataset's head was moved
+// by someone else since db last read it.
+var ErrHeadChanged = errors.New("head changed concurrently")
+
 // MaybePutData creates a new commit with the given map and lastMutationID if
 // they are different from what is currently at head. It returns the new Commit
 // if written or a zero value Commit if not (commit.NomsStruct.IsZeroValue() will be true).
+// The new commit is based on db's head, so if another writer has moved the
+// dataset's head since, nothing is written and ErrHeadChanged is returned.
 func (db *DB) MaybePutData(m kv.Map, lastMutationID uint64) (Commit, error) {
 	defer db.lock()()
 
@@ -131,6 +137,9 @@ func (db *DB) MaybePutData(m kv.Map, lastMutationID uint64) (Commit, error) {
 	commit := makeCommit(db.Noms(), basis, time.DateTime(), db.Noms().WriteValue(m.NomsMap()), m.NomsChecksum(), lastMutationID)
 	db.Noms().WriteValue(commit.NomsStruct)
 	if err := db.setHeadLocked(commit); err != nil {
+		if err == datas.ErrMergeNeeded {
+			return Commit{}, ErrHeadChanged
+		}
 		return Commit{}, err
 	}
 	return commit, nil
@@ -75,4 +75,29 @@ func TestMaybePutData(t *testing.T) {
 	assert.True(c2.NomsStruct.Equals(db.Head().NomsStruct))
 }
 
+func TestMaybePutDataHeadChanged(t *testing.T) {
+	assert := assert.New(t)
+	db, dir := LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	other, err := New(db.Noms().GetDataset(db.ds.ID()))
+	assert.NoError(err)
+
+	me := kv.NewMap(db.Noms()).Edit()
+	assert.NoError(me.Set("key", types.Bool(true)))
+	m := me.Build()
+	c1, err := other.MaybePutData(m, 1)
+	assert.NoError(err)
+
+	// db's head is now stale.
+	c2, err := db.MaybePutData(m, 2)
+	assert.Equal(ErrHeadChanged, err)
+	assert.True(c2.NomsStruct.IsZeroValue())
+
+	assert.NoError(db.Reload())
+	assert.True(c1.NomsStruct.Equals(db.Head().NomsStruct))
+	c2, err = db.MaybePutData(m, 2)
+	assert.NoError(err)
+	assert.True(c2.NomsStruct.Equals(db.Head().NomsStruct))
+}
+
 // hmmm.. we seem to have removed most tests.
@@ -38,6 +38,11 @@ type Operation struct {
 	ValueString string          `json:"valueString,omitempty"`
 }
 
+// Key returns the key op's path refers to.
+func (op Operation) Key() string {
+	return jsonPointerUnescape(strings.TrimPrefix(op.Path, "/"))
+}
+
 func jsonPointerEscape(s string) string {
 	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
 }
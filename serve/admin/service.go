@@ -0,0 +1,659 @@
+// Package admin implements an authenticated HTTP API for operating the
+// diff-server: managing accounts, their client view URL patterns, and listing their
+// clients and usage.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	zl "github.com/rs/zerolog"
+
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/time"
+)
+
+// PathPrefix is the URL path under which the admin API is served.
+const PathPrefix = "/admin"
+
+// ClientStore lists and deletes the clients of an account. It is
+// implemented by serve.Service.
+type ClientStore interface {
+	ClientIDs(accountID string) ([]string, error)
+	DeleteClients(accountID string) (int, error)
+}
+
+// Service is an instance of the admin service.
+type Service struct {
+	logger    zl.Logger
+	token     string
+	accountDB *account.DB
+	clients   ClientStore
+}
+
+// NewService instantiates the admin service. Requests must carry token as a
+// bearer token. Handlers need to be registered with RegisterHandlers.
+func NewService(logger zl.Logger, token string, accountDB *account.DB, clients ClientStore) *Service {
+	return &Service{logger, token, accountDB, clients}
+}
+
+// RegisterHandlers registers Service's handlers on the given router. Nothing
+// is registered if the service has no token, so that the admin API can't be
+// enabled by accident without auth.
+func RegisterHandlers(s *Service, router *mux.Router) {
+	if s.token == "" {
+		return
+	}
+	r := router.PathPrefix(PathPrefix).Subrouter()
+	r.Use(s.authenticate)
+	r.HandleFunc("/accounts", s.listAccounts).Methods("GET")
+	r.HandleFunc("/accounts", s.createAccount).Methods("POST")
+	r.HandleFunc("/accounts/{id:[0-9]+}", s.getAccount).Methods("GET")
+	r.HandleFunc("/accounts/{id:[0-9]+}", s.updateAccount).Methods("PATCH")
+	r.HandleFunc("/accounts/{id:[0-9]+}", s.deleteAccount).Methods("DELETE")
+	r.HandleFunc("/accounts/{id:[0-9]+}/patterns", s.listPatterns).Methods("GET")
+	r.HandleFunc("/accounts/{id:[0-9]+}/patterns", s.addPattern).Methods("POST")
+	r.HandleFunc("/accounts/{id:[0-9]+}/patterns", s.removePattern).Methods("DELETE").Queries("pattern", "{pattern}")
+	r.HandleFunc("/accounts/{id:[0-9]+}/signing-secret", s.rotateSigningSecret).Methods("POST")
+	r.HandleFunc("/accounts/{id:[0-9]+}/signing-secret", s.removeSigningSecret).Methods("DELETE")
+	r.HandleFunc("/accounts/{id:[0-9]+}/keys", s.addKey).Methods("POST")
+	r.HandleFunc("/accounts/{id:[0-9]+}/keys/{name}", s.revokeKey).Methods("DELETE")
+	r.HandleFunc("/accounts/{id:[0-9]+}/clients", s.listClients).Methods("GET")
+	r.HandleFunc("/accounts/{id:[0-9]+}/usage", s.getUsage).Methods("GET")
+}
+
+// authenticate is middleware that rejects requests without the admin token.
+func (s *Service) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const bearer = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, bearer) || subtle.ConstantTimeCompare([]byte(auth[len(bearer):]), []byte(s.token)) != 1 {
+			clientError(w, http.StatusUnauthorized, "Unauthorized", s.logger)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AccountRequest is the body of account create and update requests. In
+// updates nil fields are left unchanged. Limits replaces all of the
+// account's limits; omitted limits take the default. TLS likewise replaces
+// all of the account's TLS settings, Schemas all of its schemas and Forward
+// all of the headers and cookies it forwards.
+type AccountRequest struct {
+	Name      *string              `json:"name"`
+	Email     *string              `json:"email"`
+	HTTPSOnly *bool                `json:"httpsOnly"`
+	Status    *StatusRequest       `json:"status"`
+	Limits    *account.Limits      `json:"limits"`
+	TLS       *account.TLS         `json:"tls"`
+	Schemas   *[]account.KeySchema `json:"schemas"`
+	Forward   *account.Forward     `json:"forward"`
+}
+
+// validate returns an error if req has invalid TLS settings, schemas or
+// forwarded headers.
+func (req AccountRequest) validate() error {
+	if req.TLS != nil {
+		if _, err := req.TLS.Config(); err != nil {
+			return fmt.Errorf("invalid tls: %w", err)
+		}
+	}
+	if req.Schemas != nil {
+		if err := account.ValidateSchemas(*req.Schemas); err != nil {
+			return fmt.Errorf("invalid schemas: %w", err)
+		}
+	}
+	if req.Forward != nil {
+		if err := req.Forward.Validate(); err != nil {
+			return fmt.Errorf("invalid forward: %w", err)
+		}
+	}
+	return nil
+}
+
+// StatusRequest changes the status of an account, eg
+// {"state": "suspended", "reason": "abuse"}. Accounts can't be deleted this
+// way: use DELETE, which also removes their client data.
+type StatusRequest struct {
+	State  string `json:"state"`
+	Reason string `json:"reason"`
+}
+
+// status returns the account Status req asks for.
+func (req StatusRequest) status() (account.Status, error) {
+	if req.State == account.StateDeleted {
+		return account.Status{}, errors.New("accounts are deleted with DELETE")
+	}
+	return account.NewStatus(req.State, req.Reason, time.Now())
+}
+
+// DeleteAccountResponse is returned when an account is deleted.
+type DeleteAccountResponse struct {
+	Account        account.Record `json:"account"`
+	DeletedClients int            `json:"deletedClients"`
+}
+
+// PatternRequest is the body of requests that add a client view URL
+// pattern, eg {"pattern": "https://example.com/replicache/"}.
+type PatternRequest struct {
+	Pattern account.URLPattern `json:"pattern"`
+}
+
+// CreateAccountResponse is returned when an account is created. Key is the
+// secret of the account's first key; it is not retrievable later.
+type CreateAccountResponse struct {
+	Account account.Record `json:"account"`
+	Key     string         `json:"key"`
+}
+
+// SigningSecretResponse is returned when an account's signing secret is
+// rotated. SigningSecret is the new secret; it is not retrievable later.
+type SigningSecretResponse struct {
+	Account       account.Record `json:"account"`
+	SigningSecret string         `json:"signingSecret"`
+}
+
+// KeyRequest is the body of requests that add a key to an account, eg
+// {"name": "ci"}. Names must be unique within the account.
+type KeyRequest struct {
+	Name string `json:"name"`
+}
+
+// KeyResponse is returned when a key is added to an account. Key is the new
+// key's secret; it is not retrievable later.
+type KeyResponse struct {
+	Account account.Record `json:"account"`
+	Key     string         `json:"key"`
+}
+
+func (s *Service) listAccounts(w http.ResponseWriter, r *http.Request) {
+	records, err := account.ReadAllRecords(s.accountDB)
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	l := make([]account.Record, 0, len(records.Record))
+	for _, record := range records.Record {
+		l = append(l, account.Redact(record))
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	writeJSON(w, http.StatusOK, l, s.logger)
+}
+
+func (s *Service) getAccount(w http.ResponseWriter, r *http.Request) {
+	record, ok := s.readAccount(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, account.Redact(record), s.logger)
+}
+
+func (s *Service) createAccount(w http.ResponseWriter, r *http.Request) {
+	var req AccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		clientError(w, http.StatusBadRequest, fmt.Sprintf("Bad request payload: %s", err), s.logger)
+		return
+	}
+	if req.Name == nil || *req.Name == "" || req.Email == nil || *req.Email == "" {
+		clientError(w, http.StatusBadRequest, "name and email are required", s.logger)
+		return
+	}
+	var status account.Status
+	if req.Status != nil {
+		var err error
+		if status, err = req.Status.status(); err != nil {
+			clientError(w, http.StatusBadRequest, err.Error(), s.logger)
+			return
+		}
+	}
+	if err := req.validate(); err != nil {
+		clientError(w, http.StatusBadRequest, err.Error(), s.logger)
+		return
+	}
+	var resp CreateAccountResponse
+	err := account.Update(s.accountDB, func(records *account.Records) error {
+		id := records.NextASID
+		secret, key, err := account.NewKey(id, "default")
+		if err != nil {
+			return err
+		}
+		record := account.Record{
+			ID:          id,
+			Name:        *req.Name,
+			Email:       *req.Email,
+			DateCreated: time.Now().String(),
+			Keys:        []account.Key{key},
+			Status:      status,
+		}
+		if req.HTTPSOnly != nil {
+			record.HTTPSOnly = *req.HTTPSOnly
+		}
+		if req.Limits != nil {
+			record.Limits = *req.Limits
+		}
+		if req.TLS != nil {
+			record.TLS = *req.TLS
+		}
+		if req.Schemas != nil {
+			record.Schemas = *req.Schemas
+		}
+		if req.Forward != nil {
+			record.Forward = *req.Forward
+		}
+		records.Record[id] = record
+		records.NextASID++
+		resp = CreateAccountResponse{Account: account.Redact(record), Key: secret}
+		return nil
+	})
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	s.logger.Info().Msgf("Admin created account %d", resp.Account.ID)
+	writeJSON(w, http.StatusCreated, resp, s.logger)
+}
+
+func (s *Service) updateAccount(w http.ResponseWriter, r *http.Request) {
+	var req AccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		clientError(w, http.StatusBadRequest, fmt.Sprintf("Bad request payload: %s", err), s.logger)
+		return
+	}
+	var status account.Status
+	if req.Status != nil {
+		var err error
+		if status, err = req.Status.status(); err != nil {
+			clientError(w, http.StatusBadRequest, err.Error(), s.logger)
+			return
+		}
+	}
+	if err := req.validate(); err != nil {
+		clientError(w, http.StatusBadRequest, err.Error(), s.logger)
+		return
+	}
+	s.updateRecord(w, r, func(record *account.Record) error {
+		if req.Name != nil {
+			record.Name = *req.Name
+		}
+		if req.Email != nil {
+			record.Email = *req.Email
+		}
+		if req.HTTPSOnly != nil {
+			record.HTTPSOnly = *req.HTTPSOnly
+		}
+		if req.Status != nil {
+			record.Status = status
+		}
+		if req.Limits != nil {
+			record.Limits = *req.Limits
+		}
+		if req.TLS != nil {
+			record.TLS = *req.TLS
+		}
+		if req.Schemas != nil {
+			record.Schemas = *req.Schemas
+		}
+		if req.Forward != nil {
+			record.Forward = *req.Forward
+		}
+		return nil
+	})
+}
+
+// deleteAccount marks the account deleted, with ?reason=, and removes its
+// client data. Because that can't be undone the request must confirm it with
+// ?confirm=<id>. Deleting a deleted account removes any client data left
+// over.
+func (s *Service) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.mutableID(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("confirm") != strconv.FormatUint(uint64(id), 10) {
+		clientError(w, http.StatusBadRequest, fmt.Sprintf("Deleting an account removes its client data and cannot be undone; confirm with ?confirm=%d", id), s.logger)
+		return
+	}
+	status, err := account.NewStatus(account.StateDeleted, r.URL.Query().Get("reason"), time.Now())
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	var deleted account.Record
+	err = account.Update(s.accountDB, func(records *account.Records) error {
+		record, exists := records.Record[id]
+		if !exists {
+			return errNotFound
+		}
+		if record.Status.State != account.StateDeleted {
+			record.Status = status
+		}
+		records.Record[id] = record
+		deleted = record
+		return nil
+	})
+	if s.handleUpdateError(w, err, id) {
+		return
+	}
+	// The account is deleted first so that pulls stop writing client data,
+	// though servers that haven't refreshed their records yet might still
+	// write some; deleting again removes it.
+	n, err := s.clients.DeleteClients(strconv.FormatUint(uint64(id), 10))
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	s.logger.Info().Msgf("Admin deleted account %d and %d clients", id, n)
+	writeJSON(w, http.StatusOK, DeleteAccountResponse{account.Redact(deleted), n}, s.logger)
+}
+
+func (s *Service) listPatterns(w http.ResponseWriter, r *http.Request) {
+	record, ok := s.readAccount(w, r)
+	if !ok {
+		return
+	}
+	patterns := record.ClientViewURLPatterns
+	if patterns == nil {
+		patterns = []account.URLPattern{}
+	}
+	writeJSON(w, http.StatusOK, patterns, s.logger)
+}
+
+func (s *Service) addPattern(w http.ResponseWriter, r *http.Request) {
+	var req PatternRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		clientError(w, http.StatusBadRequest, fmt.Sprintf("Bad request payload: %s", err), s.logger)
+		return
+	}
+	s.updateRecord(w, r, func(record *account.Record) error {
+		for _, p := range record.ClientViewURLPatterns {
+			if p == req.Pattern {
+				return nil
+			}
+		}
+		record.ClientViewURLPatterns = append(record.ClientViewURLPatterns, req.Pattern)
+		return nil
+	})
+}
+
+func (s *Service) removePattern(w http.ResponseWriter, r *http.Request) {
+	pattern, err := account.ParseURLPattern(mux.Vars(r)["pattern"])
+	if err != nil {
+		clientError(w, http.StatusBadRequest, err.Error(), s.logger)
+		return
+	}
+	s.updateRecord(w, r, func(record *account.Record) error {
+		patterns := make([]account.URLPattern, 0, len(record.ClientViewURLPatterns))
+		for _, p := range record.ClientViewURLPatterns {
+			if p != pattern {
+				patterns = append(patterns, p)
+			}
+		}
+		record.ClientViewURLPatterns = patterns
+		return nil
+	})
+}
+
+func (s *Service) rotateSigningSecret(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.mutableID(w, r)
+	if !ok {
+		return
+	}
+	secret, err := account.NewSigningSecret()
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	var updated account.Record
+	err = account.Update(s.accountDB, func(records *account.Records) error {
+		record, exists := records.Record[id]
+		if !exists {
+			return errNotFound
+		}
+		record.SigningSecret = secret
+		records.Record[id] = record
+		updated = record
+		return nil
+	})
+	if s.handleUpdateError(w, err, id) {
+		return
+	}
+	writeJSON(w, http.StatusOK, SigningSecretResponse{Account: account.Redact(updated), SigningSecret: secret}, s.logger)
+}
+
+func (s *Service) removeSigningSecret(w http.ResponseWriter, r *http.Request) {
+	s.updateRecord(w, r, func(record *account.Record) error {
+		record.SigningSecret = ""
+		return nil
+	})
+}
+
+func (s *Service) addKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.mutableID(w, r)
+	if !ok {
+		return
+	}
+	var req KeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		clientError(w, http.StatusBadRequest, fmt.Sprintf("Bad request payload: %s", err), s.logger)
+		return
+	}
+	if req.Name == "" {
+		clientError(w, http.StatusBadRequest, "name is required", s.logger)
+		return
+	}
+	var updated account.Record
+	var secret string
+	err := account.Update(s.accountDB, func(records *account.Records) error {
+		record, exists := records.Record[id]
+		if !exists {
+			return errNotFound
+		}
+		if hasKey(record, req.Name) {
+			return requestError{http.StatusConflict, fmt.Sprintf("Account %d already has a key named %q", id, req.Name)}
+		}
+		var err error
+		if secret, err = account.AddKey(&record, req.Name); err != nil {
+			return err
+		}
+		records.Record[id] = record
+		updated = record
+		return nil
+	})
+	if s.handleUpdateError(w, err, id) {
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyResponse{Account: account.Redact(updated), Key: secret}, s.logger)
+}
+
+func (s *Service) revokeKey(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	s.updateRecord(w, r, func(record *account.Record) error {
+		if !hasKey(*record, name) {
+			return requestError{http.StatusNotFound, fmt.Sprintf("Account %d has no key named %q", record.ID, name)}
+		}
+		if err := account.RevokeKey(record, name); err != nil {
+			return requestError{http.StatusConflict, err.Error()}
+		}
+		return nil
+	})
+}
+
+// hasKey returns true if record has a key named name, revoked or not.
+func hasKey(record account.Record, name string) bool {
+	for _, k := range record.Keys {
+		if k.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Service) listClients(w http.ResponseWriter, r *http.Request) {
+	record, ok := s.readAccount(w, r)
+	if !ok {
+		return
+	}
+	ids, err := s.clients.ClientIDs(strconv.FormatUint(uint64(record.ID), 10))
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	writeJSON(w, http.StatusOK, ids, s.logger)
+}
+
+// DefaultUsageDays is the number of days of usage returned if the request
+// doesn't say.
+const DefaultUsageDays = 30
+
+// getUsage returns the account's daily usage for the last ?days=N days
+// (including today), oldest first. Days without usage are omitted.
+func (s *Service) getUsage(w http.ResponseWriter, r *http.Request) {
+	record, ok := s.readAccount(w, r)
+	if !ok {
+		return
+	}
+	days := DefaultUsageDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			clientError(w, http.StatusBadRequest, "days must be a positive integer", s.logger)
+			return
+		}
+		days = n
+	}
+	usage, err := account.ReadUsage(s.accountDB, time.Now().UTC().AddDate(0, 0, 1-days))
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	u := usage[record.ID]
+	if u == nil {
+		u = []account.DailyUsage{}
+	}
+	writeJSON(w, http.StatusOK, u, s.logger)
+}
+
+// readAccount reads the record named by the request's id variable. If it
+// returns false it has already written an error response.
+func (s *Service) readAccount(w http.ResponseWriter, r *http.Request) (account.Record, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		clientError(w, http.StatusBadRequest, "Invalid account ID", s.logger)
+		return account.Record{}, false
+	}
+	records, err := account.ReadAllRecords(s.accountDB)
+	if err != nil {
+		serverError(w, err, s.logger)
+		return account.Record{}, false
+	}
+	record, ok := records.Record[uint32(id)]
+	if !ok {
+		clientError(w, http.StatusNotFound, fmt.Sprintf("No such account: %d", id), s.logger)
+		return account.Record{}, false
+	}
+	return record, true
+}
+
+// mutableID returns the ID of the account named by the request if it can be
+// changed through the API. Regular accounts are overlaid from the regular
+// accounts file (or account.RegularAccounts) so changes to them in the DB
+// would have no effect.
+func (s *Service) mutableID(w http.ResponseWriter, r *http.Request) (uint32, bool) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		clientError(w, http.StatusBadRequest, "Invalid account ID", s.logger)
+		return 0, false
+	}
+	if uint32(id) < account.LowestASID {
+		clientError(w, http.StatusConflict, fmt.Sprintf("Account %d is a regular account and cannot be changed here", id), s.logger)
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// updateRecord applies f to the account named by the request and responds
+// with the updated record.
+func (s *Service) updateRecord(w http.ResponseWriter, r *http.Request, f func(record *account.Record) error) {
+	id, ok := s.mutableID(w, r)
+	if !ok {
+		return
+	}
+	var updated account.Record
+	err := account.Update(s.accountDB, func(records *account.Records) error {
+		record, exists := records.Record[id]
+		if !exists {
+			return errNotFound
+		}
+		if err := f(&record); err != nil {
+			return err
+		}
+		records.Record[id] = record
+		updated = record
+		return nil
+	})
+	if s.handleUpdateError(w, err, id) {
+		return
+	}
+	writeJSON(w, http.StatusOK, account.Redact(updated), s.logger)
+}
+
+var errNotFound = errors.New("not found")
+
+// requestError is returned by update functions to reject the request with
+// the given status code and message.
+type requestError struct {
+	code int
+	msg  string
+}
+
+func (e requestError) Error() string {
+	return e.msg
+}
+
+// handleUpdateError writes the response for an error from update and returns
+// true, or returns false if there was no error.
+func (s *Service) handleUpdateError(w http.ResponseWriter, err error, id uint32) bool {
+	if err == nil {
+		return false
+	}
+	var re requestError
+	if errors.Is(err, errNotFound) {
+		clientError(w, http.StatusNotFound, fmt.Sprintf("No such account: %d", id), s.logger)
+	} else if errors.As(err, &re) {
+		clientError(w, re.code, re.msg, s.logger)
+	} else {
+		serverError(w, err, s.logger)
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}, l zl.Logger) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		serverError(w, err, l)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
+func clientError(w http.ResponseWriter, code int, body string, l zl.Logger) {
+	w.WriteHeader(code)
+	l.Info().Int("status", code).Msg(body)
+	io.Copy(w, strings.NewReader(body))
+}
+
+func serverError(w http.ResponseWriter, err error, l zl.Logger) {
+	w.WriteHeader(http.StatusInternalServerError)
+	l.Error().Int("status", http.StatusInternalServerError).Err(err).Send()
+}
@@ -0,0 +1,284 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/serve/admin"
+	"roci.dev/diff-server/util/log"
+)
+
+const token = "s3cret"
+
+type fakeClientStore map[string][]string
+
+func (f fakeClientStore) ClientIDs(accountID string) ([]string, error) {
+	return f[accountID], nil
+}
+
+func (f fakeClientStore) DeleteClients(accountID string) (int, error) {
+	n := len(f[accountID])
+	delete(f, accountID)
+	return n, nil
+}
+
+func setup(t *testing.T, token string) (*mux.Router, *account.DB, func()) {
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(t, err)
+	db, err := account.NewDB(dir)
+	assert.NoError(t, err)
+	clients := fakeClientStore{fmt.Sprint(account.LowestASID): {"c1", "c2"}}
+	m := mux.NewRouter()
+	admin.RegisterHandlers(admin.NewService(log.Default(), token, db, clients), m)
+	return m, db, func() { assert.NoError(t, os.RemoveAll(dir)) }
+}
+
+func do(m *mux.Router, method, path, body, auth string) (int, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", "Bearer "+auth)
+	}
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	m, _, cleanup := setup(t, token)
+	defer cleanup()
+	code, _ := do(m, "GET", "/admin/accounts", "", "")
+	assert.Equal(401, code)
+	code, _ = do(m, "GET", "/admin/accounts", "", "wrong")
+	assert.Equal(401, code)
+	code, _ = do(m, "GET", "/admin/accounts", "", token)
+	assert.Equal(200, code)
+
+	// No token, no admin API.
+	m, _, cleanup2 := setup(t, "")
+	defer cleanup2()
+	code, _ = do(m, "GET", "/admin/accounts", "", "")
+	assert.Equal(404, code)
+}
+
+func TestAccounts(t *testing.T) {
+	assert := assert.New(t)
+	m, db, cleanup := setup(t, token)
+	defer cleanup()
+
+	// Create.
+	code, body := do(m, "POST", "/admin/accounts", `{"name": "Larry", "email": "larry@example.com"}`, token)
+	assert.Equal(201, code, body)
+	var created admin.CreateAccountResponse
+	assert.NoError(json.Unmarshal([]byte(body), &created))
+	assert.Equal(account.LowestASID, created.Account.ID)
+	assert.Equal("Larry", created.Account.Name)
+	assert.Equal(1, len(created.Account.Keys))
+	assert.Equal("", created.Account.Keys[0].Hash)
+	records, err := account.ReadAllRecords(db)
+	assert.NoError(err)
+	r, ok := account.Lookup(records, created.Key, false)
+	assert.True(ok)
+	assert.Equal(account.LowestASID, r.ID)
+
+	code, body = do(m, "POST", "/admin/accounts", `{"name": "Larry"}`, token)
+	assert.Equal(400, code, body)
+
+	// Read.
+	path := fmt.Sprintf("/admin/accounts/%d", account.LowestASID)
+	code, body = do(m, "GET", path, "", token)
+	assert.Equal(200, code)
+	var got account.Record
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.Equal("larry@example.com", got.Email)
+	code, body = do(m, "GET", "/admin/accounts", "", token)
+	assert.Equal(200, code)
+	var list []account.Record
+	assert.NoError(json.Unmarshal([]byte(body), &list))
+	assert.Equal(len(account.RegularAccounts)+1, len(list))
+	code, _ = do(m, "GET", "/admin/accounts/12345678", "", token)
+	assert.Equal(404, code)
+
+	// Update.
+	code, body = do(m, "PATCH", path, `{"email": "l@example.com", "status": {"state": "suspended", "reason": "abuse"}}`, token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.Equal("Larry", got.Name)
+	assert.Equal("l@example.com", got.Email)
+	assert.Equal(account.StateSuspended, got.Status.State)
+	assert.Equal("abuse", got.Status.Reason)
+	assert.NotEqual("", got.Status.Date)
+	code, body = do(m, "PATCH", path, `{"status": {"state": "deleted"}}`, token)
+	assert.Equal(400, code, body)
+	code, body = do(m, "PATCH", path, `{"status": {"state": "gone"}}`, token)
+	assert.Equal(400, code, body)
+	code, body = do(m, "PATCH", path, `{"status": {"state": "active"}}`, token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.True(account.Active(got))
+	code, _ = do(m, "PATCH", "/admin/accounts/0", `{"name": "x"}`, token)
+	assert.Equal(409, code)
+
+	// Patterns.
+	code, _ = do(m, "POST", path+"/patterns", `{"pattern": "https://example.com/cv"}`, token)
+	assert.Equal(200, code)
+	code, _ = do(m, "POST", path+"/patterns", `{"pattern": "https://example.com/cv"}`, token)
+	assert.Equal(200, code)
+	code, _ = do(m, "POST", path+"/patterns", `{"pattern": "http://localhost:*/"}`, token)
+	assert.Equal(200, code)
+	code, body = do(m, "POST", path+"/patterns", `{"pattern": "example.com"}`, token)
+	assert.Equal(400, code)
+	assert.Contains(body, "missing scheme")
+	code, body = do(m, "GET", path+"/patterns", "", token)
+	assert.Equal(200, code)
+	assert.Equal(`["https://example.com/cv","http://localhost:*/"]`+"\n", body)
+	code, _ = do(m, "DELETE", path+"/patterns?pattern="+url.QueryEscape("https://example.com/cv"), "", token)
+	assert.Equal(200, code)
+	code, body = do(m, "GET", path+"/patterns", "", token)
+	assert.Equal(200, code)
+	assert.Equal(`["http://localhost:*/"]`+"\n", body)
+	code, body = do(m, "PATCH", path, `{"httpsOnly": true}`, token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.True(got.HTTPSOnly)
+
+	// TLS.
+	code, body = do(m, "PATCH", path, `{"tls": {"minVersion": "1.3"}}`, token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.Equal(account.TLS{MinVersion: "1.3"}, got.TLS)
+	code, body = do(m, "PATCH", path, `{"tls": {"clientKey": "key"}}`, token)
+	assert.Equal(400, code, body)
+	assert.Contains(body, "invalid tls")
+
+	// Schemas.
+	code, body = do(m, "PATCH", path, `{"schemas": [{"prefix": "todo/", "schema": {"type": "object"}}]}`, token)
+	assert.Equal(200, code, body)
+	assert.Contains(body, `"Schemas":[{"prefix":"todo/","schema":{"type":"object"}}]`)
+	code, body = do(m, "PATCH", path, `{"schemas": [{"prefix": "todo/", "schema": {"type": "date"}}]}`, token)
+	assert.Equal(400, code, body)
+	assert.Contains(body, `invalid schemas: schema for prefix "todo/": /type: unknown type "date"`)
+
+	// Forwarded headers and cookies.
+	code, body = do(m, "PATCH", path, `{"forward": {"headers": [{"name": "Accept-Language"}], "cookies": [{"name": "session", "sensitive": true}]}}`, token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.Equal(account.Forward{Headers: []account.Forwarded{{Name: "Accept-Language"}}, Cookies: []account.Forwarded{{Name: "session", Sensitive: true}}}, got.Forward)
+	code, body = do(m, "PATCH", path, `{"forward": {"headers": [{"name": "Authorization"}]}}`, token)
+	assert.Equal(400, code, body)
+	assert.Contains(body, "invalid forward: header Authorization is set by the server")
+
+	// Signing secret.
+	code, body = do(m, "POST", path+"/signing-secret", "", token)
+	assert.Equal(200, code, body)
+	var rotated admin.SigningSecretResponse
+	assert.NoError(json.Unmarshal([]byte(body), &rotated))
+	assert.True(strings.HasPrefix(rotated.SigningSecret, "rss_"))
+	assert.Equal("", rotated.Account.SigningSecret)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal(rotated.SigningSecret, records.Record[account.LowestASID].SigningSecret)
+	code, body = do(m, "GET", path, "", token)
+	assert.Equal(200, code)
+	assert.NotContains(body, rotated.SigningSecret)
+	code, body = do(m, "DELETE", path+"/signing-secret", "", token)
+	assert.Equal(200, code, body)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	assert.Equal("", records.Record[account.LowestASID].SigningSecret)
+	code, _ = do(m, "POST", "/admin/accounts/0/signing-secret", "", token)
+	assert.Equal(409, code)
+
+	// Keys.
+	code, body = do(m, "POST", path+"/keys", `{"name": "ci"}`, token)
+	assert.Equal(200, code, body)
+	var added admin.KeyResponse
+	assert.NoError(json.Unmarshal([]byte(body), &added))
+	assert.Equal(2, len(added.Account.Keys))
+	assert.Equal("ci", added.Account.Keys[1].Name)
+	assert.Equal("", added.Account.Keys[1].Hash)
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	_, ok = account.Lookup(records, added.Key, false)
+	assert.True(ok)
+	code, body = do(m, "POST", path+"/keys", `{"name": "ci"}`, token)
+	assert.Equal(409, code, body)
+	code, body = do(m, "POST", path+"/keys", `{}`, token)
+	assert.Equal(400, code, body)
+	code, _ = do(m, "POST", "/admin/accounts/0/keys", `{"name": "ci"}`, token)
+	assert.Equal(409, code)
+	code, body = do(m, "DELETE", path+"/keys/ci", "", token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &got))
+	assert.True(got.Keys[1].Revoked())
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	_, ok = account.Lookup(records, added.Key, false)
+	assert.False(ok)
+	_, ok = account.Lookup(records, created.Key, false)
+	assert.True(ok)
+	code, body = do(m, "DELETE", path+"/keys/ci", "", token)
+	assert.Equal(409, code, body)
+	code, body = do(m, "DELETE", path+"/keys/nope", "", token)
+	assert.Equal(404, code, body)
+
+	// Clients.
+	code, body = do(m, "GET", path+"/clients", "", token)
+	assert.Equal(200, code)
+	assert.Equal(`["c1","c2"]`+"\n", body)
+
+	// Usage.
+	code, body = do(m, "GET", path+"/usage", "", token)
+	assert.Equal(200, code)
+	assert.Equal("[]\n", body)
+	meter := account.NewMeter(db, time.Hour, log.Default())
+	meter.RecordPull(account.LowestASID, account.PullUsage{ClientID: "c1", FullSync: true, PatchBytes: 42})
+	assert.NoError(meter.Flush())
+	code, body = do(m, "GET", path+"/usage?days=1", "", token)
+	assert.Equal(200, code)
+	var usage []account.DailyUsage
+	assert.NoError(json.Unmarshal([]byte(body), &usage))
+	assert.Equal([]account.DailyUsage{{Day: time.Now().UTC().Format("2006-01-02"), Pulls: 1, FullSyncs: 1, PatchBytes: 42, ActiveClients: 1}}, usage)
+	code, _ = do(m, "GET", path+"/usage?days=0", "", token)
+	assert.Equal(400, code)
+
+	// Delete, which must be confirmed.
+	code, body = do(m, "DELETE", path, "", token)
+	assert.Equal(400, code)
+	assert.Contains(body, fmt.Sprintf("?confirm=%d", account.LowestASID))
+	code, _ = do(m, "DELETE", path+"?confirm=1", "", token)
+	assert.Equal(400, code)
+	code, body = do(m, "DELETE", fmt.Sprintf("%s?confirm=%d&reason=churned", path, account.LowestASID), "", token)
+	assert.Equal(200, code, body)
+	var deleted admin.DeleteAccountResponse
+	assert.NoError(json.Unmarshal([]byte(body), &deleted))
+	assert.Equal(2, deleted.DeletedClients)
+	assert.Equal(account.StateDeleted, deleted.Account.Status.State)
+	assert.Equal("churned", deleted.Account.Status.Reason)
+	code, body = do(m, "DELETE", fmt.Sprintf("%s?confirm=%d", path, account.LowestASID), "", token)
+	assert.Equal(200, code, body)
+	assert.NoError(json.Unmarshal([]byte(body), &deleted))
+	assert.Equal(0, deleted.DeletedClients)
+	assert.Equal("churned", deleted.Account.Status.Reason)
+	code, _ = do(m, "DELETE", "/admin/accounts/12345678?confirm=12345678", "", token)
+	assert.Equal(404, code)
+
+	// The record is kept.
+	records, err = account.ReadAllRecords(db)
+	assert.NoError(err)
+	r, ok = records.Record[account.LowestASID]
+	assert.True(ok)
+	assert.False(account.Active(r))
+}
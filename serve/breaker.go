@@ -0,0 +1,113 @@
+package serve
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BreakerConfig configures the circuit breakers that stop pulls from
+// waiting on client view hosts that are down.
+type BreakerConfig struct {
+	// Threshold is how many consecutive failed fetches from a host for an
+	// account open their breaker. Zero or less disables the breakers.
+	Threshold int
+	// Cooldown is how long a breaker stays open before a pull is let
+	// through to probe the host again.
+	Cooldown time.Duration
+}
+
+// DefaultBreakerConfig is used unless configured otherwise.
+var DefaultBreakerConfig = BreakerConfig{
+	Threshold: 5,
+	Cooldown:  30 * time.Second,
+}
+
+// breakerKey identifies a breaker: each account has its own breaker per
+// client view host, so that one account's failing data layer can't stop
+// another account's fetches from a host they share.
+type breakerKey struct {
+	account string
+	host    string
+}
+
+// hostBreaker is the state of one breaker.
+type hostBreaker struct {
+	failures int
+	// retryAt is when the next probe may be made, once the breaker is open.
+	retryAt time.Time
+}
+
+// breaker is a circuit breaker per account and client view host. A breaker opens
+// after config.Threshold consecutive failures, after which fetches from it
+// are skipped except for one probe per config.Cooldown. A successful fetch
+// closes it. State is kept in memory so breakers are per process.
+type breaker struct {
+	config BreakerConfig
+	now    func() time.Time
+
+	mu    sync.Mutex
+	hosts map[breakerKey]*hostBreaker
+}
+
+func newBreaker(config BreakerConfig, now func() time.Time) *breaker {
+	return &breaker{config: config, now: now, hosts: map[breakerKey]*hostBreaker{}}
+}
+
+// allow returns true if a client view may be fetched from host for account.
+// If their breaker is open and its cooldown has passed, the caller is let through
+// as the probe and the next probe is pushed back by another cooldown, so
+// that a probe that never reports back doesn't keep the breaker stuck.
+func (b *breaker) allow(account, host string) bool {
+	if b.config.Threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hb := b.hosts[breakerKey{account, host}]
+	if hb == nil || hb.failures < b.config.Threshold {
+		return true
+	}
+	now := b.now()
+	if now.Before(hb.retryAt) {
+		return false
+	}
+	hb.retryAt = now.Add(b.config.Cooldown)
+	return true
+}
+
+// record records the outcome of a fetch from host for account.
+func (b *breaker) record(account, host string, ok bool) {
+	if b.config.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := breakerKey{account, host}
+	if ok {
+		delete(b.hosts, key)
+		return
+	}
+	hb := b.hosts[key]
+	if hb == nil {
+		hb = &hostBreaker{}
+		b.hosts[key] = hb
+	}
+	hb.failures++
+	if hb.failures >= b.config.Threshold {
+		hb.retryAt = b.now().Add(b.config.Cooldown)
+	}
+}
+
+// clientViewHost returns the host breakers are keyed by for a client view
+// URL. Other sources than http and https, like file:// and exec:// URLs,
+// have no host that their failures are likely shared by, so they are keyed
+// by the whole URL.
+func clientViewHost(clientViewURL string) string {
+	u, err := url.Parse(clientViewURL)
+	if err != nil || u.Host == "" || (!strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https")) {
+		return clientViewURL
+	}
+	return u.Host
+}
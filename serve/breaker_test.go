@@ -0,0 +1,69 @@
+package serve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)}
+	b := newBreaker(BreakerConfig{Threshold: 2, Cooldown: 10 * time.Second}, clock.now)
+
+	// A success resets the count of consecutive failures.
+	b.record("1", "a", false)
+	b.record("1", "a", true)
+	b.record("1", "a", false)
+	assert.True(b.allow("1", "a"))
+
+	// The breaker opens after Threshold failures, per account and host.
+	b.record("1", "a", false)
+	assert.False(b.allow("1", "a"))
+	assert.True(b.allow("1", "b"))
+	assert.True(b.allow("2", "a"))
+
+	// After the cooldown a single probe is let through.
+	clock.t = clock.t.Add(10 * time.Second)
+	assert.True(b.allow("1", "a"))
+	assert.False(b.allow("1", "a"))
+
+	// A failed probe keeps it open for another cooldown.
+	b.record("1", "a", false)
+	clock.t = clock.t.Add(5 * time.Second)
+	assert.False(b.allow("1", "a"))
+	clock.t = clock.t.Add(5 * time.Second)
+	assert.True(b.allow("1", "a"))
+
+	// A successful probe closes it.
+	b.record("1", "a", true)
+	assert.True(b.allow("1", "a"))
+	assert.True(b.allow("1", "a"))
+
+	// A probe that never reports back doesn't keep it closed to later probes.
+	b.record("1", "a", false)
+	b.record("1", "a", false)
+	clock.t = clock.t.Add(10 * time.Second)
+	assert.True(b.allow("1", "a"))
+	clock.t = clock.t.Add(10 * time.Second)
+	assert.True(b.allow("1", "a"))
+
+	// A threshold of zero disables it.
+	b = newBreaker(BreakerConfig{Threshold: 0, Cooldown: time.Hour}, clock.now)
+	for i := 0; i < 10; i++ {
+		b.record("1", "a", false)
+	}
+	assert.True(b.allow("1", "a"))
+}
+
+func TestClientViewHost(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("example.com:8080", clientViewHost("https://example.com:8080/cv?x=1"))
+	assert.Equal("example.com", clientViewHost("http://example.com"))
+	assert.Equal("not a url", clientViewHost("not a url"))
+	assert.Equal("example.com", clientViewHost("HTTPS://example.com/cv"))
+	assert.Equal("file:///tmp/a.json", clientViewHost("file:///tmp/a.json"))
+	assert.Equal("exec:///bin/cv?arg=a", clientViewHost("exec:///bin/cv?arg=a"))
+	assert.Equal("exec://cv/a", clientViewHost("exec://cv/a"))
+}
@@ -2,43 +2,463 @@ package serve
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
+
+	"roci.dev/diff-server/account"
 	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/signature"
+	"roci.dev/diff-server/util/loghttp"
 )
 
-type ClientViewGetter struct{}
+// ClientViewGetterConfig configures how a ClientViewGetter fetches client
+// views.
+type ClientViewGetterConfig struct {
+	// ConnectTimeout limits how long connecting to the data layer, including
+	// the TLS handshake, may take.
+	ConnectTimeout time.Duration
+	// ResponseTimeout limits how long each attempt may take, from sending
+	// the request until the response body has been read.
+	ResponseTimeout time.Duration
+	// TotalTimeout, if not zero, limits how long a fetch may take including
+	// all of its retries. It should be less than the server's write timeout
+	// so that the pull can still be answered.
+	TotalTimeout time.Duration
+	// Retries is how many times a fetch is retried after a network error or
+	// a 5xx response.
+	Retries int
+	// RetryBackoff is the base delay before a retry. The delay doubles with
+	// each retry and is jittered.
+	RetryBackoff time.Duration
+	// MaxBodyBytes caps the size of client view responses.
+	MaxBodyBytes int64
+	// MaxKeys caps the number of keys in a client view.
+	MaxKeys int64
+	// MaxValueBytes caps the size of each value in a client view.
+	MaxValueBytes int64
+}
+
+// DefaultClientViewGetterConfig is used by diffs serve unless configured
+// otherwise.
+var DefaultClientViewGetterConfig = ClientViewGetterConfig{
+	ConnectTimeout:  5 * time.Second,
+	ResponseTimeout: 5 * time.Second,
+	TotalTimeout:    8 * time.Second,
+	Retries:         2,
+	RetryBackoff:    100 * time.Millisecond,
+	MaxBodyBytes:    64 << 20,
+	MaxKeys:         1000000,
+	MaxValueBytes:   4 << 20,
+}
+
+// ClientViewOptions are the per-account settings a client view is fetched
+// with.
+type ClientViewOptions struct {
+	// SigningSecret, if set, is used to sign the request, see package
+	// signature.
+	SigningSecret string
+	// TLS configures the connection to the data layer.
+	TLS account.TLS
+	// MaxBytes, MaxKeys and MaxValueBytes override the getter's
+	// configuration if not zero. Negative values are unlimited.
+	MaxBytes      int64
+	MaxKeys       int64
+	MaxValueBytes int64
+	// Header is added to the request, eg headers and cookies forwarded
+	// from the pull request.
+	Header http.Header
+	// OnEntry, if set, is passed the entries of the client view as they are
+	// decoded, instead of them being returned in the response's ClientView,
+	// so that large client views needn't be held in memory. An error from
+	// it stops the fetch. Entries of fetches that fail may have been passed
+	// to it.
+	OnEntry func(key string, value json.RawMessage) error
+}
+
+// clientViewOptions returns the options to fetch record's client views
+// with.
+func clientViewOptions(record account.Record) ClientViewOptions {
+	return ClientViewOptions{
+		SigningSecret: record.SigningSecret,
+		TLS:           record.TLS,
+		MaxBytes:      record.Limits.MaxClientViewBytes,
+		MaxKeys:       record.Limits.MaxClientViewKeys,
+		MaxValueBytes: record.Limits.MaxClientViewValueBytes,
+	}
+}
+
+// clientViewLimits are the limits a client view is decoded with. Values
+// of zero or less are unlimited.
+type clientViewLimits struct {
+	maxBytes      int64
+	maxKeys       int64
+	maxValueBytes int64
+}
+
+// limits returns the limits to fetch with, opts' where given.
+func (g *ClientViewGetter) limits(opts ClientViewOptions) clientViewLimits {
+	return limitsFor(g.config, opts)
+}
+
+// limitsFor returns the limits in config, overridden by opts' where given.
+func limitsFor(config ClientViewGetterConfig, opts ClientViewOptions) clientViewLimits {
+	or := func(override, def int64) int64 {
+		if override != 0 {
+			return override
+		}
+		return def
+	}
+	return clientViewLimits{
+		maxBytes:      or(opts.MaxBytes, config.MaxBodyBytes),
+		maxKeys:       or(opts.MaxKeys, config.MaxKeys),
+		maxValueBytes: or(opts.MaxValueBytes, config.MaxValueBytes),
+	}
+}
+
+// ClientViewGetter fetches client views from the data layer over HTTP.
+type ClientViewGetter struct {
+	config ClientViewGetterConfig
+	client *http.Client
+	now    func() time.Time
+	// sleep waits for d or until ctx is done. It is replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+
+	mu         sync.Mutex
+	tlsClients map[account.TLS]*http.Client // By the accounts' TLS settings.
+}
+
+// NewClientViewGetter returns a ClientViewGetter configured by config.
+func NewClientViewGetter(config ClientViewGetterConfig) *ClientViewGetter {
+	return &ClientViewGetter{
+		config:     config,
+		client:     newClientViewClient(config, nil),
+		tlsClients: map[account.TLS]*http.Client{},
+		now:        time.Now,
+		sleep:      sleep,
+	}
+}
+
+func newClientViewClient(config ClientViewGetterConfig, tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   config.ConnectTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: loghttp.WrapTransport(transport),
+		Timeout:   config.ResponseTimeout,
+		// Redirects aren't followed: their targets haven't been authorized
+		// for the account, and would be sent its forwarded headers and TLS
+		// client certificate.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// clientFor returns the client to fetch with using the given TLS settings.
+// Clients with custom settings are kept so that their connections are
+// reused.
+func (g *ClientViewGetter) clientFor(t account.TLS) (*http.Client, error) {
+	if t.IsZero() {
+		return g.client, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.tlsClients[t]; ok {
+		return c, nil
+	}
+	tlsConfig, err := t.Config()
+	if err != nil {
+		return nil, err
+	}
+	c := newClientViewClient(g.config, tlsConfig)
+	g.tlsClients[t] = c
+	return c, nil
+}
+
+// Errors returned by Get for client views over the limits.
+var (
+	ErrClientViewTooLarge      = errors.New("client view response too large")
+	ErrClientViewTooManyKeys   = errors.New("client view has too many keys")
+	ErrClientViewValueTooLarge = errors.New("client view value too large")
+)
 
 // Get fetches a client view. It returns an error if the response from the data layer doesn't have
-// a lastMutationID.
-func (g ClientViewGetter) Get(url string, req servetypes.ClientViewRequest, authToken string, syncID string) (servetypes.ClientViewResponse, int, error) {
+// a lastMutationID. Network errors and 5xx responses are retried. The fetch
+// is abandoned if ctx is done, eg because the client making the pull went away,
+// or once the configured TotalTimeout has passed.
+func (g *ClientViewGetter) Get(ctx context.Context, url string, req servetypes.ClientViewRequest, authToken string, syncID string, opts ClientViewOptions) (servetypes.ClientViewResponse, int, error) {
+	if g.config.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.config.TotalTimeout)
+		defer cancel()
+	}
 	reqBody, err := json.Marshal(req)
 	if err != nil {
 		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("could not marshal ClientViewRequest: %w", err)
 	}
+	client, err := g.clientFor(opts.TLS)
+	if err != nil {
+		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("invalid account TLS settings: %w", err)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, code, retry, err := g.get(ctx, client, url, reqBody, authToken, syncID, opts)
+		if err == nil || !retry || attempt == g.config.Retries {
+			if err != nil && attempt > 0 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt+1)
+			}
+			return resp, code, err
+		}
+		if err := g.sleep(ctx, backoff(g.config.RetryBackoff, attempt)); err != nil {
+			return servetypes.ClientViewResponse{}, code, fmt.Errorf("error sending client view http request: %w", err)
+		}
+	}
+}
+
+// get makes a single attempt at fetching a client view. retry is true if
+// the attempt failed in a way that is worth retrying.
+func (g *ClientViewGetter) get(ctx context.Context, client *http.Client, url string, reqBody []byte, authToken string, syncID string, opts ClientViewOptions) (resp servetypes.ClientViewResponse, code int, retry bool, err error) {
 	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
 	if err != nil {
-		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("could not create client view http request: %w", err)
+		return servetypes.ClientViewResponse{}, 0, false, fmt.Errorf("could not create client view http request: %w", err)
 	}
+	httpReq = httpReq.WithContext(ctx)
 	httpReq.Header.Add("Content-type", "application/json")
+	// Setting Accept-Encoding stops the transport from asking for and
+	// decompressing gzip itself, which it would do for the whole body.
+	httpReq.Header.Add("Accept-Encoding", "zstd, gzip")
 	httpReq.Header.Add("Authorization", authToken)
 	httpReq.Header.Add("X-Replicache-SyncID", syncID)
-	httpResp, err := http.DefaultClient.Do(httpReq)
+	for name, values := range opts.Header {
+		for _, v := range values {
+			httpReq.Header.Add(name, v)
+		}
+	}
+	if opts.SigningSecret != "" {
+		// Each attempt is signed afresh so its timestamp is current.
+		signature.SignRequest(httpReq, opts.SigningSecret, g.now(), url, reqBody)
+	}
+	httpResp, err := client.Do(httpReq)
 	if err != nil {
-		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("error sending client view http request: %w", err)
+		// Errors caused by ctx aren't going to get better.
+		return servetypes.ClientViewResponse{}, 0, ctx.Err() == nil, fmt.Errorf("error sending client view http request: %w", err)
 	}
+	defer httpResp.Body.Close()
 	if httpResp.StatusCode != http.StatusOK {
-		return servetypes.ClientViewResponse{}, httpResp.StatusCode, fmt.Errorf("client view fetch http request returned %s", httpResp.Status)
+		return servetypes.ClientViewResponse{}, httpResp.StatusCode, httpResp.StatusCode >= 500, fmt.Errorf("client view fetch http request returned %s", httpResp.Status)
 	}
+	body, closeBody, err := decompress(httpResp.Body, httpResp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return servetypes.ClientViewResponse{}, httpResp.StatusCode, false, fmt.Errorf("couldnt decode client view response: %w", err)
+	}
+	defer closeBody()
+	resp, err = readClientViewResponse(body, g.limits(opts), opts.OnEntry)
+	if err != nil {
+		return servetypes.ClientViewResponse{}, httpResp.StatusCode, false, err
+	}
+	return resp, httpResp.StatusCode, false, nil
+}
+
+// maxZstdWindow caps the memory needed to decompress zstd client views.
+// It allows anything up to zstd's highest standard compression level.
+const maxZstdWindow = 8 << 20
+
+// decompress returns a reader of body decompressed according to
+// contentEncoding, and a function to release its resources.
+func decompress(body io.Reader, contentEncoding string) (io.Reader, func(), error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return body, func() {}, nil
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true), zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported Content-Encoding %q", contentEncoding)
+}
+
+// readClientViewResponse decodes a ClientViewResponse from r, refusing it
+// if it is over limits. If onEntry is not nil the client view's entries are
+// passed to it rather than returned, see ClientViewOptions.OnEntry. Limits
+// on size apply to the decompressed response.
+func readClientViewResponse(r io.Reader, limits clientViewLimits, onEntry func(string, json.RawMessage) error) (servetypes.ClientViewResponse, error) {
+	if limits.maxBytes > 0 {
+		r = &maxBytesReader{r: r, n: limits.maxBytes}
+	}
+	resp, err := decodeClientViewResponse(r, limits, onEntry)
+	if errors.Is(err, ErrClientViewTooLarge) {
+		return servetypes.ClientViewResponse{}, fmt.Errorf("%w: limit is %d bytes", ErrClientViewTooLarge, limits.maxBytes)
+	}
+	if errors.Is(err, ErrClientViewTooManyKeys) || errors.Is(err, ErrClientViewValueTooLarge) {
+		return servetypes.ClientViewResponse{}, err
+	}
+	if err != nil {
+		return servetypes.ClientViewResponse{}, fmt.Errorf("couldnt decode client view response: %w", err)
+	}
+	return resp, nil
+}
+
+// decodeClientViewResponse decodes a ClientViewResponse from r a value at
+// a time, so that a client view with too many keys or too large a value is
+// refused as soon as it is found rather than after it has all been read
+// into memory.
+func decodeClientViewResponse(r io.Reader, limits clientViewLimits, onEntry func(string, json.RawMessage) error) (servetypes.ClientViewResponse, error) {
 	var resp servetypes.ClientViewResponse
-	var r io.Reader = httpResp.Body
-	defer httpResp.Body.Close()
-	err = json.NewDecoder(r).Decode(&resp)
+	d := json.NewDecoder(r)
+	if err := expectDelim(d, '{'); err != nil {
+		return resp, err
+	}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return resp, err
+		}
+		switch t {
+		case "clientView":
+			if resp.ClientView, err = decodeClientView(d, limits, onEntry); err != nil {
+				return resp, err
+			}
+		case "lastMutationID":
+			if err := d.Decode(&resp.LastMutationID); err != nil {
+				return resp, err
+			}
+		default:
+			var skip json.RawMessage
+			if err := d.Decode(&skip); err != nil {
+				return resp, err
+			}
+		}
+	}
+	return resp, expectDelim(d, '}')
+}
+
+// decodeClientView decodes the clientView object of a ClientViewResponse
+// from d, passing each entry to onEntry as it is decoded. If onEntry is nil
+// the entries are returned instead.
+func decodeClientView(d *json.Decoder, limits clientViewLimits, onEntry func(string, json.RawMessage) error) (map[string]json.RawMessage, error) {
+	t, err := d.Token()
 	if err != nil {
-		return servetypes.ClientViewResponse{}, httpResp.StatusCode, fmt.Errorf("couldnt decode client view response: %w", err)
+		return nil, err
+	}
+	if t == nil {
+		return nil, nil
+	}
+	if t != json.Delim('{') {
+		return nil, fmt.Errorf("clientView is not an object")
+	}
+	var cv map[string]json.RawMessage
+	if onEntry == nil {
+		cv = map[string]json.RawMessage{}
+		onEntry = func(key string, value json.RawMessage) error {
+			cv[key] = value
+			return nil
+		}
+	}
+	// Entries are counted rather than distinct keys, so that the keys
+	// needn't be kept.
+	var n int64
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := t.(string)
+		if limits.maxKeys > 0 && n >= limits.maxKeys {
+			return nil, fmt.Errorf("%w: limit is %d", ErrClientViewTooManyKeys, limits.maxKeys)
+		}
+		n++
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		if limits.maxValueBytes > 0 && int64(len(v)) > limits.maxValueBytes {
+			return nil, fmt.Errorf("%w: value of key %q is %d bytes, limit is %d", ErrClientViewValueTooLarge, key, len(v), limits.maxValueBytes)
+		}
+		if err := onEntry(key, v); err != nil {
+			return nil, err
+		}
+	}
+	return cv, expectDelim(d, '}')
+}
+
+func expectDelim(d *json.Decoder, delim json.Delim) error {
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("expected %s, got %v", delim, t)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before retry number attempt+1: a random
+// duration between half and all of base doubled attempt times.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maxBytesReader reads from r until more than n bytes have been read, after
+// which it returns ErrClientViewTooLarge.
+type maxBytesReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, ErrClientViewTooLarge
+	}
+	// Read one byte more than allowed so that we can tell if there is more.
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, ErrClientViewTooLarge
 	}
-	return resp, httpResp.StatusCode, nil
+	return n, err
 }
@@ -1,14 +1,34 @@
 package serve
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
 	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/signature"
 )
 
 func b(s string) []byte {
@@ -70,12 +90,13 @@ func TestClientViewGetter_Get(t *testing.T) {
 				assert.Equal("application/json", r.Header.Get("Content-type"), tt.name)
 				assert.Equal(tt.clientViewAuth, r.Header.Get("Authorization"), tt.name)
 				assert.Equal("syncID", r.Header.Get("X-Replicache-SyncID"), tt.name)
+				assert.Equal("", r.Header.Get(signature.HeaderSignature), tt.name)
 				w.WriteHeader(tt.respCode)
 				w.Write([]byte(tt.respBody))
 			}))
 
-			g := ClientViewGetter{}
-			got, gotCode, err := g.Get(server.URL, tt.req, tt.clientViewAuth, "syncID")
+			g := NewClientViewGetter(DefaultClientViewGetterConfig)
+			got, gotCode, err := g.Get(context.Background(), server.URL, tt.req, tt.clientViewAuth, "syncID", ClientViewOptions{})
 			assert.Equal(tt.wantCode, gotCode)
 			if tt.wantErr == "" {
 				assert.NoError(err)
@@ -89,3 +110,407 @@ func TestClientViewGetter_Get(t *testing.T) {
 		})
 	}
 }
+
+func TestClientViewGetterSigned(t *testing.T) {
+	assert := assert.New(t)
+	var serverURL string
+	var attempts, verified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := signature.VerifyRequest(r, "rss_secret", serverURL+"/cv")
+		if err == nil {
+			atomic.AddInt32(&verified, 1)
+		}
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"clientView": {}, "lastMutationID": 1}`))
+	}))
+	defer server.Close()
+	serverURL = server.URL
+
+	g := NewClientViewGetter(ClientViewGetterConfig{Retries: 1})
+	_, code, err := g.Get(context.Background(), server.URL+"/cv", servetypes.ClientViewRequest{ClientID: "c1"}, "auth", "syncID", ClientViewOptions{SigningSecret: "rss_secret"})
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, code)
+	// Retries are signed too.
+	assert.Equal(int32(2), atomic.LoadInt32(&verified))
+}
+
+// selfSignedCert returns a PEM encoded self-signed certificate for client
+// auth and its key.
+func selfSignedCert(assert *assert.Assertions) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "diff-server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestClientViewGetterHeader(t *testing.T) {
+	assert := assert.New(t)
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		w.Write([]byte(`{"clientView": {}, "lastMutationID": 1}`))
+	}))
+	defer server.Close()
+
+	g := NewClientViewGetter(DefaultClientViewGetterConfig)
+	_, _, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "auth", "sync", ClientViewOptions{
+		Header: http.Header{"Accept-Language": {"de-CH"}, "Cookie": {"session=abc"}},
+	})
+	assert.NoError(err)
+	assert.Equal("de-CH", got.Get("Accept-Language"))
+	assert.Equal("session=abc", got.Get("Cookie"))
+	assert.Equal("auth", got.Get("Authorization"))
+	assert.Equal("sync", got.Get("X-Replicache-SyncID"))
+}
+
+func TestClientViewGetterTLS(t *testing.T) {
+	assert := assert.New(t)
+	clientCert, clientKey := selfSignedCert(assert)
+	clientCAs := x509.NewCertPool()
+	assert.True(clientCAs.AppendCertsFromPEM([]byte(clientCert)))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"clientView": {}, "lastMutationID": 1}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	tc := []struct {
+		tls      account.TLS
+		wantCode int
+		wantErr  string
+	}{
+		{account.TLS{}, 0, "certificate"},
+		{account.TLS{RootCAs: serverCA}, 0, "error sending client view http request"},
+		{account.TLS{RootCAs: serverCA, ClientCert: clientCert, ClientKey: clientKey}, 200, ""},
+		{account.TLS{RootCAs: serverCA, ClientCert: clientCert, ClientKey: clientKey, MinVersion: "1.3"}, 0, "version"},
+		{account.TLS{RootCAs: serverCA, ClientCert: clientCert}, 0, "invalid account TLS settings: client certificate and key must be given together"},
+	}
+	g := NewClientViewGetter(ClientViewGetterConfig{})
+	for i, t := range tc {
+		_, code, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", ClientViewOptions{TLS: t.tls})
+		assert.Equal(t.wantCode, code, "test case %d", i)
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+		} else if assert.Error(err, "test case %d", i) {
+			assert.Contains(err.Error(), t.wantErr, "test case %d", i)
+		}
+	}
+}
+
+func TestClientViewGetterRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		name      string
+		codes     []int // Response codes of successive attempts; the last one repeats.
+		retries   int
+		wantCalls int32
+		wantCode  int
+		wantErr   string
+	}{
+		{"no retries needed", []int{200}, 2, 1, 200, ""},
+		{"5xx retried", []int{503, 500, 200}, 2, 3, 200, ""},
+		{"too many 5xx", []int{503}, 2, 3, 503, "503 Service Unavailable \\(after 3 attempts\\)"},
+		{"retries off", []int{503, 200}, 0, 1, 503, "503"},
+		{"4xx not retried", []int{403, 200}, 2, 1, 403, "403"},
+	}
+	for _, tt := range tests {
+		var calls int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(atomic.AddInt32(&calls, 1))
+			if n > len(tt.codes) {
+				n = len(tt.codes)
+			}
+			w.WriteHeader(tt.codes[n-1])
+			w.Write([]byte(`{"clientView": {}, "lastMutationID": 1}`))
+		}))
+		config := DefaultClientViewGetterConfig
+		config.Retries = tt.retries
+		g := NewClientViewGetter(config)
+		var delays []time.Duration
+		g.sleep = func(ctx context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		}
+		_, code, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+		server.Close()
+		assert.Equal(tt.wantCalls, calls, tt.name)
+		assert.Equal(tt.wantCode, code, tt.name)
+		assert.Equal(int(tt.wantCalls-1), len(delays), tt.name)
+		if tt.wantErr == "" {
+			assert.NoError(err, tt.name)
+		} else if assert.Error(err, tt.name) {
+			assert.Regexp(tt.wantErr, err.Error(), tt.name)
+		}
+	}
+
+	// Network errors are retried too.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+	g := NewClientViewGetter(DefaultClientViewGetterConfig)
+	attempts := 1
+	g.sleep = func(ctx context.Context, d time.Duration) error {
+		attempts++
+		return nil
+	}
+	_, _, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+	assert.Error(err)
+	assert.Equal(3, attempts)
+}
+
+func TestClientViewGetterRedirect(t *testing.T) {
+	assert := assert.New(t)
+	var redirected bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+		w.Write([]byte(`{"clientView": {}, "lastMutationID": 1}`))
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer server.Close()
+
+	g := NewClientViewGetter(DefaultClientViewGetterConfig)
+	_, code, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", ClientViewOptions{Header: http.Header{"X-Session": {"secret"}}})
+	assert.Equal(http.StatusTemporaryRedirect, code)
+	assert.EqualError(err, "client view fetch http request returned 307 Temporary Redirect")
+	assert.False(redirected)
+}
+
+func TestClientViewGetterLimits(t *testing.T) {
+	assert := assert.New(t)
+	block := make(chan struct{})
+	defer close(block)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write([]byte(`{"clientView": {"k": "` + strings.Repeat("x", 100) + `"}, "lastMutationID": 1}`))
+		case "/slow":
+			// The server only notices the client going away once the
+			// request has been read.
+			ioutil.ReadAll(r.Body)
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer server.Close()
+
+	config := DefaultClientViewGetterConfig
+	config.MaxBodyBytes = 100
+	config.ResponseTimeout = 50 * time.Millisecond
+	config.Retries = 1
+	g := NewClientViewGetter(config)
+	var slept int
+	g.sleep = func(ctx context.Context, d time.Duration) error {
+		slept++
+		return nil
+	}
+
+	// Too large responses are not retried.
+	_, code, err := g.Get(context.Background(), server.URL+"/big", servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+	assert.Equal(200, code)
+	assert.True(errors.Is(err, ErrClientViewTooLarge))
+	assert.Equal("client view response too large: limit is 100 bytes", err.Error())
+	assert.Equal(0, slept)
+
+	// Timeouts are.
+	_, _, err = g.Get(context.Background(), server.URL+"/slow", servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+	assert.Error(err)
+	assert.Contains(err.Error(), "Timeout")
+	assert.Equal(1, slept)
+
+	// Cancellation is not.
+	config.ResponseTimeout = time.Minute
+	g = NewClientViewGetter(config)
+	g.sleep = func(ctx context.Context, d time.Duration) error {
+		slept++
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, _, err = g.Get(ctx, server.URL+"/slow", servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+	assert.True(errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(1, slept)
+
+	// The total timeout covers all attempts, and isn't retried.
+	config.TotalTimeout = 50 * time.Millisecond
+	g = NewClientViewGetter(config)
+	slept = 0
+	g.sleep = func(ctx context.Context, d time.Duration) error {
+		slept++
+		return nil
+	}
+	_, _, err = g.Get(context.Background(), server.URL+"/slow", servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+	assert.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Equal(0, slept)
+}
+
+func TestDecodeClientViewResponse(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		body    string
+		limits  clientViewLimits
+		wantCV  map[string]json.RawMessage
+		wantLMI uint64
+		wantErr string
+	}{
+		{`{"clientView": {"a": 1, "b": [2]}, "lastMutationID": 3}`, clientViewLimits{}, map[string]json.RawMessage{"a": []byte("1"), "b": []byte("[2]")}, 3, ""},
+		{`{"lastMutationID": 3, "other": {"x": 1}, "clientView": {}}`, clientViewLimits{}, map[string]json.RawMessage{}, 3, ""},
+		{`{"clientView": null}`, clientViewLimits{}, nil, 0, ""},
+		{`{"clientView": {"a": 1, "b": 2}}`, clientViewLimits{maxKeys: 2}, map[string]json.RawMessage{"a": []byte("1"), "b": []byte("2")}, 0, ""},
+		{`{"clientView": {"a": 1, "b": 2, "c": 3}}`, clientViewLimits{maxKeys: 2}, nil, 0, "client view has too many keys: limit is 2"},
+		{`{"clientView": {"a": 1, "a": 2}}`, clientViewLimits{}, map[string]json.RawMessage{"a": []byte("2")}, 0, ""},
+		{`{"clientView": {"a": 1, "a": 2}}`, clientViewLimits{maxKeys: 1}, nil, 0, "client view has too many keys: limit is 1"},
+		{`{"clientView": {"a": "abc"}}`, clientViewLimits{maxValueBytes: 5}, map[string]json.RawMessage{"a": []byte(`"abc"`)}, 0, ""},
+		{`{"clientView": {"a": "abcd"}}`, clientViewLimits{maxValueBytes: 5}, nil, 0, `client view value too large: value of key "a" is 6 bytes, limit is 5`},
+		{`{"clientView": []}`, clientViewLimits{}, nil, 0, "clientView is not an object"},
+		{`[]`, clientViewLimits{}, nil, 0, "expected {, got ["},
+		{`{"clientView": {"a": `, clientViewLimits{}, nil, 0, "unexpected EOF"},
+	}
+	for i, t := range tc {
+		resp, err := decodeClientViewResponse(strings.NewReader(t.body), t.limits, nil)
+		if t.wantErr != "" {
+			assert.EqualError(err, t.wantErr, "test case %d", i)
+			continue
+		}
+		assert.NoError(err, "test case %d", i)
+		assert.Equal(t.wantCV, resp.ClientView, "test case %d", i)
+		assert.Equal(t.wantLMI, resp.LastMutationID, "test case %d", i)
+	}
+}
+
+func TestClientViewGetterLimitOverrides(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"clientView": {"a": "xxxxxxxx", "b": 1, "c": 2}, "lastMutationID": 1}`))
+	}))
+	defer server.Close()
+
+	config := DefaultClientViewGetterConfig
+	config.MaxKeys = 2
+	g := NewClientViewGetter(config)
+	get := func(opts ClientViewOptions) error {
+		_, _, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", opts)
+		return err
+	}
+
+	err := get(ClientViewOptions{})
+	assert.True(errors.Is(err, ErrClientViewTooManyKeys), "%v", err)
+	assert.NoError(get(ClientViewOptions{MaxKeys: 3}))
+	assert.NoError(get(ClientViewOptions{MaxKeys: -1}))
+	err = get(ClientViewOptions{MaxKeys: -1, MaxValueBytes: 5})
+	assert.True(errors.Is(err, ErrClientViewValueTooLarge), "%v", err)
+	err = get(ClientViewOptions{MaxKeys: -1, MaxBytes: 10})
+	assert.True(errors.Is(err, ErrClientViewTooLarge), "%v", err)
+}
+
+func TestClientViewGetterEncodings(t *testing.T) {
+	assert := assert.New(t)
+	body := `{"clientView": {"a": "` + strings.Repeat("x", 200) + `"}, "lastMutationID": 1}`
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(body))
+	gw.Close()
+	zw, err := zstd.NewWriter(nil)
+	assert.NoError(err)
+	zstded := zw.EncodeAll([]byte(body), nil)
+
+	var gotAcceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAcceptEncoding = r.Header.Get("Accept-Encoding")
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped.Bytes())
+		case "/zstd":
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write(zstded)
+		case "/br":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("whatever"))
+		default:
+			w.Write([]byte(body))
+		}
+	}))
+	defer server.Close()
+
+	g := NewClientViewGetter(DefaultClientViewGetterConfig)
+	want := map[string]json.RawMessage{"a": []byte(`"` + strings.Repeat("x", 200) + `"`)}
+	for _, path := range []string{"/gzip", "/zstd", "/identity"} {
+		resp, code, err := g.Get(context.Background(), server.URL+path, servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+		assert.NoError(err, path)
+		assert.Equal(200, code, path)
+		assert.Equal(want, resp.ClientView, path)
+		assert.Equal("zstd, gzip", gotAcceptEncoding, path)
+	}
+
+	_, _, err = g.Get(context.Background(), server.URL+"/br", servetypes.ClientViewRequest{}, "", "", ClientViewOptions{})
+	assert.EqualError(err, `couldnt decode client view response: unsupported Content-Encoding "br"`)
+
+	// Limits apply to the decompressed response.
+	_, _, err = g.Get(context.Background(), server.URL+"/gzip", servetypes.ClientViewRequest{}, "", "", ClientViewOptions{MaxBytes: int64(gzipped.Len()) + 10})
+	assert.True(errors.Is(err, ErrClientViewTooLarge), "%v", err)
+}
+
+func TestClientViewGetterOnEntry(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"clientView": {"b": 1, "a": [2], "c": {"d": 3}}, "lastMutationID": 4}`))
+	}))
+	defer server.Close()
+
+	g := NewClientViewGetter(DefaultClientViewGetterConfig)
+	var got []string
+	opts := ClientViewOptions{OnEntry: func(key string, value json.RawMessage) error {
+		got = append(got, key+"="+string(value))
+		return nil
+	}}
+	resp, _, err := g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", opts)
+	assert.NoError(err)
+	assert.Equal([]string{"b=1", `a=[2]`, `c={"d": 3}`}, got)
+	assert.Nil(resp.ClientView)
+	assert.Equal(uint64(4), resp.LastMutationID)
+
+	// An error from OnEntry stops the fetch.
+	got = nil
+	opts.OnEntry = func(key string, value json.RawMessage) error {
+		got = append(got, key)
+		return errors.New("full")
+	}
+	_, _, err = g.Get(context.Background(), server.URL, servetypes.ClientViewRequest{}, "", "", opts)
+	assert.EqualError(err, "couldnt decode client view response: full")
+	assert.Equal([]string{"b"}, got)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	for attempt := 0; attempt < 4; attempt++ {
+		max := 100 * time.Millisecond << uint(attempt)
+		for i := 0; i < 20; i++ {
+			d := backoff(100*time.Millisecond, attempt)
+			assert.True(d >= max/2 && d <= max, "attempt %d: %s", attempt, d)
+		}
+	}
+	assert.Equal(time.Duration(0), backoff(0, 3))
+}
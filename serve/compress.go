@@ -0,0 +1,132 @@
+package serve
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionLevel is a codec-independent compression level. It is mapped
+// onto each codec's own scale.
+type CompressionLevel int
+
+const (
+	CompressionDefault CompressionLevel = iota
+	CompressionFastest
+	CompressionBest
+)
+
+// ParseCompressionLevel parses "fastest", "default" or "best".
+func ParseCompressionLevel(s string) (CompressionLevel, error) {
+	switch s {
+	case "fastest":
+		return CompressionFastest, nil
+	case "default", "":
+		return CompressionDefault, nil
+	case "best":
+		return CompressionBest, nil
+	}
+	return CompressionDefault, fmt.Errorf("Unknown compression level: %s", s)
+}
+
+// CompressionConfig configures compression of pull responses.
+type CompressionConfig struct {
+	Level CompressionLevel
+	// MinSize is the size in bytes of the uncompressed response below which
+	// responses are sent uncompressed. Small responses don't compress well
+	// and aren't worth the CPU.
+	MinSize int
+}
+
+// DefaultCompressionConfig is used if the Service is not given a
+// CompressionConfig.
+var DefaultCompressionConfig = CompressionConfig{
+	Level:   CompressionDefault,
+	MinSize: 1024,
+}
+
+// contentCoding is an HTTP content-coding we can compress responses with.
+type contentCoding struct {
+	name      string
+	newWriter func(w io.Writer, level CompressionLevel) (io.WriteCloser, error)
+}
+
+// contentCodings are the supported content-codings in order of server
+// preference, which breaks ties between equal client q-values.
+var contentCodings = []contentCoding{
+	{"zstd", newZstdWriter},
+	{"br", newBrotliWriter},
+	{"gzip", newGzipWriter},
+}
+
+func newZstdWriter(w io.Writer, level CompressionLevel) (io.WriteCloser, error) {
+	l := zstd.SpeedDefault
+	switch level {
+	case CompressionFastest:
+		l = zstd.SpeedFastest
+	case CompressionBest:
+		l = zstd.SpeedBestCompression
+	}
+	// A single response is compressed on a single goroutine; concurrency comes
+	// from handling multiple requests.
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1))
+}
+
+func newBrotliWriter(w io.Writer, level CompressionLevel) (io.WriteCloser, error) {
+	l := brotli.DefaultCompression
+	switch level {
+	case CompressionFastest:
+		l = brotli.BestSpeed
+	case CompressionBest:
+		l = brotli.BestCompression
+	}
+	return brotli.NewWriterLevel(w, l), nil
+}
+
+func newGzipWriter(w io.Writer, level CompressionLevel) (io.WriteCloser, error) {
+	l := gzip.DefaultCompression
+	switch level {
+	case CompressionFastest:
+		l = gzip.BestSpeed
+	case CompressionBest:
+		l = gzip.BestCompression
+	}
+	return gzip.NewWriterLevel(w, l)
+}
+
+// negotiateContentCoding picks the content-coding for the given
+// Accept-Encoding header, honoring q-values and the "*" wildcard. It returns
+// nil if the response should not be compressed.
+func negotiateContentCoding(acceptEncoding string) *contentCoding {
+	accepted := parseAccept(acceptEncoding)
+	qFor := func(name string) (q float64, explicit bool) {
+		for _, a := range accepted {
+			if a.value == name {
+				return a.q, true
+			}
+		}
+		for _, a := range accepted {
+			if a.value == "*" {
+				return a.q, false
+			}
+		}
+		return 0, false
+	}
+
+	var best *contentCoding
+	bestQ := 0.0
+	for i := range contentCodings {
+		if q, _ := qFor(contentCodings[i].name); q > bestQ {
+			best, bestQ = &contentCodings[i], q
+		}
+	}
+	// Identity is only preferred over a supported coding if the client
+	// explicitly asks for it with a higher q-value.
+	if q, explicit := qFor("identity"); explicit && q > bestQ {
+		return nil
+	}
+	return best
+}
@@ -0,0 +1,123 @@
+package serve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/time"
+)
+
+func TestNegotiateContentCoding(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"compress", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"GZIP", "gzip"},
+		{"*", "zstd"},
+		{"gzip;q=1.0, br;q=0.5, zstd;q=0.2", "gzip"},
+		{"zstd;q=0, *", "br"},
+		{"zstd;Q=0, *", "br"},
+		{"zstd ; q = 0.000 , *", "br"},
+		{"*, zstd;q=0, br;q=0", "gzip"},
+		{"zstd;q=invalid, *", "br"},
+		{"gzip;q=2, zstd;q=0.9", "gzip"},
+		{"gzip;q=0.5, identity", ""},
+		{"gzip;q=0", ""},
+		{"*;q=0", ""},
+		{"br;q=0.8, *;q=0.9", "zstd"},
+	}
+	for _, t := range tc {
+		got := negotiateContentCoding(t.acceptEncoding)
+		gotName := ""
+		if got != nil {
+			gotName = got.name
+		}
+		assert.Equal(t.want, gotName, t.acceptEncoding)
+	}
+}
+
+func TestPullCompression(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+
+	big := fmt.Sprintf(`"%s"`, strings.Repeat("x", 2000))
+	tc := []struct {
+		acceptEncoding string
+		value          string
+		minSize        int
+		wantEncoding   string
+	}{
+		{"", big, 1024, ""},
+		{"gzip", big, 1024, "gzip"},
+		{"gzip, br", big, 1024, "br"},
+		{"gzip, br, zstd", big, 1024, "zstd"},
+		{"gzip, br, zstd", `"small"`, 1024, ""},
+		{"gzip", `"small"`, 0, "gzip"},
+	}
+
+	for i, t := range tc {
+		msg := fmt.Sprintf("test case %d: %s", i, t.acceptEncoding)
+		td, _ := ioutil.TempDir("", "")
+		defer func() { assert.NoError(os.RemoveAll(td)) }()
+		adb, adir := account.LoadTempDB(assert)
+		defer func() { assert.NoError(os.RemoveAll(adir)) }()
+		account.AddUnittestAccount(assert, adb)
+		account.AddUnittestAccountHost(assert, adb, "clientview.com")
+
+		fcvg := &fakeClientViewGet{resp: servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"k": b(t.value)}, LastMutationID: 1}, code: 200}
+		s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false, WithCompression(CompressionConfig{Level: CompressionBest, MinSize: t.minSize}))
+
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "clientid", "clientViewURL": "http://clientview.com", "version": 3}`))
+		req.Header.Set("Authorization", account.UnittestKey)
+		req.Header.Set("Accept-Encoding", t.acceptEncoding)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(200, resp.Code, msg)
+		assert.Equal(t.wantEncoding, resp.Header().Get("Content-encoding"), msg)
+
+		var r io.Reader = resp.Body
+		switch t.wantEncoding {
+		case "gzip":
+			gr, err := gzip.NewReader(r)
+			assert.NoError(err, msg)
+			r = gr
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r)
+			assert.NoError(err, msg)
+			defer zr.Close()
+			r = zr
+		}
+		body := bytes.Buffer{}
+		_, err := io.Copy(&body, r)
+		assert.NoError(err, msg)
+		assert.Equal(resp.Header().Get("Entity-length"), fmt.Sprintf("%d", body.Len()), msg)
+		presp, err := servetypes.DecodePullResponse(&body, servetypes.EncodingJSON)
+		assert.NoError(err, msg)
+		assert.Equal(2, len(presp.Patch), msg)
+		assert.Equal(t.value, presp.Patch[1].ValueString, msg)
+	}
+}
@@ -0,0 +1,102 @@
+package serve
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"roci.dev/diff-server/account"
+)
+
+// forwardedHeader returns the headers of the pull request r to copy to the
+// client view request, as allowed by f. Allowed cookies are sent in a
+// single Cookie header.
+func forwardedHeader(f account.Forward, r *http.Request) http.Header {
+	if f.IsZero() {
+		return nil
+	}
+	h := http.Header{}
+	for _, fh := range f.Headers {
+		name := http.CanonicalHeaderKey(fh.Name)
+		for _, v := range r.Header[name] {
+			h.Add(name, v)
+		}
+	}
+	var cookies []string
+	for _, fc := range f.Cookies {
+		if c, err := r.Cookie(fc.Name); err == nil {
+			cookies = append(cookies, (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+		}
+	}
+	if len(cookies) > 0 {
+		h.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	return h
+}
+
+// corsAllowHeaders are the request headers pulls may always have.
+const corsAllowHeaders = "Authorization, Content-type, Referer, User-agent, X-Replicache-SyncID"
+
+// setCORSHeaders sets the CORS headers of the response to the pull r for
+// accounts that forward as in forwards. The headers they forward are
+// allowed in addition to corsAllowHeaders. If any of them forwards cookies
+// and r has an Origin, credentialed requests from that origin are allowed,
+// since browsers only send cookies cross-origin to servers that name the
+// origin and allow credentials.
+func setCORSHeaders(rw http.ResponseWriter, r *http.Request, forwards ...account.Forward) {
+	seen := map[string]bool{}
+	var names []string
+	credentials := false
+	for _, f := range forwards {
+		for _, fh := range f.Headers {
+			name := http.CanonicalHeaderKey(fh.Name)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		credentials = credentials || len(f.Cookies) > 0
+	}
+	sort.Strings(names)
+	allowHeaders := corsAllowHeaders
+	if len(names) > 0 {
+		allowHeaders += ", " + strings.Join(names, ", ")
+	}
+
+	h := rw.Header()
+	h.Set("Access-Control-Allow-Headers", allowHeaders)
+	if origin := r.Header.Get("Origin"); credentials && origin != "" {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+		// "*" is not a wildcard for credentialed requests.
+		h.Set("Access-Control-Allow-Methods", "POST")
+		h.Add("Vary", "Origin")
+	} else {
+		h.Set("Access-Control-Allow-Origin", "*")
+		h.Set("Access-Control-Allow-Methods", "*")
+		h.Del("Access-Control-Allow-Credentials")
+	}
+}
+
+// sensitiveHeaders returns the headers that the account r authenticates as
+// forwards as sensitive, so that they can be redacted from HTTP logs. It is
+// decided from the account's current settings for each request. Inactive
+// accounts' are included, since their pulls are logged before being
+// rejected.
+func (s *Service) sensitiveHeaders(r *http.Request) []string {
+	records, err := s.accounts.Records()
+	if err != nil {
+		// The pull reports the error.
+		return nil
+	}
+	acct, err := account.Authenticate(records, r.Header.Get("Authorization"), s.allowAccountIDAuth)
+	var statusErr *account.StatusError
+	if errors.As(err, &statusErr) {
+		acct, err = records.Record[statusErr.ID], nil
+	}
+	if err != nil {
+		return nil
+	}
+	return acct.Forward.SensitiveHeaders()
+}
@@ -0,0 +1,76 @@
+package serve
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+)
+
+func TestForwardedHeader(t *testing.T) {
+	assert := assert.New(t)
+	r := httptest.NewRequest("POST", "/pull", nil)
+	r.Header.Add("Accept-Language", "de-CH")
+	r.Header.Add("X-App-Version", "1.2")
+	r.Header.Add("X-App-Version", "1.3")
+	r.Header.Add("X-Other", "x")
+	r.Header.Add("Cookie", "session=abc; theme=dark; other=y")
+
+	tc := []struct {
+		forward account.Forward
+		want    http.Header
+	}{
+		{account.Forward{}, nil},
+		{account.Forward{Headers: []account.Forwarded{{Name: "accept-language"}, {Name: "X-App-Version"}, {Name: "X-Missing"}}},
+			http.Header{"Accept-Language": {"de-CH"}, "X-App-Version": {"1.2", "1.3"}}},
+		{account.Forward{Cookies: []account.Forwarded{{Name: "session", Sensitive: true}, {Name: "theme"}, {Name: "missing"}}},
+			http.Header{"Cookie": {"session=abc; theme=dark"}}},
+		{account.Forward{Cookies: []account.Forwarded{{Name: "missing"}}}, http.Header{}},
+	}
+	for i, t := range tc {
+		assert.Equal(t.want, forwardedHeader(t.forward, r), "test case %d", i)
+	}
+}
+
+func TestSensitiveHeaders(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, &fakeClientViewGet{}, false, WithAccountRefreshInterval(0))
+
+	tc := []struct {
+		authorization string
+		forward       account.Forward
+		state         string
+		want          []string
+	}{
+		{account.UnittestKey, account.Forward{}, "", nil},
+		{account.UnittestKey, account.Forward{Headers: []account.Forwarded{{Name: "X-Token", Sensitive: true}, {Name: "X-Other"}}, Cookies: []account.Forwarded{{Name: "session", Sensitive: true}}},
+			"", []string{"X-Token", "Cookie"}},
+		{"rk_1_unknown", account.Forward{Headers: []account.Forwarded{{Name: "X-Token", Sensitive: true}}}, "", nil},
+		// Inactive accounts' pulls are still logged.
+		{account.UnittestKey, account.Forward{Headers: []account.Forwarded{{Name: "X-Token", Sensitive: true}}}, account.StateSuspended, []string{"X-Token"}},
+		// Headers that are no longer sensitive aren't redacted.
+		{account.UnittestKey, account.Forward{Headers: []account.Forwarded{{Name: "X-Token"}}}, "", nil},
+	}
+	for i, t := range tc {
+		assert.NoError(account.Update(adb, func(records *account.Records) error {
+			r := records.Record[account.UnittestID]
+			r.Forward = t.forward
+			r.Status = account.Status{State: t.state}
+			records.Record[account.UnittestID] = r
+			return nil
+		}), "test case %d", i)
+		r := httptest.NewRequest("POST", "/pull", nil)
+		r.Header.Set("Authorization", t.authorization)
+		assert.Equal(t.want, s.sensitiveHeaders(r), "test case %d", i)
+	}
+}
@@ -3,20 +3,42 @@
 package serve
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
+	zl "github.com/rs/zerolog"
 	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/db"
+	"roci.dev/diff-server/kv"
 	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/signature"
 )
 
-// inject inserts a client view into the cache. This is primarily useful for testing without
-// having to have a data layer running.
+const (
+	// maxInjectBytes caps the size of inject request bodies.
+	maxInjectBytes = 64 << 20
+	// maxInjectClients caps the number of clients updated by one inject
+	// request.
+	maxInjectClients = 1000
+)
+
+// inject stores client data sent by a data layer, so that it can push
+// updates instead of waiting for pulls to fetch them. Requests signed with
+// the account's signing secret are always accepted, with the request's
+// path, /inject, standing in for the URL. Unsigned requests are only
+// accepted with --enable-inject, which is for testing without having to
+// have a data layer running.
 func (s *Service) inject(w http.ResponseWriter, r *http.Request) {
 	l := logger(r)
 
-	if !s.enableInject {
+	signed := r.Header.Get(signature.HeaderSignature) != ""
+	if !signed && !s.enableInject {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -26,8 +48,18 @@ func (s *Service) inject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body := bytes.Buffer{}
+	if _, err := io.Copy(&body, io.LimitReader(r.Body, maxInjectBytes+1)); err != nil {
+		serverError(w, fmt.Errorf("could not read body: %w", err), l)
+		return
+	}
+	if body.Len() > maxInjectBytes {
+		clientError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Inject request body too large: limit is %d bytes", maxInjectBytes), l)
+		return
+	}
+
 	var req servetypes.InjectRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := json.NewDecoder(bytes.NewReader(body.Bytes())).Decode(&req)
 	if err != nil {
 		clientError(w, http.StatusBadRequest, errors.Wrap(err, "Bad request payload").Error(), l)
 		return
@@ -38,32 +70,221 @@ func (s *Service) inject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// This check seems kind of useless given that much account info is public.
-	records, err := account.ReadAllRecords(s.accountDB)
+	records, err := s.accounts.Records()
 	if err != nil {
 		serverError(w, err, l)
+		return
 	}
-	_, ok := account.Lookup(records, req.AccountID)
+	acct, ok := account.LookupID(records, req.AccountID)
 	if !ok {
 		clientError(w, http.StatusBadRequest, "Unknown accountID", l)
 		return
 	}
 
-	// TODO: auth
+	if signed {
+		if acct.SigningSecret == "" {
+			clientError(w, http.StatusUnauthorized, "Account has no signing secret", l)
+			return
+		}
+		err := signature.Verify(acct.SigningSecret, r.Header.Get(signature.HeaderSignature), r.Header.Get(signature.HeaderTimestamp), r.Method, r.URL.RequestURI(), body.Bytes(), time.Now(), signature.DefaultMaxSkew)
+		if err != nil {
+			clientError(w, http.StatusUnauthorized, fmt.Sprintf("Invalid signature: %s", err), l)
+			return
+		}
+	}
 
-	if req.ClientID == "" {
-		clientError(w, http.StatusBadRequest, "Missing clientID", l)
+	if !account.Active(acct) {
+		clientError(w, http.StatusForbidden, inactiveMessage(acct.Status), l)
 		return
 	}
 
-	db, err := s.GetDB(req.AccountID, req.ClientID)
+	accountName := strconv.FormatUint(uint64(acct.ID), 10)
+	schemas, err := s.schemas.keySchemas(acct.Schemas)
 	if err != nil {
 		serverError(w, err, l)
 		return
 	}
+	limits := s.clientViewLimits(acct)
+
+	if len(req.Clients) == 0 {
+		if req.ClientID == "" {
+			clientError(w, http.StatusBadRequest, "Missing clientID", l)
+			return
+		}
+		// The single client form is checked like a batch of one full
+		// client view.
+		ci := servetypes.ClientInjection{
+			ClientID:       req.ClientID,
+			LastMutationID: req.ClientViewResponse.LastMutationID,
+			ClientView:     req.ClientViewResponse.ClientView,
+		}
+		if ci.ClientView == nil {
+			ci.ClientView = map[string]json.RawMessage{}
+		}
+		res, err := s.injectClient(accountName, ci, schemas, limits, l)
+		if err != nil {
+			serverError(w, fmt.Errorf("could not inject client %s: %w", ci.ClientID, err), l)
+			return
+		}
+		if res.Conflict {
+			clientError(w, http.StatusConflict, res.Error, l)
+		} else if res.Error != "" {
+			clientError(w, http.StatusBadRequest, res.Error, l)
+		}
+		return
+	}
+
+	if req.ClientID != "" {
+		clientError(w, http.StatusBadRequest, "Only one of clientID and clients can be given", l)
+		return
+	}
+	if len(req.Clients) > maxInjectClients {
+		clientError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Too many clients: limit is %d", maxInjectClients), l)
+		return
+	}
 
-	err = storeClientView(db, req.ClientViewResponse, l)
+	resp := servetypes.InjectResponse{Results: make([]servetypes.InjectResult, 0, len(req.Clients))}
+	for _, ci := range req.Clients {
+		res, err := s.injectClient(accountName, ci, schemas, limits, l)
+		if err != nil {
+			serverError(w, fmt.Errorf("could not inject client %s: %w", ci.ClientID, err), l)
+			return
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	w.Header().Set("Content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		l.Info().Err(err).Msg("Error writing inject response")
+	}
+}
+
+// clientViewLimits returns the limits on acct's client views: the ones they
+// are fetched with.
+func (s *Service) clientViewLimits(acct account.Record) clientViewLimits {
+	config := DefaultClientViewGetterConfig
+	if g, ok := s.clientViewGetter.(*ClientViewGetter); ok {
+		config = g.config
+	}
+	return limitsFor(config, clientViewOptions(acct))
+}
+
+// injectClient makes the update ci. Invalid updates and conflicts are
+// reported in the result; the error is for failures of the server.
+func (s *Service) injectClient(accountName string, ci servetypes.ClientInjection, schemas keySchemas, limits clientViewLimits, l zl.Logger) (servetypes.InjectResult, error) {
+	res := servetypes.InjectResult{ClientID: ci.ClientID}
+	if ci.ClientID == "" {
+		res.Error = "missing clientID"
+		return res, nil
+	}
+	if (ci.ClientView == nil) == (ci.Patch == nil) {
+		res.Error = "exactly one of clientView and patch must be given"
+		return res, nil
+	}
+	l = l.With().Str("cid", ci.ClientID).Logger()
+
+	cdb, err := s.GetDB(accountName, ci.ClientID)
 	if err != nil {
-		serverError(w, err, l)
+		return res, err
+	}
+	head := cdb.Head()
+	res.StateID = head.NomsStruct.Hash().String()
+	if ci.ExpectedStateID != "" && ci.ExpectedStateID != res.StateID {
+		res.Error = fmt.Sprintf("client is at state %s, not %s", res.StateID, ci.ExpectedStateID)
+		res.Conflict = true
+		return res, nil
+	}
+	if headLMID := uint64(head.Value.LastMutationID); ci.LastMutationID < headLMID {
+		res.Error = fmt.Sprintf("lastMutationID %d is older than the client's %d", ci.LastMutationID, headLMID)
+		return res, nil
+	}
+
+	var m kv.Map
+	if ci.ClientView != nil {
+		if err := checkInjectLimits(ci.ClientView, nil, limits); err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+		ed := newClientViewEditor(cdb.Noms(), schemas)
+		if err := ed.addAll(ci.ClientView); err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+		if err := ed.validator.err(); err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+		m = ed.me.Build()
+	} else {
+		if err := checkInjectLimits(nil, ci.Patch, limits); err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+		validator := schemaValidator{schemas: schemas}
+		for _, op := range ci.Patch {
+			if op.Op == kv.OpAdd || op.Op == kv.OpReplace {
+				validator.check(op.Key(), op.Value)
+			}
+		}
+		if err := validator.err(); err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+		m, err = kv.ApplyPatch(0, cdb.Noms(), head.Data(cdb.Noms()), ci.Patch)
+		if err != nil {
+			res.Error = fmt.Sprintf("could not apply patch: %s", err)
+			return res, nil
+		}
+		if limits.maxKeys > 0 && int64(m.Len()) > limits.maxKeys {
+			res.Error = fmt.Sprintf("%s: limit is %d", ErrClientViewTooManyKeys, limits.maxKeys)
+			return res, nil
+		}
+	}
+
+	// The data is committed on top of the head read above, so that it
+	// fails if the head has moved since, eg by a concurrent pull.
+	err = commitClientView(cdb, m, ci.LastMutationID, l)
+	if errors.Is(err, db.ErrHeadChanged) {
+		res.Error = "client's state changed concurrently"
+		res.Conflict = true
+		if err := cdb.Reload(); err != nil {
+			return res, err
+		}
+		res.StateID = cdb.Hash().String()
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+	res.StateID = cdb.Hash().String()
+	return res, nil
+}
+
+// checkInjectLimits checks an injected client view or the values of an
+// injected patch against the limits that fetched client views are held to.
+func checkInjectLimits(clientView map[string]json.RawMessage, patch []kv.Operation, limits clientViewLimits) error {
+	checkValue := func(v json.RawMessage) error {
+		if limits.maxValueBytes > 0 && int64(len(v)) > limits.maxValueBytes {
+			return fmt.Errorf("%w: limit is %d bytes", ErrClientViewValueTooLarge, limits.maxValueBytes)
+		}
+		return nil
+	}
+	if limits.maxKeys > 0 && int64(len(clientView)) > limits.maxKeys {
+		return fmt.Errorf("%w: limit is %d", ErrClientViewTooManyKeys, limits.maxKeys)
+	}
+	var size int64
+	for k, v := range clientView {
+		if err := checkValue(v); err != nil {
+			return err
+		}
+		size += int64(len(k) + len(v))
+	}
+	if limits.maxBytes > 0 && size > limits.maxBytes {
+		return fmt.Errorf("%w: limit is %d bytes", ErrClientViewTooLarge, limits.maxBytes)
+	}
+	for _, op := range patch {
+		if err := checkValue(op.Value); err != nil {
+			return err
+		}
 	}
+	return nil
 }
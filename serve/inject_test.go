@@ -2,6 +2,7 @@ package serve
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,11 +11,15 @@ import (
 	"os"
 	"strings"
 	"testing"
+	gotime "time"
 
 	"github.com/attic-labs/noms/go/types"
 	"github.com/stretchr/testify/assert"
 
 	"roci.dev/diff-server/account"
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/signature"
+	nomsjson "roci.dev/diff-server/util/noms/json"
 	"roci.dev/diff-server/util/time"
 )
 
@@ -84,3 +89,197 @@ func TestInject(t *testing.T) {
 		}
 	}
 }
+
+func TestInjectSigned(t *testing.T) {
+	assert := assert.New(t)
+	body := fmt.Sprintf(`{"accountID": "%d", "clients": [{"clientID": "c1", "lastMutationID": 1, "clientView": {"foo": "bar"}}]}`, account.UnittestID)
+
+	tc := []struct {
+		accountSecret string
+		signSecret    string
+		signedAt      gotime.Time
+		injectEnabled bool
+		wantRespCode  int
+		wantRespBody  string
+	}{
+		// Unsigned requests need --enable-inject.
+		{"secret", "", gotime.Now(), false, http.StatusNotFound, ``},
+		{"secret", "", gotime.Now(), true, http.StatusOK, `{"results":[{"clientID":"c1","stateID":"*"}]}`},
+		// Signed requests don't.
+		{"secret", "secret", gotime.Now(), false, http.StatusOK, `{"results":[{"clientID":"c1","stateID":"*"}]}`},
+		{"secret", "secret", gotime.Now(), true, http.StatusOK, `{"results":[{"clientID":"c1","stateID":"*"}]}`},
+		{"secret", "other", gotime.Now(), false, http.StatusUnauthorized, `Invalid signature: signature does not match`},
+		{"secret", "secret", gotime.Now().Add(-gotime.Hour), false, http.StatusUnauthorized, `Invalid signature: signature timestamp is too old or too far in the future`},
+		{"", "secret", gotime.Now(), false, http.StatusUnauthorized, `Account has no signing secret`},
+	}
+
+	for i, t := range tc {
+		msg := fmt.Sprintf("test case %d", i)
+		td, _ := ioutil.TempDir("", "")
+		defer func() { assert.NoError(os.RemoveAll(td)) }()
+		adb, adir := account.LoadTempDB(assert)
+		defer func() { assert.NoError(os.RemoveAll(adir)) }()
+		account.AddUnittestAccount(assert, adb)
+		assert.NoError(account.Update(adb, func(records *account.Records) error {
+			r := records.Record[account.UnittestID]
+			r.SigningSecret = t.accountSecret
+			records.Record[account.UnittestID] = r
+			return nil
+		}), msg)
+
+		s := NewService(td, account.MaxASClientViewHosts, adb, false, nil, t.injectEnabled)
+		req := httptest.NewRequest("POST", "/inject", strings.NewReader(body))
+		if t.signSecret != "" {
+			signature.SignRequest(req, t.signSecret, t.signedAt, "/inject", []byte(body))
+		}
+		resp := httptest.NewRecorder()
+		s.inject(resp, req)
+
+		assert.Equal(t.wantRespCode, resp.Code, msg)
+		if t.wantRespCode == http.StatusOK {
+			db, err := s.GetDB(fmt.Sprintf("%d", account.UnittestID), "c1")
+			assert.NoError(err, msg)
+			assert.Equal(strings.Replace(t.wantRespBody, "*", db.Hash().String(), 1)+"\n", resp.Body.String(), msg)
+		} else {
+			assert.Equal(t.wantRespBody, resp.Body.String(), msg)
+		}
+	}
+}
+
+func TestInjectClients(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Schemas = []account.KeySchema{{Prefix: "todo/", Schema: `{"type": "object"}`}}
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, nil, true)
+	accountID := fmt.Sprintf("%d", account.UnittestID)
+
+	stateID := func(clientID string) string {
+		db, err := s.GetDB(accountID, clientID)
+		assert.NoError(err)
+		return db.Hash().String()
+	}
+	data := func(clientID string) map[string]string {
+		db, err := s.GetDB(accountID, clientID)
+		assert.NoError(err)
+		r := map[string]string{}
+		db.Head().Data(db.Noms()).NomsMap().IterAll(func(k, v types.Value) {
+			b := &bytes.Buffer{}
+			assert.NoError(nomsjson.ToJSON(v, b))
+			r[string(k.(types.String))] = strings.TrimSpace(b.String())
+		})
+		return r
+	}
+	inject := func(clients string) (int, servetypes.InjectResponse, string) {
+		req := httptest.NewRequest("POST", "/inject", strings.NewReader(fmt.Sprintf(`{"accountID": "%s", "clients": %s}`, accountID, clients)))
+		resp := httptest.NewRecorder()
+		s.inject(resp, req)
+		var ir servetypes.InjectResponse
+		if resp.Code == http.StatusOK {
+			assert.NoError(json.Unmarshal(resp.Body.Bytes(), &ir))
+		}
+		return resp.Code, ir, resp.Body.String()
+	}
+
+	// Full views for several clients.
+	code, ir, _ := inject(`[
+		{"clientID": "c1", "lastMutationID": 1, "clientView": {"todo/1": {"done": false}, "foo": "bar"}},
+		{"clientID": "c2", "lastMutationID": 3, "clientView": {"foo": "baz"}}]`)
+	assert.Equal(http.StatusOK, code)
+	s1 := stateID("c1")
+	assert.Equal([]servetypes.InjectResult{{ClientID: "c1", StateID: s1}, {ClientID: "c2", StateID: stateID("c2")}}, ir.Results)
+	assert.Equal(map[string]string{"todo/1": `{"done":false}`, "foo": `"bar"`}, data("c1"))
+	assert.Equal(map[string]string{"foo": `"baz"`}, data("c2"))
+
+	// A patch against the expected state.
+	code, ir, _ = inject(fmt.Sprintf(`[{"clientID": "c1", "expectedStateID": "%s", "lastMutationID": 2, "patch": [
+		{"op": "replace", "path": "/todo~11", "value": {"done": true}},
+		{"op": "remove", "path": "/foo"}]}]`, s1))
+	assert.Equal(http.StatusOK, code)
+	s2 := stateID("c1")
+	assert.NotEqual(s1, s2)
+	assert.Equal([]servetypes.InjectResult{{ClientID: "c1", StateID: s2}}, ir.Results)
+	assert.Equal(map[string]string{"todo/1": `{"done":true}`}, data("c1"))
+
+	// Failures leave the clients as they were and don't affect the others.
+	code, ir, _ = inject(fmt.Sprintf(`[
+		{"clientID": "c1", "expectedStateID": "%s", "lastMutationID": 3, "patch": [{"op": "remove", "path": "/todo~11"}]},
+		{"clientID": "c1", "lastMutationID": 1, "clientView": {}},
+		{"clientID": "c1", "lastMutationID": 3, "clientView": {}, "patch": []},
+		{"clientID": "c1", "lastMutationID": 3},
+		{"lastMutationID": 3, "clientView": {}},
+		{"clientID": "c1", "lastMutationID": 3, "patch": [{"op": "add", "path": "/todo~12", "value": 42}]},
+		{"clientID": "c1", "lastMutationID": 3, "clientView": {"todo/2": 42}},
+		{"clientID": "c1", "lastMutationID": 3, "patch": [{"op": "add", "path": "bad", "value": 42}]},
+		{"clientID": "c2", "lastMutationID": 4, "patch": [{"op": "add", "path": "/foo", "value": "qux"}]}]`, s1))
+	assert.Equal(http.StatusOK, code)
+	assert.Equal([]servetypes.InjectResult{
+		{ClientID: "c1", StateID: s2, Error: fmt.Sprintf("client is at state %s, not %s", s2, s1), Conflict: true},
+		{ClientID: "c1", StateID: s2, Error: "lastMutationID 1 is older than the client's 2"},
+		{ClientID: "c1", Error: "exactly one of clientView and patch must be given"},
+		{ClientID: "c1", Error: "exactly one of clientView and patch must be given"},
+		{Error: "missing clientID"},
+		{ClientID: "c1", StateID: s2, Error: `client view not stored: 1 invalid values: key "todo/2": expected object, got integer`},
+		{ClientID: "c1", StateID: s2, Error: `client view not stored: 1 invalid values: key "todo/2": expected object, got integer`},
+		{ClientID: "c1", StateID: s2, Error: "could not apply patch: Invalid path bad - must start with /"},
+		{ClientID: "c2", StateID: stateID("c2")},
+	}, ir.Results)
+	assert.Equal(s2, stateID("c1"))
+	assert.Equal(map[string]string{"foo": `"qux"`}, data("c2"))
+
+	// Request errors.
+	code, _, body := inject(`[{"clientID": "c1", "clientView": {}}], "clientID": "c1"`)
+	assert.Equal(http.StatusBadRequest, code)
+	assert.Equal("Only one of clientID and clients can be given", body)
+	code, _, body = inject("[" + strings.Repeat(`{"clientID": "c1", "clientView": {}},`, maxInjectClients) + `{"clientID": "c1", "clientView": {}}]`)
+	assert.Equal(http.StatusRequestEntityTooLarge, code)
+	assert.Equal(fmt.Sprintf("Too many clients: limit is %d", maxInjectClients), body)
+}
+
+func TestInjectSingleClientChecked(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Schemas = []account.KeySchema{{Prefix: "todo/", Schema: `{"type": "object"}`}}
+		r.Limits.MaxClientViewKeys = 2
+		r.Limits.MaxClientViewValueBytes = 10
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, nil, true)
+
+	tc := []struct {
+		clientViewResponse string
+		wantCode           int
+		wantBody           string
+	}{
+		{`{"clientView": {"todo/1": {}, "foo": "bar"}, "lastMutationID": 2}`, http.StatusOK, ""},
+		{`{"clientView": {"todo/1": 42}, "lastMutationID": 3}`, http.StatusBadRequest, `client view not stored: 1 invalid values: key "todo/1": expected object, got integer`},
+		{`{"clientView": {"foo": "bar"}, "lastMutationID": 1}`, http.StatusBadRequest, "lastMutationID 1 is older than the client's 2"},
+		{`{"clientView": {"a": 1, "b": 2, "c": 3}, "lastMutationID": 3}`, http.StatusBadRequest, "client view has too many keys: limit is 2"},
+		{`{"clientView": {"a": "0123456789"}, "lastMutationID": 3}`, http.StatusBadRequest, "client view value too large: limit is 10 bytes"},
+	}
+	for i, t := range tc {
+		req := httptest.NewRequest("POST", "/inject", strings.NewReader(fmt.Sprintf(`{"accountID": "%d", "clientID": "c1", "clientViewResponse": %s}`, account.UnittestID, t.clientViewResponse)))
+		resp := httptest.NewRecorder()
+		s.inject(resp, req)
+		assert.Equal(t.wantCode, resp.Code, "test case %d", i)
+		assert.Equal(t.wantBody, resp.Body.String(), "test case %d", i)
+	}
+	db, err := s.GetDB(fmt.Sprintf("%d", account.UnittestID), "c1")
+	assert.NoError(err)
+	assert.Equal(uint64(2), uint64(db.Head().Value.LastMutationID))
+}
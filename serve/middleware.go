@@ -64,9 +64,13 @@ func panicCatcher(next http.Handler) http.Handler {
 	})
 }
 
-// logHTTP is http middleware that dumps HTTP requests and responses via loghttp.
-func logHTTP(next http.Handler) http.Handler {
+// logHTTP is http middleware that dumps HTTP requests and responses via
+// loghttp. The headers the request's account forwards as sensitive are
+// redacted, including from the client view requests made under the
+// request's context.
+func (s *Service) logHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(loghttp.WithRedactedHeaders(r.Context(), s.sensitiveHeaders(r)...))
 		handler := loghttp.Wrap(next, logger(r))
 		handler.ServeHTTP(w, r)
 	})
@@ -0,0 +1,73 @@
+package serve
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	servetypes "roci.dev/diff-server/serve/types"
+)
+
+// acceptable is a single entry of an Accept-style header, eg
+// "application/cbor;q=0.9".
+type acceptable struct {
+	value string
+	q     float64
+}
+
+// parseAccept parses an Accept-style header into its entries, most
+// preferred first. Entries with equal q-values keep their header order.
+// Entries with q=0 are kept (at the end) because they explicitly mark a
+// value as not acceptable, which matters for wildcards.
+func parseAccept(header string) []acceptable {
+	var r []acceptable
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		a := acceptable{value: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		if a.value == "" {
+			continue
+		}
+		for _, p := range params[1:] {
+			kv := strings.SplitN(p, "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "q") {
+				continue
+			}
+			a.q = parseQ(strings.TrimSpace(kv[1]))
+		}
+		r = append(r, a)
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].q > r[j].q
+	})
+	return r
+}
+
+// parseQ parses a q-value. Invalid ones are taken as 0 so that a malformed
+// exclusion, eg "zstd;q=o", still excludes rather than prefers.
+func parseQ(s string) float64 {
+	q, err := strconv.ParseFloat(s, 64)
+	if err != nil || q < 0 {
+		return 0
+	}
+	if q > 1 {
+		return 1
+	}
+	return q
+}
+
+// negotiateEncoding picks the PullResponse encoding for the given Accept
+// header. JSON is returned unless the client prefers a binary encoding.
+func negotiateEncoding(accept string) servetypes.Encoding {
+	for _, a := range parseAccept(accept) {
+		if a.q <= 0 {
+			continue
+		}
+		if a.value == "*/*" || a.value == "application/*" {
+			return servetypes.EncodingJSON
+		}
+		if e, ok := servetypes.EncodingForContentType(a.value); ok {
+			return e
+		}
+	}
+	return servetypes.EncodingJSON
+}
@@ -3,15 +3,15 @@
 package serve
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
-	"strings"
 
 	"github.com/attic-labs/noms/go/hash"
 	"github.com/attic-labs/noms/go/types"
@@ -22,6 +22,7 @@ import (
 	"roci.dev/diff-server/kv"
 	servetypes "roci.dev/diff-server/serve/types"
 	nomsjson "roci.dev/diff-server/util/noms/json"
+	"roci.dev/diff-server/util/ratelimit"
 )
 
 func (s *Service) pull(rw http.ResponseWriter, r *http.Request) {
@@ -30,20 +31,70 @@ func (s *Service) pull(rw http.ResponseWriter, r *http.Request) {
 		unsupportedMethodError(rw, r.Method, l)
 		return
 	}
-	rw.Header().Set("Access-Control-Allow-Origin", "*")
-	rw.Header().Set("Access-Control-Allow-Methods", "*")
-	rw.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-type, Referer, User-agent, X-Replicache-SyncID")
 	if r.Method == "OPTIONS" {
+		// Preflight requests don't carry the Authorization header, so they
+		// are answered for every account.
+		var forwards []account.Forward
+		if accounts, err := s.accounts.Records(); err == nil {
+			for _, record := range accounts.Record {
+				forwards = append(forwards, record.Forward)
+			}
+		}
+		setCORSHeaders(rw, r, forwards...)
 		rw.WriteHeader(200)
 		return
 	}
+	setCORSHeaders(rw, r)
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		clientError(rw, http.StatusBadRequest, "Missing Authorization header", l)
+		return
+	}
+	accounts, err := s.accounts.Records()
+	if err != nil {
+		serverError(rw, err, l)
+		return
+	}
+	// accountName names the account's storage. It is the account ID unless
+	// auth is disabled and the Authorization header doesn't identify an
+	// account, in which case the header itself is used.
+	accountName := authorization
+	acct, err := account.Authenticate(accounts, authorization, s.allowAccountIDAuth)
+	known := err == nil
+	var statusErr *account.StatusError
+	if known {
+		accountName = strconv.FormatUint(uint64(acct.ID), 10)
+		setCORSHeaders(rw, r, acct.Forward)
+	} else if errors.As(err, &statusErr) {
+		clientError(rw, http.StatusForbidden, inactiveMessage(statusErr.Status), l)
+		return
+	} else if !s.disableAuth {
+		// Don't echo the Authorization header: it might be a mistyped key.
+		clientError(rw, http.StatusBadRequest, "Unknown account or invalid key", l)
+		return
+	}
 
+	// The body is read after authenticating so that the account's limit on
+	// its size applies.
+	maxPullBytes := s.maxPullBytes
+	if known && acct.Limits.MaxPullBytes != 0 {
+		maxPullBytes = acct.Limits.MaxPullBytes
+	}
+	var bodyReader io.Reader = r.Body
+	if maxPullBytes > 0 {
+		bodyReader = io.LimitReader(r.Body, maxPullBytes+1)
+	}
 	body := bytes.Buffer{}
-	_, err := io.Copy(&body, r.Body)
+	_, err = io.Copy(&body, bodyReader)
 	if err != nil {
 		serverError(rw, fmt.Errorf("could not read body: %w", err), l)
 		return
 	}
+	if maxPullBytes > 0 && int64(body.Len()) > maxPullBytes {
+		clientError(rw, http.StatusRequestEntityTooLarge, fmt.Sprintf("Pull request body too large: limit is %d bytes", maxPullBytes), l)
+		return
+	}
 
 	var preq servetypes.PullRequest
 	err = json.Unmarshal(body.Bytes(), &preq)
@@ -57,31 +108,19 @@ func (s *Service) pull(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accountName := r.Header.Get("Authorization")
-	if accountName == "" {
-		clientError(rw, http.StatusBadRequest, "Missing Authorization header", l)
-		return
-	}
-	accounts, err := account.ReadAllRecords(s.accountDB)
-	if err != nil {
-		serverError(rw, err, l)
+	if preq.ClientID == "" {
+		clientError(rw, http.StatusBadRequest, "Missing clientID", l)
 		return
 	}
-	var acct account.Record
-	if !s.disableAuth {
-		var ok bool
-		acct, ok = account.Lookup(accounts, accountName)
-		if !ok {
-			clientError(rw, http.StatusBadRequest, fmt.Sprintf("Unknown account: %s", accountName), l)
+
+	if known {
+		if allowed, wait, reason := s.limiter.allowPull(accountName, preq.ClientID, account.EffectiveLimits(acct)); !allowed {
+			rw.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+			clientError(rw, http.StatusTooManyRequests, fmt.Sprintf("Too many requests: %s", reason), l)
 			return
 		}
 	}
 
-	if preq.ClientID == "" {
-		clientError(rw, http.StatusBadRequest, "Missing clientID", l)
-		return
-	}
-
 	db, err := s.GetDB(accountName, preq.ClientID)
 	if err != nil {
 		serverError(rw, err, l)
@@ -108,19 +147,20 @@ func (s *Service) pull(rw http.ResponseWriter, r *http.Request) {
 		clientViewURL = preq.ClientViewURL
 
 		var authorized bool
+		var reason string
 		if s.disableAuth {
 			l.Info().Msg("Ignoring auth for this request (--disable-auth=true)")
 			authorized = true
 		} else {
 			var err error
-			authorized, err = account.ClientViewURLAuthorized(s.maxASClientViewURLs, s.accountDB, accounts, acct.ID, clientViewURL, l)
+			authorized, reason, err = s.accounts.ClientViewURLAuthorized(s.maxASClientViewURLs, acct.ID, clientViewURL, l)
 			if err != nil {
 				serverError(rw, err, l)
 				return
 			}
 		}
 		if !authorized {
-			clientError(rw, http.StatusForbidden, "clientViewURL is not authorized; please contact support@replicache.dev", l)
+			clientError(rw, http.StatusForbidden, fmt.Sprintf("clientViewURL is not authorized: %s; please contact support@replicache.dev", reason), l)
 			return
 		}
 	} else {
@@ -140,7 +180,17 @@ func (s *Service) pull(rw http.ResponseWriter, r *http.Request) {
 	if preq.LastMutationID > minLastMutationID {
 		minLastMutationID = preq.LastMutationID
 	}
-	cvInfo := maybeGetAndStoreNewClientView(db, preq.ClientViewAuth, clientViewURL, s.clientViewGetter, cvReq, minLastMutationID, syncID, l)
+	schemas, err := s.schemas.keySchemas(acct.Schemas)
+	if err != nil {
+		serverError(rw, err, l)
+		return
+	}
+	cvOpts := clientViewOptions(acct)
+	cvOpts.Header = forwardedHeader(acct.Forward, r)
+	cvInfo, cvStats := maybeGetAndStoreNewClientView(r.Context(), db, accountName, preq.ClientViewAuth, clientViewURL, s.clientViewSource(clientViewURL), cvOpts, schemas, s.breaker, cvReq, minLastMutationID, syncID, l)
+	if known && cvStats.size > 0 {
+		s.limiter.addClientViewBytes(accountName, cvStats.size)
+	}
 
 	head = db.Head() // head could have changed in maybeGetAndStoreNewClientView
 	var presp servetypes.PullResponse
@@ -161,30 +211,66 @@ func (s *Service) pull(rw http.ResponseWriter, r *http.Request) {
 			ClientViewInfo: cvInfo,
 		}
 	}
-	resp, err := json.Marshal(presp)
-	if err != nil {
+	enc := negotiateEncoding(r.Header.Get("Accept"))
+	// Entity-length is the uncompressed length, which clients use to report
+	// progress, and has to be sent before the body. Rather than hold the
+	// encoded response in memory to learn it, the response is encoded twice:
+	// once to count its bytes and then again as it is sent.
+	var respLen countingWriter
+	if err := servetypes.EncodePullResponse(&respLen, enc, presp); err != nil {
 		serverError(rw, err, l)
 		return
 	}
-	// Add a newline to make output to console etc nicer.
-	resp = append(resp, byte('\n'))
-	rw.Header().Set("Content-type", "application/json")
-	rw.Header().Set("Entity-length", strconv.Itoa(len(resp)))
+	if known && s.meter != nil {
+		s.meter.RecordPull(acct.ID, account.PullUsage{
+			ClientID:          preq.ClientID,
+			FullSync:          preq.BaseStateID == "",
+			PatchBytes:        uint64(respLen),
+			ClientViewFetched: cvStats.fetched,
+			ClientViewFailed:  cvStats.failed,
+			ClientViewSize:    uint64(cvStats.size),
+		})
+	}
+	rw.Header().Set("Content-type", enc.ContentType())
+	rw.Header().Set("Entity-length", strconv.FormatInt(int64(respLen), 10))
+	rw.Header().Add("Vary", "Accept")
+	rw.Header().Add("Vary", "Accept-Encoding")
 
 	w := io.Writer(rw)
-	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-		rw.Header().Set("Content-encoding", "gzip")
-		gzw := gzip.NewWriter(rw)
-		defer gzw.Close()
-		w = gzw
+	var cw io.WriteCloser
+	if int64(respLen) >= int64(s.compression.MinSize) {
+		if cc := negotiateContentCoding(r.Header.Get("Accept-Encoding")); cc != nil {
+			cw, err = cc.newWriter(rw, s.compression.Level)
+			if err != nil {
+				serverError(rw, err, l)
+				return
+			}
+			rw.Header().Set("Content-encoding", cc.name)
+			w = cw
+		}
+	}
+	bw := bufio.NewWriter(w)
+	err = servetypes.EncodePullResponse(bw, enc, presp)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && cw != nil {
+		err = cw.Close()
 	}
-	_, err = io.Copy(w, bytes.NewReader(resp))
 	if err != nil {
-		serverError(rw, err, l)
-		return
+		// Headers have already been sent so all we can do is log.
+		l.Info().Err(err).Msg("Error writing pull response")
 	}
 }
 
+// countingWriter counts the bytes written to it and discards them.
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
 func nopPull(pullReq *servetypes.PullRequest, cvInfo *servetypes.ClientViewInfo) servetypes.PullResponse {
 	return servetypes.PullResponse{
 		StateID:        pullReq.BaseStateID,
@@ -195,8 +281,19 @@ func nopPull(pullReq *servetypes.PullRequest, cvInfo *servetypes.ClientViewInfo)
 	}
 }
 
-func maybeGetAndStoreNewClientView(db *db.DB, clientViewAuth string, url string, cvg clientViewGetter, cvReq servetypes.ClientViewRequest, minLastMutationID uint64, syncID string, l zl.Logger) servetypes.ClientViewInfo {
-	clientViewInfo := servetypes.ClientViewInfo{}
+// clientViewStats describes a client view fetch, for limits and metering.
+type clientViewStats struct {
+	fetched bool
+	failed  bool
+	// size is the number of bytes in the keys and values of the client
+	// view fetched.
+	size int64
+}
+
+// maybeGetAndStoreNewClientView fetches the client view and stores it if it
+// is newer than minLastMutationID and valid against schemas. The fetch is
+// skipped if br is open for the account's client view host.
+func maybeGetAndStoreNewClientView(ctx context.Context, db *db.DB, accountName string, clientViewAuth string, url string, cvg ClientViewSource, cvOpts ClientViewOptions, schemas keySchemas, br *breaker, cvReq servetypes.ClientViewRequest, minLastMutationID uint64, syncID string, l zl.Logger) (clientViewInfo servetypes.ClientViewInfo, stats clientViewStats) {
 	var err error
 	defer func() {
 		if err != nil {
@@ -207,47 +304,119 @@ func maybeGetAndStoreNewClientView(db *db.DB, clientViewAuth string, url string,
 
 	if url == "" {
 		err = errors.New("not fetching new client view: no url provided via account or --client-view")
-		return clientViewInfo
+		return clientViewInfo, stats
+	}
+	host := clientViewHost(url)
+	if !br.allow(accountName, host) {
+		clientViewInfo.CircuitBreakerOpen = true
+		err = fmt.Errorf("not fetching new client view: circuit breaker for %s is open after repeated failures", host)
+		return clientViewInfo, stats
+	}
+	stats.fetched = true
+	// Entries are built into the new client view as they are decoded,
+	// rather than after the whole response has been read.
+	ed := newClientViewEditor(db.Noms(), schemas)
+	cvOpts.OnEntry = ed.add
+	cvResp, cvCode, err := cvg.Get(ctx, url, cvReq, clientViewAuth, syncID, cvOpts)
+	// Only count failures that say something about the host: the client
+	// going away or the data layer rejecting the request don't. Deadlines
+	// passing do, since hosts that hang are what the breaker is for.
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		br.record(accountName, host, err == nil || (cvCode != 0 && cvCode < 500))
 	}
-	cvResp, cvCode, err := cvg.Get(url, cvReq, clientViewAuth, syncID)
 	clientViewInfo.HTTPStatusCode = cvCode
+	if err == nil {
+		// Sources that don't support OnEntry return the client view whole.
+		err = ed.addAll(cvResp.ClientView)
+	}
 	if err != nil {
-		return clientViewInfo
+		stats.failed = true
+		return clientViewInfo, stats
 	}
+	stats.size = ed.size
 
 	// Refuse to go backwards in time. minLastMutationID is the greater of
 	// the last mutation id of the client and head, the minimum lmid we will
 	// accept from the client view.
 	if cvResp.LastMutationID >= minLastMutationID {
-		err = storeClientView(db, cvResp, l)
+		// Values that don't match the account's schemas are never stored,
+		// so the client keeps syncing the last good client view.
+		if err = ed.validator.err(); err == nil {
+			err = commitClientView(db, ed.me.Build(), cvResp.LastMutationID, l)
+		}
+		stats.failed = err != nil
 	}
-	return clientViewInfo
+	return clientViewInfo, stats
 }
 
-func storeClientView(db *db.DB, cvResp servetypes.ClientViewResponse, l zl.Logger) error {
-	me := kv.NewMap(db.Noms()).Edit()
-	for k, JSON := range cvResp.ClientView {
-		v, err := nomsjson.FromJSON(JSON, db.Noms())
-		if err != nil {
-			return fmt.Errorf("error parsing clientview: %w", err)
-		}
-		if err := me.Set(types.String(k), v); err != nil {
-			return fmt.Errorf("error setting value '%s' in clientview: %w", JSON, err)
+// clientViewEditor builds a client view from its entries as they are
+// decoded, checking them against the account's schemas. Once an invalid
+// value has been seen the rest aren't built, since the client view won't
+// be stored.
+type clientViewEditor struct {
+	noms      types.ValueReadWriter
+	me        *kv.MapEditor
+	validator schemaValidator
+	// size is the number of bytes in the keys and values added.
+	size int64
+}
+
+func newClientViewEditor(noms types.ValueReadWriter, schemas keySchemas) *clientViewEditor {
+	return &clientViewEditor{noms: noms, me: kv.NewMap(noms).Edit(), validator: schemaValidator{schemas: schemas}}
+}
+
+// add adds an entry to the client view.
+func (e *clientViewEditor) add(key string, value json.RawMessage) error {
+	e.size += int64(len(key) + len(value))
+	e.validator.check(key, value)
+	if e.validator.invalid > 0 {
+		return nil
+	}
+	v, err := nomsjson.FromJSON(value, e.noms)
+	if err != nil {
+		return fmt.Errorf("error parsing clientview: %w", err)
+	}
+	if err := e.me.Set(types.String(key), v); err != nil {
+		return fmt.Errorf("error setting value '%s' in clientview: %w", value, err)
+	}
+	return nil
+}
+
+// addAll adds the entries of cv in order of their keys, so that errors are
+// reported in a stable order.
+func (e *clientViewEditor) addAll(cv map[string]json.RawMessage) error {
+	for _, k := range sortedKeys(cv) {
+		if err := e.add(k, cv[k]); err != nil {
+			return err
 		}
 	}
-	m := me.Build()
-	c, err := db.MaybePutData(m, cvResp.LastMutationID)
+	return nil
+}
+
+// storeClientView stores cvResp's client view as the client's data.
+func storeClientView(db *db.DB, cvResp servetypes.ClientViewResponse, l zl.Logger) error {
+	ed := newClientViewEditor(db.Noms(), nil)
+	if err := ed.addAll(cvResp.ClientView); err != nil {
+		return err
+	}
+	return commitClientView(db, ed.me.Build(), cvResp.LastMutationID, l)
+}
+
+// commitClientView commits m as the client's data at lastMutationID,
+// unless head already has it.
+func commitClientView(db *db.DB, m kv.Map, lastMutationID uint64, l zl.Logger) error {
+	c, err := db.MaybePutData(m, lastMutationID)
 	if err != nil {
 		return fmt.Errorf("error writing new commit: %w", err)
 	}
 	if c.NomsStruct.IsZeroValue() {
-		l.Debug().Msgf("Did not write a new commit (lastMutationID %d and checksum %s are identical to head); nop", cvResp.LastMutationID, m.Checksum())
+		l.Debug().Msgf("Did not write a new commit (lastMutationID %d and checksum %s are identical to head); nop", lastMutationID, m.Checksum())
 	} else {
 		basis, err := c.Basis(db.Noms())
 		if err != nil {
 			return err
 		}
-		l.Debug().Msgf("Wrote new commit %s with lastMutationID %d and checksum %s (previous commit %s had lastMutationID %d and checksum %s)", c.Ref().TargetHash(), cvResp.LastMutationID, m.Checksum(), basis.Ref().TargetHash(), uint64(basis.Value.LastMutationID), basis.Value.Checksum)
+		l.Debug().Msgf("Wrote new commit %s with lastMutationID %d and checksum %s (previous commit %s had lastMutationID %d and checksum %s)", c.Ref().TargetHash(), lastMutationID, m.Checksum(), basis.Ref().TargetHash(), uint64(basis.Value.LastMutationID), basis.Value.Checksum)
 	}
 	return nil
 }
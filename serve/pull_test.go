@@ -2,22 +2,27 @@ package serve
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	gotime "time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 
 	"roci.dev/diff-server/account"
 	"roci.dev/diff-server/db"
 	"roci.dev/diff-server/kv"
 	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
 	"roci.dev/diff-server/util/time"
 )
 
@@ -26,6 +31,7 @@ func TestAPI(t *testing.T) {
 	defer time.SetFake()()
 
 	unittestID := fmt.Sprintf("%d", account.UnittestID)
+	unittestKey := account.UnittestKey
 
 	tc := []struct {
 		pullMethod  string
@@ -43,7 +49,7 @@ func TestAPI(t *testing.T) {
 		// Unsupported method
 		{"GET",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -56,7 +62,7 @@ func TestAPI(t *testing.T) {
 		// Supports OPTIONS for cors headers
 		{"OPTIONS",
 			``,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -69,7 +75,7 @@ func TestAPI(t *testing.T) {
 		// Missing clientViewURL
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -82,7 +88,7 @@ func TestAPI(t *testing.T) {
 		// Client view URL not authorized (service is configured with 1 max, already has 1.)
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://cv2.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -90,7 +96,7 @@ func TestAPI(t *testing.T) {
 			0,
 			nil,
 			"",
-			"clientViewURL is not authorized"},
+			"clientViewURL is not authorized: account already uses the maximum of 1 client view hosts"},
 
 		// Successful client view fetch (auth disabled).
 		{"POST",
@@ -108,7 +114,7 @@ func TestAPI(t *testing.T) {
 		// Successful client view fetch.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
@@ -121,7 +127,7 @@ func TestAPI(t *testing.T) {
 		// Successful nop client view fetch where lastMutationID does not change.
 		{"POST",
 			`{"baseStateID": "s3n5j759kirvvs3fqeott07a43lk41ud", "checksum": "c4e7090d", "lastMutationID": 1, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
@@ -134,7 +140,7 @@ func TestAPI(t *testing.T) {
 		// Successful nop client view fetch where lastMutationID does change.
 		{"POST",
 			`{"baseStateID": "s3n5j759kirvvs3fqeott07a43lk41ud", "checksum": "c4e7090d", "lastMutationID": 1, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
@@ -147,7 +153,7 @@ func TestAPI(t *testing.T) {
 		// Client view returns LMID < diffserver's => nop
 		{"POST",
 			`{"baseStateID": "s3n5j759kirvvs3fqeott07a43lk41ud", "checksum": "c4e7090d", "lastMutationID": 1, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
@@ -160,27 +166,27 @@ func TestAPI(t *testing.T) {
 		// Fetch errors out.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"new": b(`"value"`)}, LastMutationID: 2},
 			200,
 			errors.New("boom"),
-			`{"stateID":"s3n5j759kirvvs3fqeott07a43lk41ud","lastMutationID":1,"patch":[{"op":"replace","path":"","valueString":"{}"},{"op":"add","path":"/foo","valueString":"\"bar\""}],"checksum":"c4e7090d","clientViewInfo":{"httpStatusCode":200,"errorMessage":""}}`,
+			`{"stateID":"s3n5j759kirvvs3fqeott07a43lk41ud","lastMutationID":1,"patch":[{"op":"replace","path":"","valueString":"{}"},{"op":"add","path":"/foo","valueString":"\"bar\""}],"checksum":"c4e7090d","clientViewInfo":{"httpStatusCode":200,"errorMessage":"boom"}}`,
 			""},
 
 		// Diffserver has LMID < client's => nop (fetch is also erroring in this one, but that's incidental)
 		{"POST",
 			`{"baseStateID": "12345000000000000000000000000000", "checksum": "12345678", "lastMutationID": 22, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
 			servetypes.ClientViewResponse{},
 			0,
 			errors.New("boom"),
-			`{"stateID":"12345000000000000000000000000000","lastMutationID":22,"patch":[],"checksum":"12345678","clientViewInfo":{"httpStatusCode":0,"errorMessage":""}}`,
+			`{"stateID":"12345000000000000000000000000000","lastMutationID":22,"patch":[],"checksum":"12345678","clientViewInfo":{"httpStatusCode":0,"errorMessage":"boom"}}`,
 			""},
 
 		// No Authorization header.
@@ -199,7 +205,7 @@ func TestAPI(t *testing.T) {
 		// Unsupported version
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 1}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -225,7 +231,7 @@ func TestAPI(t *testing.T) {
 		// No clientID passed in.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -238,7 +244,7 @@ func TestAPI(t *testing.T) {
 		// Invalid baseStateID.
 		{"POST",
 			`{"baseStateID": "beep", "checksum": "00000000", "clientID": "clientid", "lastMutationID": 0, "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -251,7 +257,7 @@ func TestAPI(t *testing.T) {
 		// No baseStateID is fine (first pull).
 		{"POST",
 			`{"baseStateID": "", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
@@ -264,7 +270,7 @@ func TestAPI(t *testing.T) {
 		// Invalid checksum.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "not", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"",
 			"",
@@ -277,7 +283,7 @@ func TestAPI(t *testing.T) {
 		// Ensure it canonicalizes the client view JSON.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "clientViewURL": "http://clientview.com", "version": 3}`,
-			unittestID,
+			unittestKey,
 			false,
 			"http://clientview.com",
 			"clientauth",
@@ -349,6 +355,7 @@ func TestAPIV2(t *testing.T) {
 	defer time.SetFake()()
 
 	unittestID := fmt.Sprintf("%d", account.UnittestID)
+	unittestKey := account.UnittestKey
 
 	tc := []struct {
 		pullMethod  string
@@ -365,7 +372,7 @@ func TestAPIV2(t *testing.T) {
 		// Unsupported method
 		{"GET",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
@@ -376,7 +383,7 @@ func TestAPIV2(t *testing.T) {
 		// Supports OPTIONS for cors headers
 		{"OPTIONS",
 			``,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
@@ -387,19 +394,19 @@ func TestAPIV2(t *testing.T) {
 		// No client view to fetch from.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
 			0,
 			nil,
-			`{"stateID":"s3n5j759kirvvs3fqeott07a43lk41ud","lastMutationID":1,"patch":[{"op":"replace","path":"","valueString":"{}"},{"op":"add","path":"/foo","valueString":"\"bar\""}],"checksum":"c4e7090d","clientViewInfo":{"httpStatusCode":0,"errorMessage":""}}`,
+			`{"stateID":"s3n5j759kirvvs3fqeott07a43lk41ud","lastMutationID":1,"patch":[{"op":"replace","path":"","valueString":"{}"},{"op":"add","path":"/foo","valueString":"\"bar\""}],"checksum":"c4e7090d","clientViewInfo":{"httpStatusCode":0,"errorMessage":"not fetching new client view: no url provided via account or --client-view"}}`,
 			""},
 
 		// Successful client view fetch.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"new": b(`"value"`)}, LastMutationID: 2},
@@ -411,7 +418,7 @@ func TestAPIV2(t *testing.T) {
 		// Successful nop client view fetch where lastMutationID does not change.
 		{"POST",
 			`{"baseStateID": "s3n5j759kirvvs3fqeott07a43lk41ud", "checksum": "c4e7090d", "lastMutationID": 1, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"foo": b(`"bar"`)}, LastMutationID: 1},
@@ -423,7 +430,7 @@ func TestAPIV2(t *testing.T) {
 		// Successful nop client view fetch where lastMutationID does change.
 		{"POST",
 			`{"baseStateID": "s3n5j759kirvvs3fqeott07a43lk41ud", "checksum": "c4e7090d", "lastMutationID": 1, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"foo": b(`"bar"`)}, LastMutationID: 77},
@@ -435,7 +442,7 @@ func TestAPIV2(t *testing.T) {
 		// Client view returns LMID < diffserver's => nop
 		{"POST",
 			`{"baseStateID": "s3n5j759kirvvs3fqeott07a43lk41ud", "checksum": "c4e7090d", "lastMutationID": 1, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"foo": b(`"bar"`)}, LastMutationID: 0},
@@ -447,25 +454,25 @@ func TestAPIV2(t *testing.T) {
 		// Fetch errors out.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"new": b(`"value"`)}, LastMutationID: 2},
 			200,
 			errors.New("boom"),
-			`{"stateID":"s3n5j759kirvvs3fqeott07a43lk41ud","lastMutationID":1,"patch":[{"op":"replace","path":"","valueString":"{}"},{"op":"add","path":"/foo","valueString":"\"bar\""}],"checksum":"c4e7090d","clientViewInfo":{"httpStatusCode":200,"errorMessage":""}}`,
+			`{"stateID":"s3n5j759kirvvs3fqeott07a43lk41ud","lastMutationID":1,"patch":[{"op":"replace","path":"","valueString":"{}"},{"op":"add","path":"/foo","valueString":"\"bar\""}],"checksum":"c4e7090d","clientViewInfo":{"httpStatusCode":200,"errorMessage":"boom"}}`,
 			""},
 
 		// Diffserver has LMID < client's => nop (fetch is also erroring in this one, but that's incidental)
 		{"POST",
 			`{"baseStateID": "12345000000000000000000000000000", "checksum": "12345678", "lastMutationID": 22, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{},
 			0,
 			errors.New("boom"),
-			`{"stateID":"12345000000000000000000000000000","lastMutationID":22,"patch":[],"checksum":"12345678","clientViewInfo":{"httpStatusCode":0,"errorMessage":""}}`,
+			`{"stateID":"12345000000000000000000000000000","lastMutationID":22,"patch":[],"checksum":"12345678","clientViewInfo":{"httpStatusCode":0,"errorMessage":"boom"}}`,
 			""},
 
 		// No Authorization header.
@@ -483,7 +490,7 @@ func TestAPIV2(t *testing.T) {
 		// Unsupported version
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 1}`,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
@@ -507,7 +514,7 @@ func TestAPIV2(t *testing.T) {
 		// No clientID passed in.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
@@ -519,7 +526,7 @@ func TestAPIV2(t *testing.T) {
 		// Invalid baseStateID.
 		{"POST",
 			`{"baseStateID": "beep", "checksum": "00000000", "clientID": "clientid", "lastMutationID": 0, "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
@@ -531,7 +538,7 @@ func TestAPIV2(t *testing.T) {
 		// No baseStateID is fine (first pull).
 		{"POST",
 			`{"baseStateID": "", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"new": b(`"value"`)}, LastMutationID: 2},
@@ -543,7 +550,7 @@ func TestAPIV2(t *testing.T) {
 		// Invalid checksum.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "not", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"",
 			"",
 			servetypes.ClientViewResponse{},
@@ -555,7 +562,7 @@ func TestAPIV2(t *testing.T) {
 		// Ensure it canonicalizes the client view JSON.
 		{"POST",
 			`{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewAuth": "clientauth", "version": 2}`,
-			unittestID,
+			unittestKey,
 			"cv",
 			"clientauth",
 			servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"new": b(`"\u000b"`)}, LastMutationID: 2}, // "\u000B" is canonical
@@ -632,13 +639,480 @@ type fakeClientViewGet struct {
 	gotAuth     string
 	gotClientID string
 	gotSyncID   string
+	gotOpts     ClientViewOptions
 }
 
-func (f *fakeClientViewGet) Get(url string, req servetypes.ClientViewRequest, authToken string, syncID string) (servetypes.ClientViewResponse, int, error) {
+func (f *fakeClientViewGet) Get(ctx context.Context, url string, req servetypes.ClientViewRequest, authToken string, syncID string, opts ClientViewOptions) (servetypes.ClientViewResponse, int, error) {
 	f.called = true
+	f.gotOpts = opts
 	f.gotURL = url
 	f.gotAuth = authToken
 	f.gotClientID = req.ClientID
 	f.gotSyncID = syncID
 	return f.resp, f.code, f.err
 }
+
+func TestPullEncodings(t *testing.T) {
+	assert := assert.New(t)
+	defer time.SetFake()()
+
+	tc := []struct {
+		accept  string
+		wantEnc servetypes.Encoding
+	}{
+		{"", servetypes.EncodingJSON},
+		{"*/*", servetypes.EncodingJSON},
+		{"application/json", servetypes.EncodingJSON},
+		{"text/html", servetypes.EncodingJSON},
+		{"application/cbor", servetypes.EncodingCBOR},
+		{"application/msgpack", servetypes.EncodingMsgpack},
+		{"application/x-msgpack", servetypes.EncodingMsgpack},
+		{"application/json;q=0.5, application/cbor", servetypes.EncodingCBOR},
+		{"application/cbor;q=0.5, application/msgpack;q=0.8", servetypes.EncodingMsgpack},
+		{"application/cbor;q=0, application/json", servetypes.EncodingJSON},
+	}
+
+	cvResp := servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{
+		"num":    b(`42`),
+		"obj":    b(`{"b": [true, null, 1.5, "x"], "a": {}}`),
+		"string": b(`"value"`),
+	}, LastMutationID: 2}
+	pullReq := `{"baseStateID": "00000000000000000000000000000000", "checksum": "00000000", "lastMutationID": 0, "clientID": "clientid", "clientViewURL": "http://clientview.com", "version": 3}`
+
+	for i, t := range tc {
+		msg := fmt.Sprintf("test case %d: %s", i, t.accept)
+		td, _ := ioutil.TempDir("", "")
+		defer func() { assert.NoError(os.RemoveAll(td)) }()
+		adb, adir := account.LoadTempDB(assert)
+		defer func() { assert.NoError(os.RemoveAll(adir)) }()
+		account.AddUnittestAccount(assert, adb)
+		account.AddUnittestAccountHost(assert, adb, "clientview.com")
+
+		fcvg := &fakeClientViewGet{resp: cvResp, code: 200}
+		s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+
+		pull := func(accept string) (servetypes.PullResponse, string) {
+			req := httptest.NewRequest("POST", "/pull", strings.NewReader(pullReq))
+			req.Header.Set("Authorization", account.UnittestKey)
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			resp := httptest.NewRecorder()
+			s.pull(resp, req)
+			assert.Equal(200, resp.Code, msg)
+			ct := resp.Result().Header.Get("Content-type")
+			enc, ok := servetypes.EncodingForContentType(ct)
+			assert.True(ok, msg)
+			presp, err := servetypes.DecodePullResponse(resp.Body, enc)
+			assert.NoError(err, msg)
+			return presp, ct
+		}
+
+		want, _ := pull("")
+		got, gotCT := pull(t.accept)
+		assert.Equal(t.wantEnc.ContentType(), gotCT, msg)
+		assert.Equal(want, got, msg)
+		assert.Equal(`{"a":{},"b":[true,null,1.5E0,"x"]}`, got.Patch[2].ValueString, msg)
+	}
+}
+
+func TestPullAccountIDAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	tc := []struct {
+		allowAccountIDAuth bool
+		auth               string
+		wantCode           int
+	}{
+		{false, account.UnittestKey, 200},
+		{true, account.UnittestKey, 200},
+		{false, "sandbox", 400},
+		{true, "sandbox", 200},
+		{false, "0", 400},
+		{true, "0", 200},
+		// The unittest account has a key so its ID is no longer a credential.
+		{true, fmt.Sprintf("%d", account.UnittestID), 400},
+	}
+
+	for i, t := range tc {
+		msg := fmt.Sprintf("test case %d: %s", i, t.auth)
+		td, _ := ioutil.TempDir("", "")
+		defer func() { assert.NoError(os.RemoveAll(td)) }()
+		adb, adir := account.LoadTempDB(assert)
+		defer func() { assert.NoError(os.RemoveAll(adir)) }()
+		account.AddUnittestAccount(assert, adb)
+
+		fcvg := &fakeClientViewGet{err: errors.New("boom")}
+		s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false, WithAccountIDAuth(t.allowAccountIDAuth))
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "clientid", "version": 2}`))
+		req.Header.Set("Authorization", t.auth)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(t.wantCode, resp.Code, msg)
+		if t.wantCode != 200 {
+			assert.Equal("Unknown account or invalid key", resp.Body.String(), msg)
+		}
+	}
+}
+
+func TestPullMetered(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	account.AddUnittestAccountURL(assert, adb, "http://localhost/cv")
+
+	fcvg := &fakeClientViewGet{resp: servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"k": []byte("1")}}, code: 200}
+	meter := account.NewMeter(adb, gotime.Hour, log.Default())
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false, WithMeter(meter))
+	pull := func() {
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(200, resp.Code, resp.Body.String())
+	}
+	pull()
+	fcvg.err = errors.New("boom")
+	pull()
+	assert.NoError(meter.Flush())
+
+	usage, err := account.ReadUsage(adb, gotime.Now())
+	assert.NoError(err)
+	if assert.Equal(1, len(usage[account.UnittestID])) {
+		u := usage[account.UnittestID][0]
+		assert.Equal(uint64(2), u.Pulls)
+		assert.Equal(uint64(2), u.FullSyncs)
+		assert.Equal(uint64(2), u.ClientViewFetches)
+		assert.Equal(uint64(1), u.ClientViewFailures)
+		assert.Equal(uint64(1), u.ActiveClients)
+		assert.Equal(uint64(2), u.StoredBytes)
+		assert.True(u.PatchBytes > 0)
+	}
+}
+
+func TestPullCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	account.AddUnittestAccountURL(assert, adb, "http://localhost/cv")
+
+	clock := &fakeClock{gotime.Date(2020, 5, 1, 0, 0, 0, 0, gotime.UTC)}
+	fcvg := &fakeClientViewGet{code: 503, err: errors.New("boom")}
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	s.breaker = newBreaker(BreakerConfig{Threshold: 2, Cooldown: gotime.Minute}, clock.now)
+	pullCtx := func(ctx context.Context) servetypes.PullResponse {
+		fcvg.called = false
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(200, resp.Code, resp.Body.String())
+		var presp servetypes.PullResponse
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &presp))
+		return presp
+	}
+	pull := func() servetypes.PullResponse {
+		return pullCtx(context.Background())
+	}
+
+	// Client errors don't count as failures of the host.
+	fcvg.code = 400
+	for i := 0; i < 3; i++ {
+		pull()
+		assert.True(fcvg.called)
+	}
+
+	fcvg.code = 503
+	for i := 0; i < 2; i++ {
+		presp := pull()
+		assert.True(fcvg.called)
+		assert.Equal(servetypes.ClientViewInfo{HTTPStatusCode: 503, ErrorMessage: "boom"}, presp.ClientViewInfo)
+	}
+
+	// The breaker is open so the fetch is skipped and the head is served.
+	presp := pull()
+	assert.False(fcvg.called)
+	assert.Equal(servetypes.ClientViewInfo{ErrorMessage: "not fetching new client view: circuit breaker for localhost is open after repeated failures", CircuitBreakerOpen: true}, presp.ClientViewInfo)
+	assert.Equal("00000000", presp.Checksum)
+
+	// After the cooldown the host is probed, and closes the breaker once it
+	// recovers.
+	clock.t = clock.t.Add(gotime.Minute)
+	fcvg.resp, fcvg.code, fcvg.err = servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"k": []byte("1")}, LastMutationID: 1}, 200, nil
+	presp = pull()
+	assert.True(fcvg.called)
+	assert.Equal(servetypes.ClientViewInfo{HTTPStatusCode: 200}, presp.ClientViewInfo)
+	assert.Equal(uint64(1), presp.LastMutationID)
+	pull()
+	assert.True(fcvg.called)
+
+	// Neither do clients going away...
+	s = NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	s.breaker = newBreaker(BreakerConfig{Threshold: 1, Cooldown: gotime.Minute}, clock.now)
+	fcvg.resp, fcvg.code, fcvg.err = servetypes.ClientViewResponse{}, 0, errors.New("boom")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	pullCtx(canceled)
+	assert.True(fcvg.called)
+	pull()
+	assert.True(fcvg.called)
+
+	// ...but fetches that time out do.
+	s = NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	s.breaker = newBreaker(BreakerConfig{Threshold: 1, Cooldown: gotime.Minute}, clock.now)
+	expired, cancel := context.WithDeadline(context.Background(), gotime.Now().Add(-gotime.Second))
+	defer cancel()
+	pullCtx(expired)
+	assert.True(fcvg.called)
+	pull()
+	assert.False(fcvg.called)
+}
+
+func TestPullSigningSecret(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	account.AddUnittestAccountURL(assert, adb, "http://localhost/cv")
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.SigningSecret = "rss_secret"
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+
+	fcvg := &fakeClientViewGet{code: 200}
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+	req.Header.Set("Authorization", account.UnittestKey)
+	resp := httptest.NewRecorder()
+	s.pull(resp, req)
+	assert.Equal(200, resp.Code, resp.Body.String())
+	assert.True(fcvg.called)
+	assert.NotNil(fcvg.gotOpts.OnEntry)
+	fcvg.gotOpts.OnEntry = nil
+	assert.Equal(ClientViewOptions{SigningSecret: "rss_secret"}, fcvg.gotOpts)
+}
+
+func TestPullSchemaValidation(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	account.AddUnittestAccountURL(assert, adb, "http://localhost/cv")
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Schemas = []account.KeySchema{{Prefix: "todo/", Schema: `{"type": "object"}`}}
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+
+	fcvg := &fakeClientViewGet{code: 200}
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	pull := func() servetypes.PullResponse {
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(200, resp.Code, resp.Body.String())
+		var presp servetypes.PullResponse
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &presp))
+		return presp
+	}
+
+	fcvg.resp = servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"todo/1": []byte(`{}`), "other": []byte(`"x"`)}, LastMutationID: 1}
+	presp := pull()
+	assert.Equal(servetypes.ClientViewInfo{HTTPStatusCode: 200}, presp.ClientViewInfo)
+	assert.Equal(uint64(1), presp.LastMutationID)
+	stateID := presp.StateID
+
+	// An invalid value keeps the whole client view from being stored.
+	fcvg.resp = servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"todo/1": []byte(`"garbage"`), "other": []byte(`"y"`)}, LastMutationID: 2}
+	presp = pull()
+	assert.Equal(servetypes.ClientViewInfo{HTTPStatusCode: 200, ErrorMessage: `client view not stored: 1 invalid values: key "todo/1": expected object, got string`}, presp.ClientViewInfo)
+	assert.Equal(uint64(1), presp.LastMutationID)
+	assert.Equal(stateID, presp.StateID)
+}
+
+func TestPullBodyLimit(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+
+	body := `{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`
+	pull := func(s *Service) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(body))
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		return resp
+	}
+	setLimit := func(n int64) {
+		assert.NoError(account.Update(adb, func(records *account.Records) error {
+			r := records.Record[account.UnittestID]
+			r.Limits.MaxPullBytes = n
+			records.Record[account.UnittestID] = r
+			return nil
+		}))
+	}
+
+	tc := []struct {
+		serverLimit  int64
+		accountLimit int64
+		wantCode     int
+	}{
+		{DefaultMaxPullBytes, 0, 200},
+		{int64(len(body)), 0, 200},
+		{int64(len(body)) - 1, 0, 413},
+		{0, 0, 200},
+		{10, -1, 200},
+		{10, int64(len(body)), 200},
+		{DefaultMaxPullBytes, 10, 413},
+	}
+	for i, t := range tc {
+		setLimit(t.accountLimit)
+		s := NewService(td, account.MaxASClientViewHosts, adb, false, &fakeClientViewGet{code: 200}, false, WithMaxPullBytes(t.serverLimit))
+		resp := pull(s)
+		assert.Equal(t.wantCode, resp.Code, "test case %d: %s", i, resp.Body.String())
+		if t.wantCode == 413 {
+			assert.Contains(resp.Body.String(), "Pull request body too large: limit is", "test case %d", i)
+		}
+	}
+}
+
+func TestPullForward(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	account.AddUnittestAccountURL(assert, adb, "http://localhost/cv")
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Forward = account.Forward{
+			Headers: []account.Forwarded{{Name: "Accept-Language"}},
+			Cookies: []account.Forwarded{{Name: "session", Sensitive: true}},
+		}
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+
+	fcvg := &fakeClientViewGet{code: 200, resp: servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{}, LastMutationID: 1}}
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+	req.Header.Set("Authorization", account.UnittestKey)
+	req.Header.Set("Accept-Language", "fr")
+	req.Header.Set("X-Not-Forwarded", "x")
+	req.Header.Set("Cookie", "session=abc; other=def")
+	req.Header.Set("Origin", "https://app.example.com")
+	resp := httptest.NewRecorder()
+	s.pull(resp, req)
+	assert.Equal(200, resp.Code, resp.Body.String())
+	assert.Equal(map[string][]string{"Accept-Language": {"fr"}, "Cookie": {"session=abc"}}, map[string][]string(fcvg.gotOpts.Header))
+
+	// Credentialed requests are allowed from the pulling origin, and
+	// preflights allow the forwarded headers.
+	for _, method := range []string{"POST", "OPTIONS"} {
+		req := httptest.NewRequest(method, "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+		req.Header.Set("Authorization", account.UnittestKey)
+		req.Header.Set("Origin", "https://app.example.com")
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(200, resp.Code, method)
+		h := resp.Result().Header
+		assert.Equal("https://app.example.com", h.Get("Access-Control-Allow-Origin"), method)
+		assert.Equal("true", h.Get("Access-Control-Allow-Credentials"), method)
+		assert.Equal("POST", h.Get("Access-Control-Allow-Methods"), method)
+		assert.Contains(h.Get("Access-Control-Allow-Headers"), ", Accept-Language", method)
+		assert.Contains(h["Vary"], "Origin", method)
+	}
+
+	// Without an Origin, or for accounts that don't forward cookies, any
+	// origin is allowed without credentials.
+	req = httptest.NewRequest("OPTIONS", "/pull", nil)
+	resp = httptest.NewRecorder()
+	s.pull(resp, req)
+	assert.Equal("*", resp.Result().Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal("", resp.Result().Header.Get("Access-Control-Allow-Credentials"))
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Forward.Cookies = nil
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+	req = httptest.NewRequest("OPTIONS", "/pull", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp = httptest.NewRecorder()
+	s.pull(resp, req)
+	assert.Equal("*", resp.Result().Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal("", resp.Result().Header.Get("Access-Control-Allow-Credentials"))
+	assert.Contains(resp.Result().Header.Get("Access-Control-Allow-Headers"), ", Accept-Language")
+}
+
+func TestPullStreamedClientView(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "zstd")
+		zw, _ := zstd.NewWriter(w)
+		zw.Write([]byte(body))
+		zw.Close()
+	}))
+	defer server.Close()
+	account.AddUnittestAccount(assert, adb)
+	account.AddUnittestAccountURL(assert, adb, server.URL)
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Schemas = []account.KeySchema{{Prefix: "todo/", Schema: `{"type": "object"}`}}
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, NewClientViewGetter(DefaultClientViewGetterConfig), false)
+	pull := func() servetypes.PullResponse {
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(200, resp.Code, resp.Body.String())
+		var presp servetypes.PullResponse
+		assert.NoError(json.Unmarshal(resp.Body.Bytes(), &presp))
+		return presp
+	}
+
+	body = `{"clientView": {"todo/1": {"title": "a"}, "other": [1, 2]}, "lastMutationID": 1}`
+	presp := pull()
+	assert.Equal(servetypes.ClientViewInfo{HTTPStatusCode: 200}, presp.ClientViewInfo)
+	assert.Equal(uint64(1), presp.LastMutationID)
+	if assert.Len(presp.Patch, 3) {
+		assert.Equal(`[1,2]`, presp.Patch[1].ValueString)
+		assert.Equal(`{"title":"a"}`, presp.Patch[2].ValueString)
+	}
+
+	// Invalid values are reported in the order they arrive and nothing is
+	// stored.
+	body = `{"clientView": {"todo/2": 1, "todo/1": "x"}, "lastMutationID": 2}`
+	presp = pull()
+	assert.Equal(`client view not stored: 2 invalid values: key "todo/2": expected object, got integer; key "todo/1": expected object, got string`, presp.ClientViewInfo.ErrorMessage)
+	assert.Equal(uint64(1), presp.LastMutationID)
+}
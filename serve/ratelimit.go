@@ -0,0 +1,121 @@
+package serve
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/ratelimit"
+)
+
+// dailyUsage counts an account's usage during one UTC day.
+type dailyUsage struct {
+	day             string
+	pulls           int64
+	clientViewBytes int64
+}
+
+// rateLimiter enforces account.Limits on pulls. State is kept in memory so
+// limits are per process.
+type rateLimiter struct {
+	now func() time.Time
+
+	mu        sync.Mutex
+	accounts  map[string]*ratelimit.Bucket
+	clients   map[string]*ratelimit.Bucket // By account ID and client ID.
+	daily     map[string]*dailyUsage
+	lastSweep time.Time
+}
+
+func newRateLimiter(now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		now:      now,
+		accounts: map[string]*ratelimit.Bucket{},
+		clients:  map[string]*ratelimit.Bucket{},
+		daily:    map[string]*dailyUsage{},
+	}
+}
+
+// allowPull records a pull by clientID of accountID if limits allow it. If
+// not, it returns how long the client should wait before retrying and why
+// the pull was refused.
+func (rl *rateLimiter) allowPull(accountID, clientID string, limits account.Limits) (bool, time.Duration, string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now().UTC()
+	rl.maybeSweep(now)
+
+	usage := rl.usage(accountID, now)
+	untilTomorrow := nextUTCDay(now).Sub(now)
+	if limits.DailyPulls >= 0 && usage.pulls >= limits.DailyPulls {
+		return false, untilTomorrow, fmt.Sprintf("daily quota of %d pulls exceeded", limits.DailyPulls)
+	}
+	if limits.DailyClientViewBytes >= 0 && usage.clientViewBytes >= limits.DailyClientViewBytes {
+		return false, untilTomorrow, fmt.Sprintf("daily quota of %d client view bytes exceeded", limits.DailyClientViewBytes)
+	}
+
+	var ab, cb *ratelimit.Bucket
+	if limits.PullsPerSecond >= 0 {
+		ab = ratelimit.Get(rl.accounts, accountID, limits.PullsPerSecond, limits.PullBurst, now)
+		if wait := ab.Wait(); wait > 0 {
+			return false, wait, "account pull rate limit exceeded"
+		}
+	}
+	if limits.ClientPullsPerSecond >= 0 {
+		cb = ratelimit.Get(rl.clients, accountID+"/"+clientID, limits.ClientPullsPerSecond, limits.ClientPullBurst, now)
+		if wait := cb.Wait(); wait > 0 {
+			return false, wait, "client pull rate limit exceeded"
+		}
+	}
+	// Only take tokens once both buckets allow the pull so that a client
+	// over its own limit doesn't use up its account's.
+	if ab != nil {
+		ab.Take()
+	}
+	if cb != nil {
+		cb.Take()
+	}
+	usage.pulls++
+	return true, 0, ""
+}
+
+// addClientViewBytes counts n bytes fetched from accountID's client view
+// against its daily quota.
+func (rl *rateLimiter) addClientViewBytes(accountID string, n int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.usage(accountID, rl.now().UTC()).clientViewBytes += n
+}
+
+func (rl *rateLimiter) usage(accountID string, now time.Time) *dailyUsage {
+	day := now.Format("2006-01-02")
+	u := rl.daily[accountID]
+	if u == nil || u.day != day {
+		u = &dailyUsage{day: day}
+		rl.daily[accountID] = u
+	}
+	return u
+}
+
+// maybeSweep drops buckets that have refilled completely, which behave
+// the same as new ones, and usage from previous days.
+func (rl *rateLimiter) maybeSweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < ratelimit.SweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	ratelimit.Sweep(rl.accounts, now)
+	ratelimit.Sweep(rl.clients, now)
+	day := now.Format("2006-01-02")
+	for k, u := range rl.daily {
+		if u.day != day {
+			delete(rl.daily, k)
+		}
+	}
+}
+
+func nextUTCDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
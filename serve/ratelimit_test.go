@@ -0,0 +1,166 @@
+package serve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	servetypes "roci.dev/diff-server/serve/types"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{time.Date(2020, 5, 1, 23, 59, 0, 0, time.UTC)}
+	rl := newRateLimiter(clock.now)
+
+	limits := account.Limits{
+		PullsPerSecond:       2,
+		PullBurst:            3,
+		ClientPullsPerSecond: 1,
+		ClientPullBurst:      2,
+		DailyPulls:           -1,
+		DailyClientViewBytes: -1,
+	}
+	allow := func(clientID string) (bool, time.Duration, string) {
+		return rl.allowPull("1", clientID, limits)
+	}
+
+	// Each client gets its burst, until the account's is used up.
+	ok, _, _ := allow("a")
+	assert.True(ok)
+	ok, _, _ = allow("a")
+	assert.True(ok)
+	ok, wait, reason := allow("a")
+	assert.False(ok)
+	assert.Equal(time.Second, wait)
+	assert.Equal("client pull rate limit exceeded", reason)
+	ok, _, _ = allow("b")
+	assert.True(ok)
+	ok, wait, reason = allow("b")
+	assert.False(ok)
+	assert.Equal(500*time.Millisecond, wait)
+	assert.Equal("account pull rate limit exceeded", reason)
+
+	// Tokens refill at the configured rate.
+	clock.t = clock.t.Add(time.Second)
+	ok, _, _ = allow("a")
+	assert.True(ok)
+	ok, _, _ = allow("b")
+	assert.True(ok)
+	ok, _, _ = allow("c")
+	assert.False(ok)
+
+	// Negative rates are unlimited.
+	limits.PullsPerSecond, limits.ClientPullsPerSecond = -1, -1
+	for i := 0; i < 100; i++ {
+		ok, _, _ = allow("a")
+		assert.True(ok)
+	}
+
+	// Daily quotas reset at midnight UTC.
+	limits.DailyPulls = 3
+	ok, wait, reason = allow("a")
+	assert.False(ok)
+	assert.Equal(59*time.Second, wait)
+	assert.Equal("daily quota of 3 pulls exceeded", reason)
+	clock.t = clock.t.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		ok, _, _ = allow("a")
+		assert.True(ok)
+	}
+	ok, _, _ = allow("a")
+	assert.False(ok)
+
+	limits.DailyPulls = -1
+	limits.DailyClientViewBytes = 10
+	rl.addClientViewBytes("1", 9)
+	ok, _, _ = allow("a")
+	assert.True(ok)
+	rl.addClientViewBytes("1", 1)
+	ok, _, reason = allow("a")
+	assert.False(ok)
+	assert.Equal("daily quota of 10 client view bytes exceeded", reason)
+	ok, _, _ = rl.allowPull("2", "a", limits)
+	assert.True(ok)
+
+	// Idle buckets and old usage are swept.
+	clock.t = clock.t.Add(24 * time.Hour)
+	limits.PullsPerSecond = 1
+	ok, _, _ = allow("a")
+	assert.True(ok)
+	assert.Equal(1, len(rl.accounts))
+	assert.Equal(0, len(rl.clients))
+	assert.Equal(1, len(rl.daily))
+}
+
+func TestPullRateLimited(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Limits = account.Limits{ClientPullBurst: 1, DailyClientViewBytes: 4}
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+
+	fcvg := &fakeClientViewGet{resp: servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"k": []byte("1")}}, code: 200}
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, false)
+	clock := &fakeClock{time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)}
+	s.limiter = newRateLimiter(clock.now)
+	account.AddUnittestAccountURL(assert, adb, "http://localhost/cv")
+
+	pull := func(clientID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(fmt.Sprintf(`{"baseStateID": "", "checksum": "00000000", "clientID": "%s", "version": 2}`, clientID)))
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		return resp
+	}
+
+	resp := pull("c1")
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	resp = pull("c1")
+	assert.Equal(http.StatusTooManyRequests, resp.Code)
+	assert.Equal("1", resp.Header().Get("Retry-After"))
+	assert.Equal("Too many requests: client pull rate limit exceeded", resp.Body.String())
+
+	// The client view fetched by the first pull was 2 bytes; one more uses
+	// up the day's quota.
+	resp = pull("c2")
+	assert.Equal(http.StatusOK, resp.Code, resp.Body.String())
+	resp = pull("c3")
+	assert.Equal(http.StatusTooManyRequests, resp.Code)
+	assert.Equal("43200", resp.Header().Get("Retry-After"))
+	assert.Equal("Too many requests: daily quota of 4 client view bytes exceeded", resp.Body.String())
+
+	// Unknown accounts, only possible with auth disabled, aren't limited.
+	fcvg.err = errors.New("boom")
+	s.disableAuth = true
+	req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+	req.Header.Set("Authorization", "nobody")
+	rec := httptest.NewRecorder()
+	s.pull(rec, req)
+	assert.Equal(http.StatusOK, rec.Code, rec.Body.String())
+}
@@ -0,0 +1,117 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/jsonschema"
+)
+
+// keySchema is a compiled account.KeySchema.
+type keySchema struct {
+	prefix string
+	schema *jsonschema.Schema
+}
+
+// keySchemas are an account's compiled schemas, longest prefix first.
+type keySchemas []keySchema
+
+// forKey returns the schema key's value must be valid against, or nil if
+// there is none.
+func (ks keySchemas) forKey(key string) *jsonschema.Schema {
+	for _, s := range ks {
+		if strings.HasPrefix(key, s.prefix) {
+			return s.schema
+		}
+	}
+	return nil
+}
+
+// schemaCache keeps compiled schemas, by their text, so that they aren't
+// compiled on every pull.
+type schemaCache struct {
+	mu       sync.Mutex
+	compiled map[string]*jsonschema.Schema
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{compiled: map[string]*jsonschema.Schema{}}
+}
+
+// keySchemas compiles schemas.
+func (c *schemaCache) keySchemas(schemas []account.KeySchema) (keySchemas, error) {
+	if len(schemas) == 0 {
+		return nil, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ks := make(keySchemas, 0, len(schemas))
+	for _, s := range schemas {
+		compiled, ok := c.compiled[s.Schema]
+		if !ok {
+			var err error
+			compiled, err = jsonschema.Compile([]byte(s.Schema))
+			if err != nil {
+				return nil, fmt.Errorf("schema for prefix %q: %w", s.Prefix, err)
+			}
+			c.compiled[s.Schema] = compiled
+		}
+		ks = append(ks, keySchema{prefix: s.Prefix, schema: compiled})
+	}
+	sort.SliceStable(ks, func(i, j int) bool {
+		return len(ks[i].prefix) > len(ks[j].prefix)
+	})
+	return ks, nil
+}
+
+// maxReportedSchemaErrors caps how many invalid keys are listed in the
+// error from schemaValidator.
+const maxReportedSchemaErrors = 10
+
+// schemaValidator checks the values of a client view against schemas as
+// they arrive.
+type schemaValidator struct {
+	schemas keySchemas
+	errs    []string
+	invalid int
+}
+
+// check checks the value of key.
+func (v *schemaValidator) check(key string, value json.RawMessage) {
+	s := v.schemas.forKey(key)
+	if s == nil {
+		return
+	}
+	if err := s.Validate(value); err != nil {
+		v.invalid++
+		if len(v.errs) < maxReportedSchemaErrors {
+			v.errs = append(v.errs, fmt.Sprintf("key %q: %s", key, err))
+		}
+	}
+}
+
+// err returns an error listing the invalid keys checked, in order, if
+// there were any.
+func (v *schemaValidator) err() error {
+	if v.invalid == 0 {
+		return nil
+	}
+	msg := strings.Join(v.errs, "; ")
+	if v.invalid > len(v.errs) {
+		msg += fmt.Sprintf("; and %d more", v.invalid-len(v.errs))
+	}
+	return fmt.Errorf("client view not stored: %d invalid values: %s", v.invalid, msg)
+}
+
+func sortedKeys(cv map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(cv))
+	for k := range cv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
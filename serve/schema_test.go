@@ -0,0 +1,69 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	servetypes "roci.dev/diff-server/serve/types"
+)
+
+func TestSchemaValidator(t *testing.T) {
+	assert := assert.New(t)
+	c := newSchemaCache()
+	schemas, err := c.keySchemas([]account.KeySchema{
+		{Prefix: "todo/", Schema: `{"type": "object", "required": ["title"]}`},
+		{Prefix: "todo/meta", Schema: `{"type": "string"}`},
+		{Prefix: "", Schema: `{"maxLength": 3}`},
+	})
+	assert.NoError(err)
+	_, err = c.keySchemas([]account.KeySchema{{Prefix: "x", Schema: `{"oneOf": []}`}})
+	assert.EqualError(err, `schema for prefix "x": /oneOf: unsupported keyword`)
+
+	validate := func(r servetypes.ClientViewResponse, schemas keySchemas) error {
+		v := schemaValidator{schemas: schemas}
+		for _, k := range sortedKeys(r.ClientView) {
+			v.check(k, r.ClientView[k])
+		}
+		return v.err()
+	}
+	cv := func(kv ...string) servetypes.ClientViewResponse {
+		r := servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{}}
+		for i := 0; i < len(kv); i += 2 {
+			r.ClientView[kv[i]] = json.RawMessage(kv[i+1])
+		}
+		return r
+	}
+	tc := []struct {
+		cvResp  servetypes.ClientViewResponse
+		wantErr string
+	}{
+		{cv(), ""},
+		{cv("todo/1", `{"title": "x"}`, "todo/meta", `"v"`, "other", `"abc"`), ""},
+		{cv("todo/1", `"x"`, "todo/2", `{}`, "todo/meta", `{}`, "other", `"abcd"`),
+			`client view not stored: 4 invalid values: key "other": expected at most 3 characters, got 4; key "todo/1": expected object, got string; key "todo/2": missing required property "title"; key "todo/meta": expected string, got object`},
+	}
+	for i, t := range tc {
+		err := validate(t.cvResp, schemas)
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+		} else {
+			assert.EqualError(err, t.wantErr, "test case %d", i)
+		}
+	}
+
+	// Only the first few invalid keys are listed.
+	r := cv()
+	for i := 0; i < maxReportedSchemaErrors+2; i++ {
+		r.ClientView[fmt.Sprintf("todo/%02d", i)] = json.RawMessage(`1`)
+	}
+	err = validate(r, schemas)
+	assert.Contains(err.Error(), "client view not stored: 12 invalid values: ")
+	assert.Contains(err.Error(), `key "todo/09": expected object, got integer; and 2 more`)
+
+	// Without schemas anything goes.
+	assert.NoError(validate(cv("todo/1", `1`), nil))
+}
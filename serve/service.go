@@ -1,15 +1,19 @@
 package serve
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/attic-labs/noms/go/datas"
 	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 
@@ -34,33 +38,140 @@ type Service struct {
 	storageRoot         string
 	urlPrefix           string
 	maxASClientViewURLs int
-	accountDB           *account.DB
+	accounts            *account.Store
+	accountRefresh      time.Duration
 	nomsen              map[string]datas.Database
 	disableAuth         bool
+	allowAccountIDAuth  bool
 	enableInject        bool
+	compression         CompressionConfig
+	limiter             *rateLimiter
+	breakerConfig       BreakerConfig
+	breaker             *breaker
+	schemas             *schemaCache
+	maxPullBytes        int64
+	meter               *account.Meter
 	mu                  sync.Mutex
 
 	// cvg may be nil, in which case the server skips the client view request in pull, which is
 	// useful if you are populating the db directly or in tests.
-	clientViewGetter clientViewGetter
+	clientViewGetter ClientViewSource
+	// sources fetch client views with URLs of other schemes than HTTP(S),
+	// by scheme.
+	sources map[string]ClientViewSource
 }
 
-type clientViewGetter interface {
-	Get(url string, req servetypes.ClientViewRequest, authToken string, syncID string) (servetypes.ClientViewResponse, int, error)
+// ClientViewSource fetches client views. ClientViewGetter fetches them
+// over HTTP; others can be registered for other URL schemes with
+// WithClientViewSource. code is the HTTP status code of the response, or
+// its equivalent for other sources.
+type ClientViewSource interface {
+	Get(ctx context.Context, url string, req servetypes.ClientViewRequest, authToken string, syncID string, opts ClientViewOptions) (resp servetypes.ClientViewResponse, code int, err error)
+}
+
+// Option configures optional behavior of a Service.
+type Option func(*Service)
+
+// WithCompression sets how pull responses are compressed. If not given,
+// DefaultCompressionConfig is used.
+func WithCompression(c CompressionConfig) Option {
+	return func(s *Service) {
+		s.compression = c
+	}
+}
+
+// WithAccountIDAuth allows clients to authorize with a bare account ID
+// instead of a key, for accounts that don't have any keys yet. See
+// account.Lookup.
+func WithAccountIDAuth(allow bool) Option {
+	return func(s *Service) {
+		s.allowAccountIDAuth = allow
+	}
+}
+
+// WithAccountRefreshInterval sets how often cached account records are
+// reloaded to pick up changes made by other processes. If not given,
+// account.DefaultRefreshInterval is used.
+func WithAccountRefreshInterval(d time.Duration) Option {
+	return func(s *Service) {
+		s.accountRefresh = d
+	}
+}
+
+// WithMeter counts pulls of known accounts with m. If not given, usage is
+// not metered.
+func WithMeter(m *account.Meter) Option {
+	return func(s *Service) {
+		s.meter = m
+	}
+}
+
+// WithClientViewBreaker configures the circuit breakers that skip fetching
+// client views from hosts that keep failing. If not given,
+// DefaultBreakerConfig is used.
+func WithClientViewBreaker(c BreakerConfig) Option {
+	return func(s *Service) {
+		s.breakerConfig = c
+	}
+}
+
+// WithClientViewSource fetches client views whose URLs have the given
+// scheme, eg "file", with src rather than the Service's ClientViewGetter.
+func WithClientViewSource(scheme string, src ClientViewSource) Option {
+	return func(s *Service) {
+		s.sources[strings.ToLower(scheme)] = src
+	}
+}
+
+// DefaultMaxPullBytes is the default limit on the size of pull request
+// bodies.
+const DefaultMaxPullBytes = 1 << 20
+
+// WithMaxPullBytes sets the limit on the size of pull request bodies, for
+// accounts that don't override it. Zero or less is unlimited. If not given,
+// DefaultMaxPullBytes is used.
+func WithMaxPullBytes(n int64) Option {
+	return func(s *Service) {
+		s.maxPullBytes = n
+	}
 }
 
 // NewService creates a new instances of the Replicant web service.
-func NewService(storageRoot string, maxASClientViewURLs int, accountDB *account.DB, disableAuth bool, cvg clientViewGetter, enableInject bool) *Service {
-	return &Service{
+func NewService(storageRoot string, maxASClientViewURLs int, accountDB *account.DB, disableAuth bool, cvg ClientViewSource, enableInject bool, opts ...Option) *Service {
+	s := &Service{
 		storageRoot:         storageRoot,
 		maxASClientViewURLs: maxASClientViewURLs,
-		accountDB:           accountDB,
 		nomsen:              map[string]datas.Database{},
 		disableAuth:         disableAuth,
 		enableInject:        enableInject,
+		compression:         DefaultCompressionConfig,
+		limiter:             newRateLimiter(time.Now),
+		breakerConfig:       DefaultBreakerConfig,
+		schemas:             newSchemaCache(),
+		maxPullBytes:        DefaultMaxPullBytes,
+		accountRefresh:      account.DefaultRefreshInterval,
 		mu:                  sync.Mutex{},
 		clientViewGetter:    cvg,
+		sources:             map[string]ClientViewSource{},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.accounts = account.NewStore(accountDB, s.accountRefresh)
+	s.breaker = newBreaker(s.breakerConfig, time.Now)
+	return s
+}
+
+// clientViewSource returns the source to fetch the client view at url
+// from: the one registered for its scheme, or the Service's
+// ClientViewGetter.
+func (s *Service) clientViewSource(clientViewURL string) ClientViewSource {
+	if u, err := url.Parse(clientViewURL); err == nil {
+		if src, ok := s.sources[strings.ToLower(u.Scheme)]; ok {
+			return src
+		}
+	}
+	return s.clientViewGetter
 }
 
 // RegisterHandlers register's Service's handlers on the given router.
@@ -69,7 +180,7 @@ func RegisterHandlers(s *Service, router *mux.Router) {
 	router.HandleFunc("/", s.hello)
 	inject := alice.New(panicCatcher).ThenFunc(s.inject)
 	router.Handle("/inject", inject)
-	pull := alice.New(contextLogger, panicCatcher, logHTTP).ThenFunc(s.pull)
+	pull := alice.New(contextLogger, panicCatcher, s.logHTTP).ThenFunc(s.pull)
 	router.Handle("/pull", pull)
 }
 
@@ -78,7 +189,7 @@ func (s *Service) GetDB(accountID, clientID string) (*db.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	dsName := fmt.Sprintf("client/%s", clientID)
+	dsName := clientDatasetPrefix + clientID
 	db, err := db.New(noms.GetDataset(dsName))
 	if err != nil {
 		return nil, err
@@ -86,18 +197,96 @@ func (s *Service) GetDB(accountID, clientID string) (*db.DB, error) {
 	return db, nil
 }
 
-func (s *Service) getNoms(accountID string) (datas.Database, error) {
+// clientDatasetPrefix prefixes the names of client datasets.
+const clientDatasetPrefix = "client/"
+
+// ClientIDs returns the IDs of the clients that have data stored for the
+// given account, in order.
+func (s *Service) ClientIDs(accountID string) ([]string, error) {
+	noms, err := s.getNoms(accountID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	noms.Datasets().IterAll(func(k, v types.Value) {
+		name := string(k.(types.String))
+		if strings.HasPrefix(name, clientDatasetPrefix) {
+			ids = append(ids, name[len(clientDatasetPrefix):])
+		}
+	})
+	return ids, nil
+}
+
+// maxDeleteAttempts bounds how many times DeleteClients tries to delete a
+// client that is being written to concurrently.
+const maxDeleteAttempts = 10
+
+// DeleteClients removes the data of all of the account's clients and
+// returns how many clients it removed. The account's other datasets are
+// left alone.
+func (s *Service) DeleteClients(accountID string) (int, error) {
+	ids, err := s.ClientIDs(accountID)
+	if err != nil {
+		return 0, err
+	}
+	noms, err := s.getNoms(accountID)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		// Another writer might commit to the client concurrently, in which
+		// case we retry with the new head.
+		for attempt := 1; ; attempt++ {
+			_, err = noms.Delete(noms.GetDataset(clientDatasetPrefix + id))
+			if err != datas.ErrOptimisticLockFailed || attempt == maxDeleteAttempts {
+				break
+			}
+			noms.Rebase()
+		}
+		if err == datas.ErrOptimisticLockFailed {
+			return 0, fmt.Errorf("could not delete client %s: gave up after %d attempts: %w", id, maxDeleteAttempts, err)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("could not delete client %s: %w", id, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// inactiveMessage is the error sent to clients of accounts that are not
+// active.
+func inactiveMessage(status account.Status) string {
+	msg := fmt.Sprintf("Account is %s", status.State)
+	if status.Reason != "" {
+		msg += ": " + status.Reason
+	}
+	return msg
+}
+
+// getNoms returns the Noms database the named account's data is stored in,
+// see storageSpec.
+func (s *Service) getNoms(accountName string) (datas.Database, error) {
+	sp, err := s.storageSpec(accountName)
+	if err != nil {
+		return nil, err
+	}
+	return s.getNomsForSpec(sp)
+}
+
+// getNomsForSpec returns the Noms database at the given spec. Databases are
+// cached by spec, so accounts that move storage get a new one.
+func (s *Service) getNomsForSpec(dbSpec string) (datas.Database, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	n := s.nomsen[accountID]
+	n := s.nomsen[dbSpec]
 	if n == nil {
-		sp, err := spec.ForDatabase(fmt.Sprintf("%s/%s", s.storageRoot, accountID))
+		sp, err := spec.ForDatabase(dbSpec)
 		if err != nil {
 			return nil, err
 		}
 		n = sp.GetDatabase()
-		s.nomsen[accountID] = n
+		s.nomsen[dbSpec] = n
 	} else {
 		n.Rebase()
 	}
@@ -24,8 +24,8 @@ func TestConcurrentAccessUsingMultipleServices(t *testing.T) {
 	defer func() { assert.NoError(os.RemoveAll(adir)) }()
 
 	fcvg := &fakeClientViewGet{resp: types.ClientViewResponse{}, code: 200, err: nil}
-	svc1 := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, true)
-	svc2 := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, true)
+	svc1 := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, true, WithAccountIDAuth(true))
+	svc2 := NewService(td, account.MaxASClientViewHosts, adb, false, fcvg, true, WithAccountIDAuth(true))
 
 	res := []*httptest.ResponseRecorder{
 		httptest.NewRecorder(),
@@ -71,3 +71,88 @@ func TestNo301(t *testing.T) {
 	assert.Equal(http.StatusNotFound, r.Code)
 	assert.Equal("404 page not found\n", string(r.Body.Bytes()))
 }
+
+func TestClientIDs(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+
+	svc := NewService(td, account.MaxASClientViewHosts, adb, false, nil, true)
+	ids, err := svc.ClientIDs("1")
+	assert.NoError(err)
+	assert.Equal([]string{}, ids)
+
+	for _, c := range []string{"b", "a"} {
+		_, err := svc.GetDB("1", c)
+		assert.NoError(err)
+	}
+	ids, err = svc.ClientIDs("1")
+	assert.NoError(err)
+	assert.Equal([]string{"a", "b"}, ids)
+	ids, err = svc.ClientIDs("2")
+	assert.NoError(err)
+	assert.Equal([]string{}, ids)
+}
+
+func TestDeleteClients(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+
+	svc := NewService(td, account.MaxASClientViewHosts, adb, false, nil, true)
+	for _, c := range []string{"a", "b"} {
+		_, err := svc.GetDB("1", c)
+		assert.NoError(err)
+	}
+	_, err := svc.GetDB("2", "a")
+	assert.NoError(err)
+
+	n, err := svc.DeleteClients("1")
+	assert.NoError(err)
+	assert.Equal(2, n)
+	ids, err := svc.ClientIDs("1")
+	assert.NoError(err)
+	assert.Equal([]string{}, ids)
+	ids, err = svc.ClientIDs("2")
+	assert.NoError(err)
+	assert.Equal([]string{"a"}, ids)
+	n, err = svc.DeleteClients("1")
+	assert.NoError(err)
+	assert.Equal(0, n)
+}
+
+func TestInactiveAccount(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	assert.NoError(account.Update(adb, func(records *account.Records) error {
+		r := records.Record[account.UnittestID]
+		r.Status = account.Status{State: account.StateSuspended, Reason: "unpaid invoice"}
+		records.Record[account.UnittestID] = r
+		return nil
+	}))
+
+	// Inactive accounts are rejected even with auth disabled.
+	for _, disableAuth := range []bool{false, true} {
+		s := NewService(td, account.MaxASClientViewHosts, adb, disableAuth, nil, true)
+		req := httptest.NewRequest("POST", "/pull", strings.NewReader(`{"baseStateID": "", "checksum": "00000000", "clientID": "c1", "version": 2}`))
+		req.Header.Set("Authorization", account.UnittestKey)
+		resp := httptest.NewRecorder()
+		s.pull(resp, req)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal("Account is suspended: unpaid invoice", resp.Body.String())
+
+		req = httptest.NewRequest("POST", "/inject", strings.NewReader(fmt.Sprintf(`{"accountID": "%d", "clientID": "c1", "clientViewResponse": {"clientView":{}, "lastTransactionID":"1"}}`, account.UnittestID)))
+		resp = httptest.NewRecorder()
+		s.inject(resp, req)
+		assert.Equal(http.StatusForbidden, resp.Code)
+		assert.Equal("Account is suspended: unpaid invoice", resp.Body.String())
+	}
+}
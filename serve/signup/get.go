@@ -18,8 +18,8 @@ const GetTemplate = `
 <body>
     <h2>Replicache Account Signup</h2>
 
-    <p>Please fill out the form below to generate an Account ID for Replicache.<br>
-    You need to include your Account ID in the <i>diffServerAuth</i> field when<br>
+    <p>Please fill out the form below to generate an Account ID and API key for Replicache.<br>
+    You need to include your API key in the <i>diffServerAuth</i> field when<br>
     you <a href="https://github.com/rocicorp/replicache-sdk-js#%EF%B8%8F-instantiate">instantiate Replicache</a>
     in your JavaScript application.
 
@@ -32,6 +32,8 @@ const GetTemplate = `
     <form method="POST" action="/signup">
         <label>Name: <input type="text" name="{{.Name}}"></label><br>
         <label>Email: <input type="text" name="{{.Email}}"></label><br>
+        <!-- Left empty by people, who can't see it, and filled in by bots. -->
+        <label style="display: none">Website: <input type="text" name="{{.Honeypot}}" tabindex="-1" autocomplete="off"></label>
         <input type="submit">
     </form>
 
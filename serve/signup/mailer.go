@@ -0,0 +1,86 @@
+package signup
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	zl "github.com/rs/zerolog"
+)
+
+// Mailer sends email. Signup uses it to send verification links.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends email through an SMTP server.
+type SMTPMailer struct {
+	Addr string // host:port of the server.
+	From string
+	// Auth may be nil if the server doesn't require authentication.
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer that sends from the given address through
+// the server at addr, authenticating with PLAIN auth if username is not
+// empty.
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send implements Mailer.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, message(m.From, to, subject, body))
+}
+
+// message formats an email. Header values must not contain newlines, which
+// would let them add headers of their own.
+func message(from, to, subject, body string) []byte {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		clean.Replace(from), clean.Replace(to), clean.Replace(subject), time.Now().Format(time.RFC1123Z), body))
+}
+
+// FileMailer appends email to a file instead of sending it, for local use.
+type FileMailer struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Send implements Mailer.
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(message("signup", to, subject, body), "\r\n\r\n"...))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LogMailer logs email instead of sending it, for local use.
+type LogMailer struct {
+	Logger zl.Logger
+}
+
+// Send implements Mailer.
+func (m LogMailer) Send(to, subject, body string) error {
+	m.Logger.Info().Str("to", to).Str("subject", subject).Msg(body)
+	return nil
+}
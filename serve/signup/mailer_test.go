@@ -0,0 +1,33 @@
+package signup_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/serve/signup"
+)
+
+func TestFileMailer(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	m := &signup.FileMailer{Path: filepath.Join(dir, "mail.txt")}
+	assert.NoError(m.Send("a@example.com", "Hello", "First"))
+	// Newlines can't be used to add headers.
+	assert.NoError(m.Send("b@example.com\r\nBcc: c@example.com", "Hello", "Second"))
+	b, err := ioutil.ReadFile(m.Path)
+	assert.NoError(err)
+	got := string(b)
+	assert.Contains(got, "To: a@example.com\r\nSubject: Hello\r\n")
+	assert.Contains(got, "\r\n\r\nFirst")
+	assert.Contains(got, "To: b@example.comBcc: c@example.com\r\n")
+	assert.False(strings.Contains(got, "\r\nBcc:"))
+	assert.Contains(got, "\r\n\r\nSecond")
+}
@@ -16,13 +16,21 @@ const PostSuccessTemplate = `
 
 	<h2>Your Account ID is {{ .ID }}</h2>
 
+	<p><big><strong>Your account can't be used until you verify your email address.</strong></big><br>
+	We sent a verification link to {{ .Email }}. It expires in {{ .TTL }}, after which the account is deleted.
+
+	<p>Your API key is:<br>
+	<pre>{{ .Key }}</pre>
+	<p><big><strong>Copy it now: this is the only time it will be shown.</strong></big> We only store<br>
+	a hash of it, so if you lose it we cannot recover it for you.
+
 	Please note:
 	<ul>
 	  <li>Your account is suitable for <big><big><strong>evaluation purposes</strong></big></big>. To deploy to<br>
 	  end users in production for non-evaluation purposes, please contact us at <a href="mailto:support@replicache.dev">support@replicache.dev</a>.<br>
 	  (We just need to lift some default limits for you and ensure you agree to our <a href="https://github.com/rocicorp/repc/blob/main/licenses/BSL.txt">BSL license</a>.)<br><br>
 
-	  <li>You need to include your Account ID in the <i>diffServerAuth</i> field when<br>
+	  <li>You need to include your API key in the <i>diffServerAuth</i> field when<br>
 	  you <a href="https://github.com/rocicorp/replicache-sdk-js#%EF%B8%8F-instantiate">instantiate Replicache</a>
 	  in your JavaScript application.
 
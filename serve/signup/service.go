@@ -1,16 +1,23 @@
 package signup
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	zl "github.com/rs/zerolog"
 	"roci.dev/diff-server/account"
+	"roci.dev/diff-server/util/ratelimit"
 )
 
 // Templates returns the list of Templates the signup service needs.
@@ -20,6 +27,8 @@ func Templates() []Template {
 		{Name: GetTemplateName, Content: GetTemplate},
 		{Name: PostFailureTemplateName, Content: PostFailureTemplate},
 		{Name: PostSuccessTemplateName, Content: PostSuccessTemplate},
+		{Name: VerifySuccessTemplateName, Content: VerifySuccessTemplate},
+		{Name: VerifyFailureTemplateName, Content: VerifyFailureTemplate},
 	}
 }
 
@@ -45,18 +54,84 @@ func ParseTemplates(templates []Template) (t *template.Template, err error) {
 
 // Service is an instance of the signup service. It returns a little form
 // to fill out with account information, accepts a POST from the form, and creates
-// the account in an account.DB.
+// the account in an account.DB. The account can't be used until its email
+// address is verified by following a link sent by the service's Mailer.
 type Service struct {
-	logger      zl.Logger
-	tmpl        *template.Template
-	storageRoot string
+	logger         zl.Logger
+	tmpl           *template.Template
+	storageRoot    string
+	mailer         Mailer
+	baseURL        string
+	ipLimiter      *ratelimit.Keyed
+	clientIPHeader string
+}
+
+// Option configures optional behavior of a Service.
+type Option func(*Service)
+
+// WithMailer sets the Mailer verification links are sent with. If not
+// given, they are logged.
+func WithMailer(m Mailer) Option {
+	return func(s *Service) {
+		s.mailer = m
+	}
+}
+
+// WithBaseURL sets the scheme and host verification links point at, eg
+// https://serve.replicache.dev. If not given, they point at the host the
+// signup request was sent to.
+func WithBaseURL(u string) Option {
+	return func(s *Service) {
+		s.baseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// DefaultIPRate and DefaultIPBurst limit how many signups are accepted
+// from each client IP address: a burst of 5, then one every 6 minutes.
+const (
+	DefaultIPRate  = 1.0 / (6 * 60)
+	DefaultIPBurst = 5
+)
+
+// WithIPRateLimit sets how many signups per second are accepted from each
+// client IP address on average, with bursts of up to burst signups. A
+// negative rate disables the limit. If not given, DefaultIPRate and
+// DefaultIPBurst are used.
+func WithIPRateLimit(rate float64, burst int) Option {
+	return func(s *Service) {
+		if rate < 0 {
+			s.ipLimiter = nil
+			return
+		}
+		s.ipLimiter = ratelimit.NewKeyed(rate, burst, time.Now)
+	}
+}
+
+// WithClientIPHeader sets the request header that carries the client's IP
+// address, eg X-Forwarded-For behind a proxy. Its last entry, the one the
+// proxy added, is used. If not given, or the header is missing, the address
+// the request came from is used.
+func WithClientIPHeader(h string) Option {
+	return func(s *Service) {
+		s.clientIPHeader = h
+	}
 }
 
 // NewService instantiates the signup service. Handlers need to be registered with
 // RegisterHandlers.
 // TODO NewService should probably take an account.DB instead of its storageroot
-func NewService(logger zl.Logger, tmpl *template.Template, storageRoot string) *Service {
-	return &Service{logger, tmpl, storageRoot}
+func NewService(logger zl.Logger, tmpl *template.Template, storageRoot string, opts ...Option) *Service {
+	s := &Service{
+		logger:      logger,
+		tmpl:        tmpl,
+		storageRoot: storageRoot,
+		mailer:      LogMailer{logger},
+		ipLimiter:   ratelimit.NewKeyed(DefaultIPRate, DefaultIPBurst, time.Now),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 // Path is the URL path at which to serve. It is used when running locally.
@@ -64,85 +139,333 @@ func NewService(logger zl.Logger, tmpl *template.Template, storageRoot string) *
 // rule in now.json that maps /signup to the service api path.
 const Path = "/signup"
 
+// VerifyPath is the URL path of email verification links.
+const VerifyPath = Path + "/verify"
+
 // RegisterHandlers registers Service's handlers on the given router.
 func RegisterHandlers(s *Service, router *mux.Router) {
 	router.HandleFunc(Path, s.handle)
+	router.HandleFunc(VerifyPath, s.verify)
 }
 
 func (s *Service) handle(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		if err := s.tmpl.ExecuteTemplate(w, GetTemplateName, getTemplateArgs{GetTemplateNameField, GetTemplateEmailField}); err != nil {
+		if err := s.tmpl.ExecuteTemplate(w, GetTemplateName, getTemplateArgs{GetTemplateNameField, GetTemplateEmailField, GetTemplateHoneypotField}); err != nil {
 			serverError(w, err, s.logger)
 		}
 		return
 
 	} else if r.Method == "POST" {
-		name := r.FormValue(GetTemplateNameField)
-		email := r.FormValue(GetTemplateEmailField)
+		if isJSON(r) {
+			s.postJSON(w, r)
+		} else {
+			s.postForm(w, r)
+		}
+		return
+
+	} else {
+		unsupportedMethodError(w, r.Method, s.logger)
+	}
+}
+
+func isJSON(r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+// SignupRequest is the body of a JSON signup request, which is a POST to
+// Path with Content-Type application/json.
+type SignupRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	// Website is a honeypot: it is hidden from people in the form, so only
+	// bots fill it in. Requests in which it isn't empty are rejected.
+	Website string `json:"website,omitempty"`
+}
+
+// SignupResponse is the body of the response to a successful JSON signup.
+// Key is the secret of the account's first key; it is not retrievable later.
+// The account can't be used until its email address is verified.
+type SignupResponse struct {
+	Account account.Record `json:"account"`
+	Key     string         `json:"key"`
+}
+
+// SignupErrorResponse is the body of the response to a failed JSON signup.
+type SignupErrorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// maxRequestBytes caps the size of JSON signup requests.
+const maxRequestBytes = 64 << 10
+
+// signupFailure is why signup refused to create an account.
+type signupFailure struct {
+	code       int // Used as the status of JSON responses.
+	reasons    []string
+	retryAfter time.Duration // Set if code is http.StatusTooManyRequests.
+}
 
-		// The lightest of all possible lightweight form validations.
-		validationFailures := []string{}
-		if name == "" {
-			validationFailures = append(validationFailures, "Please enter a Name (either your personal name or an entity, eg your company).")
+func (s *Service) postForm(w http.ResponseWriter, r *http.Request) {
+	created, secret, failure, err := s.signup(r, r.FormValue(GetTemplateNameField), r.FormValue(GetTemplateEmailField), r.FormValue(GetTemplateHoneypotField))
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	if failure != nil {
+		if failure.code == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(failure.retryAfter))
+			w.WriteHeader(failure.code)
 		}
-		if strings.Index(email, "@") == -1 {
-			validationFailures = append(validationFailures, "Please enter a valid Email Address so we can contact you in the event of problems.")
+		templateArgs := postFailureTemplateArgs{Reasons: failure.reasons}
+		if err := s.tmpl.ExecuteTemplate(w, PostFailureTemplateName, templateArgs); err != nil {
+			serverError(w, err, s.logger)
 		}
-		if len(validationFailures) > 0 {
-			templateArgs := postFailureTemplateArgs{Reasons: validationFailures}
-			if err := s.tmpl.ExecuteTemplate(w, PostFailureTemplateName, templateArgs); err != nil {
-				serverError(w, err, s.logger)
-			}
-			return
+		return
+	}
+	templateArgs := postSuccessTemplateArgs{ID: fmt.Sprintf("%d", created.ID), Key: secret, Email: created.Email, TTL: account.VerificationTTL.String()}
+	if err := s.tmpl.ExecuteTemplate(w, PostSuccessTemplateName, templateArgs); err != nil {
+		serverError(w, err, s.logger)
+	}
+}
+
+func (s *Service) postJSON(w http.ResponseWriter, r *http.Request) {
+	var req SignupRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, SignupErrorResponse{[]string{fmt.Sprintf("Bad request payload: %s", err)}}, s.logger)
+		return
+	}
+	created, secret, failure, err := s.signup(r, req.Name, req.Email, req.Website)
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	if failure != nil {
+		if failure.code == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(failure.retryAfter))
 		}
+		writeJSON(w, failure.code, SignupErrorResponse{failure.reasons}, s.logger)
+		return
+	}
+	// Hashes are of no use to the customer.
+	writeJSON(w, http.StatusCreated, SignupResponse{account.Redact(created), secret}, s.logger)
+}
 
-		db, err := account.NewDB(s.storageRoot)
+// signup creates an auto-signup account and emails its verification link.
+// It returns the account and the secret of its key, or why it refused to
+// create one. honeypot is the value of the honeypot field.
+func (s *Service) signup(r *http.Request, name, email, honeypot string) (account.Record, string, *signupFailure, error) {
+	ip := s.clientIP(r)
+	if s.ipLimiter != nil {
+		if ok, wait := s.ipLimiter.Allow(ip); !ok {
+			s.logger.Info().Msgf("Rate limited signup from %s", ip)
+			return account.Record{}, "", &signupFailure{http.StatusTooManyRequests, []string{"Too many signups from your address. Please try again later."}, wait}, nil
+		}
+	}
+	if honeypot != "" {
+		s.logger.Info().Msgf("Rejected signup from %s: honeypot field filled in", ip)
+		return account.Record{}, "", &signupFailure{code: http.StatusBadRequest, reasons: []string{"Signup rejected."}}, nil
+	}
+
+	// The lightest of all possible lightweight form validations.
+	name, email = strings.TrimSpace(name), strings.TrimSpace(email)
+	validationFailures := []string{}
+	if name == "" {
+		validationFailures = append(validationFailures, "Please enter a Name (either your personal name or an entity, eg your company).")
+	}
+	if strings.Index(email, "@") == -1 {
+		validationFailures = append(validationFailures, "Please enter a valid Email Address so we can contact you in the event of problems.")
+	}
+	if len(validationFailures) > 0 {
+		return account.Record{}, "", &signupFailure{code: http.StatusBadRequest, reasons: validationFailures}, nil
+	}
+	duplicate := &signupFailure{code: http.StatusConflict, reasons: []string{fmt.Sprintf("An account already exists for %s. If you signed up recently, please follow the link we emailed you. Otherwise please contact support@replicache.dev.", email)}}
+
+	db, err := account.NewDB(s.storageRoot)
+	if err != nil {
+		return account.Record{}, "", nil, err
+	}
+	now := time.Now()
+	// Regular accounts aren't in the records Update sees. Signups that
+	// expired unverified are deleted below, so they don't count.
+	all, err := account.ReadAllRecords(db)
+	if err != nil {
+		return account.Record{}, "", nil, err
+	}
+	account.DeleteExpiredUnverified(&all, now)
+	if _, found := account.LookupEmail(all, email); found {
+		return account.Record{}, "", duplicate, nil
+	}
+
+	var created account.Record
+	var secret, token string
+	var expired []uint32
+	err = account.Update(db, func(accounts *account.Records) error {
+		// Clean up after signups that were never verified.
+		expired = account.DeleteExpiredUnverified(accounts, now)
+		if _, found := account.LookupEmail(*accounts, email); found {
+			return errDuplicateEmail
+		}
+		id := accounts.NextASID
+		// The key's secret is shown exactly once, by the caller. We only store its hash.
+		var key account.Key
+		var verification account.Verification
+		var err error
+		secret, key, err = account.NewKey(id, "default")
 		if err != nil {
-			serverError(w, err, s.logger)
-			return
+			return err
 		}
-		accounts, err := account.ReadAllRecords(db)
+		token, verification, err = account.NewVerification(now)
 		if err != nil {
-			serverError(w, err, s.logger)
-			return
+			return err
 		}
-		id := accounts.NextASID
-		accounts.Record[id] = account.Record{
-			ID:          id,
-			Name:        name,
-			Email:       email,
-			DateCreated: time.Now().String(),
+		created = account.Record{
+			ID:           id,
+			Name:         name,
+			Email:        email,
+			DateCreated:  now.String(),
+			Keys:         []account.Key{key},
+			Verification: verification,
 		}
+		accounts.Record[id] = created
 		accounts.NextASID++
-		if err := account.WriteRecords(db, accounts); err != nil {
-			// TODO: retry if head was changed from under us.
+		return nil
+	})
+	if err == errDuplicateEmail {
+		return account.Record{}, "", duplicate, nil
+	}
+	if err != nil {
+		return account.Record{}, "", nil, err
+	}
+	if len(expired) > 0 {
+		s.logger.Info().Msgf("Deleted unverified auto-signup accounts: %v", expired)
+	}
+	s.logger.Info().Msgf("Created auto-signup account %d from %s", created.ID, ip)
+
+	link := fmt.Sprintf("%s%s?%s", s.linkBase(r), VerifyPath, url.Values{"id": {fmt.Sprint(created.ID)}, "token": {token}}.Encode())
+	if err := s.mailer.Send(email, verifyEmailSubject, fmt.Sprintf(verifyEmailBody, name, created.ID, link, account.VerificationTTL)); err != nil {
+		s.logger.Error().Err(err).Msgf("Could not send verification email for account %d", created.ID)
+		// Nobody can verify the account, so don't keep it around.
+		if err := account.Update(db, func(accounts *account.Records) error {
+			delete(accounts.Record, created.ID)
+			return nil
+		}); err != nil {
+			s.logger.Error().Err(err).Msgf("Could not delete unverifiable account %d", created.ID)
+		}
+		return account.Record{}, "", &signupFailure{code: http.StatusBadGateway, reasons: []string{fmt.Sprintf("We could not send a verification email to %s. Please check the address.", email)}}, nil
+	}
+	return created, secret, nil, nil
+}
+
+var errDuplicateEmail = errors.New("duplicate email")
+
+// clientIP returns the address signup rate limits are applied to.
+func (s *Service) clientIP(r *http.Request) string {
+	if s.clientIPHeader != "" {
+		if vs := r.Header.Values(s.clientIPHeader); len(vs) > 0 {
+			// X-Forwarded-For is a list that each proxy appends to. Only the
+			// last entry, added by the proxy in front of us, can be trusted:
+			// the client can send anything before it.
+			entries := strings.Split(vs[len(vs)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// linkBase returns the scheme and host links in email sent in response to
+// r should point at.
+func (s *Service) linkBase(r *http.Request) string {
+	if s.baseURL != "" {
+		return s.baseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func (s *Service) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		unsupportedMethodError(w, r.Method, s.logger)
+		return
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		if err := s.tmpl.ExecuteTemplate(w, VerifyFailureTemplateName, nil); err != nil {
 			serverError(w, err, s.logger)
-			return
 		}
-		templateArgs := postSuccessTemplateArgs{ID: fmt.Sprintf("%d", id)}
-		if err := s.tmpl.ExecuteTemplate(w, PostSuccessTemplateName, templateArgs); err != nil {
+		return
+	}
+	db, err := account.NewDB(s.storageRoot)
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	err = account.Update(db, func(accounts *account.Records) error {
+		return account.Verify(accounts, uint32(id), r.FormValue("token"), time.Now())
+	})
+	if err == account.ErrVerificationFailed {
+		s.logger.Info().Msgf("Failed verification of account %d", id)
+		w.WriteHeader(http.StatusBadRequest)
+		if err := s.tmpl.ExecuteTemplate(w, VerifyFailureTemplateName, nil); err != nil {
 			serverError(w, err, s.logger)
 		}
-		s.logger.Info().Msgf("Created auto-signup account: %#v", accounts.Record[id])
 		return
-
-	} else {
-		unsupportedMethodError(w, r.Method, s.logger)
+	}
+	if err != nil {
+		serverError(w, err, s.logger)
+		return
+	}
+	s.logger.Info().Msgf("Verified auto-signup account %d", id)
+	if err := s.tmpl.ExecuteTemplate(w, VerifySuccessTemplateName, verifySuccessTemplateArgs{ID: fmt.Sprint(id)}); err != nil {
+		serverError(w, err, s.logger)
 	}
 }
 
+const verifyEmailSubject = "Verify your Replicache account"
+
+// verifyEmailBody is formatted with the name, account ID, verification
+// link and how long the link is good for.
+const verifyEmailBody = `Hi %s,
+
+Please verify your email address to activate Replicache account %d:
+
+%s
+
+The link expires in %s. If you didn't sign up for Replicache you can ignore
+this email and the account will be deleted.
+`
+
 const GetTemplateNameField = "name"
 const GetTemplateEmailField = "email"
+const GetTemplateHoneypotField = "website"
 
 // getTemplateArgs holds the names of the form fields to use in the form.
 // They're extracted into the constants above so they are easy to change if need be.
 type getTemplateArgs struct {
-	Name  string
-	Email string
+	Name     string
+	Email    string
+	Honeypot string
 }
 
 type postSuccessTemplateArgs struct {
-	ID string // The newly created account id.
+	ID    string // The newly created account id.
+	Key   string // The secret of the account's first key.
+	Email string // Where the verification link was sent.
+	TTL   string // How long the verification link is good for.
+}
+
+type verifySuccessTemplateArgs struct {
+	ID string // The verified account id.
 }
 
 type postFailureTemplateArgs struct {
@@ -159,6 +482,17 @@ func clientError(w http.ResponseWriter, code int, body string, l zl.Logger) {
 	io.Copy(w, strings.NewReader(body))
 }
 
+func writeJSON(w http.ResponseWriter, code int, v interface{}, l zl.Logger) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		serverError(w, err, l)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(b, '\n'))
+}
+
 func serverError(w http.ResponseWriter, err error, l zl.Logger) {
 	w.WriteHeader(http.StatusInternalServerError)
 	l.Error().Int("status", http.StatusInternalServerError).Err(err).Send()
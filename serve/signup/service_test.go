@@ -2,14 +2,18 @@ package signup_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
@@ -39,9 +43,20 @@ func TestGET(t *testing.T) {
 	body := string(bodyBytes)
 	assert.True(strings.Contains(body, fmt.Sprintf(`name="%s"`, signup.GetTemplateNameField)))
 	assert.True(strings.Contains(body, fmt.Sprintf(`name="%s"`, signup.GetTemplateEmailField)))
+	assert.True(strings.Contains(body, fmt.Sprintf(`name="%s"`, signup.GetTemplateHoneypotField)))
 	assert.True(strings.Contains(body, `type="submit"`))
 }
 
+type fakeMailer struct {
+	to, subject, body string
+	err               error
+}
+
+func (f *fakeMailer) Send(to, subject, body string) error {
+	f.to, f.subject, f.body = to, subject, body
+	return f.err
+}
+
 func TestPOSTSuccess(t *testing.T) {
 	assert := assert.New(t)
 	dir, err := ioutil.TempDir("", "")
@@ -49,7 +64,8 @@ func TestPOSTSuccess(t *testing.T) {
 	defer func() { assert.NoError(os.RemoveAll(dir)) }()
 
 	tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
-	service := signup.NewService(log.Default(), tmpl, dir)
+	mailer := &fakeMailer{}
+	service := signup.NewService(log.Default(), tmpl, dir, signup.WithMailer(mailer))
 	m := mux.NewRouter()
 	signup.RegisterHandlers(service, m)
 	db, err := account.NewDB(dir)
@@ -71,6 +87,9 @@ func TestPOSTSuccess(t *testing.T) {
 	assert.Equal(200, resp.StatusCode)
 	body := string(bodyBytes)
 	assert.True(strings.Contains(body, fmt.Sprintf("ID is %d", expectedASID)))
+	assert.True(strings.Contains(body, "verification link to larry@example.com"))
+	key := regexp.MustCompile(`rk_[0-9]+_[0-9a-f]+`).FindString(body)
+	assert.True(strings.HasPrefix(key, fmt.Sprintf("rk_%d_", expectedASID)))
 
 	// Ensure the account db was updated.
 	assert.NoError(db.Reload())
@@ -79,6 +98,69 @@ func TestPOSTSuccess(t *testing.T) {
 	assert.Equal("Larry", hv.Record[expectedASID].Name)
 	assert.Equal("larry@example.com", hv.Record[expectedASID].Email)
 	assert.NotEqual("", hv.Record[expectedASID].DateCreated)
+	assert.True(account.Unverified(hv.Record[expectedASID]))
+
+	// The key doesn't work until the email address is verified.
+	_, found := account.Lookup(hv, key, false)
+	assert.False(found)
+	assert.Equal("larry@example.com", mailer.to)
+	link := regexp.MustCompile(`http://example.com/signup/verify\?\S+`).FindString(mailer.body)
+	assert.NotEqual("", link, mailer.body)
+
+	verify := func(link string) (int, string) {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", link, nil))
+		return rec.Code, rec.Body.String()
+	}
+	code, body := verify(strings.Replace(link, "token=", "token=0", 1))
+	assert.Equal(400, code)
+	assert.Contains(body, "Could not verify")
+	code, body = verify(link)
+	assert.Equal(200, code)
+	assert.Contains(body, fmt.Sprintf("Account %d is ready", expectedASID))
+	// Following the link again is fine.
+	code, _ = verify(link)
+	assert.Equal(200, code)
+
+	// Ensure the key shown authorizes the account and isn't stored in the clear.
+	assert.NoError(db.Reload())
+	hv = db.HeadValue()
+	got, found := account.Lookup(hv, key, false)
+	assert.True(found)
+	assert.Equal(expectedASID, got.ID)
+	assert.Equal(1, len(got.Keys))
+	assert.NotContains(got.Keys[0].Hash, key[len(key)-16:])
+}
+
+func TestPOSTMailFailure(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
+	mailer := &fakeMailer{err: errors.New("boom")}
+	service := signup.NewService(log.Default(), tmpl, dir, signup.WithMailer(mailer), signup.WithBaseURL("https://serve.replicache.dev/"))
+	m := mux.NewRouter()
+	signup.RegisterHandlers(service, m)
+
+	postData := url.Values{}
+	postData.Set(signup.GetTemplateNameField, "Larry")
+	postData.Set(signup.GetTemplateEmailField, "larry@example.com")
+	postForm := httptest.NewRequest("POST", signup.Path, bytes.NewBufferString(postData.Encode()))
+	postForm.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, postForm)
+	assert.Equal(200, rec.Code)
+	assert.Contains(rec.Body.String(), "could not send a verification email")
+	assert.Contains(mailer.body, "https://serve.replicache.dev/signup/verify?id=1000000&token=")
+
+	// The account that couldn't be verified is gone.
+	db, err := account.NewDB(dir)
+	assert.NoError(err)
+	hv := db.HeadValue()
+	assert.Equal(0, len(hv.Record))
+	assert.Equal(account.LowestASID+1, hv.NextASID)
 }
 
 func TestPOSTFailure(t *testing.T) {
@@ -118,3 +200,130 @@ func TestPOSTFailure(t *testing.T) {
 	hv := db.HeadValue()
 	assert.Equal(expectedNextASID, hv.NextASID)
 }
+
+func TestPOSTJSON(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
+	mailer := &fakeMailer{}
+	service := signup.NewService(log.Default(), tmpl, dir, signup.WithMailer(mailer), signup.WithIPRateLimit(-1, 0))
+	m := mux.NewRouter()
+	signup.RegisterHandlers(service, m)
+
+	tc := []struct {
+		body         string
+		expectedCode int
+		expectedErr  string
+	}{
+		{`{"name": "Larry", "email": "larry@example.com"}`, 201, ""},
+		{`{"name": "Larry", "email": " LARRY@example.com"}`, 409, "An account already exists for LARRY@example.com"},
+		{`{"name": "", "email": "larry"}`, 400, "Please enter a Name"},
+		{`{"name": "Bot", "email": "bot@example.com", "website": "http://spam.example.com"}`, 400, "Signup rejected."},
+		{`not json`, 400, "Bad request payload"},
+	}
+
+	for i, t := range tc {
+		msg := fmt.Sprintf("test case %d: %s", i, t.body)
+		req := httptest.NewRequest("POST", signup.Path, strings.NewReader(t.body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		assert.Equal(t.expectedCode, rec.Code, msg)
+		assert.Equal("application/json", rec.Header().Get("Content-Type"), msg)
+		if t.expectedErr != "" {
+			var got signup.SignupErrorResponse
+			assert.NoError(json.Unmarshal(rec.Body.Bytes(), &got), msg)
+			assert.Contains(strings.Join(got.Errors, "\n"), t.expectedErr, msg)
+			continue
+		}
+		var got signup.SignupResponse
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &got), msg)
+		assert.Equal(account.LowestASID, got.Account.ID, msg)
+		assert.Equal("larry@example.com", got.Account.Email, msg)
+		assert.Equal("", got.Account.Keys[0].Hash, msg)
+		assert.Equal("", got.Account.Verification.TokenHash, msg)
+		assert.NotEqual("", got.Account.Verification.Expires, msg)
+		assert.Equal("larry@example.com", mailer.to, msg)
+
+		// The key doesn't work until the account is verified.
+		db, err := account.NewDB(dir)
+		assert.NoError(err)
+		records, err := account.ReadRecords(db)
+		assert.NoError(err)
+		_, found := account.Lookup(records, got.Key, false)
+		assert.False(found, msg)
+	}
+
+	// Only the first signup created an account.
+	db, err := account.NewDB(dir)
+	assert.NoError(err)
+	assert.Equal(1, len(db.HeadValue().Record))
+}
+
+func TestPOSTExpiredUnverified(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
+	service := signup.NewService(log.Default(), tmpl, dir, signup.WithMailer(&fakeMailer{}), signup.WithIPRateLimit(-1, 0))
+	m := mux.NewRouter()
+	signup.RegisterHandlers(service, m)
+
+	// An earlier signup with the same email that was never verified.
+	db, err := account.NewDB(dir)
+	assert.NoError(err)
+	assert.NoError(account.Update(db, func(records *account.Records) error {
+		_, verification, err := account.NewVerification(time.Now().Add(-2 * account.VerificationTTL))
+		records.Record[records.NextASID] = account.Record{ID: records.NextASID, Name: "Larry", Email: "larry@example.com", Verification: verification}
+		records.NextASID++
+		return err
+	}))
+
+	req := httptest.NewRequest("POST", signup.Path, strings.NewReader(`{"name": "Larry", "email": "larry@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+	assert.Equal(201, rec.Code, rec.Body.String())
+	var got signup.SignupResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(account.LowestASID+1, got.Account.ID)
+
+	// The expired signup is gone.
+	assert.NoError(db.Reload())
+	assert.Equal(1, len(db.HeadValue().Record))
+}
+
+func TestPOSTRateLimited(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+
+	tmpl := template.Must(signup.ParseTemplates(signup.Templates()))
+	service := signup.NewService(log.Default(), tmpl, dir, signup.WithMailer(&fakeMailer{}), signup.WithIPRateLimit(1.0/60, 1), signup.WithClientIPHeader("X-Forwarded-For"))
+	m := mux.NewRouter()
+	signup.RegisterHandlers(service, m)
+
+	post := func(email, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", signup.Path, strings.NewReader(fmt.Sprintf(`{"name": "Larry", "email": "%s"}`, email)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The last entry is the one added by the trusted proxy; the ones before
+	// it are whatever the client sent.
+	assert.Equal(201, post("a@example.com", "10.0.0.1, 1.2.3.4").Code)
+	rec := post("b@example.com", "10.0.0.2, 1.2.3.4")
+	assert.Equal(429, rec.Code)
+	assert.Equal("60", rec.Header().Get("Retry-After"))
+	assert.Contains(rec.Body.String(), "Too many signups")
+	assert.Equal(201, post("c@example.com", "5.6.7.8").Code)
+}
@@ -0,0 +1,48 @@
+package signup
+
+const VerifySuccessTemplateName = "verify_success"
+
+// VerifySuccessTemplate is the HTML template rendered when a customer
+// follows a valid verification link.
+const VerifySuccessTemplate = `
+<html>
+
+<head>
+    <title>Replicache Account Signup: Verified!</title>
+</head>
+
+<body>
+    <h2>Thanks, your email address is verified.</h2>
+
+	<p>Account {{ .ID }} is ready to use with the API key you were shown when you signed up.
+
+	<p>Potential next steps: <a href="https://github.com/rocicorp/replicache/blob/main/README.md">Replicache README</a>,
+	<a href="https://js.replicache.dev/#replicache-js-sdk">Replicache JS Quick start</a>, or
+	<a href="mailto:support@replicache.dev">contact us at support@replicache.dev</a>.
+</body>
+
+</html>
+`
+
+const VerifyFailureTemplateName = "verify_failure"
+
+// VerifyFailureTemplate is the HTML template rendered when a verification
+// link is invalid or has expired.
+const VerifyFailureTemplate = `
+<html>
+
+<head>
+    <title>Replicache Account Signup: Oops!</title>
+</head>
+
+<body>
+    <h2>Could not verify account :(</h2>
+
+	<p>The verification link is invalid or has expired. Unverified accounts are deleted after a while,<br>
+	so you might need to <a href="/signup">sign up</a> again. If you feel that you've reached this page<br>
+	in error, our apologies, please email <a href="mailto:support@replicache.dev">support@replicache.dev</a>.<br>
+	Thanks!
+</body>
+
+</html>
+`
@@ -0,0 +1,199 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	servetypes "roci.dev/diff-server/serve/types"
+)
+
+// The client view sources in this file read client views from the server's
+// own filesystem, for local development and tests. They let whoever can
+// pull read files and run commands on the server, so they must never be
+// enabled in production.
+
+// FileClientViewSource reads client views from file:// URLs. If the URL
+// names a directory, the client view of each client is read from the file
+// <clientID>.json in it. Files hold a ClientViewResponse.
+type FileClientViewSource struct {
+	config ClientViewGetterConfig
+}
+
+// NewFileClientViewSource returns a FileClientViewSource that enforces the
+// size limits in config.
+func NewFileClientViewSource(config ClientViewGetterConfig) FileClientViewSource {
+	return FileClientViewSource{config: config}
+}
+
+// Get implements ClientViewSource. Missing files are reported with code
+// 404.
+func (s FileClientViewSource) Get(ctx context.Context, clientViewURL string, req servetypes.ClientViewRequest, authToken string, syncID string, opts ClientViewOptions) (servetypes.ClientViewResponse, int, error) {
+	path, err := sourcePath(clientViewURL, "file")
+	if err != nil {
+		return servetypes.ClientViewResponse{}, 0, err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		if req.ClientID == "" || strings.ContainsAny(req.ClientID, `/\`) || req.ClientID == "." || req.ClientID == ".." {
+			return servetypes.ClientViewResponse{}, 0, fmt.Errorf("invalid client ID %q for client view directory", req.ClientID)
+		}
+		path = filepath.Join(path, req.ClientID+".json")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return servetypes.ClientViewResponse{}, http.StatusNotFound, fmt.Errorf("client view file %s not found", path)
+	}
+	if err != nil {
+		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("could not open client view file: %w", err)
+	}
+	defer f.Close()
+	resp, err := readClientViewResponse(f, limitsFor(s.config, opts), opts.OnEntry)
+	if err != nil {
+		return servetypes.ClientViewResponse{}, http.StatusOK, err
+	}
+	return resp, http.StatusOK, nil
+}
+
+// ExecClientViewSource fetches client views by running the command named
+// by exec:// URLs, eg exec:///usr/local/bin/client-view?arg=--verbose, with
+// the arg query parameters as its arguments. The command is given the
+// ClientViewRequest on stdin and the client view auth and sync ID in the
+// environment variables REPLICACHE_CLIENT_VIEW_AUTH and REPLICACHE_SYNC_ID,
+// and must write a ClientViewResponse to stdout.
+type ExecClientViewSource struct {
+	config ClientViewGetterConfig
+}
+
+// NewExecClientViewSource returns an ExecClientViewSource that enforces
+// the size limits in config and kills commands that take longer than its
+// ResponseTimeout.
+func NewExecClientViewSource(config ClientViewGetterConfig) ExecClientViewSource {
+	return ExecClientViewSource{config: config}
+}
+
+const (
+	// maxExecStderr caps how much of a failed command's stderr is reported.
+	maxExecStderr = 1 << 10
+	// execWaitDelay is how long to wait for a killed command's output to
+	// be closed, eg by processes it started, before giving up on it.
+	execWaitDelay = time.Second
+)
+
+// errExecOutputDone stops the copying of a command's output once its
+// client view has been read.
+var errExecOutputDone = errors.New("client view read")
+
+// Get implements ClientViewSource. Commands that exit with an error are
+// reported with code 500.
+func (s ExecClientViewSource) Get(ctx context.Context, clientViewURL string, req servetypes.ClientViewRequest, authToken string, syncID string, opts ClientViewOptions) (servetypes.ClientViewResponse, int, error) {
+	path, err := sourcePath(clientViewURL, "exec")
+	if err != nil {
+		return servetypes.ClientViewResponse{}, 0, err
+	}
+	u, _ := url.Parse(clientViewURL)
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("could not marshal ClientViewRequest: %w", err)
+	}
+	if s.config.ResponseTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.ResponseTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, path, u.Query()["arg"]...)
+	cmd.Stdin = bytes.NewReader(reqBody)
+	cmd.Env = append(os.Environ(), "REPLICACHE_CLIENT_VIEW_AUTH="+authToken, "REPLICACHE_SYNC_ID="+syncID)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = &limitedWriter{w: stderr, n: maxExecStderr}
+	// Stdout is read through a pipe of our own rather than StdoutPipe so
+	// that Wait can be running while it is read, and gives up on output
+	// from processes the command left behind once it has been killed.
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.WaitDelay = execWaitDelay
+	if err := cmd.Start(); err != nil {
+		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("could not run client view command: %w", err)
+	}
+	waited := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		waited <- err
+	}()
+	resp, decodeErr := readClientViewResponse(pr, limitsFor(s.config, opts), opts.OnEntry)
+	// Output after the response is discarded, as is the rest of a response
+	// that is going to be thrown away.
+	pr.CloseWithError(errExecOutputDone)
+	if decodeErr != nil {
+		cmd.Process.Kill()
+	}
+	waitErr := <-waited
+
+	if ctx.Err() != nil {
+		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("client view command %s: %w", path, ctx.Err())
+	}
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) && exitErr.Exited() {
+		return servetypes.ClientViewResponse{}, http.StatusInternalServerError, fmt.Errorf("client view command %s failed: %w: %s", path, waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if decodeErr != nil {
+		return servetypes.ClientViewResponse{}, http.StatusOK, decodeErr
+	}
+	if waitErr != nil && !errors.Is(waitErr, errExecOutputDone) {
+		return servetypes.ClientViewResponse{}, 0, fmt.Errorf("client view command %s: %w", path, waitErr)
+	}
+	return resp, http.StatusOK, nil
+}
+
+// sourcePath returns the path of a file:// or exec:// URL, which must be
+// absolute.
+func sourcePath(clientViewURL string, scheme string) (string, error) {
+	u, err := url.Parse(clientViewURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid client view URL: %w", err)
+	}
+	if !strings.EqualFold(u.Scheme, scheme) {
+		return "", fmt.Errorf("client view URL %s is not a %s:// URL", clientViewURL, scheme)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("client view URL %s must be on localhost", clientViewURL)
+	}
+	if !filepath.IsAbs(u.Path) {
+		return "", fmt.Errorf("client view URL %s must have an absolute path", clientViewURL)
+	}
+	return filepath.Clean(u.Path), nil
+}
+
+// limitedWriter writes to w until n bytes have been written, after which it
+// discards writes.
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n <= 0 {
+		return len(p), nil
+	}
+	q := p
+	if int64(len(q)) > l.n {
+		q = q[:l.n]
+	}
+	n, err := l.w.Write(q)
+	l.n -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}
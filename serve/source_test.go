@@ -0,0 +1,128 @@
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	servetypes "roci.dev/diff-server/serve/types"
+)
+
+func TestFileClientViewSource(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "cv.json"), []byte(`{"clientView": {"a": 1}, "lastMutationID": 2}`), 0644))
+	assert.NoError(os.Mkdir(filepath.Join(dir, "clients"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "clients", "c1.json"), []byte(`{"clientView": {"b": 2}, "lastMutationID": 3}`), 0644))
+
+	config := DefaultClientViewGetterConfig
+	config.MaxKeys = 1
+	src := NewFileClientViewSource(config)
+	tc := []struct {
+		url      string
+		clientID string
+		opts     ClientViewOptions
+		wantResp servetypes.ClientViewResponse
+		wantCode int
+		wantErr  string
+	}{
+		{"file://" + dir + "/cv.json", "c1", ClientViewOptions{}, servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"a": []byte("1")}, LastMutationID: 2}, 200, ""},
+		{"file://localhost" + dir + "/cv.json", "c1", ClientViewOptions{}, servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"a": []byte("1")}, LastMutationID: 2}, 200, ""},
+		{"file://" + dir + "/clients", "c1", ClientViewOptions{}, servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"b": []byte("2")}, LastMutationID: 3}, 200, ""},
+		{"file://" + dir + "/clients", "c2", ClientViewOptions{}, servetypes.ClientViewResponse{}, 404, "not found"},
+		{"file://" + dir + "/clients", "..", ClientViewOptions{}, servetypes.ClientViewResponse{}, 0, `invalid client ID ".."`},
+		{"file://" + dir + "/missing.json", "c1", ClientViewOptions{}, servetypes.ClientViewResponse{}, 404, "not found"},
+		{"file://" + dir + "/cv.json", "c1", ClientViewOptions{MaxBytes: 10}, servetypes.ClientViewResponse{}, 200, "client view response too large: limit is 10 bytes"},
+		{"file://example.com/cv.json", "c1", ClientViewOptions{}, servetypes.ClientViewResponse{}, 0, "must be on localhost"},
+		{"file:cv.json", "c1", ClientViewOptions{}, servetypes.ClientViewResponse{}, 0, "must have an absolute path"},
+	}
+	for i, t := range tc {
+		resp, code, err := src.Get(context.Background(), t.url, servetypes.ClientViewRequest{ClientID: t.clientID}, "", "", t.opts)
+		assert.Equal(t.wantCode, code, "test case %d", i)
+		if t.wantErr != "" {
+			if assert.Error(err, "test case %d", i) {
+				assert.Contains(err.Error(), t.wantErr, "test case %d", i)
+			}
+			continue
+		}
+		assert.NoError(err, "test case %d", i)
+		assert.Equal(t.wantResp, resp, "test case %d", i)
+	}
+}
+
+func TestExecClientViewSource(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(err)
+	defer func() { assert.NoError(os.RemoveAll(dir)) }()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755))
+		return "exec://" + path
+	}
+	echo := script("echo", `req=$(cat)
+printf '{"clientView": {"req": %s, "auth": "%s", "sync": "%s", "arg": "%s"}, "lastMutationID": 1}' "$req" "$REPLICACHE_CLIENT_VIEW_AUTH" "$REPLICACHE_SYNC_ID" "$1"
+`)
+	fail := script("fail", "echo oops >&2\nexit 3\n")
+	garbage := script("garbage", "echo nope\n")
+	slow := script("slow", "sleep 5\n")
+
+	config := DefaultClientViewGetterConfig
+	config.ResponseTimeout = 200 * time.Millisecond
+	src := NewExecClientViewSource(config)
+	get := func(url string) (servetypes.ClientViewResponse, int, error) {
+		return src.Get(context.Background(), url, servetypes.ClientViewRequest{ClientID: "c1"}, "tok", "sid", ClientViewOptions{})
+	}
+
+	resp, code, err := get(echo + "?arg=x")
+	assert.NoError(err)
+	assert.Equal(200, code)
+	assert.Equal(servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{
+		"req":  []byte(`{"clientID":"c1"}`),
+		"auth": []byte(`"tok"`),
+		"sync": []byte(`"sid"`),
+		"arg":  []byte(`"x"`),
+	}, LastMutationID: 1}, resp)
+
+	_, code, err = get(fail)
+	assert.Equal(500, code)
+	assert.Contains(err.Error(), "failed: exit status 3: oops")
+
+	_, code, err = get(garbage)
+	assert.Equal(200, code)
+	assert.Contains(err.Error(), "couldnt decode client view response")
+
+	_, code, err = get(slow)
+	assert.Equal(0, code)
+	assert.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	_, code, err = get("exec://" + filepath.Join(dir, "missing"))
+	assert.Equal(0, code)
+	assert.Contains(err.Error(), "could not run client view command")
+}
+
+func TestClientViewSourceDispatch(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+
+	def, file := &fakeClientViewGet{}, &fakeClientViewGet{}
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, def, false, WithClientViewSource("FILE", file))
+	assert.Equal(file, s.clientViewSource("file:///tmp/cv.json"))
+	assert.Equal(file, s.clientViewSource("File:///tmp/cv.json"))
+	assert.Equal(def, s.clientViewSource("https://example.com/cv"))
+	assert.Equal(def, s.clientViewSource("exec:///bin/cv"))
+	assert.Equal(def, s.clientViewSource(""))
+}
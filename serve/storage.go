@@ -0,0 +1,84 @@
+package serve
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/attic-labs/noms/go/d"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+)
+
+// storageSpec returns the spec of the Noms database the named account's
+// data is stored in: the account's StorageSpec if it has one, otherwise a
+// database under the service's storage root. accountName is an account ID,
+// or the Authorization header if auth is disabled and it doesn't identify
+// an account.
+func (s *Service) storageSpec(accountName string) (string, error) {
+	records, err := s.accounts.Records()
+	if err != nil {
+		return "", err
+	}
+	if id, err := strconv.ParseUint(accountName, 10, 32); err == nil {
+		if r, ok := records.Record[uint32(id)]; ok && r.StorageSpec != "" {
+			return r.StorageSpec, nil
+		}
+	}
+	return s.rootStorageSpec(accountName), nil
+}
+
+// rootStorageSpec returns the spec of the named account's database under
+// the storage root.
+func (s *Service) rootStorageSpec(accountName string) string {
+	return fmt.Sprintf("%s/%s", s.storageRoot, accountName)
+}
+
+// CopyStorage copies all of the datasets of the account with the given ID
+// from where it is currently stored to the Noms database at dbSpec, or to
+// its database under the storage root if dbSpec is empty, and returns how
+// many it copied. Datasets that already exist at dbSpec are overwritten.
+// The source is left as it is and the account's StorageSpec is not changed:
+// the caller does that once the copy has succeeded.
+//
+// Pulls that write to the account during the copy might not be copied; the
+// clients involved will be sent the client view again in full.
+func (s *Service) CopyStorage(id uint32, dbSpec string) (int, error) {
+	accountName := strconv.FormatUint(uint64(id), 10)
+	from, err := s.storageSpec(accountName)
+	if err != nil {
+		return 0, err
+	}
+	if dbSpec == "" {
+		dbSpec = s.rootStorageSpec(accountName)
+	}
+	if dbSpec == from {
+		return 0, fmt.Errorf("account %d is already stored in %s", id, dbSpec)
+	}
+	if _, err := spec.ForDatabase(dbSpec); err != nil {
+		return 0, err
+	}
+	src, err := s.getNomsForSpec(from)
+	if err != nil {
+		return 0, err
+	}
+	sink, err := s.getNomsForSpec(dbSpec)
+	if err != nil {
+		return 0, err
+	}
+
+	heads := map[string]types.Ref{}
+	src.Datasets().IterAll(func(k, v types.Value) {
+		heads[string(k.(types.String))] = v.(types.Ref)
+	})
+	for name, head := range heads {
+		// Pull panics rather than returning errors.
+		if err := d.Try(func() { datas.Pull(src, sink, head, nil) }); err != nil {
+			return 0, fmt.Errorf("could not copy dataset %s: %w", name, err)
+		}
+		if _, err := sink.SetHead(sink.GetDataset(name), head); err != nil {
+			return 0, fmt.Errorf("could not copy dataset %s: %w", name, err)
+		}
+	}
+	return len(heads), nil
+}
@@ -0,0 +1,81 @@
+package serve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"roci.dev/diff-server/account"
+	servetypes "roci.dev/diff-server/serve/types"
+	"roci.dev/diff-server/util/log"
+)
+
+func TestCopyStorage(t *testing.T) {
+	assert := assert.New(t)
+	td, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(td)) }()
+	other, _ := ioutil.TempDir("", "")
+	defer func() { assert.NoError(os.RemoveAll(other)) }()
+	adb, adir := account.LoadTempDB(assert)
+	defer func() { assert.NoError(os.RemoveAll(adir)) }()
+	account.AddUnittestAccount(assert, adb)
+	name := fmt.Sprintf("%d", account.UnittestID)
+
+	s := NewService(td, account.MaxASClientViewHosts, adb, false, nil, true)
+	db, err := s.GetDB(name, "c1")
+	assert.NoError(err)
+	assert.NoError(storeClientView(db, servetypes.ClientViewResponse{ClientView: map[string]json.RawMessage{"k": []byte(`"v"`)}, LastMutationID: 1}, log.Default()))
+	head := db.Head().NomsStruct.Hash()
+
+	setSpec := func(dbSpec string) {
+		assert.NoError(account.Update(adb, func(records *account.Records) error {
+			r := records.Record[account.UnittestID]
+			r.StorageSpec = dbSpec
+			records.Record[account.UnittestID] = r
+			return nil
+		}))
+	}
+
+	// Copy to the other database and switch the account over.
+	n, err := s.CopyStorage(account.UnittestID, other)
+	assert.NoError(err)
+	assert.Equal(1, n)
+	_, err = s.CopyStorage(account.UnittestID, td+"/"+name)
+	assert.EqualError(err, fmt.Sprintf("account %d is already stored in %s/%s", account.UnittestID, td, name))
+	setSpec(other)
+	sp, err := s.storageSpec(name)
+	assert.NoError(err)
+	assert.Equal(other, sp)
+	db, err = s.GetDB(name, "c1")
+	assert.NoError(err)
+	assert.Equal(head, db.Head().NomsStruct.Hash())
+
+	// Writes go to the other database.
+	_, err = s.GetDB(name, "c2")
+	assert.NoError(err)
+	ids, err := s.ClientIDs(name)
+	assert.NoError(err)
+	assert.Equal([]string{"c1", "c2"}, ids)
+
+	// And back to the storage root, which still has the old data.
+	n, err = s.CopyStorage(account.UnittestID, "")
+	assert.NoError(err)
+	assert.Equal(2, n)
+	setSpec("")
+	ids, err = s.ClientIDs(name)
+	assert.NoError(err)
+	assert.Equal([]string{"c1", "c2"}, ids)
+	db, err = s.GetDB(name, "c1")
+	assert.NoError(err)
+	assert.Equal(head, db.Head().NomsStruct.Hash())
+
+	// Accounts without a spec of their own, including unknown ones, are
+	// stored under the root.
+	sp, err = s.storageSpec("nobody")
+	assert.NoError(err)
+	assert.Equal(td+"/nobody", sp)
+}
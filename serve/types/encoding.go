@@ -0,0 +1,357 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"roci.dev/diff-server/kv"
+	nomsjson "roci.dev/diff-server/util/noms/json"
+)
+
+// Encoding is a wire format for a PullResponse. JSON is the default. In the
+// binary encodings patch values are embedded natively instead of being
+// stringified into kv.Operation.ValueString.
+type Encoding int
+
+const (
+	EncodingJSON Encoding = iota
+	EncodingCBOR
+	EncodingMsgpack
+)
+
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeCBOR    = "application/cbor"
+	ContentTypeMsgpack = "application/msgpack"
+)
+
+// ContentType returns the media type to send in the Content-type header.
+func (e Encoding) ContentType() string {
+	switch e {
+	case EncodingCBOR:
+		return ContentTypeCBOR
+	case EncodingMsgpack:
+		return ContentTypeMsgpack
+	default:
+		return ContentTypeJSON
+	}
+}
+
+func (e Encoding) String() string {
+	return e.ContentType()
+}
+
+// EncodingForContentType returns the Encoding for the given media type and
+// true, or false if the media type is not supported. Media type parameters
+// are ignored.
+func EncodingForContentType(contentType string) (Encoding, bool) {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return EncodingJSON, false
+	}
+	switch mt {
+	case ContentTypeJSON:
+		return EncodingJSON, true
+	case ContentTypeCBOR:
+		return EncodingCBOR, true
+	case ContentTypeMsgpack, "application/x-msgpack":
+		return EncodingMsgpack, true
+	}
+	return EncodingJSON, false
+}
+
+// binaryPullResponse is the shape of a PullResponse in the binary encodings.
+// The binary encoders fall back to the json struct tags.
+type binaryPullResponse struct {
+	StateID        string            `json:"stateID"`
+	LastMutationID uint64            `json:"lastMutationID"`
+	Patch          []binaryOperation `json:"patch"`
+	Checksum       string            `json:"checksum"`
+	ClientViewInfo ClientViewInfo    `json:"clientViewInfo"`
+}
+
+// binaryOperation is a kv.Operation with its value embedded natively. Value
+// is nil for remove operations.
+type binaryOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+var (
+	cborEncMode cbor.EncMode
+	cborDecMode cbor.DecMode
+)
+
+func init() {
+	var err error
+	// Canonical so that the same response always encodes to the same bytes.
+	if cborEncMode, err = cbor.CanonicalEncOptions().EncMode(); err != nil {
+		panic(err)
+	}
+	if cborDecMode, err = (cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}).DecMode(); err != nil {
+		panic(err)
+	}
+}
+
+// EncodePullResponse writes resp to w in the given encoding. Patch operations
+// are encoded and written one at a time, so that the encoded response is
+// never held in memory as a whole. The bytes written are the same as those
+// of encoding resp (or, in the binary encodings, a binaryPullResponse) in
+// one go.
+func EncodePullResponse(w io.Writer, e Encoding, resp PullResponse) error {
+	switch e {
+	case EncodingJSON:
+		return encodeJSONPullResponse(w, resp)
+	case EncodingCBOR:
+		return encodeCBORPullResponse(w, resp)
+	case EncodingMsgpack:
+		return encodeMsgpackPullResponse(w, resp)
+	}
+	return fmt.Errorf("unknown encoding: %d", e)
+}
+
+// streamWriter writes encoded pieces of a response to w, remembering the
+// first error so that it need only be checked at the end.
+type streamWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *streamWriter) raw(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *streamWriter) encoded(b []byte, err error) {
+	if sw.err == nil {
+		sw.err = err
+	}
+	sw.raw(b)
+}
+
+func encodeJSONPullResponse(w io.Writer, resp PullResponse) error {
+	sw := &streamWriter{w: w}
+	sw.raw([]byte(`{"stateID":`))
+	sw.encoded(json.Marshal(resp.StateID))
+	sw.raw([]byte(`,"lastMutationID":`))
+	sw.encoded(json.Marshal(resp.LastMutationID))
+	sw.raw([]byte(`,"patch":`))
+	if resp.Patch == nil {
+		sw.raw([]byte("null"))
+	} else {
+		sw.raw([]byte("["))
+		for i, op := range resp.Patch {
+			if i > 0 {
+				sw.raw([]byte(","))
+			}
+			sw.encoded(json.Marshal(op))
+		}
+		sw.raw([]byte("]"))
+	}
+	sw.raw([]byte(`,"checksum":`))
+	sw.encoded(json.Marshal(resp.Checksum))
+	sw.raw([]byte(`,"clientViewInfo":`))
+	sw.encoded(json.Marshal(resp.ClientViewInfo))
+	// Add a newline to make output to console etc nicer.
+	sw.raw([]byte("}\n"))
+	return sw.err
+}
+
+// CBOR major types of the heads written by encodeCBORPullResponse.
+const (
+	cborArray = 4
+	cborMap   = 5
+)
+
+// cborHead returns the head of a CBOR data item of the given major type and
+// length, in its shortest form as canonical CBOR requires.
+func cborHead(major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return []byte{m | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{m | 24, byte(n)}
+	case n <= math.MaxUint16:
+		b := []byte{m | 25, 0, 0}
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		return b
+	case n <= math.MaxUint32:
+		b := []byte{m | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		return b
+	}
+	b := []byte{m | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], n)
+	return b
+}
+
+// encodeCBORPullResponse writes the fields of a binaryPullResponse in
+// canonical order, that is by the length and then the bytes of their keys.
+func encodeCBORPullResponse(w io.Writer, resp PullResponse) error {
+	sw := &streamWriter{w: w}
+	sw.raw(cborHead(cborMap, 5))
+	sw.encoded(cborEncMode.Marshal("patch"))
+	sw.raw(cborHead(cborArray, uint64(len(resp.Patch))))
+	for _, op := range resp.Patch {
+		bop, err := toBinaryOperation(op)
+		if err != nil {
+			return err
+		}
+		sw.encoded(cborEncMode.Marshal(bop))
+	}
+	sw.encoded(cborEncMode.Marshal("stateID"))
+	sw.encoded(cborEncMode.Marshal(resp.StateID))
+	sw.encoded(cborEncMode.Marshal("checksum"))
+	sw.encoded(cborEncMode.Marshal(resp.Checksum))
+	sw.encoded(cborEncMode.Marshal("clientViewInfo"))
+	sw.encoded(cborEncMode.Marshal(resp.ClientViewInfo))
+	sw.encoded(cborEncMode.Marshal("lastMutationID"))
+	sw.encoded(cborEncMode.Marshal(resp.LastMutationID))
+	return sw.err
+}
+
+// encodeMsgpackPullResponse writes the fields of a binaryPullResponse in
+// the order they are declared, as msgpack encodes structs.
+func encodeMsgpackPullResponse(w io.Writer, resp PullResponse) error {
+	enc := msgpack.NewEncoder(w)
+	enc.SetCustomStructTag("json")
+	enc.SetSortMapKeys(true)
+	err := enc.EncodeMapLen(5)
+	encode := func(v interface{}) {
+		if err == nil {
+			err = enc.Encode(v)
+		}
+	}
+	encode("stateID")
+	encode(resp.StateID)
+	encode("lastMutationID")
+	encode(resp.LastMutationID)
+	encode("patch")
+	if err == nil {
+		err = enc.EncodeArrayLen(len(resp.Patch))
+	}
+	for _, op := range resp.Patch {
+		bop, berr := toBinaryOperation(op)
+		if berr != nil {
+			return berr
+		}
+		encode(bop)
+	}
+	encode("checksum")
+	encode(resp.Checksum)
+	encode("clientViewInfo")
+	encode(resp.ClientViewInfo)
+	return err
+}
+
+// toBinaryOperation converts op's value from JSON to its native form.
+func toBinaryOperation(op kv.Operation) (binaryOperation, error) {
+	bop := binaryOperation{Op: op.Op, Path: op.Path}
+	if op.Op != kv.OpRemove {
+		raw := []byte(op.ValueString)
+		if op.ValueString == "" {
+			raw = op.Value
+		}
+		v, err := nativeFromJSON(raw)
+		if err != nil {
+			return binaryOperation{}, fmt.Errorf("could not convert value at %s: %w", op.Path, err)
+		}
+		bop.Value = v
+	}
+	return bop, nil
+}
+
+// DecodePullResponse reads a PullResponse in the given encoding from r. Patch
+// values from the binary encodings are returned stringified in
+// kv.Operation.ValueString as canonical JSON, as they are in the JSON
+// encoding.
+func DecodePullResponse(r io.Reader, e Encoding) (PullResponse, error) {
+	var resp PullResponse
+	if e == EncodingJSON {
+		err := json.NewDecoder(r).Decode(&resp)
+		return resp, err
+	}
+
+	var bresp binaryPullResponse
+	var err error
+	switch e {
+	case EncodingCBOR:
+		err = cborDecMode.NewDecoder(r).Decode(&bresp)
+	case EncodingMsgpack:
+		dec := msgpack.NewDecoder(r)
+		dec.SetCustomStructTag("json")
+		err = dec.Decode(&bresp)
+	default:
+		err = fmt.Errorf("unknown encoding: %d", e)
+	}
+	if err != nil {
+		return PullResponse{}, err
+	}
+
+	resp = PullResponse{
+		StateID:        bresp.StateID,
+		LastMutationID: bresp.LastMutationID,
+		Patch:          make([]kv.Operation, 0, len(bresp.Patch)),
+		Checksum:       bresp.Checksum,
+		ClientViewInfo: bresp.ClientViewInfo,
+	}
+	for _, bop := range bresp.Patch {
+		op := kv.Operation{Op: bop.Op, Path: bop.Path}
+		if bop.Op != kv.OpRemove {
+			b, err := json.Marshal(bop.Value)
+			if err == nil {
+				b, err = nomsjson.Canonicalize(b)
+			}
+			if err != nil {
+				return PullResponse{}, fmt.Errorf("could not convert value at %s: %w", bop.Path, err)
+			}
+			op.ValueString = string(b)
+		}
+		resp.Patch = append(resp.Patch, op)
+	}
+	return resp, nil
+}
+
+// nativeFromJSON decodes JSON into plain Go values. Integral numbers become
+// int64 so that the binary encodings can use their compact integer forms.
+func nativeFromJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return fixNumbers(v), nil
+}
+
+func fixNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = fixNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = fixNumbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,135 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"roci.dev/diff-server/kv"
+)
+
+func TestEncodePullResponseRoundtrip(t *testing.T) {
+	assert := assert.New(t)
+
+	resp := PullResponse{
+		StateID:        "stateid",
+		LastMutationID: 7,
+		Patch: []kv.Operation{
+			{Op: kv.OpReplace, Path: "", ValueString: "{}"},
+			{Op: kv.OpAdd, Path: "/a", ValueString: `{"b":[1,2.5E0,"c",null]}`},
+			{Op: kv.OpReplace, Path: "/d", ValueString: "null"},
+			{Op: kv.OpRemove, Path: "/e"},
+		},
+		Checksum:       "12345678",
+		ClientViewInfo: ClientViewInfo{HTTPStatusCode: 200, ErrorMessage: "oops"},
+	}
+
+	for _, enc := range []Encoding{EncodingJSON, EncodingCBOR, EncodingMsgpack} {
+		buf := &bytes.Buffer{}
+		assert.NoError(EncodePullResponse(buf, enc, resp), enc.String())
+		raw := buf.Bytes()
+
+		got, err := DecodePullResponse(bytes.NewReader(raw), enc)
+		assert.NoError(err, enc.String())
+		assert.Equal(resp, got, enc.String())
+
+		// Values must be embedded natively in the binary encodings.
+		var generic map[string]interface{}
+		switch enc {
+		case EncodingCBOR:
+			assert.NoError(cborDecMode.Unmarshal(raw, &generic))
+		case EncodingMsgpack:
+			assert.NoError(msgpack.Unmarshal(raw, &generic))
+		default:
+			continue
+		}
+		op := generic["patch"].([]interface{})[1].(map[string]interface{})
+		_, isMap := op["value"].(map[string]interface{})
+		assert.True(isMap, "%s: %#v", enc, op["value"])
+	}
+}
+
+func TestEncodePullResponseStreamed(t *testing.T) {
+	assert := assert.New(t)
+
+	// Many operations, so that the CBOR and msgpack array heads are long.
+	long := make([]kv.Operation, 70000)
+	for i := range long {
+		long[i] = kv.Operation{Op: kv.OpRemove, Path: "/e"}
+	}
+
+	for i, resp := range []PullResponse{
+		{},
+		{Patch: []kv.Operation{}},
+		{Patch: long},
+		{
+			StateID:        "stateid",
+			LastMutationID: 1 << 40,
+			Patch: []kv.Operation{
+				{Op: kv.OpAdd, Path: "/a<b>", ValueString: `{"z":1,"y":[true,"x"]}`},
+				{Op: kv.OpReplace, Path: "/c", Value: []byte(`"d"`)},
+				{Op: kv.OpRemove, Path: "/e"},
+			},
+			Checksum:       "12345678",
+			ClientViewInfo: ClientViewInfo{HTTPStatusCode: 500, ErrorMessage: "<oops>", CircuitBreakerOpen: true},
+		},
+	} {
+		bresp := binaryPullResponse{
+			StateID:        resp.StateID,
+			LastMutationID: resp.LastMutationID,
+			Patch:          []binaryOperation{},
+			Checksum:       resp.Checksum,
+			ClientViewInfo: resp.ClientViewInfo,
+		}
+		for _, op := range resp.Patch {
+			bop, err := toBinaryOperation(op)
+			assert.NoError(err)
+			bresp.Patch = append(bresp.Patch, bop)
+		}
+
+		for _, enc := range []Encoding{EncodingJSON, EncodingCBOR, EncodingMsgpack} {
+			msg := fmt.Sprintf("test case %d, %s", i, enc)
+			var want []byte
+			var err error
+			switch enc {
+			case EncodingJSON:
+				want, err = json.Marshal(resp)
+				want = append(want, '\n')
+			case EncodingCBOR:
+				want, err = cborEncMode.Marshal(bresp)
+			case EncodingMsgpack:
+				buf := &bytes.Buffer{}
+				menc := msgpack.NewEncoder(buf)
+				menc.SetCustomStructTag("json")
+				menc.SetSortMapKeys(true)
+				err = menc.Encode(bresp)
+				want = buf.Bytes()
+			}
+			assert.NoError(err, msg)
+
+			got := &bytes.Buffer{}
+			assert.NoError(EncodePullResponse(got, enc, resp), msg)
+			assert.True(bytes.Equal(want, got.Bytes()), msg)
+		}
+	}
+}
+
+func TestCBOREncodingIsDeterministic(t *testing.T) {
+	assert := assert.New(t)
+	resp := PullResponse{Patch: []kv.Operation{{Op: kv.OpAdd, Path: "/a", ValueString: `{"z":1,"y":2,"x":3,"w":4}`}}}
+	var prev []byte
+	for i := 0; i < 10; i++ {
+		buf := &bytes.Buffer{}
+		assert.NoError(EncodePullResponse(buf, EncodingCBOR, resp))
+		if prev != nil {
+			assert.Equal(prev, buf.Bytes())
+		}
+		prev = buf.Bytes()
+	}
+	assert.NoError(cbor.Valid(prev))
+}
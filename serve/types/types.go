@@ -31,6 +31,9 @@ type PullResponse struct {
 type ClientViewInfo struct {
 	HTTPStatusCode int    `json:"httpStatusCode"`
 	ErrorMessage   string `json:"errorMessage"`
+	// CircuitBreakerOpen is true if the client view wasn't fetched because
+	// its host has been failing. The client gets the data it had before.
+	CircuitBreakerOpen bool `json:"circuitBreakerOpen,omitempty"`
 }
 
 type ClientViewRequest struct {
@@ -42,8 +45,41 @@ type ClientViewResponse struct {
 	LastMutationID uint64                     `json:"lastMutationID"`
 }
 
+// InjectRequest stores data for clients of an account. Either Clients lists
+// the clients to update, or ClientID and ClientViewResponse give a single
+// client's full view, as in the original testing-only form.
 type InjectRequest struct {
 	AccountID          string             `json:"accountID"`
-	ClientID           string             `json:"clientID"`
-	ClientViewResponse ClientViewResponse `json:"clientViewResponse"`
+	ClientID           string             `json:"clientID,omitempty"`
+	ClientViewResponse ClientViewResponse `json:"clientViewResponse,omitempty"`
+	Clients            []ClientInjection  `json:"clients,omitempty"`
+}
+
+// ClientInjection updates one client's data, either to the full ClientView
+// or by applying Patch to its current data. Patch values are raw JSON, as in
+// version 0 pulls. If ExpectedStateID is set the update is only made if it
+// is the client's current state.
+type ClientInjection struct {
+	ClientID        string                     `json:"clientID"`
+	ExpectedStateID string                     `json:"expectedStateID,omitempty"`
+	LastMutationID  uint64                     `json:"lastMutationID"`
+	ClientView      map[string]json.RawMessage `json:"clientView,omitempty"`
+	Patch           []kv.Operation             `json:"patch,omitempty"`
+}
+
+// InjectResponse has the result of each of an InjectRequest's Clients, in
+// order.
+type InjectResponse struct {
+	Results []InjectResult `json:"results"`
+}
+
+// InjectResult is the outcome of a ClientInjection. StateID is the client's
+// state after it, or its current state if it failed. Conflict is true if
+// the client's state wasn't the expected one, in which case the update can
+// be retried against StateID.
+type InjectResult struct {
+	ClientID string `json:"clientID"`
+	StateID  string `json:"stateID,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Conflict bool   `json:"conflict,omitempty"`
 }
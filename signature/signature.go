@@ -0,0 +1,128 @@
+// Package signature signs the requests diff-server makes to client view
+// URLs, and lets data layers verify that a request really came from
+// diff-server.
+//
+// Requests for accounts with a signing secret carry two headers:
+//
+//	X-Replicache-Timestamp: 1588334400
+//	X-Replicache-Signature: v1=<hex HMAC-SHA256>
+//
+// The signature is an HMAC-SHA256, keyed with the account's signing secret,
+// over the timestamp, the request method, the client view URL and the
+// request body, each separated by a newline. A data layer written in Go can
+// check it with VerifyRequest:
+//
+//	body, err := signature.VerifyRequest(r, secret, "https://example.com/replicache-client-view")
+//	if err != nil {
+//		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+//		return
+//	}
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying the signature and the time it was made.
+const (
+	HeaderSignature = "X-Replicache-Signature"
+	HeaderTimestamp = "X-Replicache-Timestamp"
+)
+
+// version prefixes signatures so the scheme can change without breaking
+// verifiers of the old one.
+const version = "v1="
+
+// DefaultMaxSkew is how old (or far in the future) a signature's timestamp
+// may be for VerifyRequest to accept it. It limits replay of captured
+// requests.
+const DefaultMaxSkew = 5 * time.Minute
+
+// Errors returned when verification fails.
+var (
+	ErrMissing  = errors.New("request is not signed")
+	ErrExpired  = errors.New("signature timestamp is too old or too far in the future")
+	ErrMismatch = errors.New("signature does not match")
+)
+
+// Sign returns the signature header value for a request with the given
+// method, URL and body made at timestamp.
+func Sign(secret string, timestamp time.Time, method, url string, body []byte) string {
+	return version + hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), method, url, body))
+}
+
+// SignRequest sets the signature headers on r, which must be a request for
+// url with the given body.
+func SignRequest(r *http.Request, secret string, timestamp time.Time, url string, body []byte) {
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp.Unix(), 10))
+	r.Header.Set(HeaderSignature, Sign(secret, timestamp, r.Method, url, body))
+}
+
+func mac(secret, timestamp, method, url string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s\n%s\n%s\n", timestamp, method, url)
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks the signature and timestamp header values of a request
+// with the given method, URL and body, as of now.
+func Verify(secret, sig, timestamp string, method, url string, body []byte, now time.Time, maxSkew time.Duration) error {
+	if sig == "" || timestamp == "" {
+		return ErrMissing
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", HeaderTimestamp, err)
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > maxSkew || d < -maxSkew {
+		return ErrExpired
+	}
+	if !strings.HasPrefix(sig, version) {
+		return ErrMismatch
+	}
+	got, err := hex.DecodeString(sig[len(version):])
+	if err != nil || !hmac.Equal(got, mac(secret, timestamp, method, url, body)) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// VerifyRequest reads r's body and checks its signature, allowing
+// DefaultMaxSkew. url is the client view URL as configured in the pull,
+// which can differ from what the data layer sees behind a proxy; if empty
+// it is reconstructed from r. On success the body is returned, and r.Body
+// is replaced so it can be read again.
+func VerifyRequest(r *http.Request, secret string, url string) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if url == "" {
+		url = requestURL(r)
+	}
+	err = Verify(secret, r.Header.Get(HeaderSignature), r.Header.Get(HeaderTimestamp), r.Method, url, body, time.Now(), DefaultMaxSkew)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -0,0 +1,76 @@
+package signature
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	url := "https://example.com/cv"
+	body := []byte(`{"clientID":"c1"}`)
+	sig := Sign("secret", now, "POST", url, body)
+	assert.True(strings.HasPrefix(sig, "v1="))
+
+	tc := []struct {
+		secret  string
+		sig     string
+		ts      string
+		method  string
+		url     string
+		body    string
+		now     time.Time
+		wantErr error
+	}{
+		{"secret", sig, ts, "POST", url, string(body), now, nil},
+		{"secret", sig, ts, "POST", url, string(body), now.Add(DefaultMaxSkew), nil},
+		{"secret", sig, ts, "POST", url, string(body), now.Add(-DefaultMaxSkew), nil},
+		{"secret", sig, ts, "POST", url, string(body), now.Add(DefaultMaxSkew + time.Second), ErrExpired},
+		{"secret", sig, ts, "POST", url, string(body), now.Add(-DefaultMaxSkew - time.Second), ErrExpired},
+		{"other", sig, ts, "POST", url, string(body), now, ErrMismatch},
+		{"secret", sig, ts, "GET", url, string(body), now, ErrMismatch},
+		{"secret", sig, ts, "POST", url + "x", string(body), now, ErrMismatch},
+		{"secret", sig, ts, "POST", url, `{"clientID":"c2"}`, now, ErrMismatch},
+		{"secret", sig, strconv.FormatInt(now.Unix()+1, 10), "POST", url, string(body), now, ErrMismatch},
+		{"secret", sig[3:], ts, "POST", url, string(body), now, ErrMismatch},
+		{"secret", "v1=zz", ts, "POST", url, string(body), now, ErrMismatch},
+		{"secret", "", ts, "POST", url, string(body), now, ErrMissing},
+		{"secret", sig, "", "POST", url, string(body), now, ErrMissing},
+	}
+	for i, t := range tc {
+		err := Verify(t.secret, t.sig, t.ts, t.method, t.url, []byte(t.body), t.now, DefaultMaxSkew)
+		assert.Equal(t.wantErr, err, "test case %d", i)
+	}
+	assert.Error(Verify("secret", sig, "soon", "POST", url, body, now, DefaultMaxSkew))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	assert := assert.New(t)
+	body := `{"clientID":"c1"}`
+	r := httptest.NewRequest("POST", "http://example.com/cv?x=1", strings.NewReader(body))
+	SignRequest(r, "secret", time.Now(), "http://example.com/cv?x=1", []byte(body))
+
+	// The URL is reconstructed from the request if not given.
+	got, err := VerifyRequest(r, "secret", "")
+	assert.NoError(err)
+	assert.Equal(body, string(got))
+	b, err := ioutil.ReadAll(r.Body)
+	assert.NoError(err)
+	assert.Equal(body, string(b))
+
+	// As seen behind a proxy.
+	r = httptest.NewRequest("POST", "http://internal:8080/cv?x=1", strings.NewReader(body))
+	SignRequest(r, "secret", time.Now(), "https://example.com/cv?x=1", []byte(body))
+	_, err = VerifyRequest(r, "secret", "")
+	assert.Equal(ErrMismatch, err)
+	_, err = VerifyRequest(r, "secret", "https://example.com/cv?x=1")
+	assert.NoError(err)
+}
@@ -0,0 +1,420 @@
+// Package jsonschema validates JSON values against a subset of JSON Schema
+// (draft 2019-09). The supported keywords are type, enum, const,
+// properties, required, additionalProperties, minProperties,
+// maxProperties, items (a single schema), minItems, maxItems, minLength,
+// maxLength, pattern, minimum, maximum, exclusiveMinimum and
+// exclusiveMaximum, as well as the annotations $schema, $id, $comment,
+// title, description, default and examples. Other keywords are rejected by
+// Compile rather than ignored, so that a schema never checks less than it
+// appears to.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled schema.
+type Schema struct {
+	// never is true for the schema false, which nothing is valid against.
+	never bool
+
+	types                      []string
+	enum                       []interface{}
+	constant                   interface{}
+	hasConst                   bool
+	properties                 map[string]*Schema
+	required                   []string
+	additionalProperties       *Schema
+	minProperties              *int
+	maxProperties              *int
+	items                      *Schema
+	minItems                   *int
+	maxItems                   *int
+	minLength                  *int
+	maxLength                  *int
+	pattern                    *regexp.Regexp
+	minimum, maximum           *float64
+	exclusiveMin, exclusiveMax *float64
+}
+
+var annotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+var typeNames = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+// Compile parses a schema.
+func Compile(b []byte) (*Schema, error) {
+	v, err := decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	return compile(v, "")
+}
+
+func compile(v interface{}, path string) (*Schema, error) {
+	switch v := v.(type) {
+	case bool:
+		return &Schema{never: !v}, nil
+	case map[string]interface{}:
+		s := &Schema{}
+		for k, kv := range v {
+			if err := s.compileKeyword(k, kv, path); err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", path, k, err)
+			}
+		}
+		return s, nil
+	}
+	if path == "" {
+		return nil, errors.New("schema must be an object or a boolean")
+	}
+	return nil, fmt.Errorf("%s: schema must be an object or a boolean", path)
+}
+
+func (s *Schema) compileKeyword(k string, v interface{}, path string) error {
+	var err error
+	switch k {
+	case "type":
+		switch t := v.(type) {
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			for _, e := range t {
+				name, ok := e.(string)
+				if !ok {
+					return errors.New("must be a string or an array of strings")
+				}
+				s.types = append(s.types, name)
+			}
+		default:
+			return errors.New("must be a string or an array of strings")
+		}
+		for _, t := range s.types {
+			if !typeNames[t] {
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	case "enum":
+		e, ok := v.([]interface{})
+		if !ok {
+			return errors.New("must be an array")
+		}
+		s.enum = e
+	case "const":
+		s.constant, s.hasConst = v, true
+	case "properties":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(m))
+		for name, pv := range m {
+			if s.properties[name], err = compile(pv, path+"/properties/"+name); err != nil {
+				return err
+			}
+		}
+	case "required":
+		r, ok := v.([]interface{})
+		if !ok {
+			return errors.New("must be an array of strings")
+		}
+		for _, e := range r {
+			name, ok := e.(string)
+			if !ok {
+				return errors.New("must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	case "additionalProperties":
+		s.additionalProperties, err = compile(v, path+"/additionalProperties")
+	case "items":
+		s.items, err = compile(v, path+"/items")
+	case "minProperties":
+		s.minProperties, err = count(v)
+	case "maxProperties":
+		s.maxProperties, err = count(v)
+	case "minItems":
+		s.minItems, err = count(v)
+	case "maxItems":
+		s.maxItems, err = count(v)
+	case "minLength":
+		s.minLength, err = count(v)
+	case "maxLength":
+		s.maxLength, err = count(v)
+	case "pattern":
+		p, ok := v.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		s.pattern, err = regexp.Compile(p)
+	case "minimum":
+		s.minimum, err = number(v)
+	case "maximum":
+		s.maximum, err = number(v)
+	case "exclusiveMinimum":
+		s.exclusiveMin, err = number(v)
+	case "exclusiveMaximum":
+		s.exclusiveMax, err = number(v)
+	default:
+		if !annotations[k] {
+			return errors.New("unsupported keyword")
+		}
+	}
+	return err
+}
+
+func count(v interface{}) (*int, error) {
+	n, ok := v.(json.Number)
+	if ok {
+		if i, err := strconv.Atoi(string(n)); err == nil && i >= 0 {
+			return &i, nil
+		}
+	}
+	return nil, errors.New("must be a non-negative integer")
+}
+
+func number(v interface{}) (*float64, error) {
+	n, ok := v.(json.Number)
+	if ok {
+		if f, err := n.Float64(); err == nil {
+			return &f, nil
+		}
+	}
+	return nil, errors.New("must be a number")
+}
+
+// ValidationError describes why a value is not valid against a schema.
+type ValidationError struct {
+	// Path is the JSON pointer to the invalid part of the value, empty if
+	// it's the whole value.
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Validate checks the JSON value b against s. If b is not valid the error
+// is a *ValidationError describing the first violation found.
+func (s *Schema) Validate(b []byte) error {
+	v, err := decode(b)
+	if err != nil {
+		return err
+	}
+	return s.validate(v, "")
+}
+
+func (s *Schema) validate(v interface{}, path string) error {
+	fail := func(format string, args ...interface{}) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+	if s.never {
+		return fail("no value is allowed")
+	}
+	if len(s.types) > 0 && !hasType(v, s.types) {
+		return fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+	}
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if equal(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !equal(v, s.constant) {
+		return fail("value is not the allowed value")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		if s.minProperties != nil && len(v) < *s.minProperties {
+			return fail("expected at least %d properties, got %d", *s.minProperties, len(v))
+		}
+		if s.maxProperties != nil && len(v) > *s.maxProperties {
+			return fail("expected at most %d properties, got %d", *s.maxProperties, len(v))
+		}
+		// Check properties in order so that the error is deterministic.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ps, ok := s.properties[name]
+			if !ok {
+				ps = s.additionalProperties
+			}
+			if ps == nil {
+				continue
+			}
+			if err := ps.validate(v[name], path+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fail("expected at least %d items, got %d", *s.minItems, len(v))
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fail("expected at most %d items, got %d", *s.maxItems, len(v))
+		}
+		if s.items != nil {
+			for i, e := range v {
+				if err := s.items.validate(e, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			return fail("expected at least %d characters, got %d", *s.minLength, n)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fail("expected at most %d characters, got %d", *s.maxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("does not match pattern %q", s.pattern.String())
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.minimum != nil && f < *s.minimum {
+			return fail("%s is less than the minimum of %g", v, *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			return fail("%s is greater than the maximum of %g", v, *s.maximum)
+		}
+		if s.exclusiveMin != nil && f <= *s.exclusiveMin {
+			return fail("%s is not greater than %g", v, *s.exclusiveMin)
+		}
+		if s.exclusiveMax != nil && f >= *s.exclusiveMax {
+			return fail("%s is not less than %g", v, *s.exclusiveMax)
+		}
+	}
+	return nil
+}
+
+func hasType(v interface{}, types []string) bool {
+	t := typeOf(v)
+	for _, want := range types {
+		if want == t || (want == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// typeOf returns the JSON Schema type of v. Numbers without a fractional
+// part are integers.
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// equal compares JSON values, treating numbers as equal if their values are.
+func equal(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, aerr := an.Float64()
+		bf, berr := bn.Float64()
+		return aerr == nil && berr == nil && af == bf
+	}
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			if bv, ok := b[k]; !ok || !equal(av, bv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func decode(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// escape escapes a property name for use in a JSON pointer.
+func escape(name string) string {
+	return strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,93 @@
+package jsonschema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		schema  string
+		wantErr string
+	}{
+		{`true`, ""},
+		{`{}`, ""},
+		{`{"$schema": "https://json-schema.org/draft/2019-09/schema", "title": "User", "type": "object"}`, ""},
+		{`{"type": ["string", "null"]}`, ""},
+		{`{"properties": {"a": {"items": {"type": "integer"}}}}`, ""},
+		{`[]`, "schema must be an object or a boolean"},
+		{`{"type": "date"}`, `/type: unknown type "date"`},
+		{`{"oneOf": []}`, "/oneOf: unsupported keyword"},
+		{`{"properties": {"a": {"anyOf": []}}}`, "/properties/a/anyOf: unsupported keyword"},
+		{`{"maxLength": -1}`, "/maxLength: must be a non-negative integer"},
+		{`{"pattern": "("}`, "/pattern: error parsing regexp"},
+		{`{"minimum": "1"}`, "/minimum: must be a number"},
+		{`{`, "invalid schema"},
+	}
+	for i, t := range tc {
+		_, err := Compile([]byte(t.schema))
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+		} else if assert.Error(err, "test case %d", i) {
+			assert.Contains(err.Error(), t.wantErr, "test case %d", i)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	tc := []struct {
+		schema  string
+		value   string
+		wantErr string
+	}{
+		{`true`, `"anything"`, ""},
+		{`false`, `1`, "no value is allowed"},
+		{`{"type": "object"}`, `{}`, ""},
+		{`{"type": "object"}`, `"s"`, "expected object, got string"},
+		{`{"type": ["string", "null"]}`, `null`, ""},
+		{`{"type": ["string", "null"]}`, `1`, "expected string or null, got integer"},
+		{`{"type": "integer"}`, `1.0`, ""},
+		{`{"type": "integer"}`, `1.5`, "expected integer, got number"},
+		{`{"type": "number"}`, `1`, ""},
+		{`{"enum": ["a", 1, {"b": [2]}]}`, `1.0`, ""},
+		{`{"enum": ["a", 1, {"b": [2]}]}`, `{"b": [2]}`, ""},
+		{`{"enum": ["a", 1, {"b": [2]}]}`, `"b"`, "value is not one of the allowed values"},
+		{`{"const": true}`, `false`, "value is not the allowed value"},
+		{`{"required": ["id"]}`, `{"name": "x"}`, `missing required property "id"`},
+		{`{"required": ["id"]}`, `"not an object"`, ""},
+		{`{"properties": {"id": {"type": "string"}}}`, `{"id": 1}`, "/id: expected string, got integer"},
+		{`{"properties": {"a/b": {"properties": {"c~": false}}}}`, `{"a/b": {"c~": 1}}`, "/a~1b/c~0: no value is allowed"},
+		{`{"properties": {"id": true}, "additionalProperties": false}`, `{"id": 1, "x": 2}`, "/x: no value is allowed"},
+		{`{"additionalProperties": {"type": "string"}}`, `{"a": "1", "b": 2}`, "/b: expected string, got integer"},
+		{`{"minProperties": 1}`, `{}`, "expected at least 1 properties, got 0"},
+		{`{"maxProperties": 1}`, `{"a": 1, "b": 2}`, "expected at most 1 properties, got 2"},
+		{`{"items": {"type": "integer"}}`, `[1, 2, "3"]`, "/2: expected integer, got string"},
+		{`{"minItems": 1}`, `[]`, "expected at least 1 items, got 0"},
+		{`{"maxItems": 1}`, `[1, 2]`, "expected at most 1 items, got 2"},
+		{`{"maxLength": 2}`, `"héé"`, "expected at most 2 characters, got 3"},
+		{`{"minLength": 2}`, `"h"`, "expected at least 2 characters, got 1"},
+		{`{"pattern": "^[a-z]+$"}`, `"abc"`, ""},
+		{`{"pattern": "^[a-z]+$"}`, `"ab1"`, `does not match pattern "^[a-z]+$"`},
+		{`{"minimum": 1, "maximum": 3}`, `3`, ""},
+		{`{"minimum": 1}`, `0.5`, "0.5 is less than the minimum of 1"},
+		{`{"maximum": 3}`, `4`, "4 is greater than the maximum of 3"},
+		{`{"exclusiveMinimum": 1}`, `1`, "1 is not greater than 1"},
+		{`{"exclusiveMaximum": 3}`, `3`, "3 is not less than 3"},
+		{`{}`, `{"a": 1} 2`, "unexpected data after JSON value"},
+	}
+	for i, t := range tc {
+		s, err := Compile([]byte(t.schema))
+		if !assert.NoError(err, "test case %d", i) {
+			continue
+		}
+		err = s.Validate([]byte(t.value))
+		if t.wantErr == "" {
+			assert.NoError(err, "test case %d", i)
+		} else if assert.Error(err, "test case %d", i) {
+			assert.Equal(t.wantErr, err.Error(), "test case %d", i)
+		}
+	}
+}
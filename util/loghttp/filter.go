@@ -3,6 +3,7 @@ package loghttp
 import (
 	"bytes"
 	"fmt"
+	"net/http"
 	"regexp"
 )
 
@@ -67,6 +68,50 @@ func (hw HeaderAllowlist) Filter(httpReq []byte) []byte {
 	return filtered[:l]
 }
 
+// HeaderRedactor is a FilterFunc that replaces the values of the headers
+// it names with "REDACTED", eg so that session cookies don't end up in logs.
+type HeaderRedactor struct {
+	names map[string]bool
+}
+
+// NewHeaderRedactor returns a new HeaderRedactor that redacts the headers
+// listed in names, which are matched case-insensitively.
+func NewHeaderRedactor(names []string) HeaderRedactor {
+	hr := HeaderRedactor{map[string]bool{}}
+	for _, n := range names {
+		hr.names[http.CanonicalHeaderKey(n)] = true
+	}
+	return hr
+}
+
+// Filter filters the given HTTP request/response dump.
+func (hr HeaderRedactor) Filter(httpReq []byte) []byte {
+	endHeadersIndex := bytes.Index(httpReq, []byte("\r\n\r\n"))
+	if len(hr.names) == 0 || endHeadersIndex == -1 {
+		return httpReq
+	}
+	headerLines := bytes.Split(httpReq[:endHeadersIndex], []byte("\r\n"))
+	var filtered bytes.Buffer
+	filtered.Grow(len(httpReq))
+
+	// Copy the request or status line to output.
+	filtered.Write(headerLines[0])
+	filtered.WriteString("\r\n")
+
+	for i := 1; i < len(headerLines); i++ {
+		colon := bytes.IndexByte(headerLines[i], ':')
+		if colon != -1 && hr.names[http.CanonicalHeaderKey(string(headerLines[i][:colon]))] {
+			filtered.Write(headerLines[i][:colon])
+			filtered.WriteString(": REDACTED")
+		} else {
+			filtered.Write(headerLines[i])
+		}
+		filtered.WriteString("\r\n")
+	}
+	filtered.Write(httpReq[endHeadersIndex+2:])
+	return filtered.Bytes()
+}
+
 // BodyElider is a FilterFunc that limits the size of the HTTP
 // request/response body to max bytes. Bytes are clipped from the
 // middle of the body, replaced with "...".
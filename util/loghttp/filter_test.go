@@ -1,6 +1,7 @@
 package loghttp
 
 import (
+	"context"
 	"testing"
 )
 
@@ -83,6 +84,74 @@ func TestHeaderAllowlist_Filter(t *testing.T) {
 	}
 }
 
+func TestHeaderRedactor_Filter(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		httpReq string
+		want    string
+	}{
+		{
+			"not http: random text",
+			[]string{"Cookie"},
+			"This is not HTTP",
+			"This is not HTTP",
+		},
+		{
+			"request: no names",
+			[]string{},
+			"GET / HTTP/1.0\r\nCookie: a=b\r\n\r\nbody",
+			"GET / HTTP/1.0\r\nCookie: a=b\r\n\r\nbody",
+		},
+		{
+			"request: no headers",
+			[]string{"Cookie"},
+			"GET / HTTP/1.0\r\n\r\n",
+			"GET / HTTP/1.0\r\n\r\n",
+		},
+		{
+			"request: redacts some headers",
+			[]string{"cookie", "X-Session"},
+			"GET / HTTP/1.0\r\nFoo: bar\r\nCookie: a=b; c=d\r\nX-Session: secret\r\n\r\nbody",
+			"GET / HTTP/1.0\r\nFoo: bar\r\nCookie: REDACTED\r\nX-Session: REDACTED\r\n\r\nbody",
+		},
+		{
+			"response: redacts repeated headers",
+			[]string{"Set-Cookie"},
+			"HTTP/1.0 200 OK\r\nSet-Cookie: a=b\r\nSet-Cookie: c=d\r\n\r\n",
+			"HTTP/1.0 200 OK\r\nSet-Cookie: REDACTED\r\nSet-Cookie: REDACTED\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hr := NewHeaderRedactor(tt.names)
+			got := string(hr.Filter([]byte(tt.httpReq)))
+			if got != tt.want {
+				t.Errorf("HeaderRedactor.Filter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRedactedHeaders(t *testing.T) {
+	dump := "GET / HTTP/1.0\r\nFoo: bar\r\nX-Token: secret\r\n\r\n"
+	if got := string(filter(context.Background(), []byte(dump))); got != dump {
+		t.Errorf("filter() = %q, want %q", got, dump)
+	}
+	if got := string(filter(WithRedactedHeaders(context.Background()), []byte(dump))); got != dump {
+		t.Errorf("filter() = %q, want %q", got, dump)
+	}
+	want := "GET / HTTP/1.0\r\nFoo: bar\r\nX-Token: REDACTED\r\n\r\n"
+	if got := string(filter(WithRedactedHeaders(context.Background(), "x-token"), []byte(dump))); got != want {
+		t.Errorf("filter() = %q, want %q", got, want)
+	}
+	dump = "POST /pull HTTP/1.1\r\nAuthorization: rk_1_secret\r\nproxy-authorization: Basic abc\r\n\r\n"
+	want = "POST /pull HTTP/1.1\r\nAuthorization: REDACTED\r\nproxy-authorization: REDACTED\r\n\r\n"
+	if got := string(filter(context.Background(), []byte(dump))); got != want {
+		t.Errorf("filter() = %q, want %q", got, want)
+	}
+}
+
 func TestBodyElider_Filter(t *testing.T) {
 	tests := []struct {
 		name    string
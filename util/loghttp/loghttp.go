@@ -3,12 +3,16 @@ package loghttp
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"strings"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	lh "github.com/motemen/go-loghttp"
 	zl "github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
@@ -30,7 +34,7 @@ func init() {
 				zlog.Err(err).Stack().Msg("Could not dump request")
 				return
 			}
-			dump = filter(dump)
+			dump = filter(req.Context(), dump)
 		}
 		// TODO: Properly contextualize these logs.
 		zlog.Debug().
@@ -42,32 +46,71 @@ func init() {
 	}
 
 	lh.DefaultLogResponse = func(resp *http.Response) {
-		var dump []byte
-		var err error
-		if strings.Index(resp.Request.URL.String(), "dynamodb") != -1 {
-			dump = []byte("<dynamo response>")
-		} else {
-			dump, err = httputil.DumpResponse(resp, true)
-			if err != nil {
-				zlog.Err(err).Stack().Msg("Could not dump response")
-				return
-			}
-			dump = filter(dump)
+		logResponse(resp, true)
+	}
+}
+
+// logResponse logs resp, with its body if body is true.
+func logResponse(resp *http.Response, body bool) {
+	var dump []byte
+	var err error
+	if strings.Index(resp.Request.URL.String(), "dynamodb") != -1 {
+		dump = []byte("<dynamo response>")
+	} else {
+		dump, err = httputil.DumpResponse(resp, body)
+		if err != nil {
+			zlog.Err(err).Stack().Msg("Could not dump response")
+			return
 		}
-		zlog.Debug().
-			Timestamp().
-			Str("method", resp.Request.Method).
-			Str("url", resp.Request.URL.String()).
-			Int("status", resp.StatusCode).
-			Bytes("dump", dump).
-			Msg("Outgoing request <--")
+		dump = filter(resp.Request.Context(), dump)
+	}
+	zlog.Debug().
+		Timestamp().
+		Str("method", resp.Request.Method).
+		Str("url", resp.Request.URL.String()).
+		Int("status", resp.StatusCode).
+		Bytes("dump", dump).
+		Msg("Outgoing request <--")
+}
+
+// WrapTransport returns a RoundTripper that logs the requests made with rt
+// the way http.DefaultTransport's are. Response bodies are not dumped:
+// that would read them whole before the caller gets to stream or limit
+// them.
+func WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &lh.Transport{
+		Transport:   rt,
+		LogResponse: func(resp *http.Response) { logResponse(resp, false) },
 	}
 }
 
 // Filters are called on the HTTP dump before it is logged.
 var Filters []FilterFunc
 
-func filter(httpReq []byte) []byte {
+// redactKey is the context key of the HeaderRedactor of a request.
+type redactKey struct{}
+
+// WithRedactedHeaders returns a copy of ctx under which the values of the
+// named headers are redacted from the dumps of requests made with it, before
+// Filters are called. This covers incoming requests logged by Handler and
+// outgoing requests logged by the logging transports, as well as their
+// responses.
+func WithRedactedHeaders(ctx context.Context, names ...string) context.Context {
+	if len(names) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, redactKey{}, NewHeaderRedactor(names))
+}
+
+// credentialHeaders are redacted from every dump, whatever the context and
+// Filters say, so that keys and tokens never end up in logs.
+var credentialHeaders = NewHeaderRedactor([]string{"Authorization", "Proxy-Authorization"})
+
+func filter(ctx context.Context, httpReq []byte) []byte {
+	httpReq = credentialHeaders.Filter(httpReq)
+	if r, ok := ctx.Value(redactKey{}).(HeaderRedactor); ok {
+		httpReq = r.Filter(httpReq)
+	}
 	for _, f := range Filters {
 		httpReq = f(httpReq)
 	}
@@ -90,15 +133,24 @@ type Handler struct {
 	l       zl.Logger
 }
 
-// ServeHTTP logs the request, calls the underlying handler, and logs the response.
+// maxDumpBodyBytes caps how much of a body is logged, so that logging
+// doesn't read whole bodies into memory ahead of the limits handlers apply.
+const maxDumpBodyBytes = 64 << 10
+
+// ServeHTTP logs the request, calls the underlying handler, and logs the
+// response. Nothing is captured unless debug logging is on.
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	dump, err := httputil.DumpRequest(r, true)
+	if h.l.GetLevel() > zl.DebugLevel || zl.GlobalLevel() > zl.DebugLevel {
+		h.wrapped.ServeHTTP(w, r)
+		return
+	}
+	dump, err := dumpRequest(r)
 	if err != nil {
 		h.l.Err(err).Stack().Msg("Could not dump request")
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
-	dump = filter(dump)
+	dump = filter(r.Context(), dump)
 
 	ll := h.l.With().
 		Str("method", r.Method).
@@ -112,33 +164,72 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	rl := &responseLogger{ResponseWriter: w, status: 200, l: ll}
 	h.wrapped.ServeHTTP(rl, r)
 	body := rl.responseBody.Bytes()
-	maybeUnzippedBody, err := maybeUnzip(body)
-	if err == nil {
+	truncated := rl.size > int64(len(body))
+	maybeUnzippedBody, err := maybeDecompress(body, rl.Header().Get("Content-encoding"))
+	if err == nil || truncated {
+		// Decompressing a truncated body fails at its end; what was
+		// decompressed up to there is logged.
 		body = maybeUnzippedBody
 	} else {
-		ll.Err(err).Stack().Msgf("Error maybe-unzipping response of size %d with status %d; body: '%s'", len(body), rl.status, string(body))
+		ll.Err(err).Stack().Msgf("Error maybe-decompressing response of size %d with status %d; body: '%s'", len(body), rl.status, string(body))
 	}
-	body = filter(body)
+	body = filter(r.Context(), body)
 	ll.Debug().
 		Int("status", rl.status).
+		Int64("size", rl.size).
+		Bool("truncated", truncated).
 		Bytes("body", body).
 		Msg("Incoming request <--")
 }
 
-func maybeUnzip(b []byte) ([]byte, error) {
-	if http.DetectContentType(b) != "application/x-gzip" {
-		return b, nil
+// dumpRequest dumps r with at most maxDumpBodyBytes of its body. The part of
+// the body that is read is put back in front of the rest for the handler.
+func dumpRequest(r *http.Request) ([]byte, error) {
+	dump, err := httputil.DumpRequest(r, false)
+	if err != nil || r.Body == nil || r.Body == http.NoBody {
+		return dump, err
 	}
-	zr, err := gzip.NewReader(bytes.NewReader(b))
-	if err != nil {
+	var prefix bytes.Buffer
+	if _, err := io.Copy(&prefix, io.LimitReader(r.Body, maxDumpBodyBytes)); err != nil {
 		return nil, err
 	}
-	return ioutil.ReadAll(zr)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix.Bytes()), r.Body), r.Body}
+	return append(dump, prefix.Bytes()...), nil
 }
 
+// maybeDecompress decompresses b according to its Content-encoding. Gzip is
+// also sniffed in case the header wasn't set. At most maxDumpBodyBytes are
+// decompressed. On errors, what was decompressed before them is returned.
+func maybeDecompress(b []byte, contentEncoding string) ([]byte, error) {
+	switch {
+	case contentEncoding == "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(io.LimitReader(zr, maxDumpBodyBytes))
+	case contentEncoding == "br":
+		return ioutil.ReadAll(io.LimitReader(brotli.NewReader(bytes.NewReader(b)), maxDumpBodyBytes))
+	case contentEncoding == "gzip" || http.DetectContentType(b) == "application/x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(io.LimitReader(zr, maxDumpBodyBytes))
+	}
+	return b, nil
+}
+
+// responseLogger captures the status and the first maxDumpBodyBytes of the
+// body of a response.
 type responseLogger struct {
 	http.ResponseWriter
 	responseBody bytes.Buffer
+	size         int64 // Of the whole body.
 	status       int
 	l            zl.Logger
 }
@@ -149,11 +240,17 @@ func (r *responseLogger) WriteHeader(status int) {
 }
 
 func (r *responseLogger) Write(b []byte) (int, error) {
-	_, err := r.responseBody.Write(b)
-	if err != nil {
-		r.l.Err(err).Msgf("Could not capture response body of length %d with status %d for logging; body: '%s'", len(b), r.status, string(b))
+	if room := maxDumpBodyBytes - r.responseBody.Len(); room > 0 {
+		c := b
+		if len(c) > room {
+			c = c[:room]
+		}
+		if _, err := r.responseBody.Write(c); err != nil {
+			r.l.Err(err).Msgf("Could not capture response body of length %d with status %d for logging", len(b), r.status)
+		}
 	}
 	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
 	if err != nil {
 		r.l.Err(err).Msgf("Error writing response body of length %d with status %d; body: '%s'", len(b), r.status, string(b))
 	}
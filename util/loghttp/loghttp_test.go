@@ -3,13 +3,21 @@ package loghttp
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	zl "github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
 
-func Test_maybeUnzip(t *testing.T) {
+func Test_maybeDecompress(t *testing.T) {
 	assert := assert.New(t)
 
 	var buf bytes.Buffer
@@ -18,32 +26,151 @@ func Test_maybeUnzip(t *testing.T) {
 	assert.NoError(err)
 	assert.NoError(zw.Close())
 
+	var zbuf bytes.Buffer
+	zsw, err := zstd.NewWriter(&zbuf)
+	assert.NoError(err)
+	_, err = zsw.Write([]byte("this is zstd"))
+	assert.NoError(err)
+	assert.NoError(zsw.Close())
+
+	var bbuf bytes.Buffer
+	bw := brotli.NewWriter(&bbuf)
+	_, err = bw.Write([]byte("this is brotli"))
+	assert.NoError(err)
+	assert.NoError(bw.Close())
+
 	tests := []struct {
-		in   []byte
-		want []byte
+		in       []byte
+		encoding string
+		want     []byte
 	}{
 		{
 			[]byte{},
+			"",
 			[]byte{},
 		},
 		{
 			[]byte("\n"),
+			"",
 			[]byte("\n"),
 		},
 		{
 			[]byte("not gzipped"),
+			"",
 			[]byte("not gzipped"),
 		},
 		{
 			buf.Bytes(),
+			"",
 			[]byte("this is gzipped"),
 		},
+		{
+			buf.Bytes(),
+			"gzip",
+			[]byte("this is gzipped"),
+		},
+		{
+			zbuf.Bytes(),
+			"zstd",
+			[]byte("this is zstd"),
+		},
+		{
+			bbuf.Bytes(),
+			"br",
+			[]byte("this is brotli"),
+		},
 	}
 	for i, tt := range tests {
-		got, err := maybeUnzip(tt.in)
+		got, err := maybeDecompress(tt.in, tt.encoding)
 		assert.NoError(err)
 		if !reflect.DeepEqual(got, tt.want) {
-			t.Errorf("%d: maybeUnzip() = %v, want %v", i, got, tt.want)
+			t.Errorf("%d: maybeDecompress() = %v, want %v", i, got, tt.want)
 		}
 	}
 }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+type countingReader struct {
+	r *strings.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestWrapTransport(t *testing.T) {
+	assert := assert.New(t)
+	body := &countingReader{r: strings.NewReader("response body")}
+	rt := WrapTransport(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(body), Request: r}, nil
+	}))
+	req, err := http.NewRequest("POST", "http://example.com/", strings.NewReader("request body"))
+	assert.NoError(err)
+	resp, err := rt.RoundTrip(req)
+	assert.NoError(err)
+	// The response body is left for the caller to read.
+	assert.Equal(0, body.n)
+	b, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Equal("response body", string(b))
+}
+
+func TestDumpRequest(t *testing.T) {
+	assert := assert.New(t)
+	body := strings.Repeat("x", maxDumpBodyBytes+10)
+	r, err := http.NewRequest("POST", "http://example.com/pull", strings.NewReader(body))
+	assert.NoError(err)
+	r.ContentLength = -1
+	dump, err := dumpRequest(r)
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(string(dump), "POST /pull HTTP/1.1\r\n"))
+	assert.True(strings.HasSuffix(string(dump), "\r\n\r\n"+body[:maxDumpBodyBytes]))
+	// The handler still reads the whole body.
+	got, err := ioutil.ReadAll(r.Body)
+	assert.NoError(err)
+	assert.Equal(body, string(got))
+
+	r, err = http.NewRequest("GET", "http://example.com/", nil)
+	assert.NoError(err)
+	dump, err = dumpRequest(r)
+	assert.NoError(err)
+	assert.Equal("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", string(dump))
+}
+
+func TestHandler(t *testing.T) {
+	assert := assert.New(t)
+	defer zl.SetGlobalLevel(zl.GlobalLevel())
+
+	body := strings.Repeat("x", 2*maxDumpBodyBytes)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body[:maxDumpBodyBytes-10]))
+		w.Write([]byte(body[maxDumpBodyBytes-10:]))
+	})
+	get := func() (string, string) {
+		var log bytes.Buffer
+		w := httptest.NewRecorder()
+		Wrap(handler, zl.New(&log).Level(zl.DebugLevel)).ServeHTTP(w, httptest.NewRequest("GET", "/pull", nil))
+		return w.Body.String(), log.String()
+	}
+
+	// Nothing is logged unless debug logging is on.
+	zl.SetGlobalLevel(zl.InfoLevel)
+	got, log := get()
+	assert.Equal(body, got)
+	assert.Equal("", log)
+
+	// Only the start of the body is logged.
+	zl.SetGlobalLevel(zl.DebugLevel)
+	got, log = get()
+	assert.Equal(body, got)
+	assert.Contains(log, `"truncated":true`)
+	assert.Contains(log, fmt.Sprintf(`"size":%d`, len(body)))
+	assert.Contains(log, `"body":"xxx`)
+	assert.True(len(log) < 2*maxDumpBodyBytes, "%d", len(log))
+}
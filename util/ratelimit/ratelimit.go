@@ -0,0 +1,138 @@
+// Package ratelimit implements token bucket rate limiting.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket allows events at rate per second on average, with bursts of up to
+// burst events. It is not safe for concurrent use.
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket. rate must be positive; a burst of less
+// than one is treated as one.
+func NewBucket(rate float64, burst int, now time.Time) *Bucket {
+	b := &Bucket{last: now}
+	b.Configure(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// Configure updates the bucket's parameters, eg when the limits they come
+// from are edited.
+func (b *Bucket) Configure(rate float64, burst int) {
+	b.rate = rate
+	b.burst = math.Max(float64(burst), 1)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Refill adds the tokens accrued since the last refill.
+func (b *Bucket) Refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// Wait returns how long until a token is available, zero if one is
+// available now. The bucket must have been refilled.
+func (b *Bucket) Wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Take takes a token. The caller must have checked that one is available
+// with Wait.
+func (b *Bucket) Take() {
+	b.tokens--
+}
+
+// Full returns true if the bucket is full, in which case it behaves the
+// same as a new one.
+func (b *Bucket) Full() bool {
+	return b.tokens >= b.burst
+}
+
+// SweepInterval is how often Keyed drops idle buckets.
+const SweepInterval = time.Minute
+
+// Keyed limits events per key, eg per client IP, with a bucket per key.
+// It is safe for concurrent use.
+type Keyed struct {
+	rate  float64
+	burst int
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// NewKeyed returns a Keyed limiter allowing rate events per second per
+// key, with bursts of up to burst events.
+func NewKeyed(rate float64, burst int, now func() time.Time) *Keyed {
+	return &Keyed{rate: rate, burst: burst, now: now, buckets: map[string]*Bucket{}}
+}
+
+// Allow takes a token from key's bucket and returns true if one is
+// available. If not, it returns how long until one is.
+func (k *Keyed) Allow(key string) (bool, time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	if now.Sub(k.lastSweep) >= SweepInterval {
+		k.lastSweep = now
+		Sweep(k.buckets, now)
+	}
+	b := Get(k.buckets, key, k.rate, k.burst, now)
+	if wait := b.Wait(); wait > 0 {
+		return false, wait
+	}
+	b.Take()
+	return true, 0
+}
+
+// Get returns the refilled bucket for key in buckets, creating it if
+// necessary and updating its parameters otherwise.
+func Get(buckets map[string]*Bucket, key string, rate float64, burst int, now time.Time) *Bucket {
+	b := buckets[key]
+	if b == nil {
+		b = NewBucket(rate, burst, now)
+		buckets[key] = b
+	}
+	b.Configure(rate, burst)
+	b.Refill(now)
+	return b
+}
+
+// Sweep drops the buckets that are full, which behave the same as new
+// ones, from buckets.
+func Sweep(buckets map[string]*Bucket, now time.Time) {
+	for k, b := range buckets {
+		if b.Refill(now); b.Full() {
+			delete(buckets, k)
+		}
+	}
+}
+
+// RetryAfter formats d for the Retry-After header, which takes whole
+// seconds.
+func RetryAfter(d time.Duration) string {
+	s := int64(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return fmt.Sprint(s)
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	b := NewBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		assert.Equal(time.Duration(0), b.Wait())
+		b.Take()
+	}
+	assert.Equal(500*time.Millisecond, b.Wait())
+	b.Refill(now.Add(250 * time.Millisecond))
+	assert.Equal(250*time.Millisecond, b.Wait())
+	b.Refill(now.Add(time.Hour))
+	assert.True(b.Full())
+
+	// Shrinking the burst drops excess tokens.
+	b.Configure(1, 1)
+	b.Take()
+	assert.Equal(time.Second, b.Wait())
+	b.Configure(1, 0)
+	assert.Equal(time.Second, b.Wait())
+}
+
+func TestKeyed(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	k := NewKeyed(0.5, 2, func() time.Time { return now })
+
+	tc := []struct {
+		key      string
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{"a", true, 0},
+		{"a", true, 0},
+		{"a", false, 2 * time.Second},
+		{"b", true, 0},
+	}
+	for i, t := range tc {
+		ok, wait := k.Allow(t.key)
+		assert.Equal(t.wantOK, ok, "test case %d", i)
+		assert.Equal(t.wantWait, wait, "test case %d", i)
+	}
+
+	// Idle keys are swept.
+	now = now.Add(time.Hour)
+	ok, _ := k.Allow("b")
+	assert.True(ok)
+	assert.Equal(1, len(k.buckets))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("1", RetryAfter(0))
+	assert.Equal("1", RetryAfter(time.Millisecond))
+	assert.Equal("2", RetryAfter(1001*time.Millisecond))
+	assert.Equal("60", RetryAfter(time.Minute))
+}